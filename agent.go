@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// conntrackKey identifies a connection by its original direction.
+type conntrackKey struct {
+	transport                   string
+	source, destination         string
+	sourcePort, destinationPort int
+}
+
+// conntrackEntry holds a connection's cumulative counters. The server is
+// taken from the reply direction, so connections to a Service are attributed
+// to the pod behind it rather than the ClusterIP.
+type conntrackEntry struct {
+	key                       conntrackKey
+	server                    string
+	serverPort                int
+	originalBytes, replyBytes int64
+}
+
+// readConntrack parses /proc/net/nf_conntrack. Byte counters are only
+// present with net.netfilter.nf_conntrack_acct=1.
+func readConntrack(path string) ([]conntrackEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []conntrackEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		entry := conntrackEntry{key: conntrackKey{transport: fields[2]}}
+		// Every key appears once per direction, original first.
+		seen := make(map[string]int)
+		for _, field := range fields[3:] {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			reply := seen[key] > 0
+			seen[key]++
+			switch key {
+			case "src":
+				if reply {
+					entry.server = value
+				} else {
+					entry.key.source = value
+				}
+			case "dst":
+				if !reply {
+					entry.key.destination = value
+				}
+			case "sport":
+				if reply {
+					entry.serverPort, _ = strconv.Atoi(value)
+				} else {
+					entry.key.sourcePort, _ = strconv.Atoi(value)
+				}
+			case "dport":
+				if !reply {
+					entry.key.destinationPort, _ = strconv.Atoi(value)
+				}
+			case "bytes":
+				n, _ := strconv.ParseInt(value, 10, 64)
+				if reply {
+					entry.replyBytes = n
+				} else {
+					entry.originalBytes = n
+				}
+			}
+		}
+		if entry.key.source == "" || entry.server == "" {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// conntrackDeltas turns cumulative counters into the bytes moved since the
+// previous snapshot. Bytes a connection moved between the last snapshot and
+// its removal from the table are not seen.
+type conntrackDeltas struct {
+	previous map[conntrackKey]conntrackEntry
+}
+
+func (d *conntrackDeltas) update(entries []conntrackEntry, at time.Time, filter cidrFilter) []NetworkFlow {
+	current := make(map[conntrackKey]conntrackEntry, len(entries))
+	var docs []NetworkFlow
+	for _, entry := range entries {
+		current[entry.key] = entry
+		original, reply := entry.originalBytes, entry.replyBytes
+		// A counter going down means the tuple was reused by a new connection.
+		if before, ok := d.previous[entry.key]; ok && before.originalBytes <= original && before.replyBytes <= reply {
+			original -= before.originalBytes
+			reply -= before.replyBytes
+		}
+		key := entry.key
+		if !filter.match(key.source, entry.server) {
+			continue
+		}
+		if original > 0 {
+			docs = append(docs, NetworkFlow{
+				Source: key.source, Destination: entry.server,
+				SourcePort: key.sourcePort, DestinationPort: entry.serverPort,
+				Transport: key.transport, Bytes: original, Timestamp: at,
+			})
+		}
+		if reply > 0 {
+			docs = append(docs, NetworkFlow{
+				Source: entry.server, Destination: key.source,
+				SourcePort: entry.serverPort, DestinationPort: key.sourcePort,
+				Transport: key.transport, Bytes: reply, Timestamp: at,
+			})
+		}
+	}
+	d.previous = current
+	return docs
+}
+
+// agentCapture yields the flows seen since the previous call.
+type agentCapture interface {
+	collect(at time.Time) ([]NetworkFlow, error)
+}
+
+type conntrackCapture struct {
+	path   string
+	filter cidrFilter
+	deltas conntrackDeltas
+	warned bool
+}
+
+func newConntrackCapture(path string, filter cidrFilter) (*conntrackCapture, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return &conntrackCapture{path: path, filter: filter}, nil
+}
+
+func (c *conntrackCapture) collect(at time.Time) ([]NetworkFlow, error) {
+	entries, err := readConntrack(c.path)
+	if err != nil {
+		return nil, err
+	}
+	if !c.warned && len(entries) > 0 && !hasConntrackBytes(entries) {
+		log.Printf("No byte counters in %s; enable them with sysctl net.netfilter.nf_conntrack_acct=1", c.path)
+		c.warned = true
+	}
+	return c.deltas.update(entries, at, c.filter), nil
+}
+
+func runAgent(args []string) {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		log.Fatalf("Error loading config: %s", err)
+	}
+
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	fs.String("config", "", "YAML or TOML configuration file; flags override its values")
+	capturePtr := fs.String("capture", "conntrack", "How to account traffic: conntrack, or ebpf for a socket filter counting every packet (Linux)")
+	conntrackPtr := fs.String("conntrack", "/proc/net/nf_conntrack", "Conntrack table to snapshot; the agent needs the host network namespace")
+	interfacePtr := fs.String("interface", "", "Only count packets sent on this interface with --capture=ebpf (default all)")
+	perContainerPtr := fs.Bool("per-container", false, "Count packets per sending container with --capture=ebpf, from a cgroup hook that sees only traffic of local sockets, so sidecars and applications are told apart")
+	cgroupRootPtr := fs.String("cgroup-root", "/sys/fs/cgroup", "Root of the host's cgroup v2 hierarchy for --per-container")
+	maxPairsPtr := fs.Int("max-pairs", 65536, "Address pairs the eBPF map holds between exports")
+	intervalPtr := fs.Duration("interval", 30*time.Second, "How often to snapshot the table and ship counters")
+	indexPtr := fs.String("index", "kube-netflow-agent", "Elasticsearch index to write counters to; point elasticsearch.index of the reports at it too, e.g. filebeat-*,kube-netflow-agent")
+	shipToPtr := fs.String("ship-to", "", "Register with and ship counters to this kube-netflow collect --agent-listen address as gzipped protobuf instead of indexing them in Elasticsearch")
+	fs.Var((*stringList)(&cfg.Network), "network", "Only ship connections within these networks")
+	fs.Parse(args)
+
+	// Bulk writes need one concrete index, not the patterns searches take.
+	if *shipToPtr == "" && (*indexPtr == "" || strings.ContainsAny(*indexPtr, "*?,")) {
+		log.Fatalf("--index must name a single index, got %q", *indexPtr)
+	}
+	filter, err := parseCIDRFilter(cfg.Network)
+	if err != nil {
+		log.Fatalf("Invalid network filter: %s", err)
+	}
+	if *perContainerPtr {
+		switch {
+		case *capturePtr != "ebpf":
+			log.Fatalf("--per-container needs --capture=ebpf")
+		case *interfacePtr != "":
+			log.Fatalf("--per-container counts what containers send on any interface; drop --interface")
+		case *shipToPtr != "":
+			// The collector's protocol has no container field.
+			log.Fatalf("--per-container indexes in Elasticsearch; drop --ship-to")
+		}
+	}
+	var capture agentCapture
+	switch *capturePtr {
+	case "conntrack":
+		capture, err = newConntrackCapture(*conntrackPtr, filter)
+	case "ebpf":
+		if *perContainerPtr {
+			capture, err = newEBPFContainerCapture(*cgroupRootPtr, *maxPairsPtr, filter)
+			break
+		}
+		capture, err = newEBPFCapture(*interfacePtr, *maxPairsPtr, filter)
+	default:
+		err = fmt.Errorf("unknown capture: %s", *capturePtr)
+	}
+	if err != nil {
+		log.Fatalf("Error starting %s capture: %s", *capturePtr, err)
+	}
+	var ship func(ctx context.Context, docs []NetworkFlow) error
+	var shipper *flowShipper
+	if *shipToPtr != "" {
+		shipper, err = newFlowShipper(*shipToPtr, *capturePtr, *intervalPtr)
+		if err != nil {
+			log.Fatalf("Error connecting to %s: %s", *shipToPtr, err)
+		}
+		defer shipper.Close()
+		ship = shipper.ship
+	} else {
+		es, err := newElasticClient(cfg.Elasticsearch)
+		if err != nil {
+			log.Fatalf("Error creating the client: %s", err)
+		}
+		ship = func(ctx context.Context, docs []NetworkFlow) error {
+			return bulkIndex(ctx, es, *indexPtr, docs)
+		}
+	}
+
+	ticker := time.NewTicker(*intervalPtr)
+	defer ticker.Stop()
+	for first := true; ; first = false {
+		docs, err := capture.collect(time.Now().UTC().Truncate(*intervalPtr))
+		switch {
+		case err != nil:
+			log.Printf("Error reading %s counters: %s", *capturePtr, err)
+		// The first snapshot only establishes the baseline; counters of
+		// connections older than the agent are not attributed to its start.
+		case !first:
+			if err := ship(context.Background(), docs); err != nil {
+				log.Printf("Error shipping %d flows: %s", len(docs), err)
+			}
+		}
+		if shipper != nil {
+			if err != nil {
+				shipper.report.failed(err)
+			}
+			if err := shipper.heartbeat(context.Background()); err != nil {
+				log.Printf("Error sending heartbeat to %s: %s", *shipToPtr, err)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+func hasConntrackBytes(entries []conntrackEntry) bool {
+	for _, entry := range entries {
+		if entry.originalBytes > 0 || entry.replyBytes > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// AlertsConfig checks threshold rules against every window queried.
+type AlertsConfig struct {
+	// Rules is a YAML or TOML file with a list of rules.
+	Rules string `yaml:"rules" toml:"rules"`
+	// URL receives firing and resolved alerts as JSON; it defaults to
+	// webhook.url, sent with webhook.headers.
+	URL     string            `yaml:"url" toml:"url"`
+	Headers map[string]string `yaml:"headers" toml:"headers"`
+}
+
+// alertRule fires when the traffic between the nodes it matches exceeds
+// Above, e.g.
+//
+//	rules:
+//	- name: payments-egress
+//	  source: "payments/*"
+//	  destination: 0.0.0.0/0
+//	  by: source
+//	  above: 1GB
+type alertRule struct {
+	Name string `yaml:"name" toml:"name"`
+	// Source and Destination are globs over node names, such as
+	// "payments/*", or CIDR ranges matching the addresses no resolver
+	// labelled. Empty or "*" matches every node.
+	Source      string `yaml:"source" toml:"source"`
+	Destination string `yaml:"destination" toml:"destination"`
+	// By adds up the matching traffic per pair (the default), per source,
+	// per destination or in total before comparing it with Above.
+	By    string `yaml:"by" toml:"by"`
+	Above string `yaml:"above" toml:"above"`
+	// Per makes Above a rate, e.g. 10GB per 1h, scaled to the window.
+	Per time.Duration `yaml:"per" toml:"per"`
+
+	threshold           float64
+	source, destination func(string) bool
+}
+
+// alert is a rule exceeded by one group of traffic. Source and Destination
+// are left empty when the rule adds them up.
+type alert struct {
+	Rule        string  `json:"rule"`
+	Source      string  `json:"source,omitempty"`
+	Destination string  `json:"destination,omitempty"`
+	Bytes       float64 `json:"bytes"`
+	Threshold   float64 `json:"threshold"`
+}
+
+func (a alert) key() string {
+	return a.Rule + "\x00" + a.Source + "\x00" + a.Destination
+}
+
+func loadAlertRules(path string) ([]alertRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Rules []alertRule `yaml:"rules" toml:"rules"`
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		meta, err := toml.Decode(string(data), &file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("%s: unknown setting %s", path, undecoded[0])
+		}
+	default:
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&file); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	names := make(map[string]bool)
+	for i := range file.Rules {
+		rule := &file.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("%s: duplicate rule %q", path, rule.Name)
+		}
+		names[rule.Name] = true
+		switch rule.By {
+		case "":
+			rule.By = "pair"
+		case "pair", "source", "destination", "total":
+		default:
+			return nil, fmt.Errorf("%s: rule %q: by must be pair, source, destination or total", path, rule.Name)
+		}
+		threshold, err := parseByteSize(rule.Above)
+		if err != nil {
+			return nil, fmt.Errorf("%s: rule %q: above: %w", path, rule.Name, err)
+		}
+		if rule.Per < 0 {
+			return nil, fmt.Errorf("%s: rule %q: per must be positive", path, rule.Name)
+		}
+		rule.threshold = float64(threshold)
+		if rule.source, err = nodeMatcher(rule.Source); err != nil {
+			return nil, fmt.Errorf("%s: rule %q: source: %w", path, rule.Name, err)
+		}
+		if rule.destination, err = nodeMatcher(rule.Destination); err != nil {
+			return nil, fmt.Errorf("%s: rule %q: destination: %w", path, rule.Name, err)
+		}
+	}
+	return file.Rules, nil
+}
+
+func nodeMatcher(pattern string) (func(string) bool, error) {
+	if pattern == "" || pattern == "*" {
+		return func(string) bool { return true }, nil
+	}
+	if _, network, err := net.ParseCIDR(pattern); err == nil {
+		return func(name string) bool {
+			ip := net.ParseIP(name)
+			return ip != nil && network.Contains(ip)
+		}, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q", pattern)
+	}
+	return func(name string) bool {
+		ok, _ := path.Match(pattern, name)
+		return ok
+	}, nil
+}
+
+// evaluate returns the groups of matrix's traffic over the rule's threshold
+// for a window of the given length, largest first.
+func (r alertRule) evaluate(matrix *FlowMatrix, window time.Duration) []alert {
+	threshold := r.threshold
+	if r.Per > 0 {
+		threshold *= float64(window) / float64(r.Per)
+	}
+	totals := make(map[[2]string]float64)
+	for i, source := range matrix.Names {
+		if !r.source(source) {
+			continue
+		}
+		for j, destination := range matrix.Names {
+			if matrix.Flow[i][j] == 0 || !r.destination(destination) {
+				continue
+			}
+			group := [2]string{source, destination}
+			switch r.By {
+			case "source":
+				group[1] = ""
+			case "destination":
+				group[0] = ""
+			case "total":
+				group = [2]string{}
+			}
+			totals[group] += matrix.Flow[i][j]
+		}
+	}
+
+	var alerts []alert
+	for group, bytes := range totals {
+		if bytes > threshold {
+			alerts = append(alerts, alert{r.Name, group[0], group[1], bytes, threshold})
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Bytes > alerts[j].Bytes })
+	return alerts
+}
+
+// alerter evaluates the rules after each query and notifies about alerts
+// that start or stop firing.
+type alerter struct {
+	cfg   Config
+	rules []alertRule
+
+	mu     sync.Mutex
+	firing map[string]alert
+}
+
+func newAlerter(cfg Config) (*alerter, error) {
+	rules, err := loadAlertRules(cfg.Alerts.Rules)
+	if err != nil {
+		return nil, err
+	}
+	return &alerter{cfg: cfg, rules: rules, firing: make(map[string]alert)}, nil
+}
+
+// alertReport is the body posted when alerts start or stop firing.
+type alertReport struct {
+	Title    string    `json:"title"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Firing   []alert   `json:"firing"`
+	Resolved []alert   `json:"resolved"`
+}
+
+// check evaluates the rules against the window [from, to) and returns the
+// alerts firing in it. New and resolved alerts are logged and posted; when
+// posting fails they are reported again after the next query.
+func (a *alerter) check(ctx context.Context, matrix *FlowMatrix, from, to time.Time) ([]alert, error) {
+	var firing []alert
+	for _, rule := range a.rules {
+		firing = append(firing, rule.evaluate(matrix, to.Sub(from))...)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	report := alertReport{Title: a.cfg.Output.Title, From: from.UTC(), To: to.UTC()}
+	now := make(map[string]alert)
+	for _, fired := range firing {
+		now[fired.key()] = fired
+		if _, ok := a.firing[fired.key()]; !ok {
+			report.Firing = append(report.Firing, fired)
+		}
+	}
+	for key, resolved := range a.firing {
+		if _, ok := now[key]; !ok {
+			report.Resolved = append(report.Resolved, resolved)
+		}
+	}
+	for _, fired := range report.Firing {
+		log.Printf("Alert %s firing: %s", fired.Rule, fired.describe())
+	}
+	for _, resolved := range report.Resolved {
+		log.Printf("Alert %s resolved: %s", resolved.Rule, resolved.describe())
+	}
+	if len(report.Firing) > 0 || len(report.Resolved) > 0 {
+		if err := a.post(ctx, report); err != nil {
+			return firing, err
+		}
+	}
+	a.firing = now
+	return firing, nil
+}
+
+func (a alert) describe() string {
+	source, destination := a.Source, a.Destination
+	if source == "" {
+		source = "*"
+	}
+	if destination == "" {
+		destination = "*"
+	}
+	return fmt.Sprintf("%s → %s sent %.1f MB, over %.1f MB", source, destination, a.Bytes/1024/1024, a.Threshold/1024/1024)
+}
+
+func (a *alerter) post(ctx context.Context, report alertReport) error {
+	url, headers := a.cfg.Alerts.URL, a.cfg.Alerts.Headers
+	if url == "" {
+		url, headers = a.cfg.Webhook.URL, a.cfg.Webhook.Headers
+	}
+	if url == "" {
+		return nil
+	}
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	res, err := notifyClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("posting alerts: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return fmt.Errorf("posting alerts: %s: %s", res.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BaselineConfig learns each pair's usual byte rate and flags windows that
+// stray from it.
+type BaselineConfig struct {
+	// Path is the bolt database holding the learned rates, or an
+	// s3://, elasticsearch:// or configmap:// location keeping them as one
+	// JSON document.
+	Path string `yaml:"path" toml:"path"`
+	// ZScore flags a pair whose rate is this many standard deviations from
+	// its mean; Percent flags one that differs from its mean by this much.
+	// Zero disables either test.
+	ZScore  float64 `yaml:"zScore" toml:"zScore"`
+	Percent float64 `yaml:"percent" toml:"percent"`
+	// MinSamples is how many windows a pair must have been seen in before
+	// it can be flagged.
+	MinSamples int `yaml:"minSamples" toml:"minSamples"`
+}
+
+var baselineBucket = []byte("pairs")
+
+// pairStats is the running mean and variance of a pair's byte rate, kept
+// with Welford's algorithm.
+type pairStats struct {
+	Samples   int       `json:"samples"`
+	Mean      float64   `json:"mean"`
+	M2        float64   `json:"m2"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func (s *pairStats) add(rate float64, now time.Time) {
+	s.Samples++
+	delta := rate - s.Mean
+	s.Mean += delta / float64(s.Samples)
+	s.M2 += delta * (rate - s.Mean)
+	s.UpdatedAt = now
+}
+
+func (s pairStats) stddev() float64 {
+	if s.Samples < 2 {
+		return 0
+	}
+	return math.Sqrt(s.M2 / float64(s.Samples-1))
+}
+
+// anomaly is a pair whose rate in the current window strays from its
+// baseline.
+type anomaly struct {
+	Source      string  `json:"source"`
+	Destination string  `json:"destination"`
+	Rate        float64 `json:"rate"`
+	Mean        float64 `json:"mean"`
+	ZScore      float64 `json:"zScore"`
+	Percent     float64 `json:"percent"`
+}
+
+func (a anomaly) describe() string {
+	return fmt.Sprintf("%s → %s at %.1f KB/s, usually %.1f KB/s (%+.0f%%, z=%.1f)", a.Source, a.Destination, a.Rate/1024, a.Mean/1024, a.Percent, a.ZScore)
+}
+
+// baseline is the store of learned per-pair rates, in a bolt database or,
+// for shared storage, a state store.
+type baseline struct {
+	cfg   BaselineConfig
+	db    *bolt.DB
+	state stateStore
+}
+
+func openBaseline(cfg Config) (*baseline, error) {
+	if cfg.Baseline.ZScore < 0 || cfg.Baseline.Percent < 0 {
+		return nil, fmt.Errorf("z-score and percent must not be negative")
+	}
+	if strings.Contains(cfg.Baseline.Path, "://") {
+		state, err := openState(cfg, cfg.Baseline.Path)
+		if err != nil {
+			return nil, err
+		}
+		return &baseline{cfg: cfg.Baseline, state: state}, nil
+	}
+
+	db, err := bolt.Open(cfg.Baseline.Path, 0o644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", cfg.Baseline.Path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(baselineBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &baseline{cfg: cfg.Baseline, db: db}, nil
+}
+
+func (b *baseline) Close() error {
+	if b.db == nil {
+		return nil
+	}
+	return b.db.Close()
+}
+
+// update calls fn with the learned rates by pairKey and stores what it
+// leaves in the map.
+func (b *baseline) update(ctx context.Context, fn func(rates map[string]pairStats) error) error {
+	rates := make(map[string]pairStats)
+	if b.db != nil {
+		return b.db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(baselineBucket)
+			err := bucket.ForEach(func(key, data []byte) error {
+				var stats pairStats
+				if err := json.Unmarshal(data, &stats); err != nil {
+					return fmt.Errorf("baseline of %q: %w", key, err)
+				}
+				rates[string(key)] = stats
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if err := fn(rates); err != nil {
+				return err
+			}
+			for key, stats := range rates {
+				data, err := json.Marshal(stats)
+				if err != nil {
+					return err
+				}
+				if err := bucket.Put([]byte(key), data); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	data, err := b.state.load(ctx)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(data, &rates); err != nil {
+			return fmt.Errorf("baseline: %w", err)
+		}
+	}
+	if err := fn(rates); err != nil {
+		return err
+	}
+	if data, err = json.Marshal(rates); err != nil {
+		return err
+	}
+	return b.state.save(ctx, data)
+}
+
+func pairKey(source, destination string) []byte {
+	return []byte(source + "\x00" + destination)
+}
+
+// observe compares the rates of matrix's pairs over [from, to) with their
+// baselines, then folds them into the baselines. Pairs that deviate are
+// marked on the matrix so their chords are highlighted, and returned
+// largest deviation first. A pair absent from the window leaves its
+// baseline unchanged.
+func (b *baseline) observe(ctx context.Context, matrix *FlowMatrix, from, to time.Time) ([]anomaly, error) {
+	seconds := to.Sub(from).Seconds()
+	if seconds <= 0 {
+		return nil, nil
+	}
+	var anomalies []anomaly
+	err := b.update(ctx, func(rates map[string]pairStats) error {
+		for i, source := range matrix.Names {
+			for j, destination := range matrix.Names {
+				if matrix.Flow[i][j] == 0 {
+					continue
+				}
+				key := string(pairKey(source, destination))
+				stats := rates[key]
+				rate := matrix.Flow[i][j] / seconds
+				if found, ok := b.check(stats, rate); ok {
+					found.Source, found.Destination = source, destination
+					anomalies = append(anomalies, found)
+				}
+				stats.add(rate, to)
+				rates[key] = stats
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(anomalies, func(i, j int) bool {
+		return math.Abs(anomalies[i].Percent) > math.Abs(anomalies[j].Percent)
+	})
+	matrix.anomalies = make(map[[2]string]anomaly, len(anomalies))
+	for _, found := range anomalies {
+		matrix.anomalies[[2]string{found.Source, found.Destination}] = found
+		log.Printf("Anomaly: %s", found.describe())
+	}
+	return anomalies, nil
+}
+
+// check reports whether rate strays from stats by more than the configured
+// z-score or percentage.
+func (b *baseline) check(stats pairStats, rate float64) (anomaly, bool) {
+	if stats.Samples < b.cfg.MinSamples || stats.Samples == 0 {
+		return anomaly{}, false
+	}
+	found := anomaly{Rate: rate, Mean: stats.Mean}
+	if stats.Mean > 0 {
+		found.Percent = (rate - stats.Mean) / stats.Mean * 100
+	}
+	if stddev := stats.stddev(); stddev > 0 {
+		found.ZScore = (rate - stats.Mean) / stddev
+	}
+	flagged := b.cfg.ZScore > 0 && math.Abs(found.ZScore) >= b.cfg.ZScore
+	flagged = flagged || b.cfg.Percent > 0 && math.Abs(found.Percent) >= b.cfg.Percent
+	return found, flagged
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// memoryState is a stateStore holding its document in memory.
+type memoryState struct {
+	data []byte
+}
+
+func (m *memoryState) load(ctx context.Context) ([]byte, error) {
+	if m.data == nil {
+		return nil, fs.ErrNotExist
+	}
+	return m.data, nil
+}
+
+func (m *memoryState) save(ctx context.Context, data []byte) error {
+	m.data = data
+	return nil
+}
+
+func TestBaselineStores(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Baseline = BaselineConfig{Path: filepath.Join(t.TempDir(), "baseline.db"), Percent: 50, MinSamples: 3}
+	bolted, err := openBaseline(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bolted.Close()
+	stored := &baseline{cfg: cfg.Baseline, state: &memoryState{}}
+
+	for name, learned := range map[string]*baseline{"bolt": bolted, "state store": stored} {
+		from := time.Unix(0, 0)
+		for i, bytes := range []float64{1000, 1100, 900, 1000, 5000} {
+			matrix := NewFlowMatrix()
+			matrix.Add("10.0.0.1", "10.0.0.2", bytes)
+			to := from.Add(100 * time.Second)
+			anomalies, err := learned.observe(context.Background(), matrix, from, to)
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			if flagged := len(anomalies) > 0; flagged != (i == 4) {
+				t.Errorf("%s: window %d flagged %v", name, i, anomalies)
+			}
+			from = to
+		}
+	}
+}
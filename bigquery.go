@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const bigQueryAPI = "https://bigquery.googleapis.com/bigquery/v2"
+
+// BigQueryConfig reads Google VPC Flow Logs routed to BigQuery by a log sink.
+// Table is project.dataset.table and may end in * for date-sharded exports.
+// Column settings are SQL expressions over the exported log entry.
+type BigQueryConfig struct {
+	Table             string `yaml:"table" toml:"table"`
+	Project           string `yaml:"project" toml:"project"`
+	Location          string `yaml:"location" toml:"location"`
+	SourceColumn      string `yaml:"sourceColumn" toml:"sourceColumn"`
+	DestinationColumn string `yaml:"destinationColumn" toml:"destinationColumn"`
+	BytesColumn       string `yaml:"bytesColumn" toml:"bytesColumn"`
+	StartColumn       string `yaml:"startColumn" toml:"startColumn"`
+	EndColumn         string `yaml:"endColumn" toml:"endColumn"`
+}
+
+type bigQuerySource struct {
+	cfg        BigQueryConfig
+	token      string
+	httpClient *http.Client
+}
+
+func newBigQuerySource(cfg BigQueryConfig) (*bigQuerySource, error) {
+	if strings.Count(cfg.Table, ".") != 2 || strings.Contains(cfg.Table, "`") {
+		return nil, fmt.Errorf("bigquery source needs a project.dataset.table, got %q", cfg.Table)
+	}
+	if cfg.Project == "" {
+		cfg.Project, _, _ = strings.Cut(cfg.Table, ".")
+	}
+
+	httpClient := &http.Client{Timeout: 5 * time.Minute}
+	token, err := googleAccessToken(context.Background(), httpClient)
+	if err != nil {
+		return nil, fmt.Errorf("getting Google credentials: %w", err)
+	}
+	return &bigQuerySource{cfg: cfg, token: token, httpClient: httpClient}, nil
+}
+
+// googleAccessToken uses gcloud when it is installed, so the usual account
+// selection applies, and otherwise the metadata server of the GCE VM or GKE
+// workload identity the process runs as.
+func googleAccessToken(ctx context.Context, httpClient *http.Client) (string, error) {
+	if _, err := exec.LookPath("gcloud"); err == nil {
+		out, err := exec.CommandContext(ctx, "gcloud", "auth", "print-access-token").Output()
+		if err != nil {
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				return "", fmt.Errorf("gcloud auth print-access-token: %s", strings.TrimSpace(string(exitErr.Stderr)))
+			}
+			return "", err
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("gcloud is not installed and the metadata server is unreachable: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server: %s", res.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+func (s *bigQuerySource) Name() string {
+	return "bigquery"
+}
+
+func (s *bigQuerySource) Version(ctx context.Context) (string, error) {
+	return "v2", nil
+}
+
+func (s *bigQuerySource) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, bigQueryAPI+path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return fmt.Errorf("bigquery: %s: %s", res.Status, strings.TrimSpace(string(data)))
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+type bigQueryResult struct {
+	JobComplete  bool `json:"jobComplete"`
+	JobReference struct {
+		JobID    string `json:"jobId"`
+		Location string `json:"location"`
+	} `json:"jobReference"`
+	PageToken string `json:"pageToken"`
+	Rows      []struct {
+		F []struct {
+			V interface{} `json:"v"`
+		} `json:"f"`
+	} `json:"rows"`
+}
+
+func timestampParameter(name string, t time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"name":           name,
+		"parameterType":  map[string]interface{}{"type": "TIMESTAMP"},
+		"parameterValue": map[string]interface{}{"value": t.UTC().Format(time.RFC3339Nano)},
+	}
+}
+
+func (s *bigQuerySource) Fetch(ctx context.Context, from, to time.Time, networkFilters []string) (*FlowMatrix, error) {
+	filter, err := parseCIDRFilter(networkFilters)
+	if err != nil {
+		return nil, err
+	}
+
+	// Entries are written after the flow interval closes, so the log
+	// timestamp bounds the scan from below and prunes partitions.
+	sql := fmt.Sprintf(`SELECT %s AS flow_source, %s AS flow_destination, SUM(SAFE_CAST(%s AS INT64)) AS flow_bytes
+FROM `+"`%s`"+`
+WHERE timestamp >= @from
+  AND SAFE_CAST(%s AS TIMESTAMP) >= @from AND SAFE_CAST(%s AS TIMESTAMP) < @to`,
+		s.cfg.SourceColumn, s.cfg.DestinationColumn, s.cfg.BytesColumn, s.cfg.Table, s.cfg.EndColumn, s.cfg.StartColumn)
+	if strings.HasSuffix(s.cfg.Table, "*") {
+		sql += "\n  AND _TABLE_SUFFIX BETWEEN FORMAT_TIMESTAMP('%Y%m%d', @from) AND FORMAT_TIMESTAMP('%Y%m%d', TIMESTAMP_ADD(@to, INTERVAL 1 DAY))"
+	}
+	sql += "\nGROUP BY flow_source, flow_destination"
+
+	request := map[string]interface{}{
+		"query":         sql,
+		"useLegacySql":  false,
+		"parameterMode": "NAMED",
+		"queryParameters": []interface{}{
+			timestampParameter("from", from),
+			timestampParameter("to", to),
+		},
+		"timeoutMs": 60000,
+	}
+	if s.cfg.Location != "" {
+		request["location"] = s.cfg.Location
+	}
+
+	var result bigQueryResult
+	projectPath := "/projects/" + url.PathEscape(s.cfg.Project)
+	if err := s.do(ctx, http.MethodPost, projectPath+"/queries", request, &result); err != nil {
+		return nil, err
+	}
+
+	matrix := NewFlowMatrix()
+	for {
+		for _, row := range result.Rows {
+			if len(row.F) != 3 {
+				return nil, fmt.Errorf("bigquery: expected 3 columns, got %d", len(row.F))
+			}
+			source, _ := row.F[0].V.(string)
+			destination, _ := row.F[1].V.(string)
+			value, _ := row.F[2].V.(string)
+			if source == "" || destination == "" || !filter.match(source, destination) {
+				continue
+			}
+			total, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			matrix.Add(source, destination, total)
+		}
+
+		if result.JobComplete && result.PageToken == "" {
+			return matrix, nil
+		}
+		params := url.Values{}
+		params.Set("timeoutMs", "60000")
+		params.Set("location", result.JobReference.Location)
+		if result.PageToken != "" {
+			params.Set("pageToken", result.PageToken)
+		}
+		path := projectPath + "/queries/" + url.PathEscape(result.JobReference.JobID) + "?" + params.Encode()
+		result = bigQueryResult{}
+		if err := s.do(ctx, http.MethodGet, path, nil, &result); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// bundleFlows is flows.json in a bundle.
+type bundleFlows struct {
+	From  time.Time       `json:"from"`
+	To    time.Time       `json:"to"`
+	Nodes []apiNode       `json:"nodes"`
+	Pairs []flowTablePair `json:"pairs"`
+}
+
+// writeBundle packages files, under their base names, with the matrix as
+// flows.csv and flows.json into a zip archive at path, for attaching to
+// tickets or audits.
+func writeBundle(path string, files []string, matrix *FlowMatrix, nodes []apiNode, manifest Manifest) error {
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	add := func(name string, data []byte) error {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: manifest.GeneratedAt})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := add(filepath.Base(file), data); err != nil {
+			return err
+		}
+	}
+
+	pairs := topPairs(matrix, 0)
+	var table bytes.Buffer
+	cw := csv.NewWriter(&table)
+	cw.Write([]string{"source", "destination", "bytes"})
+	for _, pair := range pairs {
+		cw.Write([]string{pair.Source, pair.Destination, strconv.FormatFloat(pair.Bytes, 'f', 0, 64)})
+	}
+	cw.Flush()
+	if err := add("flows.csv", table.Bytes()); err != nil {
+		return err
+	}
+	flows, err := json.MarshalIndent(bundleFlows{From: manifest.From, To: manifest.To, Nodes: nodes, Pairs: pairs}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := add("flows.json", append(flows, '\n')); err != nil {
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, archive.Bytes())
+}
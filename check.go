@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+// checkReport prints the outcome of each check and counts the failures.
+type checkReport struct {
+	out    io.Writer
+	failed int
+}
+
+func (r *checkReport) pass(format string, args ...interface{}) {
+	fmt.Fprintf(r.out, "ok    %s\n", fmt.Sprintf(format, args...))
+}
+
+func (r *checkReport) skip(format string, args ...interface{}) {
+	fmt.Fprintf(r.out, "skip  %s\n", fmt.Sprintf(format, args...))
+}
+
+// fail reports problem along with what to do about it.
+func (r *checkReport) fail(problem, fix string) {
+	r.failed++
+	fmt.Fprintf(r.out, "FAIL  %s\n", problem)
+	if fix != "" {
+		fmt.Fprintf(r.out, "      %s\n", fix)
+	}
+}
+
+// runCheck validates a config and tries it out: it connects to the source
+// and Kubernetes, checks Elasticsearch maps the flow fields so they can be
+// aggregated, and looks for flows in the window. It exits with status 1
+// when any check fails.
+func runCheck(args []string) {
+	report := &checkReport{out: os.Stdout}
+	cfg, err := loadConfig(args)
+	if err != nil {
+		report.fail(fmt.Sprintf("config: %s", err), "Fix the file; kube-netflow init writes a minimal one to start from")
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.String("config", "", "YAML or TOML configuration file to check")
+	fs.StringVar(&cfg.Window, "window", cfg.Window, "Window to look for flows in (e.g., 15m, 1h, 24h)")
+	fs.Var((*stringList)(&cfg.Network), "network", "Network CIDR filter to look for flows with")
+	fs.Parse(args)
+
+	if problems := configProblems(cfg); len(problems) > 0 {
+		for _, problem := range problems {
+			report.fail("config: "+problem, "")
+		}
+	} else {
+		report.pass("config")
+	}
+
+	ctx := context.Background()
+	source, err := newFlowSource(cfg)
+	if err != nil {
+		report.fail(fmt.Sprintf("%s source: %s", cfg.Source, err), "Check the source's settings in the config")
+	} else {
+		checkSource(ctx, report, cfg, source)
+	}
+
+	if resolverEnabled(cfg, "kubernetes") {
+		checkKubernetes(ctx, report, cfg.Kubernetes)
+	} else {
+		report.skip("kubernetes: labels are off")
+	}
+
+	if report.failed > 0 {
+		fmt.Fprintf(report.out, "\n%d checks failed\n", report.failed)
+		os.Exit(1)
+	}
+}
+
+// configProblems lists the settings of cfg that kube-netflow would refuse
+// to run with.
+func configProblems(cfg Config) []string {
+	var problems []string
+	if _, ok := flowSources[cfg.Source]; !ok {
+		if _, ok := cfg.Plugins[cfg.Source]; !ok {
+			problems = append(problems, fmt.Sprintf("unknown source %q; use one of %s or a plugin named under plugins", cfg.Source, strings.Join(sourceNames(), ", ")))
+		}
+	}
+	if _, err := parseWindow(cfg.Window); err != nil {
+		problems = append(problems, fmt.Sprintf("window: %s", err))
+	}
+	if cfg.CompareWindow != "" {
+		if offset, err := parseWindow(cfg.CompareWindow); err != nil || offset <= 0 {
+			problems = append(problems, fmt.Sprintf("compareWindow %q is not a positive window", cfg.CompareWindow))
+		}
+	}
+	for _, cidr := range cfg.Network {
+		if _, _, err := cidrToRange(strings.TrimSpace(cidr)); err != nil {
+			problems = append(problems, fmt.Sprintf("network: %s", err))
+		}
+	}
+	if len(cfg.Protocols) > 0 && cfg.Source != "elasticsearch" {
+		problems = append(problems, "protocols needs the elasticsearch source, which records ports")
+	}
+	if cfg.Privacy.MinPairFlows > 0 && cfg.Source != "elasticsearch" {
+		problems = append(problems, "privacy.minPairFlows needs the elasticsearch source, which counts flow records")
+	}
+	if cfg.Limits.MaxWindow < 0 {
+		problems = append(problems, "limits.maxWindow must not be negative")
+	}
+	if cfg.Elasticsearch.CorrectClockSkew && cfg.Elasticsearch.MaxClockSkew <= 0 {
+		problems = append(problems, "elasticsearch.correctClockSkew needs elasticsearch.maxClockSkew")
+	}
+	if cfg.Kubernetes.GroupBy != "ip" && cfg.Kubernetes.GroupBy != "namespace" {
+		problems = append(problems, fmt.Sprintf("kubernetes.groupBy must be ip or namespace, not %q", cfg.Kubernetes.GroupBy))
+	}
+	if cfg.Kubernetes.OwnershipIndex != "" {
+		if _, err := os.Stat(cfg.Kubernetes.OwnershipIndex); err != nil {
+			problems = append(problems, fmt.Sprintf("kubernetes.ownershipIndex: %s", err))
+		}
+	}
+
+	out := cfg.Output
+	if out.Width <= 0 || out.Height <= 0 || out.DPI <= 0 {
+		problems = append(problems, "output.width, output.height and output.dpi must be positive")
+	}
+	switch out.Format {
+	case "png", "svg", "pdf", "eps", "nodegraph":
+	case "html":
+		if out.Table {
+			problems = append(problems, "output.format html already includes the table; drop output.table")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unsupported output.format %q", out.Format))
+	}
+	if _, ok := diagramLayouts[out.Layout]; !ok {
+		problems = append(problems, fmt.Sprintf("unsupported output.layout %q", out.Layout))
+	}
+	if out.ClusterNamespaces && out.Layout != "graph" {
+		problems = append(problems, "output.clusterNamespaces needs output.layout graph")
+	}
+	if _, ok := chordThemes[out.Theme]; !ok {
+		problems = append(problems, fmt.Sprintf("unsupported output.theme %q", out.Theme))
+	}
+	if out.Timelapse != "" {
+		switch strings.ToLower(filepath.Ext(out.Timelapse)) {
+		case ".gif", ".mp4":
+		default:
+			problems = append(problems, "output.timelapse must name a .gif or .mp4 file")
+		}
+		if out.Frames <= 0 {
+			problems = append(problems, "output.frames must be positive")
+		}
+	}
+	if out.Keep < 0 {
+		problems = append(problems, "output.keep must not be negative")
+	}
+	if len(cfg.Email.To) > 0 && (cfg.Email.Host == "" || cfg.Email.From == "") {
+		problems = append(problems, "email.to needs email.host and email.from")
+	}
+	if cfg.Slack.Channel != "" && cfg.Slack.Token == "" && os.Getenv("SLACK_TOKEN") == "" {
+		problems = append(problems, "slack.channel needs slack.token or SLACK_TOKEN")
+	}
+	return problems
+}
+
+// checkSource connects to source and looks for flows in the window, and
+// for Elasticsearch checks the flow fields on the way.
+func checkSource(ctx context.Context, report *checkReport, cfg Config, source FlowSource) {
+	probeCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+	version, err := source.Version(probeCtx)
+	cancel()
+	if err != nil {
+		fix := "Check the source's address and that it is up"
+		if cfg.Source == "elasticsearch" {
+			fix = "Check elasticsearch.addresses, the credentials and elasticsearch.tls"
+		}
+		report.fail(fmt.Sprintf("%s: cannot connect: %s", source.Name(), err), fix)
+		return
+	}
+	report.pass("%s: connected to %s", source.Name(), version)
+
+	es, _ := source.(*elasticSource)
+	if es != nil {
+		checkFieldCaps(ctx, report, es.es, es.index)
+	}
+
+	window, err := parseWindow(cfg.Window)
+	if err != nil {
+		report.skip("data: no valid window to look in")
+		return
+	}
+	queryCtx, cancel := context.WithTimeout(ctx, 2*probeTimeout)
+	defer cancel()
+	from, to, lag, err := queryRange(queryCtx, source, window, time.Now(), cfg.ShiftLag)
+	if err != nil {
+		report.fail(fmt.Sprintf("data: %s", err), "")
+		return
+	}
+	matrix, err := source.Fetch(queryCtx, from, to, cfg.Network)
+	if err != nil {
+		report.fail(fmt.Sprintf("data: querying %s to %s: %s", from.Format(time.RFC3339), to.Format(time.RFC3339), err), "")
+		return
+	}
+	var pairs int
+	for i := range matrix.Flow {
+		for _, bytes := range matrix.Flow[i] {
+			if bytes > 0 {
+				pairs++
+			}
+		}
+	}
+	if pairs > 0 {
+		report.pass("data: %d conversations between %d nodes in the last %s", pairs, len(matrix.Names), cfg.Window)
+		if lag > window/2 && !cfg.ShiftLag {
+			report.fail(fmt.Sprintf("data: ingestion lags %s behind, over half the window", lag.Round(time.Second)), "Set shiftLag: true so the window ends at the newest flow")
+		}
+		return
+	}
+
+	fix := "Widen the window, or check that flows are being collected"
+	if es != nil && len(cfg.Network) > 0 {
+		if docs, err := countFlows(queryCtx, es.es, es.index, from, to); err == nil && docs > 0 {
+			fix = fmt.Sprintf("%s holds %d flows in the window, but none with both ends in %s; widen network", es.index, docs, strings.Join(cfg.Network, ", "))
+		}
+	}
+	report.fail(fmt.Sprintf("data: no flows in the last %s", cfg.Window), fix)
+}
+
+// checkFieldCaps checks the indices matching index map each flow field to
+// one type that kube-netflow can aggregate on.
+func checkFieldCaps(ctx context.Context, report *checkReport, es *elasticsearch.Client, index string) {
+	names := make([]string, len(flowFields))
+	for i, field := range flowFields {
+		names[i] = field.name
+	}
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	res, err := es.FieldCaps(es.FieldCaps.WithContext(ctx), es.FieldCaps.WithIndex(index), es.FieldCaps.WithFields(names...))
+	if err != nil {
+		report.fail(fmt.Sprintf("fields: %s", err), "")
+		return
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		report.fail(fmt.Sprintf("fields: %s", res.String()), "Check elasticsearch.index names the flow indices and the user may read them")
+		return
+	}
+	var caps struct {
+		Indices []string `json:"indices"`
+		Fields  map[string]map[string]struct {
+			Aggregatable           bool     `json:"aggregatable"`
+			NonAggregatableIndices []string `json:"non_aggregatable_indices"`
+		} `json:"fields"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&caps); err != nil {
+		report.fail(fmt.Sprintf("fields: %s", err), "")
+		return
+	}
+	if len(caps.Indices) == 0 {
+		report.fail(fmt.Sprintf("fields: no index matches %s", index), "Set elasticsearch.index to the pattern of the flow indices")
+		return
+	}
+
+	for _, field := range flowFields {
+		types := caps.Fields[field.name]
+		var kinds []string
+		for kind := range types {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		switch {
+		case len(kinds) == 0 && field.usedBy == "":
+			report.fail(fmt.Sprintf("fields: %s is missing", field.name), "Map it in the index template; kube-netflow cannot draw flows without it")
+		case len(kinds) == 0:
+			report.skip("fields: %s is missing, leaving out %s", field.name, field.usedBy)
+		case len(kinds) > 1:
+			report.fail(fmt.Sprintf("fields: %s is mapped as %s in different indices", field.name, strings.Join(kinds, " and ")),
+				fmt.Sprintf("Map it as %s in the index template and reindex or roll over", field.types[0]))
+		case !containsString(field.types, kinds[0]):
+			report.fail(fmt.Sprintf("fields: %s is mapped as %s", field.name, kinds[0]),
+				fmt.Sprintf("Map it as %s in the index template and reindex or roll over", field.types[0]))
+		case !types[kinds[0]].Aggregatable:
+			fix := "Enable doc_values for it in the index template"
+			if indices := types[kinds[0]].NonAggregatableIndices; len(indices) > 0 {
+				fix = fmt.Sprintf("Enable doc_values for it in %s", strings.Join(indices, ", "))
+			}
+			report.fail(fmt.Sprintf("fields: %s cannot be aggregated", field.name), fix)
+		default:
+			report.pass("fields: %s is an aggregatable %s", field.name, kinds[0])
+		}
+	}
+}
+
+// countFlows counts the flow records in [from, to), whatever their
+// addresses.
+func countFlows(ctx context.Context, es *elasticsearch.Client, index string, from, to time.Time) (int, error) {
+	result, err := search(ctx, es, index, map[string]interface{}{
+		"size":             0,
+		"track_total_hits": true,
+		"query": timeRangeCondition(map[string]interface{}{
+			"gte": from.Format(time.RFC3339),
+			"lt":  to.Format(time.RFC3339),
+		}),
+	})
+	if err != nil {
+		return 0, err
+	}
+	hits, _ := result["hits"].(map[string]interface{})
+	total, _ := hits["total"].(map[string]interface{})
+	count, _ := total["value"].(float64)
+	return int(count), nil
+}
+
+// checkKubernetes lists the cluster's pods, services and nodes as the
+// kubernetes resolver does.
+func checkKubernetes(ctx context.Context, report *checkReport, cfg KubernetesConfig) {
+	client, err := newKubeClient(cfg.Kubeconfig)
+	if err != nil {
+		report.fail(fmt.Sprintf("kubernetes: %s", err), "Set kubernetes.kubeconfig, or run in the cluster with a service account")
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	inventory, err := loadKubeInventory(ctx, client)
+	if err != nil {
+		report.fail(fmt.Sprintf("kubernetes: %s", err), "Grant the user or service account list on pods, services and nodes")
+		return
+	}
+	kinds := make(map[string]int)
+	for _, endpoints := range inventory {
+		for _, endpoint := range endpoints {
+			if endpoint.Until.IsZero() {
+				kinds[endpoint.Kind]++
+			}
+		}
+	}
+	report.pass("kubernetes: %d pods, %d services and %d nodes", kinds["pod"], kinds["service"], kinds["node"])
+}
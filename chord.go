@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"io"
+	"math"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+	"gonum.org/v1/plot/vg/vgimg"
+)
+
+type ChordDiagram struct {
+	Flow   [][]float64
+	Labels []string
+	Color  func(i, j int) color.Color
+	Theme  chordTheme
+	// ResolvedBy names the resolver behind each label, for SVG tooltips.
+	ResolvedBy map[string]string
+	// Anomalies are the pairs, by label, drawn in red because they stray
+	// from the learned baseline.
+	Anomalies map[[2]string]anomaly
+}
+
+// anomalyColor highlights chords that stray from the baseline.
+var anomalyColor = color.RGBA{R: 220, G: 30, B: 30, A: 255}
+
+// chordTheme holds the colours of everything but the chords.
+type chordTheme struct {
+	Background color.Color
+	Text       color.Color
+	Arc        color.Color
+	// LabelBackground is drawn behind labels to keep them legible over
+	// chords.
+	LabelBackground color.Color
+	// Dashes, when set, tell chords apart by their source's dash pattern
+	// and their destination's shade of gray rather than by colour.
+	Dashes [][]vg.Length
+}
+
+var chordThemes = map[string]chordTheme{
+	"light": {
+		Background:      color.White,
+		Text:            color.Black,
+		Arc:             color.RGBA{100, 100, 100, 255},
+		LabelBackground: color.RGBA{255, 255, 255, 220},
+	},
+	// dark matches Grafana's dark panels.
+	"dark": {
+		Background:      color.RGBA{24, 27, 31, 255},
+		Text:            color.RGBA{204, 204, 220, 255},
+		Arc:             color.RGBA{140, 140, 150, 255},
+		LabelBackground: color.RGBA{24, 27, 31, 220},
+	},
+	// print survives grayscale printers and photocopiers.
+	"print": {
+		Background:      color.White,
+		Text:            color.Black,
+		Arc:             color.Black,
+		LabelBackground: color.RGBA{255, 255, 255, 220},
+		Dashes: [][]vg.Length{
+			nil,
+			{vg.Points(6), vg.Points(3)},
+			{vg.Points(1.5), vg.Points(2)},
+			{vg.Points(8), vg.Points(3), vg.Points(1.5), vg.Points(3)},
+			{vg.Points(12), vg.Points(4)},
+			{vg.Points(4), vg.Points(2), vg.Points(1.5), vg.Points(2), vg.Points(1.5), vg.Points(2)},
+		},
+	},
+}
+
+func (c ChordDiagram) Plot(canvas draw.Canvas, plt *plot.Plot) {
+	origin := vg.Point{X: canvas.Size().X / 2, Y: canvas.Size().Y / 2}
+	radius := math.Min(float64(canvas.Size().X), float64(canvas.Size().Y)) * 0.35
+
+	n := len(c.Flow)
+	angleStep := 2 * math.Pi / float64(n)
+
+	outerLabelFont := plot.DefaultFont
+	outerLabelFont.Size = vg.Length(12)
+	outerLabelStyle := draw.TextStyle{
+		Color:   c.Theme.Text,
+		Font:    outerLabelFont,
+		Handler: plot.DefaultTextHandler,
+	}
+
+	baseLabelFont := plot.DefaultFont
+	baseLabelFont.Size = vg.Length(12)
+	baseLabelStyle := draw.TextStyle{
+		Color:   c.Theme.Text,
+		Font:    baseLabelFont,
+		Handler: plot.DefaultTextHandler,
+	}
+
+	for i := 0; i < n; i++ {
+		angle := float64(i) * angleStep
+		startAngle := angle - angleStep/3
+		endAngle := angle + angleStep/3
+
+		var path vg.Path
+		path.Move(pointOnCircle(origin, vg.Length(radius), startAngle))
+		path.Arc(origin, vg.Length(radius), startAngle, endAngle-startAngle)
+		canvas.SetLineWidth(vg.Points(2)) // Thicker arc lines
+		canvas.SetColor(c.Theme.Arc)
+		if c.Labels != nil {
+			annotate(canvas, c.nodeTooltip(i))
+		}
+		canvas.Stroke(path)
+
+		if c.Labels != nil {
+			baseAngle := angle
+			basePos := pointOnCircle(origin, vg.Length(radius*1.07), baseAngle)
+
+			baseRotation := baseAngle
+			if baseAngle > math.Pi/2 && baseAngle < 3*math.Pi/2 {
+				baseRotation += math.Pi
+			}
+			baseLabelStyle.Rotation = baseRotation
+			baseLabelStyle.XAlign = draw.XCenter
+			baseLabelStyle.YAlign = draw.YCenter
+
+			bgBaseStyle := baseLabelStyle
+			bgBaseStyle.Color = c.Theme.LabelBackground
+			canvas.FillText(bgBaseStyle, basePos, c.Labels[i])
+			canvas.FillText(baseLabelStyle, basePos, c.Labels[i])
+
+			labelAngle := angle
+			labelRotation := labelAngle + math.Pi/2
+			if labelAngle > math.Pi/2 && labelAngle < 3*math.Pi/2 {
+				labelRotation += math.Pi
+			}
+
+			totalBytes := float64(0)
+			for j := 0; j < n; j++ {
+				totalBytes += c.Flow[i][j]
+			}
+			statsLabel := fmt.Sprintf("%.1f MB", totalBytes/1024/1024) // Convert to MB
+
+			labelPos := pointOnCircle(origin, vg.Length(radius*1.15), angle)
+			outerLabelStyle.Rotation = labelRotation
+			outerLabelStyle.XAlign = draw.XCenter
+			outerLabelStyle.YAlign = draw.YCenter
+
+			bgStyle := outerLabelStyle
+			bgStyle.Color = c.Theme.LabelBackground
+			canvas.FillText(bgStyle, labelPos, statsLabel)
+			canvas.FillText(outerLabelStyle, labelPos, statsLabel)
+		}
+	}
+
+	maxFlow := 0.0
+	for i := range c.Flow {
+		for j := range c.Flow[i] {
+			if c.Flow[i][j] > maxFlow {
+				maxFlow = c.Flow[i][j]
+			}
+		}
+	}
+
+	for i := range c.Flow {
+		for j := range c.Flow[i] {
+			if c.Flow[i][j] > 0 {
+				weight := c.Flow[i][j] / maxFlow
+				var found anomaly
+				var anomalous bool
+				if c.Labels != nil {
+					found, anomalous = c.Anomalies[[2]string{c.Labels[i], c.Labels[j]}]
+					tip := chordTooltip{
+						title: fmt.Sprintf("%s → %s: %.1f MB", c.Labels[i], c.Labels[j], c.Flow[i][j]/1024/1024),
+						data:  []string{"source", c.Labels[i], "destination", c.Labels[j], "bytes", fmt.Sprintf("%.0f", c.Flow[i][j])},
+					}
+					if anomalous {
+						tip.title += fmt.Sprintf(" (%+.0f%% from baseline)", found.Percent)
+						tip.data = append(tip.data, "anomaly", fmt.Sprintf("%.1f", found.ZScore))
+					}
+					annotate(canvas, tip)
+				}
+				width := vg.Length(weight * 3)
+				var dashes []vg.Length
+				if c.Theme.Dashes != nil {
+					width = vg.Points(0.5 + weight*4.5)
+					dashes = c.Theme.Dashes[i%len(c.Theme.Dashes)]
+				}
+				clr := c.Color(i, j)
+				if anomalous {
+					// Solid, so the highlight survives grayscale printing.
+					clr, dashes = anomalyColor, nil
+				}
+				drawChord(canvas, origin, vg.Length(radius), i, j, n, width, dashes, clr)
+			}
+		}
+	}
+}
+
+func (c ChordDiagram) nodeTooltip(i int) chordTooltip {
+	var out, in float64
+	for j := range c.Flow {
+		out += c.Flow[i][j]
+		in += c.Flow[j][i]
+	}
+	tip := chordTooltip{
+		title: fmt.Sprintf("%s: %.1f MB sent, %.1f MB received", c.Labels[i], out/1024/1024, in/1024/1024),
+		data:  []string{"node", c.Labels[i], "bytes-out", fmt.Sprintf("%.0f", out), "bytes-in", fmt.Sprintf("%.0f", in)},
+	}
+	if resolver := c.ResolvedBy[c.Labels[i]]; resolver != "" {
+		tip.title += " (labelled by " + resolver + ")"
+		tip.data = append(tip.data, "resolver", resolver)
+	}
+	return tip
+}
+
+func pointOnCircle(origin vg.Point, radius vg.Length, angle float64) vg.Point {
+	return vg.Point{
+		X: origin.X + radius*vg.Length(math.Cos(angle)),
+		Y: origin.Y + radius*vg.Length(math.Sin(angle)),
+	}
+}
+
+func drawChord(canvas draw.Canvas, origin vg.Point, radius vg.Length, i, j, n int, width vg.Length, dashes []vg.Length, clr color.Color) {
+	angleStep := 2 * math.Pi / float64(n)
+	angle1 := float64(i) * angleStep
+	angle2 := float64(j) * angleStep
+
+	start := pointOnCircle(origin, radius, angle1)
+	end := pointOnCircle(origin, radius, angle2)
+
+	var path vg.Path
+	path.Move(start)
+
+	ctrl1 := vg.Point{
+		X: origin.X + radius*0.5*vg.Length(math.Cos(angle1)),
+		Y: origin.Y + radius*0.5*vg.Length(math.Sin(angle1)),
+	}
+	ctrl2 := vg.Point{
+		X: origin.X + radius*0.5*vg.Length(math.Cos(angle2)),
+		Y: origin.Y + radius*0.5*vg.Length(math.Sin(angle2)),
+	}
+
+	path.CubeTo(ctrl1, ctrl2, end)
+
+	canvas.SetLineWidth(width)
+	canvas.SetLineDash(dashes, 0)
+	rgba := color.RGBAModel.Convert(clr).(color.RGBA)
+	rgba.A = uint8(math.Min(255, float64(rgba.A)+100))
+	canvas.SetColor(rgba)
+	canvas.Stroke(path)
+	canvas.SetLineDash(nil, 0)
+}
+
+// chordFormats are the formats, by extension, the diagram can be written
+// in: vector PDF, EPS and SVG for reports and printing, or PNG.
+var chordFormats = map[string]bool{"png": true, "svg": true, "pdf": true, "eps": true}
+
+// plotSize is the size diagrams are drawn at and, for PNG, their
+// resolution. A zero dpi keeps gonum/plot's default of 96.
+type plotSize struct {
+	width, height vg.Length
+	dpi           int
+}
+
+func outputSize(out OutputConfig) plotSize {
+	return plotSize{vg.Length(out.Width) * vg.Inch, vg.Length(out.Height) * vg.Inch, out.DPI}
+}
+
+// diagramLayouts lay out a matrix as a diagram, by --layout.
+var diagramLayouts = map[string]func(matrix *FlowMatrix, title string, out OutputConfig, theme chordTheme) *plot.Plot{
+	"chord": func(matrix *FlowMatrix, title string, _ OutputConfig, theme chordTheme) *plot.Plot {
+		return chordPlot(matrix, title, theme)
+	},
+	"heatmap": func(matrix *FlowMatrix, title string, _ OutputConfig, theme chordTheme) *plot.Plot {
+		return heatmapPlot(matrix, title, theme)
+	},
+	"bundled": func(matrix *FlowMatrix, title string, _ OutputConfig, theme chordTheme) *plot.Plot {
+		return bundledPlot(matrix, title, theme)
+	},
+	"graph": func(matrix *FlowMatrix, title string, out OutputConfig, theme chordTheme) *plot.Plot {
+		return graphPlot(matrix, title, theme, out.ClusterNamespaces)
+	},
+}
+
+func diagramPlot(matrix *FlowMatrix, title string, out OutputConfig, theme chordTheme) (*plot.Plot, error) {
+	build, ok := diagramLayouts[out.Layout]
+	if !ok {
+		return nil, fmt.Errorf("unknown layout: %s", out.Layout)
+	}
+	return build(matrix, title, out, theme), nil
+}
+
+// renderDiagram writes the diagram in out's layout to path in format.
+func renderDiagram(matrix *FlowMatrix, title string, out OutputConfig, path, format string, size plotSize, theme chordTheme) error {
+	p, err := diagramPlot(matrix, title, out, theme)
+	if err != nil {
+		return err
+	}
+	return renderPlot(p, path, format, size)
+}
+
+// renderPlot writes p to path in format.
+func renderPlot(p *plot.Plot, path, format string, size plotSize) error {
+	var image bytes.Buffer
+	if err := writePlot(&image, p, format, size); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, image.Bytes())
+}
+
+// writeDiagram renders the diagram in out's layout and format (png, svg,
+// pdf or eps) to w.
+func writeDiagram(w io.Writer, matrix *FlowMatrix, title string, out OutputConfig, format string, size plotSize, theme chordTheme) error {
+	p, err := diagramPlot(matrix, title, out, theme)
+	if err != nil {
+		return err
+	}
+	return writePlot(w, p, format, size)
+}
+
+func writePlot(w io.Writer, p *plot.Plot, format string, size plotSize) error {
+	switch {
+	case format == "svg":
+		return writeChordSVG(w, p, size.width, size.height)
+	case format == "png" && size.dpi > 0:
+		canvas := vgimg.NewWith(vgimg.UseWH(size.width, size.height), vgimg.UseDPI(size.dpi))
+		p.Draw(draw.New(canvas))
+		_, err := vgimg.PngCanvas{Canvas: canvas}.WriteTo(w)
+		return err
+	}
+	wt, err := p.WriterTo(size.width, size.height, format)
+	if err != nil {
+		return err
+	}
+	_, err = wt.WriteTo(w)
+	return err
+}
+
+func chordPlot(matrix *FlowMatrix, title string, theme chordTheme) *plot.Plot {
+	return newChordPlot(matrix, title, theme, func(i, j int) color.Color {
+		if theme.Dashes != nil {
+			return color.Gray{Y: uint8(37 * j % 160)}
+		}
+		return color.RGBA{R: uint8(30 * i), G: uint8(30 * j), B: 255, A: 200} // Increased base opacity
+	})
+}
+
+// newChordPlot lays out matrix as a chord diagram with chords coloured by
+// chordColor.
+func newChordPlot(matrix *FlowMatrix, title string, theme chordTheme, chordColor func(i, j int) color.Color) *plot.Plot {
+	p := plot.New()
+	p.BackgroundColor = theme.Background
+
+	p.X.Min = -1
+	p.X.Max = 1
+	p.Y.Min = -1
+	p.Y.Max = 1
+
+	p.X.Label.Text = ""
+	p.Y.Label.Text = ""
+	p.X.Tick.Length = 0
+	p.Y.Tick.Length = 0
+	p.X.Tick.Label.Font.Size = 0
+	p.Y.Tick.Label.Font.Size = 0
+	p.X.LineStyle.Width = 0
+	p.Y.LineStyle.Width = 0
+
+	p.Title.Text = title
+	p.Title.TextStyle.Font.Size = vg.Points(16)
+	p.Title.TextStyle.Color = theme.Text
+	p.Add(ChordDiagram{
+		Theme:      theme,
+		Flow:       matrix.Flow,
+		Labels:     matrix.Names,
+		ResolvedBy: matrix.resolvedBy,
+		Anomalies:  matrix.anomalies,
+		Color:      chordColor,
+	})
+	return p
+}
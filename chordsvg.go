@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+	"gonum.org/v1/plot/vg/vgsvg"
+)
+
+// chordTooltip is shown on hover over an arc or chord of an SVG diagram.
+type chordTooltip struct {
+	title string
+	// data holds the element's data- attributes, name then value.
+	data []string
+}
+
+// tooltipCanvas counts the paths an SVG canvas writes so the ones drawn
+// after annotate can be given their tooltips once the document is done.
+type tooltipCanvas struct {
+	*vgsvg.Canvas
+	widths []vg.Length
+	paths  int
+	next   *chordTooltip
+	tips   map[int]chordTooltip
+}
+
+// annotate attaches tip to the next path drawn on canvas, if it is an SVG.
+func annotate(canvas draw.Canvas, tip chordTooltip) {
+	inner := canvas.Canvas
+	// Cropping nests draw.Canvases.
+	for {
+		cropped, ok := inner.(draw.Canvas)
+		if !ok {
+			break
+		}
+		inner = cropped.Canvas
+	}
+	if c, ok := inner.(*tooltipCanvas); ok {
+		c.next = &tip
+	}
+}
+
+func (c *tooltipCanvas) SetLineWidth(w vg.Length) {
+	c.widths[len(c.widths)-1] = w
+	c.Canvas.SetLineWidth(w)
+}
+
+func (c *tooltipCanvas) Push() {
+	c.widths = append(c.widths, c.widths[len(c.widths)-1])
+	c.Canvas.Push()
+}
+
+func (c *tooltipCanvas) Pop() {
+	c.widths = c.widths[:len(c.widths)-1]
+	c.Canvas.Pop()
+}
+
+// Stroke mirrors vgsvg, which writes nothing for zero-width lines.
+func (c *tooltipCanvas) Stroke(path vg.Path) {
+	if c.widths[len(c.widths)-1] > 0 {
+		c.record()
+	}
+	c.next = nil
+	c.Canvas.Stroke(path)
+}
+
+func (c *tooltipCanvas) Fill(path vg.Path) {
+	c.record()
+	c.next = nil
+	c.Canvas.Fill(path)
+}
+
+func (c *tooltipCanvas) record() {
+	if c.next != nil {
+		c.tips[c.paths] = *c.next
+	}
+	c.paths++
+}
+
+// writeChordSVG draws p as SVG with a <title> and data- attributes on each
+// arc and chord, so browsers show details on hover even in a static file.
+// The document itself is titled after the plot and described by its totals.
+func writeChordSVG(w io.Writer, p *plot.Plot, width, height vg.Length) error {
+	canvas := &tooltipCanvas{
+		Canvas: vgsvg.New(width, height),
+		widths: []vg.Length{vg.Points(1)}, // as set by vg.Initialize
+		tips:   make(map[int]chordTooltip),
+	}
+	p.Draw(draw.New(canvas))
+	var svg bytes.Buffer
+	if _, err := canvas.WriteTo(&svg); err != nil {
+		return err
+	}
+
+	doc := svg.String()
+	var out strings.Builder
+	if start := strings.Index(doc, "<svg "); start >= 0 {
+		end := start + strings.Index(doc[start:], ">") + 1
+		out.WriteString(doc[:end])
+		out.WriteString("\n<title>" + html.EscapeString(p.Title.Text) + "</title>")
+		out.WriteString("\n<desc>" + html.EscapeString(describeTips(canvas.tips)) + "</desc>")
+		doc = doc[end:]
+	}
+	for n := 0; ; n++ {
+		start := strings.Index(doc, "<path ")
+		if start < 0 {
+			break
+		}
+		end := start + strings.Index(doc[start:], "/>")
+		out.WriteString(doc[:end])
+		if tip, ok := canvas.tips[n]; ok {
+			for i := 0; i+1 < len(tip.data); i += 2 {
+				out.WriteString(`data-` + tip.data[i] + `="` + html.EscapeString(tip.data[i+1]) + `" `)
+			}
+			out.WriteString("><title>" + html.EscapeString(tip.title) + "</title></path>")
+		} else {
+			out.WriteString("/>")
+		}
+		doc = doc[end+len("/>"):]
+	}
+	out.WriteString(doc)
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// describeTips summarises a diagram from its tooltips.
+func describeTips(tips map[int]chordTooltip) string {
+	var nodes, chords int
+	var total float64
+	// Layouts without node tooltips count the nodes their flows name.
+	named := make(map[string]bool)
+	for _, tip := range tips {
+		if len(tip.data) < 2 {
+			continue
+		}
+		switch tip.data[0] {
+		case "node":
+			nodes++
+		case "source":
+			chords++
+			named[tip.data[1]] = true
+			if len(tip.data) >= 4 {
+				named[tip.data[3]] = true
+			}
+			// data is source, destination, bytes, ...
+			if len(tip.data) < 6 {
+				continue
+			}
+			if v, err := strconv.ParseFloat(tip.data[5], 64); err == nil {
+				total += v
+			}
+		}
+	}
+	if nodes == 0 {
+		nodes = len(named)
+	}
+	return fmt.Sprintf("%d nodes, %d flows, %.1f MB", nodes, chords, total/1024/1024)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ClickHouseConfig describes the flow table. Column settings are SQL
+// expressions, so schemas that store addresses as binary (e.g. goflow2's
+// FixedString(16)) can be converted with IPv6NumToString and friends.
+type ClickHouseConfig struct {
+	URL               string `yaml:"url" toml:"url"`
+	Username          string `yaml:"username" toml:"username"`
+	Password          string `yaml:"password" toml:"password"`
+	Table             string `yaml:"table" toml:"table"`
+	SourceColumn      string `yaml:"sourceColumn" toml:"sourceColumn"`
+	DestinationColumn string `yaml:"destinationColumn" toml:"destinationColumn"`
+	BytesColumn       string `yaml:"bytesColumn" toml:"bytesColumn"`
+	TimeColumn        string `yaml:"timeColumn" toml:"timeColumn"`
+	Limit             int    `yaml:"limit" toml:"limit"`
+}
+
+type clickHouseSource struct {
+	cfg        ClickHouseConfig
+	httpClient *http.Client
+}
+
+func newClickHouseSource(cfg ClickHouseConfig) (*clickHouseSource, error) {
+	if cfg.URL == "" || cfg.Table == "" {
+		return nil, fmt.Errorf("clickhouse source needs url and table")
+	}
+	return &clickHouseSource{cfg: cfg, httpClient: &http.Client{Timeout: 5 * time.Minute}}, nil
+}
+
+func (s *clickHouseSource) Name() string {
+	return "clickhouse"
+}
+
+// query runs sql over the HTTP interface. Values are passed as server-side
+// query parameters ({name:Type} placeholders) rather than interpolated.
+func (s *clickHouseSource) query(ctx context.Context, sql string, params url.Values) (io.ReadCloser, error) {
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("output_format_json_quote_64bit_integers", "0")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.URL+"/?"+params.Encode(), strings.NewReader(sql))
+	if err != nil {
+		return nil, err
+	}
+	if s.cfg.Username != "" {
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return nil, fmt.Errorf("clickhouse: %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return res.Body, nil
+}
+
+func (s *clickHouseSource) Version(ctx context.Context) (string, error) {
+	body, err := s.query(ctx, "SELECT version()", nil)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	version, err := io.ReadAll(body)
+	return strings.TrimSpace(string(version)), err
+}
+
+func (s *clickHouseSource) Fetch(ctx context.Context, from, to time.Time, networkFilters []string) (*FlowMatrix, error) {
+	params := url.Values{}
+	params.Set("param_from", fmt.Sprint(from.Unix()))
+	params.Set("param_to", fmt.Sprint(to.Unix()))
+
+	where := []string{
+		fmt.Sprintf("%s >= toDateTime({from:UInt32})", s.cfg.TimeColumn),
+		fmt.Sprintf("%s < toDateTime({to:UInt32})", s.cfg.TimeColumn),
+	}
+	var networks []string
+	for i, cidr := range networkFilters {
+		name := fmt.Sprintf("cidr%d", i)
+		params.Set("param_"+name, strings.TrimSpace(cidr))
+		networks = append(networks, fmt.Sprintf("(isIPAddressInRange(flow_source, {%[1]s:String}) AND isIPAddressInRange(flow_destination, {%[1]s:String}))", name))
+	}
+	if len(networks) > 0 {
+		where = append(where, "("+strings.Join(networks, " OR ")+")")
+	}
+
+	// Aliases are prefixed so they cannot shadow the table's own columns.
+	sql := fmt.Sprintf(`SELECT toString(%s) AS flow_source, toString(%s) AS flow_destination, sum(%s) AS flow_bytes
+FROM %s
+WHERE %s
+GROUP BY flow_source, flow_destination
+ORDER BY flow_bytes DESC
+LIMIT %d
+FORMAT JSONEachRow`,
+		s.cfg.SourceColumn, s.cfg.DestinationColumn, s.cfg.BytesColumn,
+		s.cfg.Table, strings.Join(where, " AND "), s.cfg.Limit)
+
+	body, err := s.query(ctx, sql, params)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	matrix := NewFlowMatrix()
+	dec := json.NewDecoder(body)
+	for {
+		var row struct {
+			Source      string  `json:"flow_source"`
+			Destination string  `json:"flow_destination"`
+			Bytes       float64 `json:"flow_bytes"`
+		}
+		if err := dec.Decode(&row); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("clickhouse: decoding row: %w", err)
+		}
+		matrix.Add(row.Source, row.Destination, row.Bytes)
+	}
+	return matrix, nil
+}
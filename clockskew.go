@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+const (
+	// exporterField names the device that exported a flow in filebeat's
+	// netflow documents.
+	exporterField = "observer.ip"
+	// skewHorizon is how far back, by ingest time, exporters' clocks are
+	// compared with Elasticsearch's.
+	skewHorizon = 15 * time.Minute
+	// skewRefresh is how long detected skews are reused.
+	skewRefresh = time.Minute
+)
+
+// skewedSource is implemented by sources that can tell which exporters'
+// clocks stray from the source's own, by how much. Positive skews are
+// clocks running ahead.
+type skewedSource interface {
+	ClockSkews(ctx context.Context, now time.Time) (map[string]time.Duration, error)
+}
+
+// skewCache holds the last detected skews.
+type skewCache struct {
+	mu      sync.Mutex
+	at      time.Time
+	skews   map[string]time.Duration
+	flagged map[string]bool
+}
+
+// ClockSkews returns the exporters whose median flow timestamp strays from
+// event.ingested by more than MaxClockSkew. Normal ingest delay counts as
+// skew too, so the limit should exceed it.
+func (s *elasticSource) ClockSkews(ctx context.Context, now time.Time) (map[string]time.Duration, error) {
+	if s.maxSkew <= 0 {
+		return nil, nil
+	}
+	s.skew.mu.Lock()
+	defer s.skew.mu.Unlock()
+	if s.skew.skews != nil && now.Sub(s.skew.at) < skewRefresh {
+		return s.skew.skews, nil
+	}
+
+	query := map[string]interface{}{
+		"size": 0,
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": []map[string]interface{}{
+					{"range": map[string]interface{}{"event.ingested": map[string]interface{}{
+						"gte": now.Add(-skewHorizon).Format(time.RFC3339),
+					}}},
+					{"exists": map[string]interface{}{"field": "@timestamp"}},
+				},
+			},
+		},
+		"aggs": map[string]interface{}{
+			"exporters": map[string]interface{}{
+				"terms": map[string]interface{}{"field": exporterField, "size": termsSize},
+				"aggs": map[string]interface{}{
+					"offset": map[string]interface{}{
+						"percentiles": map[string]interface{}{
+							"percents": []float64{50},
+							"script": map[string]interface{}{
+								"source": "doc['@timestamp'].value.toInstant().toEpochMilli() - doc['event.ingested'].value.toInstant().toEpochMilli()",
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	result, err := search(ctx, s.es, s.index, query)
+	if err != nil {
+		return nil, fmt.Errorf("measuring exporter clock skew: %w", err)
+	}
+
+	skews := make(map[string]time.Duration)
+	aggs, _ := result["aggregations"].(map[string]interface{})
+	exporters, _ := aggs["exporters"].(map[string]interface{})
+	buckets, _ := exporters["buckets"].([]interface{})
+	for _, bucket := range buckets {
+		b, _ := bucket.(map[string]interface{})
+		exporter, _ := b["key"].(string)
+		offset, _ := b["offset"].(map[string]interface{})
+		values, _ := offset["values"].(map[string]interface{})
+		median, ok := values["50.0"].(float64)
+		if exporter == "" || !ok {
+			continue
+		}
+		skew := time.Duration(median) * time.Millisecond
+		if skew > s.maxSkew || skew < -s.maxSkew {
+			skews[exporter] = skew.Round(time.Second)
+		}
+	}
+
+	// Log each exporter as it starts and stops being skewed.
+	flagged := make(map[string]bool, len(skews))
+	for exporter, skew := range skews {
+		flagged[exporter] = true
+		if !s.skew.flagged[exporter] {
+			log.Printf("Exporter %s timestamps are %s from ingest time", exporter, describeSkew(skew))
+		}
+	}
+	for exporter := range s.skew.flagged {
+		if !flagged[exporter] {
+			log.Printf("Exporter %s timestamps are back within %s of ingest time", exporter, s.maxSkew)
+		}
+	}
+	s.skew.at, s.skew.skews, s.skew.flagged = now, skews, flagged
+	return skews, nil
+}
+
+func describeSkew(skew time.Duration) string {
+	if skew < 0 {
+		return (-skew).String() + " behind"
+	}
+	return skew.String() + " ahead"
+}
+
+// describeSkews lists skews by exporter for manifests.
+func describeSkews(skews map[string]time.Duration) map[string]string {
+	if len(skews) == 0 {
+		return nil
+	}
+	described := make(map[string]string, len(skews))
+	for exporter, skew := range skews {
+		described[exporter] = describeSkew(skew)
+	}
+	return described
+}
+
+// fetchCorrected reads [from, to) from raw flows, reading each skewed
+// exporter's flows over the range its clock put them in instead. Rollups
+// are skipped because they do not keep the exporter.
+func fetchCorrected(ctx context.Context, es *elasticsearch.Client, index string, conditions []map[string]interface{}, from, to time.Time, skews map[string]time.Duration) (*FlowMatrix, error) {
+	exporters := make([]string, 0, len(skews))
+	for exporter := range skews {
+		exporters = append(exporters, exporter)
+	}
+	sort.Strings(exporters)
+
+	rangeFor := func(skew time.Duration) map[string]interface{} {
+		return timeRangeCondition(map[string]interface{}{
+			"gte": from.Add(skew).Format(time.RFC3339Nano),
+			"lt":  to.Add(skew).Format(time.RFC3339Nano),
+		})
+	}
+	others := append(append([]map[string]interface{}{}, conditions...), rangeFor(0), map[string]interface{}{
+		"bool": map[string]interface{}{
+			"must_not": map[string]interface{}{"terms": map[string]interface{}{exporterField: exporters}},
+		},
+	})
+	matrix, err := fetchFlowMatrix(ctx, es, index, others, from, to)
+	if err != nil {
+		return nil, err
+	}
+	for _, exporter := range exporters {
+		shifted := append(append([]map[string]interface{}{}, conditions...), rangeFor(skews[exporter]), map[string]interface{}{
+			"term": map[string]interface{}{exporterField: exporter},
+		})
+		part, err := fetchFlowMatrix(ctx, es, index, shifted, from.Add(skews[exporter]), to.Add(skews[exporter]))
+		if err != nil {
+			return nil, fmt.Errorf("exporter %s: %w", exporter, err)
+		}
+		matrix.Merge(part)
+	}
+	return matrix, nil
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"hash/maphash"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/cpu"
+)
+
+// flowPair keys the per-minute totals by address, so adding a record to an
+// existing pair does not allocate.
+type flowPair struct {
+	source, destination netip.Addr
+}
+
+// shardSeed keys the shard hash, so crafted addresses cannot pile onto one
+// shard.
+var shardSeed = maphash.MakeSeed()
+
+// shard spreads pairs over n shards, n being a power of two, hashing every
+// byte of both addresses.
+func (p flowPair) shard(n int) int {
+	var key [32]byte
+	source, destination := p.source.As16(), p.destination.As16()
+	copy(key[:16], source[:])
+	copy(key[16:], destination[:])
+	return int(maphash.Bytes(shardSeed, key[:]) & uint64(n-1))
+}
+
+// flowWindow keeps per-minute totals of received flows so the collector
+// can render any trailing window without storing individual records. Pairs
+// are spread over many more shards than there are readers, each with its
+// own lock, so readers on different cores rarely wait for one another;
+// snapshots merge the shards.
+type flowWindow struct {
+	shards []flowShard
+}
+
+type flowShard struct {
+	// Keep the locks and maps of neighbouring shards on separate cache
+	// lines.
+	_       cpu.CacheLinePad
+	mu      sync.Mutex
+	minutes map[int64]map[flowPair]float64
+}
+
+func newFlowWindow() *flowWindow {
+	n := 1
+	for n < runtime.GOMAXPROCS(0)*4 {
+		n *= 2
+	}
+	w := &flowWindow{shards: make([]flowShard, n)}
+	for i := range w.shards {
+		w.shards[i].minutes = make(map[int64]map[flowPair]float64)
+	}
+	return w
+}
+
+func (w *flowWindow) add(t time.Time, source, destination netip.Addr, bytes float64) {
+	minute := t.Unix() / 60
+	pair := flowPair{source, destination}
+	shard := &w.shards[pair.shard(len(w.shards))]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	pairs, ok := shard.minutes[minute]
+	if !ok {
+		pairs = make(map[flowPair]float64)
+		shard.minutes[minute] = pairs
+	}
+	pairs[pair] += bytes
+}
+
+// snapshot merges the minutes in [from, to) and forgets those before from.
+func (w *flowWindow) snapshot(from, to time.Time) *FlowMatrix {
+	matrix := NewFlowMatrix()
+	for i := range w.shards {
+		shard := &w.shards[i]
+		shard.mu.Lock()
+		for minute, pairs := range shard.minutes {
+			switch {
+			case minute < from.Unix()/60:
+				delete(shard.minutes, minute)
+			case minute < to.Unix()/60+1:
+				for pair, bytes := range pairs {
+					matrix.Add(pair.source.String(), pair.destination.String(), bytes)
+				}
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return matrix
+}
+
+// prefixFilter is cidrFilter for netip addresses, which the collector
+// matches without allocating.
+type prefixFilter []netip.Prefix
+
+func (f cidrFilter) prefixes() prefixFilter {
+	var prefixes prefixFilter
+	for _, ipNet := range f {
+		addr, _ := netip.AddrFromSlice(ipNet.IP)
+		ones, _ := ipNet.Mask.Size()
+		if addr.Is4In6() {
+			addr = addr.Unmap()
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, ones))
+	}
+	return prefixes
+}
+
+func (f prefixFilter) match(source, destination netip.Addr) bool {
+	if len(f) == 0 {
+		return true
+	}
+	for _, prefix := range f {
+		if prefix.Contains(source) && prefix.Contains(destination) {
+			return true
+		}
+	}
+	return false
+}
+
+// collectorStats counts what the listeners received, for sizing the
+// collector under load.
+type collectorStats struct {
+	datagrams, records, errors atomic.Uint64
+}
+
+// sflowInterfaces keeps the latest counters of every interface sFlow agents
+// report in counter samples, for the collector's stats.
+type sflowInterfaces struct {
+	mu     sync.Mutex
+	latest map[sflowInterfaceKey]sflowInterfaceCounters
+}
+
+type sflowInterfaceKey struct {
+	agent netip.Addr
+	index uint32
+}
+
+// sflowTotals sums the latest counters over the interfaces.
+type sflowTotals struct {
+	interfaces                            int
+	inOctets, outOctets, errors, discards uint64
+}
+
+func newSFlowInterfaces() *sflowInterfaces {
+	return &sflowInterfaces{latest: make(map[sflowInterfaceKey]sflowInterfaceCounters)}
+}
+
+func (s *sflowInterfaces) update(c sflowInterfaceCounters) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latest[sflowInterfaceKey{c.Agent, c.Index}] = c
+}
+
+func (s *sflowInterfaces) totals() sflowTotals {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	totals := sflowTotals{interfaces: len(s.latest)}
+	for _, c := range s.latest {
+		totals.inOctets += c.InOctets
+		totals.outOctets += c.OutOctets
+		totals.errors += uint64(c.InErrors) + uint64(c.OutErrors)
+		totals.discards += uint64(c.InDiscards) + uint64(c.OutDiscards)
+	}
+	return totals
+}
+
+type flowDecoder func(packet []byte, exporter netip.Addr, fn func(source, destination netip.Addr, bytes float64)) error
+
+// listenFlows receives datagrams on conn until it is closed, adding every
+// record that passes filter to window at its arrival time. The read buffer
+// and the record callback are reused across datagrams. Each reader socket
+// runs its own listenFlows, with decoder state of its own.
+func listenFlows(conn *net.UDPConn, decode flowDecoder, window *flowWindow, filter prefixFilter, stats *collectorStats) {
+	buf := make([]byte, 65535)
+	var now time.Time
+	add := func(source, destination netip.Addr, bytes float64) {
+		stats.records.Add(1)
+		if filter.match(source, destination) {
+			window.add(now, source, destination, bytes)
+		}
+	}
+	for {
+		n, addr, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			log.Printf("Error receiving flows: %s", err)
+			return
+		}
+		stats.datagrams.Add(1)
+		exporter := addr.Addr().Unmap()
+		now = time.Now()
+		if err := decode(buf[:n], exporter, add); err != nil {
+			stats.errors.Add(1)
+			log.Printf("Dropping datagram from %s: %s", exporter, err)
+		}
+	}
+}
+
+func runCollect(args []string) {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		log.Fatalf("Error loading config: %s", err)
+	}
+
+	fs := flag.NewFlagSet("collect", flag.ExitOnError)
+	fs.String("config", "", "YAML or TOML configuration file; flags override its values")
+	listenPtr := fs.String("listen", ":2055", "UDP address to receive NetFlow v5/v9 and IPFIX datagrams on")
+	agentListenPtr := fs.String("agent-listen", "", "TCP address to receive flows shipped by kube-netflow agent --ship-to on (e.g. :7070)")
+	policyPtr := fs.String("agent-policy", "", "YAML or TOML file of the sampling rate, ports and namespaces --agent-listen agents ship, pushed to them with each heartbeat and reread every minute")
+	statusListenPtr := fs.String("status-listen", "", "HTTP address to serve the status of the --agent-listen agents on, at /agents and /api/v1/agents")
+	sflowListenPtr := fs.String("sflow-listen", "", "UDP address to receive sFlow v5 datagrams on (e.g. :6343)")
+	readersPtr := fs.Int("readers", runtime.GOMAXPROCS(0), "Sockets receiving each of --listen and --sflow-listen in parallel, one decoding goroutine each; the kernel keeps every exporter on one socket (Linux; elsewhere one socket)")
+	intervalPtr := fs.Duration("interval", time.Minute, "How often to render the diagram")
+	statsPtr := fs.Duration("stats-interval", 0, "How often to log throughput, losses, socket backlog and GC activity (0 disables)")
+	fs.StringVar(&cfg.Window, "window", cfg.Window, "Trailing window kept in memory and rendered")
+	fs.Var((*stringList)(&cfg.Network), "network", "Network CIDR filter")
+	fs.BoolVar(&cfg.Kubernetes.Labels, "kube-labels", cfg.Kubernetes.Labels, "Label IPs with Kubernetes pod, service, or node names")
+	fs.BoolVar(&cfg.Enrichment.ReverseDNS, "reverse-dns", cfg.Enrichment.ReverseDNS, "Label addresses Kubernetes does not know with their reverse DNS name")
+	fs.StringVar(&cfg.Enrichment.StaticLabelsFile, "labels-file", cfg.Enrichment.StaticLabelsFile, "Hosts-style file naming addresses and CIDR ranges outside Kubernetes, e.g. '192.168.1.10 nas'")
+	fs.IntVar(&cfg.Enrichment.Workers, "enrichment-workers", cfg.Enrichment.Workers, "Concurrent reverse DNS lookups")
+	fs.StringVar(&cfg.Limits.MemoryBudget, "memory-budget", cfg.Limits.MemoryBudget, "Soft memory limit for the in-memory window, e.g. 1GiB")
+	fs.StringVar(&cfg.Kubernetes.GroupBy, "group-by", cfg.Kubernetes.GroupBy, "Aggregate nodes by ip or namespace")
+	fs.Parse(args)
+
+	window, err := parseWindow(cfg.Window)
+	if err != nil {
+		log.Fatalf("Invalid window: %s", err)
+	}
+	if _, err := cfg.Limits.apply(); err != nil {
+		log.Fatalf("Invalid limits: %s", err)
+	}
+	if *readersPtr < 1 {
+		log.Fatalf("--readers must be at least 1")
+	}
+	filter, err := parseCIDRFilter(cfg.Network)
+	if err != nil {
+		log.Fatalf("Invalid network filter: %s", err)
+	}
+	prefixes := filter.prefixes()
+	cfg.Source = "netflow"
+
+	flows := newFlowWindow()
+	stats := &collectorStats{}
+	interfaces := newSFlowInterfaces()
+	conns, err := listenUDPs(*listenPtr, *readersPtr)
+	if err != nil {
+		log.Fatalf("Error listening on %s: %s", *listenPtr, err)
+	}
+	// Templates and sequence numbers are per exporter, and an exporter's
+	// datagrams all reach one socket, so each reader keeps its own.
+	var templates []*netflowTemplates
+	for _, conn := range conns {
+		t := newNetflowTemplates()
+		templates = append(templates, t)
+		go listenFlows(conn, func(packet []byte, exporter netip.Addr, fn func(source, destination netip.Addr, bytes float64)) error {
+			return decodeNetFlow(packet, exporter, t, fn)
+		}, flows, prefixes, stats)
+	}
+	log.Printf("Receiving NetFlow on %s with %d readers, rendering %s every %s", conns[0].LocalAddr(), len(conns), cfg.Output.Path, *intervalPtr)
+
+	if *sflowListenPtr != "" {
+		sflowConns, err := listenUDPs(*sflowListenPtr, *readersPtr)
+		if err != nil {
+			log.Fatalf("Error listening on %s: %s", *sflowListenPtr, err)
+		}
+		for _, conn := range sflowConns {
+			go listenFlows(conn, func(packet []byte, exporter netip.Addr, fn func(source, destination netip.Addr, bytes float64)) error {
+				return decodeSFlow(packet, fn, interfaces.update)
+			}, flows, prefixes, stats)
+		}
+		log.Printf("Receiving sFlow on %s with %d readers", sflowConns[0].LocalAddr(), len(sflowConns))
+	}
+
+	var delivered *deliveries
+	if *agentListenPtr != "" {
+		agents := newFleet()
+		delivered = newDeliveries(window)
+		var policies *policyStore
+		if *policyPtr != "" {
+			if policies, err = newPolicyStore(*policyPtr, cfg.Kubernetes.Kubeconfig); err != nil {
+				log.Fatalf("Error loading agent policies: %s", err)
+			}
+			go policies.watch(context.Background())
+		}
+		ingest := &flowIngest{window: flows, filter: prefixes, stats: stats, fleet: agents, policies: policies, deliveries: delivered}
+		go func() {
+			if err := serveIngest(*agentListenPtr, ingest); err != nil {
+				log.Fatalf("Error receiving agent flows: %s", err)
+			}
+		}()
+		if *statusListenPtr != "" {
+			go func() {
+				log.Fatal(serveFleet(*statusListenPtr, agents))
+			}()
+		}
+	}
+
+	if *statsPtr > 0 {
+		go reportStats(*statsPtr, stats, templates, interfaces, conns[0].LocalAddr())
+	}
+
+	enrich := newEnricher(cfg)
+	ticker := time.NewTicker(*intervalPtr)
+	defer ticker.Stop()
+	for range ticker.C {
+		to := time.Now()
+		from := to.Add(-window)
+		manifest := Manifest{
+			GeneratedAt:    to.UTC(),
+			From:           from.UTC(),
+			To:             to.UTC(),
+			CodeVersion:    codeVersion(),
+			SourceVersions: dependencyVersions(),
+			Settings:       flagSettings(fs),
+		}
+		manifest.SourceVersions["netflow"] = "v5,v9,ipfix,sflow5"
+
+		// Missing agent snapshots lower the completeness score in the
+		// title, so a dip is not mistaken for less traffic.
+		run := cfg
+		manifest.Completeness = newCompleteness()
+		if agents, overall, ok := delivered.completeness(from, to); ok {
+			manifest.AgentCompleteness = agents
+			manifest.Completeness.limit("agents", overall)
+			if missing := incomplete(agents); len(missing) > 0 {
+				log.Printf("Agent data %.0f%% complete; missing snapshots from %s", overall, strings.Join(missing, ", "))
+			}
+		}
+		run.Output.Title = fmt.Sprintf("%s (%s)", cfg.Output.Title, manifest.Completeness.describe())
+
+		matrix, err := prepareMatrix(context.Background(), run, enrich, flows.snapshot(from, to), from, to)
+		if err != nil {
+			log.Printf("Error %s", err)
+			continue
+		}
+		if err := publish(context.Background(), run, enrich, matrix, manifest); err != nil {
+			log.Printf("Error %s", err)
+		}
+	}
+}
+
+// reportStats logs collector throughput and backpressure every interval.
+// Lost records come from NetFlow v5 sequence numbers; the socket backlog and
+// kernel drops, summed over the reader sockets, are read from /proc and only
+// reported on Linux. Interface traffic, errors and discards come from sFlow
+// counter samples.
+func reportStats(interval time.Duration, stats *collectorStats, templates []*netflowTemplates, interfaces *sflowInterfaces, addr net.Addr) {
+	port := 0
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		port = udp.Port
+	}
+	var previous runtime.MemStats
+	runtime.ReadMemStats(&previous)
+	var datagrams, records uint64
+	var counters sflowTotals
+	for range time.Tick(interval) {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		d, r := stats.datagrams.Load(), stats.records.Load()
+		seconds := interval.Seconds()
+
+		var lost uint64
+		for _, t := range templates {
+			lost += t.lost.Load()
+		}
+		line := fmt.Sprintf("%.0f datagrams/s, %.0f records/s, %d decode errors, %d lost records",
+			float64(d-datagrams)/seconds, float64(r-records)/seconds, stats.errors.Load(), lost)
+		if queue, drops, ok := udpSocketStats(port); ok {
+			line += fmt.Sprintf(", socket queue %d bytes, %d socket drops", queue, drops)
+		}
+		current := interfaces.totals()
+		if current.interfaces > 0 {
+			// The sums jump as interfaces appear and when agents restart
+			// their counters; there is no rate for those intervals.
+			var in, out float64
+			if current.interfaces == counters.interfaces && current.inOctets >= counters.inOctets && current.outOctets >= counters.outOctets {
+				in = float64(current.inOctets-counters.inOctets) * 8 / seconds
+				out = float64(current.outOctets-counters.outOctets) * 8 / seconds
+			}
+			line += fmt.Sprintf(", %d sFlow interfaces at %.0f bit/s in and %.0f bit/s out with %d errors and %d discards",
+				current.interfaces, in, out, current.errors, current.discards)
+		}
+		line += fmt.Sprintf(", heap %d MiB, %d GCs, %s GC pause",
+			mem.HeapAlloc>>20, mem.NumGC-previous.NumGC, time.Duration(mem.PauseTotalNs-previous.PauseTotalNs))
+		log.Printf("Collector: %s", line)
+
+		datagrams, records, previous, counters = d, r, mem, current
+	}
+}
+
+// udpSocketStats finds the UDP sockets bound to port in /proc/net/udp{,6} and
+// returns their receive queue length and the datagrams the kernel dropped
+// because a queue was full.
+func udpSocketStats(port int) (queue, drops uint64, ok bool) {
+	for _, path := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) < 13 {
+				continue
+			}
+			_, localPort, _ := strings.Cut(fields[1], ":")
+			if p, err := strconv.ParseUint(localPort, 16, 16); err != nil || int(p) != port {
+				continue
+			}
+			_, rxQueue, _ := strings.Cut(fields[4], ":")
+			n, _ := strconv.ParseUint(rxQueue, 16, 64)
+			dropped, _ := strconv.ParseUint(fields[12], 10, 64)
+			queue, drops, ok = queue+n, drops+dropped, true
+		}
+	}
+	return queue, drops, ok
+}
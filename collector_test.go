@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestFlowPairShardSpreadsSources(t *testing.T) {
+	const shards = 16
+	destination := netip.MustParseAddr("10.96.0.10")
+	used := make(map[int]int)
+	for i := 0; i < 1024; i++ {
+		source := netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)})
+		shard := flowPair{source, destination}.shard(shards)
+		if shard < 0 || shard >= shards {
+			t.Fatalf("shard %d out of range", shard)
+		}
+		used[shard]++
+	}
+	// 1024 sources of one subnet talking to one service should load every
+	// shard, none with more than twice its share.
+	if len(used) != shards {
+		t.Errorf("sources landed on %d of %d shards", len(used), shards)
+	}
+	for shard, n := range used {
+		if n > 2*1024/shards {
+			t.Errorf("shard %d holds %d of 1024 pairs", shard, n)
+		}
+	}
+}
+
+func TestSFlowInterfacesKeepLatest(t *testing.T) {
+	agent := netip.MustParseAddr("192.0.2.10")
+	interfaces := newSFlowInterfaces()
+	interfaces.update(sflowInterfaceCounters{Agent: agent, Index: 3, InOctets: 100, OutOctets: 10, InErrors: 1})
+	interfaces.update(sflowInterfaceCounters{Agent: agent, Index: 3, InOctets: 300, OutOctets: 30, InErrors: 2, OutDiscards: 1})
+	interfaces.update(sflowInterfaceCounters{Agent: agent, Index: 7, InOctets: 50, OutOctets: 5})
+	want := sflowTotals{interfaces: 2, inOctets: 350, outOctets: 35, errors: 2, discards: 1}
+	if got := interfaces.totals(); got != want {
+		t.Errorf("totals %+v, want %+v", got, want)
+	}
+}
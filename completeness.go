@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// exporterBuckets is how many slices of the window exporters are checked
+// for flows in, each at least a minute long and, per exporter, at least its
+// export interval.
+const exporterBuckets = 60
+
+// queryCoverage is how much of the matching data the answers to a set of
+// queries hold: shards that failed to answer and the documents of buckets
+// truncated terms aggregations left out are missing from them.
+type queryCoverage struct {
+	Shards, FailedShards int
+	Docs, OmittedDocs    float64
+}
+
+func (c *queryCoverage) add(other queryCoverage) {
+	c.Shards += other.Shards
+	c.FailedShards += other.FailedShards
+	c.Docs += other.Docs
+	c.OmittedDocs += other.OmittedDocs
+}
+
+// gappedSource is implemented by sources that can tell, per exporter, the
+// percentage of a range it sent flows in.
+type gappedSource interface {
+	ExporterCoverage(ctx context.Context, from, to time.Time) (map[string]float64, error)
+}
+
+// Completeness scores how much of the data an artifact shows, as a
+// percentage. Each factor is the percentage left after one way data goes
+// missing, and the score is their product.
+type Completeness struct {
+	Score   float64            `json:"score"`
+	Factors map[string]float64 `json:"factors,omitempty"`
+}
+
+func newCompleteness() *Completeness {
+	return &Completeness{Score: 100, Factors: make(map[string]float64)}
+}
+
+// limit records that only percent of the data survived factor.
+func (c *Completeness) limit(factor string, percent float64) {
+	percent = math.Max(0, math.Min(100, percent))
+	c.Factors[factor] = percent
+	c.Score *= percent / 100
+}
+
+// queryCompleteness scores a query of window from failed shards, truncated
+// buckets, exporters' gaps and, when the window was not shifted back by it,
+// ingest lag.
+func queryCompleteness(coverage queryCoverage, exporters map[string]float64, lag, window time.Duration, shifted bool) *Completeness {
+	c := newCompleteness()
+	if coverage.Shards > 0 {
+		c.limit("shards", 100*float64(coverage.Shards-coverage.FailedShards)/float64(coverage.Shards))
+	}
+	if coverage.Docs > 0 {
+		c.limit("buckets", 100*(1-coverage.OmittedDocs/coverage.Docs))
+	}
+	if len(exporters) > 0 {
+		var total float64
+		for _, percent := range exporters {
+			total += percent
+		}
+		c.limit("exporters", total/float64(len(exporters)))
+	}
+	if lag > 0 && !shifted && window > 0 {
+		c.limit("ingest lag", 100*(1-float64(lag)/float64(window)))
+	}
+	return c
+}
+
+// describe is the score as printed on artifacts. It is rounded down so
+// incomplete data never shows as 100%.
+func (c *Completeness) describe() string {
+	return fmt.Sprintf("data %.0f%% complete", math.Floor(c.Score))
+}
+
+// describeFactors lists the factors below 100%, lowest first.
+func (c *Completeness) describeFactors() string {
+	var factors []string
+	for factor, percent := range c.Factors {
+		if percent < 100 {
+			factors = append(factors, factor)
+		}
+	}
+	sort.Slice(factors, func(i, j int) bool { return c.Factors[factors[i]] < c.Factors[factors[j]] })
+	for i, factor := range factors {
+		factors[i] = fmt.Sprintf("%s %.1f%%", factor, c.Factors[factor])
+	}
+	return strings.Join(factors, ", ")
+}
+
+// ExporterCoverage returns, for each exporter that sent flows in [from, to)
+// or the window before it, the percentage of the window's slices it sent
+// flows in. An exporter that fell silent scores 0. An exporter's slices are
+// widened to its export interval, taken from the distinct timestamps it sent
+// flows at in the window before, or in the window when it is new, so one
+// exporting every 5 minutes is not missing from four slices in five.
+func (s *elasticSource) ExporterCoverage(ctx context.Context, from, to time.Time) (map[string]float64, error) {
+	length := to.Sub(from)
+	step := length / exporterBuckets
+	if step < time.Minute {
+		step = time.Minute
+	}
+	exports := map[string]interface{}{
+		"exports": map[string]interface{}{
+			"cardinality": map[string]interface{}{"field": "@timestamp"},
+		},
+	}
+	query := map[string]interface{}{
+		"size": 0,
+		"query": timeRangeCondition(map[string]interface{}{
+			"gte": from.Add(-length).Format(time.RFC3339),
+			"lt":  to.Format(time.RFC3339),
+		}),
+		"aggs": map[string]interface{}{
+			"exporters": map[string]interface{}{
+				"terms": map[string]interface{}{"field": exporterField, "size": termsSize},
+				"aggs": map[string]interface{}{
+					"before": map[string]interface{}{
+						"filter": timeRangeCondition(map[string]interface{}{
+							"gte": from.Add(-length).Format(time.RFC3339),
+							"lt":  from.Format(time.RFC3339),
+						}),
+						"aggs": exports,
+					},
+					"window": map[string]interface{}{
+						"filter": timeRangeCondition(map[string]interface{}{
+							"gte": from.Format(time.RFC3339),
+							"lt":  to.Format(time.RFC3339),
+						}),
+						"aggs": map[string]interface{}{
+							"exports": exports["exports"],
+							"slices": map[string]interface{}{
+								"date_histogram": map[string]interface{}{
+									"field":          "@timestamp",
+									"fixed_interval": fmt.Sprintf("%ds", int(step.Seconds())),
+									"min_doc_count":  0,
+									"extended_bounds": map[string]interface{}{
+										"min": from.UnixMilli(),
+										"max": to.Add(-time.Millisecond).UnixMilli(),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	result, err := search(ctx, s.es, s.index, query)
+	if err != nil {
+		return nil, fmt.Errorf("checking exporters for gaps: %w", err)
+	}
+
+	coverage := make(map[string]float64)
+	aggs, _ := result["aggregations"].(map[string]interface{})
+	exporters, _ := aggs["exporters"].(map[string]interface{})
+	buckets, _ := exporters["buckets"].([]interface{})
+	for _, bucket := range buckets {
+		b, _ := bucket.(map[string]interface{})
+		exporter, _ := b["key"].(string)
+		window, _ := b["window"].(map[string]interface{})
+		slices, _ := window["slices"].(map[string]interface{})
+		sliceBuckets, _ := slices["buckets"].([]interface{})
+		if exporter == "" {
+			continue
+		}
+		if len(sliceBuckets) == 0 {
+			coverage[exporter] = 0
+			continue
+		}
+
+		before, _ := b["before"].(map[string]interface{})
+		n, _ := before["exports"].(map[string]interface{})["value"].(float64)
+		if n == 0 {
+			n, _ = window["exports"].(map[string]interface{})["value"].(float64)
+		}
+		// Group the histogram's slices into ones at least an export
+		// interval long.
+		group := 1
+		if n > 0 {
+			group = int(math.Ceil(float64(length) / n / float64(step)))
+		}
+		if group < 1 {
+			group = 1
+		}
+		var sent, total int
+		for start := 0; start < len(sliceBuckets); start += group {
+			total++
+			for _, slice := range sliceBuckets[start:min(start+group, len(sliceBuckets))] {
+				if count, _ := slice.(map[string]interface{})["doc_count"].(float64); count > 0 {
+					sent++
+					break
+				}
+			}
+		}
+		coverage[exporter] = 100 * float64(sent) / float64(total)
+	}
+	return coverage, nil
+}
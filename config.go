@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Source        string                  `yaml:"source" toml:"source"`
+	Elasticsearch ElasticsearchConfig     `yaml:"elasticsearch" toml:"elasticsearch"`
+	ClickHouse    ClickHouseConfig        `yaml:"clickhouse" toml:"clickhouse"`
+	Loki          LokiConfig              `yaml:"loki" toml:"loki"`
+	Prometheus    PrometheusConfig        `yaml:"prometheus" toml:"prometheus"`
+	VPCFlowLogs   VPCFlowLogsConfig       `yaml:"vpcFlowLogs" toml:"vpcFlowLogs"`
+	BigQuery      BigQueryConfig          `yaml:"bigquery" toml:"bigquery"`
+	NSGFlowLogs   NSGFlowLogsConfig       `yaml:"nsgFlowLogs" toml:"nsgFlowLogs"`
+	Hubble        HubbleConfig            `yaml:"hubble" toml:"hubble"`
+	Pcap          PcapConfig              `yaml:"pcap" toml:"pcap"`
+	Plugins       map[string]PluginConfig `yaml:"plugins" toml:"plugins"`
+	Shadow        ShadowConfig            `yaml:"shadow" toml:"shadow"`
+	Window        string                  `yaml:"window" toml:"window"`
+	Network       []string                `yaml:"network" toml:"network"`
+	Resolution    string                  `yaml:"resolution" toml:"resolution"`
+	// CompareWindow also queries the window this far back, e.g. 1d, and
+	// writes how the traffic changed.
+	CompareWindow string `yaml:"compareWindow" toml:"compareWindow"`
+	// ShiftLag ends the window at the source's newest data rather than now.
+	ShiftLag   bool             `yaml:"shiftLag" toml:"shiftLag"`
+	Protocols  []string         `yaml:"protocols" toml:"protocols"`
+	Kafka      KafkaConfig      `yaml:"kafka" toml:"kafka"`
+	Kubernetes KubernetesConfig `yaml:"kubernetes" toml:"kubernetes"`
+	Enrichment EnrichmentConfig `yaml:"enrichment" toml:"enrichment"`
+	Limits     LimitsConfig     `yaml:"limits" toml:"limits"`
+	Privacy    PrivacyConfig    `yaml:"privacy" toml:"privacy"`
+	Output     OutputConfig     `yaml:"output" toml:"output"`
+	Email      EmailConfig      `yaml:"email" toml:"email"`
+	Slack      SlackConfig      `yaml:"slack" toml:"slack"`
+	Webhook    WebhookConfig    `yaml:"webhook" toml:"webhook"`
+	Alerts     AlertsConfig     `yaml:"alerts" toml:"alerts"`
+	Baseline   BaselineConfig   `yaml:"baseline" toml:"baseline"`
+	Rollup     RollupConfig     `yaml:"rollup" toml:"rollup"`
+}
+
+type ElasticsearchConfig struct {
+	Addresses    []string          `yaml:"addresses" toml:"addresses"`
+	Username     string            `yaml:"username" toml:"username"`
+	Password     string            `yaml:"password" toml:"password"`
+	APIKey       string            `yaml:"apiKey" toml:"apiKey"`
+	ServiceToken string            `yaml:"serviceToken" toml:"serviceToken"`
+	Credentials  CredentialsConfig `yaml:"credentials" toml:"credentials"`
+	Index        string            `yaml:"index" toml:"index"`
+	TLS          TLSConfig         `yaml:"tls" toml:"tls"`
+	// MaxClockSkew flags exporters whose flow timestamps stray further than
+	// this from event.ingested; zero disables the check. CorrectClockSkew
+	// also reads their flows from where their clocks put them, so they land
+	// in the right window.
+	MaxClockSkew     time.Duration `yaml:"maxClockSkew" toml:"maxClockSkew"`
+	CorrectClockSkew bool          `yaml:"correctClockSkew" toml:"correctClockSkew"`
+}
+
+type TLSConfig struct {
+	CAFile             string `yaml:"caFile" toml:"caFile"`
+	CertFile           string `yaml:"certFile" toml:"certFile"`
+	KeyFile            string `yaml:"keyFile" toml:"keyFile"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify" toml:"insecureSkipVerify"`
+}
+
+type KubernetesConfig struct {
+	Labels     bool   `yaml:"labels" toml:"labels"`
+	Kubeconfig string `yaml:"kubeconfig" toml:"kubeconfig"`
+	GroupBy    string `yaml:"groupBy" toml:"groupBy"`
+	// OwnershipIndex is the file maintained by `kube-netflow ipwatch`.
+	OwnershipIndex string `yaml:"ownershipIndex" toml:"ownershipIndex"`
+	// HostOwners attributes a node's address, by node name or IP, to the
+	// namespace/name of the workload sharing it, for nodes running several
+	// host-network pods or Windows nodes where pod and node IPs coincide.
+	HostOwners map[string]string `yaml:"hostOwners" toml:"hostOwners"`
+}
+
+type PrivacyConfig struct {
+	MinPairBytes        float64 `yaml:"minPairBytes" toml:"minPairBytes"`
+	MinPairFlows        float64 `yaml:"minPairFlows" toml:"minPairFlows"`
+	NoiseEpsilon        float64 `yaml:"noiseEpsilon" toml:"noiseEpsilon"`
+	NoiseSensitivity    float64 `yaml:"noiseSensitivity" toml:"noiseSensitivity"`
+	PseudonymizeKeyFile string  `yaml:"pseudonymizeKeyFile" toml:"pseudonymizeKeyFile"`
+}
+
+type OutputConfig struct {
+	Path  string `yaml:"path" toml:"path"`
+	Title string `yaml:"title" toml:"title"`
+	// Format is png, svg, pdf or eps for the chord diagram, html for a
+	// self-contained report or nodegraph for the JSON of Grafana's Node
+	// Graph panel.
+	Format string `yaml:"format" toml:"format"`
+	// Table also writes the data as an HTML table next to the output.
+	Table bool `yaml:"table" toml:"table"`
+	// Bundle also packages the outputs, their manifest and the data as CSV
+	// and JSON into this zip archive.
+	Bundle string `yaml:"bundle" toml:"bundle"`
+	// Timelapse also writes the window as an animated .gif or .mp4 of
+	// Frames diagrams, one per equal slice of the window.
+	Timelapse string `yaml:"timelapse" toml:"timelapse"`
+	Frames    int    `yaml:"frames" toml:"frames"`
+	// Keep retains this many timestamped copies of the output and the
+	// bundle, such as network_flow-20240131T120000Z.png, pruning older ones.
+	Keep int `yaml:"keep" toml:"keep"`
+	// Width and Height are the diagram's size in inches, and DPI the
+	// resolution of PNG output.
+	Width  float64 `yaml:"width" toml:"width"`
+	Height float64 `yaml:"height" toml:"height"`
+	DPI    int     `yaml:"dpi" toml:"dpi"`
+	// Layout is chord, bundled, heatmap or graph.
+	Layout string `yaml:"layout" toml:"layout"`
+	// ClusterNamespaces pulls each namespace's nodes together in the graph
+	// layout.
+	ClusterNamespaces bool `yaml:"clusterNamespaces" toml:"clusterNamespaces"`
+	// Theme is light, dark or print.
+	Theme string `yaml:"theme" toml:"theme"`
+	// Lang is the language of the fixed strings of HTML reports and
+	// tables: en, de, es or fr.
+	Lang    string `yaml:"lang" toml:"lang"`
+	SignKey string `yaml:"signKey" toml:"signKey"`
+	// StaleAfter is how old served data may be before responses warn
+	// about it.
+	StaleAfter time.Duration `yaml:"staleAfter" toml:"staleAfter"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Source: "elasticsearch",
+		Elasticsearch: ElasticsearchConfig{
+			Addresses: []string{"http://localhost:9200"},
+			Index:     "filebeat-*",
+		},
+		ClickHouse: ClickHouseConfig{
+			Table:             "flows",
+			SourceColumn:      "src_ip",
+			DestinationColumn: "dst_ip",
+			BytesColumn:       "bytes",
+			TimeColumn:        "timestamp",
+			Limit:             termsSize * termsSize,
+		},
+		Loki: LokiConfig{
+			Query:            `sum by (src, dst) (sum_over_time({job="netflow"} | json | unwrap bytes [$window]))`,
+			SourceLabel:      "src",
+			DestinationLabel: "dst",
+		},
+		Prometheus: PrometheusConfig{
+			Query:            `sum by (source, destination) (increase(kube_netflow_bytes_total[$window]))`,
+			SourceLabel:      "source",
+			DestinationLabel: "destination",
+		},
+		VPCFlowLogs: VPCFlowLogsConfig{DatePrefixes: "daily"},
+		BigQuery: BigQueryConfig{
+			SourceColumn:      "jsonPayload.connection.src_ip",
+			DestinationColumn: "jsonPayload.connection.dest_ip",
+			BytesColumn:       "jsonPayload.bytes_sent",
+			StartColumn:       "jsonPayload.start_time",
+			EndColumn:         "jsonPayload.end_time",
+		},
+		Kafka: KafkaConfig{
+			TopicField:  "kafka.topic",
+			ClientField: "kafka.client_id",
+		},
+		Shadow:     ShadowConfig{Tolerance: 0.01, Report: 5},
+		Window:     "3h",
+		Network:    []string{"10.0.0.0/8"},
+		Resolution: "auto",
+		ShiftLag:   true,
+		Kubernetes: KubernetesConfig{GroupBy: "ip"},
+		Enrichment: EnrichmentConfig{
+			Workers:       32,
+			LookupTimeout: 2 * time.Second,
+			CacheTTL:      time.Hour,
+			NegativeTTL:   5 * time.Minute,
+			InventoryTTL:  time.Minute,
+		},
+		Email:    EmailConfig{Port: 587, Summary: 10},
+		Slack:    SlackConfig{Summary: 5},
+		Webhook:  WebhookConfig{Summary: 10},
+		Limits:   LimitsConfig{QueryConcurrency: 4, RenderConcurrency: 2, MaxWindow: 31 * 24 * time.Hour, RequestBurst: 10},
+		Baseline: BaselineConfig{ZScore: 3, MinSamples: 5},
+		Rollup:   RollupConfig{Interval: "1h", Delay: 5 * time.Minute, AllowedLateness: time.Hour},
+		Privacy:  PrivacyConfig{NoiseSensitivity: 1 << 20},
+		Output: OutputConfig{
+			Path:       "network_flow.png",
+			Title:      "Network Traffic Flow Between IPs",
+			Format:     "png",
+			Layout:     "chord",
+			Theme:      "light",
+			Lang:       "en",
+			Width:      24,
+			Height:     24,
+			DPI:        96,
+			Frames:     24,
+			StaleAfter: 15 * time.Minute,
+		},
+	}
+}
+
+// loadConfig returns the defaults overlaid with the file named by --config in
+// args, if any. Flags are bound to the result afterwards so they take
+// precedence over the file.
+func loadConfig(args []string) (Config, error) {
+	cfg := defaultConfig()
+	path := configPath(args)
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		meta, err := toml.Decode(string(data), &cfg)
+		if err != nil {
+			return cfg, fmt.Errorf("%s: %w", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return cfg, fmt.Errorf("%s: unknown setting %s", path, undecoded[0])
+		}
+	default:
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&cfg); err != nil && err != io.EOF {
+			return cfg, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return cfg, nil
+}
+
+func configPath(args []string) string {
+	for i, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		if value, ok := strings.CutPrefix(name, "config="); ok {
+			return value
+		}
+		if name == "config" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// stringList is a comma-separated flag bound to a config list.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+type containerFlow struct {
+	Source, Destination, Container string
+	Bytes                          float64
+}
+
+// fetchContainerFlows breaks each pair down by the sending container, which
+// only agents running with --per-container record. Rollups do not keep
+// containers, so this always reads raw flows.
+func fetchContainerFlows(ctx context.Context, es *elasticsearch.Client, index string, networkFilters []string, from, to time.Time) ([]containerFlow, error) {
+	conditions, err := flowConditions(networkFilters, timeRangeCondition(map[string]interface{}{
+		"gte": from.Format(time.RFC3339),
+		"lt":  to.Format(time.RFC3339),
+	}))
+	if err != nil {
+		return nil, err
+	}
+	conditions = append(conditions, map[string]interface{}{"exists": map[string]interface{}{"field": "container.id"}})
+
+	aggs := pairAggs(from)
+	destinations := aggs["source_nodes"].(map[string]interface{})["aggs"].(map[string]interface{})["destinations"].(map[string]interface{})
+	destinations["aggs"] = map[string]interface{}{
+		"containers": map[string]interface{}{
+			"terms": map[string]interface{}{"field": "container.id", "size": termsSize},
+			"aggs":  destinations["aggs"],
+		},
+	}
+
+	result, err := search(ctx, es, index, map[string]interface{}{
+		"size":  0,
+		"query": map[string]interface{}{"bool": map[string]interface{}{"must": conditions}},
+		"aggs":  aggs,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var flows []containerFlow
+	for _, bucket := range buckets(result["aggregations"], "source_nodes") {
+		for _, destination := range buckets(bucket, "destinations") {
+			for _, container := range buckets(destination, "containers") {
+				flows = append(flows, containerFlow{
+					Source:      bucket["key"].(string),
+					Destination: destination["key"].(string),
+					Container:   container["key"].(string),
+					Bytes:       container["bytes"].(map[string]interface{})["value"].(float64),
+				})
+			}
+		}
+	}
+	sort.Slice(flows, func(i, j int) bool { return flows[i].Bytes > flows[j].Bytes })
+	return flows, nil
+}
+
+// loadContainerNames lists the cluster's containers and the owners of its
+// addresses over [from, to). Without access to the cluster the reports fall
+// back to container IDs and addresses, so errors are only logged.
+func loadContainerNames(ctx context.Context, cfg Config, from, to time.Time) (map[string]kubeContainer, kubeOwners) {
+	client, err := newKubeClient(cfg.Kubernetes.Kubeconfig)
+	if err != nil {
+		log.Printf("Error creating Kubernetes client, reporting container IDs: %s", err)
+		return nil, nil
+	}
+	containers, err := loadKubeContainers(ctx, client)
+	if err != nil {
+		log.Printf("Error listing containers, reporting container IDs: %s", err)
+	}
+	inventory, err := loadKubeInventory(ctx, client)
+	if err != nil {
+		log.Printf("Error loading Kubernetes objects, reporting addresses: %s", err)
+		return containers, nil
+	}
+	return containers, inventory.Resolve(from, to)
+}
+
+// containerLabel names a container by namespace, pod and name, or by the
+// sending address and short ID when it has since gone.
+func containerLabel(containers map[string]kubeContainer, flow containerFlow) string {
+	if container, ok := containers[flow.Container]; ok {
+		return container.Label()
+	}
+	id := flow.Container
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return flow.Source + "/" + id
+}
+
+func runContainers(args []string) {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		log.Fatalf("Error loading config: %s", err)
+	}
+
+	fs := flag.NewFlagSet("containers", flag.ExitOnError)
+	fs.String("config", "", "YAML or TOML configuration file; flags override its values")
+	fs.StringVar(&cfg.Window, "window", cfg.Window, "Time window to report on")
+	fs.Var((*stringList)(&cfg.Network), "network", "Network CIDR filter")
+	fs.StringVar(&cfg.Kubernetes.Kubeconfig, "kubeconfig", cfg.Kubernetes.Kubeconfig, "Kubeconfig used to name containers and destinations outside the cluster (defaults to kubectl's)")
+	byPtr := fs.String("by", "pair", "Report per container and destination, or per container")
+	fs.Parse(args)
+
+	window, err := parseWindow(cfg.Window)
+	if err != nil {
+		log.Fatalf("Invalid window: %s", err)
+	}
+	es, err := newElasticClient(cfg.Elasticsearch)
+	if err != nil {
+		log.Fatalf("Error creating the client: %s", err)
+	}
+
+	ctx := context.Background()
+	to := time.Now()
+	from := to.Add(-window)
+	flows, err := fetchContainerFlows(ctx, es, cfg.Elasticsearch.Index, cfg.Network, from, to)
+	if err != nil {
+		log.Fatalf("Error querying flows: %s", err)
+	}
+	if len(flows) == 0 {
+		log.Printf("No per-container flows in the last %s; run the agent with --capture=ebpf --per-container", cfg.Window)
+	}
+	containers, owners := loadContainerNames(ctx, cfg, from, to)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	switch *byPtr {
+	case "pair":
+		fmt.Fprintln(w, "CONTAINER\tDESTINATION\tBYTES")
+		for _, flow := range flows {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", containerLabel(containers, flow), owners.label(flow.Destination), strconv.FormatFloat(flow.Bytes, 'f', 0, 64))
+		}
+	case "container":
+		totals := make(map[string]float64)
+		for _, flow := range flows {
+			totals[containerLabel(containers, flow)] += flow.Bytes
+		}
+		var labels []string
+		for label := range totals {
+			labels = append(labels, label)
+		}
+		sort.Slice(labels, func(i, j int) bool { return totals[labels[i]] > totals[labels[j]] })
+		fmt.Fprintln(w, "CONTAINER\tBYTES")
+		for _, label := range labels {
+			fmt.Fprintf(w, "%s\t%s\n", label, strconv.FormatFloat(totals[label], 'f', 0, 64))
+		}
+	default:
+		log.Fatalf("Unsupported --by: %s", *byPtr)
+	}
+	w.Flush()
+}
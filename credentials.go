@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CredentialsConfig selects where Elasticsearch credentials come from. With no
+// provider the username/password, apiKey or serviceToken in the elasticsearch
+// section, or their flags, are used; a provider excludes them.
+type CredentialsConfig struct {
+	Provider string   `yaml:"provider" toml:"provider"`
+	Path     string   `yaml:"path" toml:"path"`
+	Command  []string `yaml:"command" toml:"command"`
+}
+
+type Credentials struct {
+	Username     string `yaml:"username" json:"username"`
+	Password     string `yaml:"password" json:"password"`
+	APIKey       string `yaml:"apiKey" json:"apiKey"`
+	ServiceToken string `yaml:"serviceToken" json:"serviceToken"`
+}
+
+func resolveCredentials(cfg ElasticsearchConfig) (Credentials, error) {
+	source := cfg.Credentials
+	if source.Provider != "" && (cfg.Username != "" || cfg.Password != "" || cfg.APIKey != "" || cfg.ServiceToken != "") {
+		return Credentials{}, fmt.Errorf("credentials provider %s excludes elasticsearch username, password, apiKey and serviceToken and --es-api-key and --es-service-token; set one or the other", source.Provider)
+	}
+	switch source.Provider {
+	case "":
+		return Credentials{
+			Username:     cfg.Username,
+			Password:     cfg.Password,
+			APIKey:       cfg.APIKey,
+			ServiceToken: cfg.ServiceToken,
+		}, nil
+	case "env":
+		return Credentials{
+			Username:     os.Getenv("ELASTICSEARCH_USERNAME"),
+			Password:     os.Getenv("ELASTICSEARCH_PASSWORD"),
+			APIKey:       os.Getenv("ELASTICSEARCH_API_KEY"),
+			ServiceToken: os.Getenv("ELASTICSEARCH_SERVICE_TOKEN"),
+		}, nil
+	case "secret":
+		return secretCredentials(source.Path)
+	case "file":
+		data, err := os.ReadFile(source.Path)
+		if err != nil {
+			return Credentials{}, err
+		}
+		return decodeCredentials(source.Path, data)
+	case "command":
+		if len(source.Command) == 0 {
+			return Credentials{}, fmt.Errorf("credentials provider command needs a command")
+		}
+		var stderr bytes.Buffer
+		cmd := exec.Command(source.Command[0], source.Command[1:]...)
+		cmd.Stderr = &stderr
+		data, err := cmd.Output()
+		if err != nil {
+			return Credentials{}, fmt.Errorf("credentials command: %w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return decodeCredentials(source.Command[0], data)
+	default:
+		return Credentials{}, fmt.Errorf("unknown credentials provider: %s", source.Provider)
+	}
+}
+
+// secretCredentials reads a Kubernetes Secret mounted as a volume, where each
+// key is a file named after it. Keys that are absent are left empty.
+func secretCredentials(dir string) (Credentials, error) {
+	if dir == "" {
+		return Credentials{}, fmt.Errorf("credentials provider secret needs a path")
+	}
+	var creds Credentials
+	keys := map[string]*string{
+		"username":      &creds.Username,
+		"password":      &creds.Password,
+		"api-key":       &creds.APIKey,
+		"service-token": &creds.ServiceToken,
+	}
+	for name, value := range keys {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return Credentials{}, err
+		}
+		*value = strings.TrimRight(string(data), "\r\n")
+	}
+	if creds == (Credentials{}) {
+		return Credentials{}, fmt.Errorf("%s: no credentials found", dir)
+	}
+	return creds, nil
+}
+
+// decodeCredentials accepts a YAML or JSON document with username and
+// password keys.
+func decodeCredentials(source string, data []byte) (Credentials, error) {
+	var creds Credentials
+	if err := yaml.Unmarshal(data, &creds); err != nil {
+		return Credentials{}, fmt.Errorf("%s: %w", source, err)
+	}
+	return creds, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+var databaseProtocols = []string{"postgres", "mysql", "redis", "mongodb", "cassandra", "memcached", "elasticsearch", "etcd"}
+
+type databaseClient struct {
+	Database, Protocol, Client string
+	// Connections counts distinct client ports, which approximates
+	// connections for pooled and short-lived clients alike.
+	Connections float64
+	Bytes       float64
+	// PreviousBytes covers the window of the same length just before.
+	PreviousBytes float64
+}
+
+func (c databaseClient) trend() string {
+	if c.PreviousBytes == 0 {
+		return "new"
+	}
+	return fmt.Sprintf("%+.0f%%", 100*(c.Bytes-c.PreviousBytes)/c.PreviousBytes)
+}
+
+func fetchDatabaseClients(ctx context.Context, es *elasticsearch.Client, index string, networkFilters []string, from, to time.Time) ([]databaseClient, error) {
+	previous := from.Add(-to.Sub(from))
+	conditions, err := flowConditions(networkFilters, timeRangeCondition(map[string]interface{}{
+		"gte": previous.Format(time.RFC3339),
+		"lt":  to.Format(time.RFC3339),
+	}))
+	if err != nil {
+		return nil, err
+	}
+	conditions = append(conditions, protocolCondition(databaseProtocols))
+
+	period := func(gte, lt time.Time) map[string]interface{} {
+		return timeRangeCondition(map[string]interface{}{"gte": gte.Format(time.RFC3339), "lt": lt.Format(time.RFC3339)})
+	}
+	query := map[string]interface{}{
+		"size":  0,
+		"query": map[string]interface{}{"bool": map[string]interface{}{"must": conditions}},
+		"aggs": map[string]interface{}{
+			"databases": map[string]interface{}{
+				"terms": map[string]interface{}{"field": "destination.ip", "size": termsSize},
+				"aggs": map[string]interface{}{
+					"ports": map[string]interface{}{
+						"terms": map[string]interface{}{"field": "destination.port", "size": termsSize},
+						"aggs": map[string]interface{}{
+							"protocols": map[string]interface{}{
+								"terms": map[string]interface{}{"field": "network.protocol", "size": termsSize, "missing": missingProtocol},
+								"aggs": map[string]interface{}{
+									"clients": map[string]interface{}{
+										"terms": map[string]interface{}{"field": "source.ip", "size": termsSize},
+										"aggs": map[string]interface{}{
+											"periods": map[string]interface{}{
+												"filters": map[string]interface{}{
+													"filters": map[string]interface{}{
+														"current":  period(from, to),
+														"previous": period(previous, from),
+													},
+												},
+												"aggs": map[string]interface{}{
+													"bytes":       map[string]interface{}{"sum": map[string]interface{}{"field": "network.bytes"}},
+													"connections": map[string]interface{}{"cardinality": map[string]interface{}{"field": "source.port"}},
+												},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	result, err := search(ctx, es, index, query)
+	if err != nil {
+		return nil, err
+	}
+
+	totals := make(map[databaseClient]databaseClient)
+	for _, database := range buckets(result["aggregations"], "databases") {
+		for _, port := range buckets(database, "ports") {
+			portNumber, _ := port["key"].(float64)
+			for _, protocol := range buckets(port, "protocols") {
+				for _, client := range buckets(protocol, "clients") {
+					key := databaseClient{
+						Database: database["key"].(string),
+						Protocol: classifyProtocol(fmt.Sprint(protocol["key"]), int(portNumber)),
+						Client:   client["key"].(string),
+					}
+					periods := client["periods"].(map[string]interface{})["buckets"].(map[string]interface{})
+					current := periods["current"].(map[string]interface{})
+					before := periods["previous"].(map[string]interface{})
+
+					total := totals[key]
+					total.Database, total.Protocol, total.Client = key.Database, key.Protocol, key.Client
+					total.Bytes += current["bytes"].(map[string]interface{})["value"].(float64)
+					total.Connections += current["connections"].(map[string]interface{})["value"].(float64)
+					total.PreviousBytes += before["bytes"].(map[string]interface{})["value"].(float64)
+					totals[key] = total
+				}
+			}
+		}
+	}
+
+	var clients []databaseClient
+	for _, client := range totals {
+		if client.Bytes > 0 {
+			clients = append(clients, client)
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].Database != clients[j].Database {
+			return clients[i].Database < clients[j].Database
+		}
+		return clients[i].Bytes > clients[j].Bytes
+	})
+	return clients, nil
+}
+
+func runDatabases(args []string) {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		log.Fatalf("Error loading config: %s", err)
+	}
+
+	fs := flag.NewFlagSet("databases", flag.ExitOnError)
+	fs.String("config", "", "YAML or TOML configuration file; flags override its values")
+	fs.StringVar(&cfg.Window, "window", cfg.Window, "Time window to report on; the trend compares with the window before it")
+	fs.Var((*stringList)(&cfg.Network), "network", "Network CIDR filter")
+	fs.Parse(args)
+
+	window, err := parseWindow(cfg.Window)
+	if err != nil {
+		log.Fatalf("Invalid window: %s", err)
+	}
+	es, err := newElasticClient(cfg.Elasticsearch)
+	if err != nil {
+		log.Fatalf("Error creating the client: %s", err)
+	}
+
+	to := time.Now()
+	clients, err := fetchDatabaseClients(context.Background(), es, cfg.Elasticsearch.Index, cfg.Network, to.Add(-window), to)
+	if err != nil {
+		log.Fatalf("Error querying flows: %s", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DATABASE\tPROTOCOL\tCLIENT\tCONNECTIONS\tBYTES\tTREND")
+	for _, c := range clients {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", c.Database, c.Protocol, c.Client,
+			strconv.FormatFloat(c.Connections, 'f', 0, 64), strconv.FormatFloat(c.Bytes, 'f', 0, 64), c.trend())
+	}
+	w.Flush()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxAhead bounds the out-of-order sequence numbers kept per agent. Past
+// it, the oldest missing batches are given up as lost.
+const maxAhead = 1024
+
+// deliveries tracks the batches each agent delivered, so batches an agent
+// resends after a failed call are merged once, and so the collector can
+// tell how much of a window's agent data arrived.
+type deliveries struct {
+	// retain is how long snapshot times are kept, the collector's window.
+	retain time.Duration
+
+	mu     sync.Mutex
+	agents map[string]*agentDeliveries
+}
+
+type agentDeliveries struct {
+	session string
+	// next is the lowest sequence number not yet received, and ahead the
+	// received ones above it.
+	next     uint64
+	ahead    map[uint64]bool
+	interval time.Duration
+	// firstSeen survives agent restarts so the outage counts against
+	// completeness.
+	firstSeen, lastSeen time.Time
+	// snapshots maps the agent's capture times to the collector's.
+	snapshots map[int64]time.Time
+}
+
+func newDeliveries(retain time.Duration) *deliveries {
+	return &deliveries{retain: retain, agents: make(map[string]*agentDeliveries)}
+}
+
+// accept records batch, captured at by the collector's clock, and reports
+// whether it is a duplicate of one already merged.
+func (d *deliveries) accept(batch *FlowBatch, at, now time.Time) bool {
+	if batch.GetSequence() == 0 {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	a := d.agents[batch.GetAgent()]
+	if a == nil {
+		a = &agentDeliveries{firstSeen: now, snapshots: make(map[int64]time.Time)}
+		d.agents[batch.GetAgent()] = a
+	}
+	if a.session != batch.GetSession() {
+		if a.session != "" {
+			log.Printf("Agent %s restarted", batch.GetAgent())
+		}
+		a.session, a.next, a.ahead = batch.GetSession(), 1, make(map[uint64]bool)
+	}
+
+	sequence := batch.GetSequence()
+	if sequence < a.next || a.ahead[sequence] {
+		return true
+	}
+	a.ahead[sequence] = true
+	if len(a.ahead) > maxAhead {
+		oldest := sequence
+		for s := range a.ahead {
+			if s < oldest {
+				oldest = s
+			}
+		}
+		log.Printf("Agent %s: giving up on batches %d to %d", batch.GetAgent(), a.next, oldest-1)
+		a.next = oldest
+	}
+	for a.ahead[a.next] {
+		delete(a.ahead, a.next)
+		a.next++
+	}
+
+	a.interval = batch.GetInterval().AsDuration()
+	a.lastSeen = now
+	if batch.GetCapturedAt() != nil {
+		a.snapshots[batch.GetCapturedAt().AsTime().UnixNano()] = at
+	}
+	for captured, t := range a.snapshots {
+		if now.Sub(t) > d.retain {
+			delete(a.snapshots, captured)
+		}
+	}
+	return false
+}
+
+// completeness returns the percentage of the snapshots agents were due to
+// take in [from, to) that arrived, per agent and overall. Agents not seen
+// since before from are gone and not counted; ok is false without agents.
+func (d *deliveries) completeness(from, to time.Time) (agents map[string]float64, overall float64, ok bool) {
+	if d == nil {
+		return nil, 0, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	agents = make(map[string]float64)
+	var expected, received int
+	for name, a := range d.agents {
+		if a.interval <= 0 || a.lastSeen.Before(from) {
+			continue
+		}
+		start := from
+		if a.firstSeen.After(start) {
+			start = a.firstSeen
+		}
+		due := int(to.Sub(start) / a.interval)
+		if due <= 0 {
+			continue
+		}
+		arrived := 0
+		for _, t := range a.snapshots {
+			if !t.Before(from) && t.Before(to) {
+				arrived++
+			}
+		}
+		if arrived > due {
+			arrived = due
+		}
+		agents[name] = 100 * float64(arrived) / float64(due)
+		expected += due
+		received += arrived
+	}
+	if expected == 0 {
+		return nil, 0, false
+	}
+	return agents, 100 * float64(received) / float64(expected), true
+}
+
+// incomplete lists the agents below 100%, least complete first.
+func incomplete(agents map[string]float64) []string {
+	var names []string
+	for name, percent := range agents {
+		if percent < 100 {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return agents[names[i]] < agents[names[j]] })
+	return names
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+type demoService struct {
+	Namespace string
+	Name      string
+	Replicas  int
+}
+
+var demoServices = []demoService{
+	{"ingress-nginx", "controller", 2},
+	{"web", "frontend", 3},
+	{"shop", "catalog", 2},
+	{"shop", "checkout", 2},
+	{"shop", "cart", 2},
+	{"payments", "gateway", 2},
+	{"data", "postgres", 1},
+	{"data", "redis", 1},
+	{"monitoring", "prometheus", 1},
+	{"kube-system", "coredns", 2},
+}
+
+// Average bytes per hour between two services at the daily peak.
+var demoCalls = []struct {
+	From, To string
+	Bytes    float64
+}{
+	{"ingress-nginx/controller", "web/frontend", 900e6},
+	{"web/frontend", "shop/catalog", 400e6},
+	{"web/frontend", "shop/cart", 150e6},
+	{"web/frontend", "shop/checkout", 80e6},
+	{"shop/checkout", "payments/gateway", 40e6},
+	{"shop/checkout", "shop/cart", 30e6},
+	{"shop/catalog", "data/postgres", 250e6},
+	{"shop/cart", "data/redis", 120e6},
+	{"payments/gateway", "data/postgres", 20e6},
+	{"monitoring/prometheus", "web/frontend", 15e6},
+	{"monitoring/prometheus", "shop/catalog", 10e6},
+	{"monitoring/prometheus", "data/postgres", 10e6},
+	{"web/frontend", "kube-system/coredns", 5e6},
+	{"shop/checkout", "kube-system/coredns", 3e6},
+}
+
+func demoPodIP(service, replica int) string {
+	return fmt.Sprintf("10.244.%d.%d", service+1, replica+10)
+}
+
+func demoServiceIndex(key string) int {
+	for i, s := range demoServices {
+		if s.Namespace+"/"+s.Name == key {
+			return i
+		}
+	}
+	panic("unknown demo service " + key)
+}
+
+// demoLoad follows a business-hours curve peaking at 14:00 UTC and dropping
+// to roughly a third overnight.
+func demoLoad(t time.Time) float64 {
+	hour := float64(t.UTC().Hour()) + float64(t.UTC().Minute())/60
+	return 0.35 + 0.65*(1+math.Sin(2*math.Pi*(hour-8)/24))/2
+}
+
+func demoMatrix(window time.Duration, now time.Time) *FlowMatrix {
+	rng := rand.New(rand.NewSource(1))
+	matrix := NewFlowMatrix()
+
+	for _, call := range demoCalls {
+		from := demoServiceIndex(call.From)
+		to := demoServiceIndex(call.To)
+		pairs := float64(demoServices[from].Replicas * demoServices[to].Replicas)
+
+		for t := now.Add(-window); t.Before(now); t = t.Add(time.Hour) {
+			step := time.Hour
+			if now.Sub(t) < step {
+				step = now.Sub(t)
+			}
+			total := call.Bytes * demoLoad(t) * step.Hours()
+
+			for i := 0; i < demoServices[from].Replicas; i++ {
+				for j := 0; j < demoServices[to].Replicas; j++ {
+					jitter := 0.8 + 0.4*rng.Float64()
+					matrix.Add(demoPodIP(from, i), demoPodIP(to, j), total/pairs*jitter)
+				}
+			}
+		}
+	}
+	return matrix
+}
+
+func demoInventory() kubeInventory {
+	inventory := make(kubeInventory)
+	for i, s := range demoServices {
+		for r := 0; r < s.Replicas; r++ {
+			inventory.add(demoPodIP(i, r), kubeEndpoint{Kind: "pod", Namespace: s.Namespace, Name: fmt.Sprintf("%s-%d", s.Name, r)})
+		}
+	}
+	return inventory
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// diffTableSize is how many of the largest changes the diff table lists.
+const diffTableSize = 25
+
+// flowDelta is how a pair's traffic changed between two windows.
+type flowDelta struct {
+	Source      string
+	Destination string
+	Before      float64
+	After       float64
+}
+
+func (d flowDelta) change() float64 {
+	return d.After - d.Before
+}
+
+// diffMatrices returns the pairs whose traffic differs between before and
+// after, largest change first.
+func diffMatrices(before, after *FlowMatrix) []flowDelta {
+	pairs := make(map[[2]string]*flowDelta)
+	collect := func(matrix *FlowMatrix, after bool) {
+		for i, source := range matrix.Names {
+			for j, destination := range matrix.Names {
+				if matrix.Flow[i][j] == 0 {
+					continue
+				}
+				key := [2]string{source, destination}
+				if pairs[key] == nil {
+					pairs[key] = &flowDelta{Source: source, Destination: destination}
+				}
+				if after {
+					pairs[key].After += matrix.Flow[i][j]
+				} else {
+					pairs[key].Before += matrix.Flow[i][j]
+				}
+			}
+		}
+	}
+	collect(before, false)
+	collect(after, true)
+
+	var deltas []flowDelta
+	for _, delta := range pairs {
+		if delta.change() != 0 {
+			deltas = append(deltas, *delta)
+		}
+	}
+	sort.Slice(deltas, func(i, j int) bool {
+		return math.Abs(deltas[i].change()) > math.Abs(deltas[j].change())
+	})
+	return deltas
+}
+
+// diffPath is where the diff of the output at path is written with the
+// given extension, e.g. network_flow-diff.png.
+func diffPath(path, ext string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + "-diff" + ext
+}
+
+var (
+	increaseColor = color.RGBA{R: 214, G: 39, B: 40, A: 200}
+	decreaseColor = color.RGBA{R: 31, G: 119, B: 180, A: 200}
+)
+
+// renderDiff draws deltas as a chord diagram whose chords are as wide as
+// the change and coloured by whether traffic grew or shrank.
+func renderDiff(deltas []flowDelta, title, path, format string, size plotSize, theme chordTheme) error {
+	matrix := NewFlowMatrix()
+	grew := make(map[[2]int]bool)
+	for _, delta := range deltas {
+		matrix.Add(delta.Source, delta.Destination, math.Abs(delta.change()))
+		if delta.change() > 0 {
+			grew[[2]int{matrix.Index(delta.Source), matrix.Index(delta.Destination)}] = true
+		}
+	}
+	p := newChordPlot(matrix, title, theme, func(i, j int) color.Color {
+		switch {
+		case theme.Dashes != nil && grew[[2]int{i, j}]:
+			return color.Gray{Y: 0}
+		case theme.Dashes != nil:
+			return color.Gray{Y: 150}
+		case grew[[2]int{i, j}]:
+			return increaseColor
+		default:
+			return decreaseColor
+		}
+	})
+	return renderPlot(p, path, format, size)
+}
+
+// writeDiffTable writes the largest changes between the windows before and
+// after as an aligned text table.
+func writeDiffTable(path string, deltas []flowDelta, before, after [2]time.Time) error {
+	var table bytes.Buffer
+	fmt.Fprintf(&table, "Before: %s – %s\n", before[0].UTC().Format(time.RFC3339), before[1].UTC().Format(time.RFC3339))
+	fmt.Fprintf(&table, "After:  %s – %s\n\n", after[0].UTC().Format(time.RFC3339), after[1].UTC().Format(time.RFC3339))
+
+	w := tabwriter.NewWriter(&table, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tDESTINATION\tBEFORE MB\tAFTER MB\tCHANGE MB\tCHANGE\t")
+	if len(deltas) > diffTableSize {
+		deltas = deltas[:diffTableSize]
+	}
+	for _, delta := range deltas {
+		percent := "new"
+		if delta.Before > 0 {
+			percent = fmt.Sprintf("%+.0f%%", delta.change()/delta.Before*100)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.1f\t%.1f\t%+.1f\t%s\t\n", delta.Source, delta.Destination,
+			delta.Before/1024/1024, delta.After/1024/1024, delta.change()/1024/1024, percent)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, table.Bytes())
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+type egressDomain struct {
+	Domain  string
+	Bytes   float64
+	Clients float64
+}
+
+// egressCondition matches flows leaving the given networks: the source is
+// inside one of them and the destination inside none.
+func egressCondition(networkFilters []string) map[string]interface{} {
+	var sources, destinations []map[string]interface{}
+	for _, cidr := range networkFilters {
+		sources = append(sources, map[string]interface{}{"term": map[string]interface{}{"source.ip": cidr}})
+		destinations = append(destinations, map[string]interface{}{"term": map[string]interface{}{"destination.ip": cidr}})
+	}
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"should":               sources,
+			"minimum_should_match": 1,
+			"must_not":             destinations,
+		},
+	}
+}
+
+// fetchEgressDomains totals egress per TLS server name. Egress without a
+// server name (plain TCP, ECH, non-TLS protocols) is reported as "-".
+func fetchEgressDomains(ctx context.Context, es *elasticsearch.Client, index, sniField string, networkFilters []string, from, to time.Time, top int) ([]egressDomain, error) {
+	if len(networkFilters) == 0 {
+		return nil, fmt.Errorf("egress needs at least one internal network")
+	}
+	for _, cidr := range networkFilters {
+		if _, _, err := cidrToRange(cidr); err != nil {
+			return nil, err
+		}
+	}
+	query := map[string]interface{}{
+		"size": 0,
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": []map[string]interface{}{
+					egressCondition(networkFilters),
+					timeRangeCondition(map[string]interface{}{
+						"gte": from.Format(time.RFC3339),
+						"lt":  to.Format(time.RFC3339),
+					}),
+				},
+			},
+		},
+		"aggs": map[string]interface{}{
+			"domains": map[string]interface{}{
+				"terms": map[string]interface{}{
+					"field":   sniField,
+					"size":    top,
+					"missing": missingProtocol,
+					"order":   map[string]interface{}{"bytes": "desc"},
+				},
+				"aggs": map[string]interface{}{
+					"bytes":   map[string]interface{}{"sum": map[string]interface{}{"field": "network.bytes"}},
+					"clients": map[string]interface{}{"cardinality": map[string]interface{}{"field": "source.ip"}},
+				},
+			},
+		},
+	}
+	result, err := search(ctx, es, index, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var domains []egressDomain
+	for _, bucket := range buckets(result["aggregations"], "domains") {
+		domains = append(domains, egressDomain{
+			Domain:  fmt.Sprint(bucket["key"]),
+			Bytes:   bucket["bytes"].(map[string]interface{})["value"].(float64),
+			Clients: bucket["clients"].(map[string]interface{})["value"].(float64),
+		})
+	}
+	return domains, nil
+}
+
+func runDomains(args []string) {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		log.Fatalf("Error loading config: %s", err)
+	}
+
+	fs := flag.NewFlagSet("domains", flag.ExitOnError)
+	fs.String("config", "", "YAML or TOML configuration file; flags override its values")
+	fs.StringVar(&cfg.Window, "window", cfg.Window, "Time window to report on")
+	fs.Var((*stringList)(&cfg.Network), "network", "Internal networks; traffic from them to anywhere else counts as egress")
+	sniFieldPtr := fs.String("sni-field", "tls.client.server_name", "Document field holding the TLS server name")
+	topPtr := fs.Int("top", 25, "Number of domains to list")
+	fs.Parse(args)
+
+	window, err := parseWindow(cfg.Window)
+	if err != nil {
+		log.Fatalf("Invalid window: %s", err)
+	}
+	es, err := newElasticClient(cfg.Elasticsearch)
+	if err != nil {
+		log.Fatalf("Error creating the client: %s", err)
+	}
+
+	to := time.Now()
+	domains, err := fetchEgressDomains(context.Background(), es, cfg.Elasticsearch.Index, *sniFieldPtr, cfg.Network, to.Add(-window), to, *topPtr)
+	if err != nil {
+		log.Fatalf("Error querying flows: %s", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DOMAIN\tBYTES\tCLIENTS")
+	for _, d := range domains {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", d.Domain, strconv.FormatFloat(d.Bytes, 'f', 0, 64), strconv.FormatFloat(d.Clients, 'f', 0, 64))
+	}
+	w.Flush()
+}
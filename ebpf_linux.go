@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"regexp"
+	"syscall"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+	"golang.org/x/sys/unix"
+)
+
+// ebpfPairKey is the map key: both addresses as 16 bytes, IPv4 mapped, and
+// when counting per container the cgroup ID of the sending socket.
+type ebpfPairKey struct {
+	Source, Destination [16]byte
+	Cgroup              uint64
+}
+
+// ebpfCapture counts bytes per address pair in a BPF hash map, from a
+// socket filter on a packet socket that sees every packet the node sends.
+// Counting only outgoing packets sees each forwarded packet once per node;
+// both nodes of a cross-node pair report the same pair document ID, so it is
+// stored once.
+//
+// Per container, a cgroup egress hook on the root of the cgroup hierarchy
+// counts instead. It sees packets as the sockets of each container send
+// them, so a sidecar and the application in one pod are counted apart.
+type ebpfCapture struct {
+	socket   int
+	hook     link.Link
+	pairs    *ebpf.Map
+	program  *ebpf.Program
+	filter   cidrFilter
+	previous map[ebpfPairKey]uint64
+	// containers is set when counting per container.
+	containers *cgroupContainers
+}
+
+func htons(v uint16) uint16 {
+	return binary.NativeEndian.Uint16(binary.BigEndian.AppendUint16(nil, v))
+}
+
+const (
+	protocolOffset = 16 // offsetof(struct __sk_buff, protocol)
+	ebpfKey        = -40
+	ebpfValue      = -48
+)
+
+// ebpfClearKey zeroes the key on the stack.
+func ebpfClearKey() asm.Instructions {
+	var insns asm.Instructions
+	for offset := int16(0); offset < 40; offset += 8 {
+		insns = append(insns, asm.StoreImm(asm.RFP, ebpfKey+offset, 0, asm.DWord))
+	}
+	return insns
+}
+
+// ebpfAddToPair, labelled update, adds R7 to the counter of the key on the
+// stack, creating it when missing, and goes on at out.
+func ebpfAddToPair(pairs *ebpf.Map) asm.Instructions {
+	return asm.Instructions{
+		asm.LoadMapPtr(asm.R1, pairs.FD()).WithSymbol("update"),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, ebpfKey),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "new"),
+		asm.StoreXAdd(asm.R0, asm.R7, asm.DWord),
+		asm.Ja.Label("out"),
+
+		// A packet of a pair created concurrently on another CPU is lost.
+		asm.StoreMem(asm.RFP, ebpfValue, asm.R7, asm.DWord).WithSymbol("new"),
+		asm.LoadMapPtr(asm.R1, pairs.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, ebpfKey),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, ebpfValue),
+		asm.Mov.Imm(asm.R4, int32(ebpf.UpdateNoExist)),
+		asm.FnMapUpdateElem.Call(),
+	}
+}
+
+// ebpfInstructions builds the filter, which adds skb->len to the pair's
+// counter and returns 0 so no packet is ever queued to the socket.
+func ebpfInstructions(pairs *ebpf.Map) asm.Instructions {
+	const (
+		pktTypeOffset  = 4 // offsetof(struct __sk_buff, pkt_type)
+		packetOutgoing = 4
+		key            = ebpfKey
+	)
+	insns := asm.Instructions{
+		// LD_ABS needs the context in R6.
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.LoadMem(asm.R2, asm.R6, pktTypeOffset, asm.Word),
+		asm.JNE.Imm(asm.R2, packetOutgoing, "out"),
+		asm.LoadMem(asm.R7, asm.R6, 0, asm.Word),
+	}
+	insns = append(insns, ebpfClearKey()...)
+	insns = append(insns,
+		asm.LoadMem(asm.R2, asm.R6, protocolOffset, asm.Word),
+		asm.JEq.Imm(asm.R2, int32(htons(0x86dd)), "ipv6"),
+		asm.JNE.Imm(asm.R2, int32(htons(0x0800)), "out"),
+
+		// IPv4 addresses go into ::ffff:a.b.c.d.
+		asm.StoreImm(asm.RFP, key+10, 0xffff, asm.Half),
+		asm.StoreImm(asm.RFP, key+16+10, 0xffff, asm.Half),
+		asm.LoadAbs(12, asm.Word),
+		asm.HostTo(asm.BE, asm.R0, asm.Word),
+		asm.StoreMem(asm.RFP, key+12, asm.R0, asm.Word),
+		asm.LoadAbs(16, asm.Word),
+		asm.HostTo(asm.BE, asm.R0, asm.Word),
+		asm.StoreMem(asm.RFP, key+16+12, asm.R0, asm.Word),
+		asm.Ja.Label("update"),
+	)
+	// IPv6 source and destination are at 8 and 24.
+	for i := int32(0); i < 8; i++ {
+		insn := asm.LoadAbs(8+4*i, asm.Word)
+		if i == 0 {
+			insn = insn.WithSymbol("ipv6")
+		}
+		insns = append(insns, insn,
+			asm.HostTo(asm.BE, asm.R0, asm.Word),
+			asm.StoreMem(asm.RFP, int16(key+4*i), asm.R0, asm.Word))
+	}
+	insns = append(insns, ebpfAddToPair(pairs)...)
+	return append(insns,
+		asm.Mov.Imm(asm.R0, 0).WithSymbol("out"),
+		asm.Return(),
+	)
+}
+
+// ebpfCgroupInstructions builds the cgroup egress program, which adds
+// skb->len to the counter of the pair and the sending socket's cgroup and
+// returns 1 to let every packet through. Its packets start at the IP header
+// and are read with bpf_skb_load_bytes, which copies them in network order.
+func ebpfCgroupInstructions(pairs *ebpf.Map) asm.Instructions {
+	const key = ebpfKey
+	// load copies n bytes at offset of the packet to the key at at.
+	load := func(offset int32, at int32, n int32) asm.Instructions {
+		return asm.Instructions{
+			asm.Mov.Reg(asm.R1, asm.R6),
+			asm.Mov.Imm(asm.R2, offset),
+			asm.Mov.Reg(asm.R3, asm.RFP),
+			asm.Add.Imm(asm.R3, key+at),
+			asm.Mov.Imm(asm.R4, n),
+			asm.FnSkbLoadBytes.Call(),
+			asm.JNE.Imm(asm.R0, 0, "out"),
+		}
+	}
+	insns := asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.LoadMem(asm.R7, asm.R6, 0, asm.Word),
+	}
+	insns = append(insns, ebpfClearKey()...)
+	insns = append(insns,
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.FnSkbCgroupId.Call(),
+		asm.StoreMem(asm.RFP, key+32, asm.R0, asm.DWord),
+		asm.LoadMem(asm.R2, asm.R6, protocolOffset, asm.Word),
+		asm.JEq.Imm(asm.R2, int32(htons(0x86dd)), "ipv6"),
+		asm.JNE.Imm(asm.R2, int32(htons(0x0800)), "out"),
+
+		// IPv4 addresses go into ::ffff:a.b.c.d.
+		asm.StoreImm(asm.RFP, key+10, 0xffff, asm.Half),
+		asm.StoreImm(asm.RFP, key+16+10, 0xffff, asm.Half),
+	)
+	insns = append(insns, load(12, 12, 4)...)
+	insns = append(insns, load(16, 16+12, 4)...)
+	insns = append(insns, asm.Ja.Label("update"))
+	// IPv6 source and destination lie next to each other from 8.
+	ipv6 := load(8, 0, 32)
+	ipv6[0] = ipv6[0].WithSymbol("ipv6")
+	insns = append(insns, ipv6...)
+	insns = append(insns, ebpfAddToPair(pairs)...)
+	return append(insns,
+		asm.Mov.Imm(asm.R0, 1).WithSymbol("out"),
+		asm.Return(),
+	)
+}
+
+func newPairMap(maxPairs int) (*ebpf.Map, error) {
+	pairs, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       ebpf.Hash,
+		KeySize:    40,
+		ValueSize:  8,
+		MaxEntries: uint32(maxPairs),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating map: %w", err)
+	}
+	return pairs, nil
+}
+
+func newEBPFCapture(iface string, maxPairs int, filter cidrFilter) (*ebpfCapture, error) {
+	pairs, err := newPairMap(maxPairs)
+	if err != nil {
+		return nil, err
+	}
+	program, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:         ebpf.SocketFilter,
+		License:      "GPL",
+		Instructions: ebpfInstructions(pairs),
+	})
+	if err != nil {
+		pairs.Close()
+		return nil, fmt.Errorf("loading program: %w", err)
+	}
+
+	// A datagram packet socket starts packets at the network header, so the
+	// filter works the same on Ethernet, tunnel and WireGuard interfaces.
+	socket, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM, int(htons(unix.ETH_P_ALL)))
+	if err == nil && iface != "" {
+		var ifi *net.Interface
+		if ifi, err = net.InterfaceByName(iface); err == nil {
+			err = unix.Bind(socket, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: ifi.Index})
+		}
+	}
+	if err == nil {
+		err = unix.SetsockoptInt(socket, unix.SOL_SOCKET, unix.SO_ATTACH_BPF, program.FD())
+	}
+	if err != nil {
+		if socket > 0 {
+			unix.Close(socket)
+		}
+		program.Close()
+		pairs.Close()
+		return nil, fmt.Errorf("attaching socket filter: %w", err)
+	}
+	return &ebpfCapture{socket: socket, pairs: pairs, program: program, filter: filter, previous: make(map[ebpfPairKey]uint64)}, nil
+}
+
+// newEBPFContainerCapture counts per container from a cgroup egress hook on
+// cgroupRoot, the host's cgroup v2 hierarchy. Only packets sent by local
+// sockets pass it, so traffic the node forwards is not counted.
+func newEBPFContainerCapture(cgroupRoot string, maxPairs int, filter cidrFilter) (*ebpfCapture, error) {
+	pairs, err := newPairMap(maxPairs)
+	if err != nil {
+		return nil, err
+	}
+	program, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:         ebpf.CGroupSKB,
+		AttachType:   ebpf.AttachCGroupInetEgress,
+		License:      "GPL",
+		Instructions: ebpfCgroupInstructions(pairs),
+	})
+	if err != nil {
+		pairs.Close()
+		return nil, fmt.Errorf("loading program: %w", err)
+	}
+	hook, err := link.AttachCgroup(link.CgroupOptions{Path: cgroupRoot, Attach: ebpf.AttachCGroupInetEgress, Program: program})
+	if err != nil {
+		program.Close()
+		pairs.Close()
+		return nil, fmt.Errorf("attaching to %s: %w", cgroupRoot, err)
+	}
+	return &ebpfCapture{
+		socket:     -1,
+		hook:       hook,
+		pairs:      pairs,
+		program:    program,
+		filter:     filter,
+		previous:   make(map[ebpfPairKey]uint64),
+		containers: &cgroupContainers{root: cgroupRoot},
+	}, nil
+}
+
+// containerIDPattern finds the runtime's container ID in a cgroup name:
+// cri-containerd-<id>.scope, crio-<id>.scope and docker-<id>.scope with
+// the systemd driver, or <id> with the cgroupfs one.
+var containerIDPattern = regexp.MustCompile(`([0-9a-f]{64})(\.scope)?$`)
+
+// cgroupContainers maps cgroup IDs, the inode numbers of cgroup v2
+// directories, to the IDs of the containers they hold.
+type cgroupContainers struct {
+	root string
+	ids  map[uint64]string
+}
+
+// scan walks the hierarchy again, for cgroups created since the last scan.
+func (c *cgroupContainers) scan() error {
+	ids := make(map[uint64]string)
+	err := filepath.WalkDir(c.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Cgroups vanish as containers stop.
+			return fs.SkipDir
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			if match := containerIDPattern.FindStringSubmatch(entry.Name()); match != nil {
+				ids[stat.Ino] = match[1]
+			} else {
+				ids[stat.Ino] = ""
+			}
+		}
+		return nil
+	})
+	c.ids = ids
+	return err
+}
+
+// lookup returns the container ID of cgroup, empty for cgroups that hold
+// no container, such as host services. rescan allows a scan for a cgroup
+// not seen before.
+func (c *cgroupContainers) lookup(cgroup uint64, rescan *bool) string {
+	id, ok := c.ids[cgroup]
+	if !ok && *rescan {
+		*rescan = false
+		c.scan()
+		id = c.ids[cgroup]
+	}
+	return id
+}
+
+// collect reports the growth of every counter since the last call. Pairs
+// that stayed idle are removed so the map does not fill up with them.
+func (c *ebpfCapture) collect(at time.Time) ([]NetworkFlow, error) {
+	rescan := true
+	var key ebpfPairKey
+	var total uint64
+	current := make(map[ebpfPairKey]uint64)
+	var idle []ebpfPairKey
+	var docs []NetworkFlow
+	// Cgroups holding no container, and the nested cgroups of one, add up
+	// to one document, as bulkIndex gives them one ID.
+	merged := make(map[[3]string]int)
+	entries := c.pairs.Iterate()
+	for entries.Next(&key, &total) {
+		delta := total
+		if before, ok := c.previous[key]; ok && before <= total {
+			delta = total - before
+		}
+		if delta == 0 {
+			idle = append(idle, key)
+			continue
+		}
+		current[key] = total
+		source := netip.AddrFrom16(key.Source).Unmap().String()
+		destination := netip.AddrFrom16(key.Destination).Unmap().String()
+		if c.filter.match(source, destination) {
+			doc := NetworkFlow{Source: source, Destination: destination, Bytes: int64(delta), Timestamp: at}
+			if c.containers != nil {
+				doc.ContainerID = c.containers.lookup(key.Cgroup, &rescan)
+				id := [3]string{source, destination, doc.ContainerID}
+				if i, ok := merged[id]; ok {
+					docs[i].Bytes += doc.Bytes
+					continue
+				}
+				merged[id] = len(docs)
+			}
+			docs = append(docs, doc)
+		}
+	}
+	if err := entries.Err(); err != nil {
+		return nil, err
+	}
+	for _, key := range idle {
+		c.pairs.Delete(key)
+	}
+	c.previous = current
+	return docs, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestCgroupContainers(t *testing.T) {
+	root := t.TempDir()
+	containerd := strings.Repeat("a", 64)
+	crio := strings.Repeat("b", 64)
+	cgroupfs := strings.Repeat("c", 64)
+	dirs := map[string]string{
+		"kubepods.slice/kubepods-pod1.slice/cri-containerd-" + containerd + ".scope": containerd,
+		"kubepods.slice/kubepods-pod2.slice/crio-" + crio + ".scope":                 crio,
+		"kubepods/besteffort/pod3/" + cgroupfs:                                       cgroupfs,
+		"system.slice/kubelet.service":                                               "",
+		"kubepods.slice/kubepods-pod1.slice":                                         "",
+	}
+	for dir := range dirs {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inode := func(dir string) uint64 {
+		info, err := os.Stat(filepath.Join(root, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Sys().(*syscall.Stat_t).Ino
+	}
+
+	containers := &cgroupContainers{root: root}
+	for dir, want := range dirs {
+		rescan := true
+		if got := containers.lookup(inode(dir), &rescan); got != want {
+			t.Errorf("container of %s = %q, want %q", dir, got, want)
+		}
+	}
+
+	// A container started since the last scan is found by one rescan per
+	// collection.
+	started := strings.Repeat("d", 64)
+	dir := "kubepods.slice/kubepods-pod4.slice/cri-containerd-" + started + ".scope"
+	if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	rescan := false
+	if got := containers.lookup(inode(dir), &rescan); got != "" {
+		t.Errorf("found %q without a rescan", got)
+	}
+	rescan = true
+	if got := containers.lookup(inode(dir), &rescan); got != started {
+		t.Errorf("container after a rescan = %q, want %q", got, started)
+	}
+	if rescan {
+		t.Error("lookup did not use up the rescan")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+func newEBPFCapture(iface string, maxPairs int, filter cidrFilter) (agentCapture, error) {
+	return nil, fmt.Errorf("eBPF capture needs Linux")
+}
+
+func newEBPFContainerCapture(cgroupRoot string, maxPairs int, filter cidrFilter) (agentCapture, error) {
+	return nil, fmt.Errorf("eBPF capture needs Linux")
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+)
+
+// bundleStrength is how closely bundled chords follow the group hierarchy,
+// from 0 for straight lines to 1 for fully merged bundles.
+const bundleStrength = 0.85
+
+// BundledDiagram draws a flow matrix as a circle of nodes arranged by group,
+// with chords routed through their groups' hubs so chords between the same
+// two groups merge into one bundle instead of each taking its own curve.
+type BundledDiagram struct {
+	Flow   [][]float64
+	Labels []string
+	// Groups names each node's group, and Order is the nodes in the order
+	// they sit around the circle, by group.
+	Groups []string
+	Order  []int
+	Color  func(i, j int) color.Color
+	Theme  chordTheme
+	// ResolvedBy names the resolver behind each label, for SVG tooltips.
+	ResolvedBy map[string]string
+	// Anomalies are the pairs, by label, drawn in red because they stray
+	// from the learned baseline.
+	Anomalies map[[2]string]anomaly
+}
+
+// bundledPlot lays out matrix as a chord diagram with hierarchical edge
+// bundling, grouping nodes by namespace, or by subnet when unlabelled.
+func bundledPlot(matrix *FlowMatrix, title string, theme chordTheme) *plot.Plot {
+	p := plot.New()
+	p.BackgroundColor = theme.Background
+	p.HideAxes()
+	p.X.Min, p.X.Max = -1, 1
+	p.Y.Min, p.Y.Max = -1, 1
+	p.Title.Text = title
+	p.Title.TextStyle.Font.Size = vg.Points(16)
+	p.Title.TextStyle.Color = theme.Text
+
+	groups := make([]string, len(matrix.Names))
+	order := make([]int, len(matrix.Names))
+	for i, name := range matrix.Names {
+		groups[i] = nodeGroup(name)
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return groups[order[a]] < groups[order[b]] })
+
+	// Chords take their source group's colour, so bundles read as flows
+	// out of a group.
+	numbers := make(map[string]int)
+	for _, i := range order {
+		if _, ok := numbers[groups[i]]; !ok {
+			numbers[groups[i]] = len(numbers)
+		}
+	}
+	p.Add(BundledDiagram{
+		Flow:   matrix.Flow,
+		Labels: matrix.Names,
+		Groups: groups,
+		Order:  order,
+		Color: func(i, j int) color.Color {
+			group := numbers[groups[i]]
+			if theme.Dashes != nil {
+				return color.Gray{Y: uint8(37 * group % 160)}
+			}
+			return color.RGBA{R: uint8(60 * group), G: uint8(110 + 40*group), B: 255, A: 160}
+		},
+		Theme:      theme,
+		ResolvedBy: matrix.resolvedBy,
+		Anomalies:  matrix.anomalies,
+	})
+	return p
+}
+
+// nodeGroup is the namespace of a label such as kube-system/coredns, the
+// /24 or /64 subnet of an unlabelled address, and "other" for the rest.
+func nodeGroup(label string) string {
+	if namespace, _, found := strings.Cut(label, "/"); found {
+		return namespace
+	}
+	addr, err := netip.ParseAddr(label)
+	if err != nil {
+		return "other"
+	}
+	bits := 24
+	if addr.Is6() && !addr.Is4In6() {
+		bits = 64
+	}
+	prefix, _ := addr.Unmap().Prefix(bits)
+	return prefix.String()
+}
+
+func (b BundledDiagram) Plot(canvas draw.Canvas, plt *plot.Plot) {
+	origin := vg.Point{X: canvas.Min.X + canvas.Size().X/2, Y: canvas.Min.Y + canvas.Size().Y/2}
+	radius := vg.Length(math.Min(float64(canvas.Size().X), float64(canvas.Size().Y)) * 0.35)
+	n := len(b.Flow)
+	if n == 0 {
+		return
+	}
+
+	// Nodes sit around the circle by group, with a gap of one node
+	// between groups.
+	var gaps int
+	for k := 1; k < n; k++ {
+		if b.Groups[b.Order[k]] != b.Groups[b.Order[k-1]] {
+			gaps++
+		}
+	}
+	if gaps > 0 {
+		gaps++
+	}
+	step := 2 * math.Pi / float64(n+gaps)
+	angles := make([]float64, n)
+	slot := 0
+	for k, i := range b.Order {
+		if k > 0 && b.Groups[i] != b.Groups[b.Order[k-1]] {
+			slot++
+		}
+		angles[i] = float64(slot) * step
+		slot++
+	}
+
+	// Each group's hub sits halfway to the centre at the middle of its arc.
+	type span struct{ from, to float64 }
+	spans := make(map[string]span)
+	for _, i := range b.Order {
+		s, ok := spans[b.Groups[i]]
+		if !ok {
+			s = span{angles[i], angles[i]}
+		}
+		s.to = angles[i]
+		spans[b.Groups[i]] = s
+	}
+	hubs := make(map[string]vg.Point)
+	for group, s := range spans {
+		hubs[group] = pointOnCircle(origin, radius/2, (s.from+s.to)/2)
+	}
+
+	maxFlow := 0.0
+	for i := range b.Flow {
+		for j := range b.Flow[i] {
+			maxFlow = math.Max(maxFlow, b.Flow[i][j])
+		}
+	}
+	for i := range b.Flow {
+		for j := range b.Flow[i] {
+			if b.Flow[i][j] <= 0 || i == j {
+				continue
+			}
+			weight := b.Flow[i][j] / maxFlow
+			var found anomaly
+			var anomalous bool
+			if b.Labels != nil {
+				found, anomalous = b.Anomalies[[2]string{b.Labels[i], b.Labels[j]}]
+				tip := chordTooltip{
+					title: fmt.Sprintf("%s → %s: %.1f MB", b.Labels[i], b.Labels[j], b.Flow[i][j]/1024/1024),
+					data:  []string{"source", b.Labels[i], "destination", b.Labels[j], "bytes", fmt.Sprintf("%.0f", b.Flow[i][j])},
+				}
+				if anomalous {
+					tip.title += fmt.Sprintf(" (%+.0f%% from baseline)", found.Percent)
+					tip.data = append(tip.data, "anomaly", fmt.Sprintf("%.1f", found.ZScore))
+				}
+				annotate(canvas, tip)
+			}
+
+			// Route through the shared group hub, or through both hubs and
+			// the centre between groups.
+			start, end := pointOnCircle(origin, radius, angles[i]), pointOnCircle(origin, radius, angles[j])
+			route := []vg.Point{start, hubs[b.Groups[i]], end}
+			if b.Groups[i] != b.Groups[j] {
+				route = []vg.Point{start, hubs[b.Groups[i]], origin, hubs[b.Groups[j]], end}
+			}
+
+			style := draw.LineStyle{Color: b.Color(i, j), Width: vg.Points(0.5 + 3*weight)}
+			if b.Theme.Dashes != nil {
+				style.Dashes = b.Theme.Dashes[i%len(b.Theme.Dashes)]
+			}
+			if anomalous {
+				// Solid, so the highlight survives grayscale printing.
+				style = draw.LineStyle{Color: anomalyColor, Width: vg.Points(1 + 3*weight)}
+			}
+			canvas.SetLineStyle(style)
+			canvas.Stroke(bundlePath(route))
+		}
+	}
+	canvas.SetLineDash(nil, 0)
+
+	labelFont := plot.DefaultFont
+	labelFont.Size = vg.Points(10)
+	labelStyle := draw.TextStyle{
+		Color:   b.Theme.Text,
+		Font:    labelFont,
+		Handler: plot.DefaultTextHandler,
+		YAlign:  draw.YCenter,
+	}
+	for i := 0; i < n; i++ {
+		var arc vg.Path
+		arc.Move(pointOnCircle(origin, radius, angles[i]-step/3))
+		arc.Arc(origin, radius, angles[i]-step/3, 2*step/3)
+		canvas.SetLineStyle(draw.LineStyle{Color: b.Theme.Arc, Width: vg.Points(3)})
+		if b.Labels != nil {
+			annotate(canvas, ChordDiagram{Flow: b.Flow, Labels: b.Labels, ResolvedBy: b.ResolvedBy}.nodeTooltip(i))
+		}
+		canvas.Stroke(arc)
+
+		if b.Labels != nil {
+			drawRadialLabel(canvas, labelStyle, b.Theme.LabelBackground, origin, radius*1.03, angles[i], b.Labels[i])
+		}
+	}
+
+	// Group names go outside their nodes' labels, along an arc spanning
+	// the group.
+	groupFont := plot.DefaultFont
+	groupFont.Size = vg.Points(12)
+	groupStyle := draw.TextStyle{
+		Color:   b.Theme.Text,
+		Font:    groupFont,
+		Handler: plot.DefaultTextHandler,
+		XAlign:  draw.XCenter,
+		YAlign:  draw.YCenter,
+	}
+	outer := radius * 1.35
+	for group, s := range spans {
+		var arc vg.Path
+		arc.Move(pointOnCircle(origin, outer, s.from-step/3))
+		arc.Arc(origin, outer, s.from-step/3, s.to-s.from+2*step/3)
+		canvas.SetLineStyle(draw.LineStyle{Color: b.Theme.Arc, Width: vg.Points(1)})
+		canvas.Stroke(arc)
+
+		// Along the arc, turned over on the bottom half to stay upright.
+		middle := (s.from + s.to) / 2
+		groupStyle.Rotation = middle - math.Pi/2
+		if middle > math.Pi {
+			groupStyle.Rotation += math.Pi
+		}
+		canvas.FillText(groupStyle, pointOnCircle(origin, outer+vg.Points(10), middle), group)
+	}
+}
+
+// drawRadialLabel writes text outward from the circle at angle, flipped on
+// the left half so it never reads upside down.
+func drawRadialLabel(canvas draw.Canvas, style draw.TextStyle, background color.Color, origin vg.Point, radius vg.Length, angle float64, text string) {
+	style.Rotation = angle
+	style.XAlign = draw.XLeft
+	if angle > math.Pi/2 && angle < 3*math.Pi/2 {
+		style.Rotation += math.Pi
+		style.XAlign = draw.XRight
+	}
+	at := pointOnCircle(origin, radius, angle)
+	behind := style
+	behind.Color = background
+	canvas.FillText(behind, at, text)
+	canvas.FillText(style, at, text)
+}
+
+// bundlePath draws a cubic B-spline along route, first pulled
+// bundleStrength of the way from the straight line between its ends.
+// Repeating the ends makes the curve start and end on them.
+func bundlePath(route []vg.Point) vg.Path {
+	last := len(route) - 1
+	points := make([]vg.Point, 0, len(route)+4)
+	for k, p := range route {
+		t := float64(k) / float64(last)
+		straight := vg.Point{
+			X: route[0].X + vg.Length(t)*(route[last].X-route[0].X),
+			Y: route[0].Y + vg.Length(t)*(route[last].Y-route[0].Y),
+		}
+		p = vg.Point{
+			X: vg.Length(bundleStrength)*p.X + vg.Length(1-bundleStrength)*straight.X,
+			Y: vg.Length(bundleStrength)*p.Y + vg.Length(1-bundleStrength)*straight.Y,
+		}
+		if k == 0 || k == last {
+			points = append(points, p, p)
+		}
+		points = append(points, p)
+	}
+
+	// Each run of four control points is one Bézier segment.
+	var path vg.Path
+	for k := 0; k+3 < len(points); k++ {
+		p0, p1, p2, p3 := points[k], points[k+1], points[k+2], points[k+3]
+		if k == 0 {
+			path.Move(vg.Point{X: (p0.X + 4*p1.X + p2.X) / 6, Y: (p0.Y + 4*p1.Y + p2.Y) / 6})
+		}
+		path.CubeTo(
+			vg.Point{X: (2*p1.X + p2.X) / 3, Y: (2*p1.Y + p2.Y) / 3},
+			vg.Point{X: (p1.X + 2*p2.X) / 3, Y: (p1.Y + 2*p2.Y) / 3},
+			vg.Point{X: (p1.X + 4*p2.X + p3.X) / 6, Y: (p1.Y + 4*p2.Y + p3.Y) / 6},
+		)
+	}
+	return path
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+const termsSize = 100
+
+// flowIDsSize bounds the flows per pair whose interim exports are
+// deduplicated by flow.id. The exports of the flows past it are left out of
+// the pair's bytes and counted as omitted in the query's coverage.
+const flowIDsSize = 1000
+
+func cidrToRange(cidr string) (string, string, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid CIDR notation: %s", cidr)
+	}
+
+	network := ipNet.IP
+	broadcast := make(net.IP, len(network))
+	copy(broadcast, network)
+	for i := range broadcast {
+		broadcast[i] |= ^ipNet.Mask[i]
+	}
+
+	return network.String(), broadcast.String(), nil
+}
+
+func newElasticClient(cfg ElasticsearchConfig) (*elasticsearch.Client, error) {
+	creds, err := resolveCredentials(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("resolving credentials: %w", err)
+	}
+	tlsConfig, err := cfg.TLS.build()
+	if err != nil {
+		return nil, fmt.Errorf("configuring TLS: %w", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return elasticsearch.NewClient(elasticsearch.Config{
+		Transport:    transport,
+		Addresses:    cfg.Addresses,
+		Username:     creds.Username,
+		Password:     creds.Password,
+		APIKey:       creds.APIKey,
+		ServiceToken: creds.ServiceToken,
+	})
+}
+
+func (cfg TLSConfig) build() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+
+	if cfg.CAFile != "" {
+		ca, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("%s: no certificates found", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func networkCondition(networkFilters []string) (map[string]interface{}, error) {
+	var networkConditions []map[string]interface{}
+	for _, cidr := range networkFilters {
+		networkStart, networkEnd, err := cidrToRange(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		networkConditions = append(networkConditions,
+			map[string]interface{}{
+				"bool": map[string]interface{}{
+					"must": []map[string]interface{}{
+						{
+							"range": map[string]interface{}{
+								"source.ip": map[string]interface{}{
+									"gte": networkStart,
+									"lte": networkEnd,
+								},
+							},
+						},
+						{
+							"range": map[string]interface{}{
+								"destination.ip": map[string]interface{}{
+									"gte": networkStart,
+									"lte": networkEnd,
+								},
+							},
+						},
+					},
+				},
+			},
+		)
+	}
+	// A pair matches when both ends fall inside any one of the networks,
+	// as with cidrFilter for the other sources.
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"should":               networkConditions,
+			"minimum_should_match": 1,
+		},
+	}, nil
+}
+
+func timeRangeCondition(bounds map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"range": map[string]interface{}{
+			"@timestamp": bounds,
+		},
+	}
+}
+
+func flowConditions(networkFilters []string, timeRange map[string]interface{}) ([]map[string]interface{}, error) {
+	var conditions []map[string]interface{}
+	if len(networkFilters) > 0 {
+		condition, err := networkCondition(networkFilters)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+	return append(conditions, timeRange), nil
+}
+
+func pairAggs(from time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"source_nodes": map[string]interface{}{
+			"terms": map[string]interface{}{
+				"field": "source.ip",
+				"size":  termsSize,
+			},
+			"aggs": map[string]interface{}{
+				"destinations": map[string]interface{}{
+					"terms": map[string]interface{}{
+						"field": "destination.ip",
+						"size":  termsSize,
+					},
+					"aggs": pairBytesAggs(from),
+				},
+			},
+		},
+	}
+}
+
+// pairBytesAggs totals a pair's bytes over a range starting at from.
+// Filebeat indexes every export of a netflow record: delta counts add up,
+// but exporters sending total counts repeat a long flow's running total in
+// each interim update, and summing them counts its early bytes again and
+// again. Those records are keyed on flow.id instead: a flow that started in
+// the range counts its largest total, and one already running counts how
+// much its total grew.
+//
+// That is an estimate. A running flow's growth is measured from its first
+// export in the range, so the bytes it sent between from and that export
+// are missed, up to an active timeout's worth per flow. Only the flowIDsSize
+// flows with the most exports are kept per pair; decodePairs reports the
+// rest as omitted documents rather than summing their repeated totals.
+func pairBytesAggs(from time.Time) map[string]interface{} {
+	cumulative := map[string]interface{}{
+		"bool": map[string]interface{}{
+			"must":     map[string]interface{}{"exists": map[string]interface{}{"field": "netflow.octet_total_count"}},
+			"must_not": map[string]interface{}{"exists": map[string]interface{}{"field": "netflow.octet_delta_count"}},
+		},
+	}
+	return map[string]interface{}{
+		"deltas": map[string]interface{}{
+			"filter": map[string]interface{}{"bool": map[string]interface{}{"must_not": cumulative}},
+			"aggs": map[string]interface{}{
+				"bytes": map[string]interface{}{"sum": map[string]interface{}{"field": "network.bytes"}},
+			},
+		},
+		"totals": map[string]interface{}{
+			"filter": cumulative,
+			"aggs": map[string]interface{}{
+				"flows": map[string]interface{}{
+					"terms": map[string]interface{}{"field": "flow.id", "size": flowIDsSize},
+					"aggs": map[string]interface{}{
+						"first": map[string]interface{}{"min": map[string]interface{}{"field": "netflow.octet_total_count"}},
+						"last":  map[string]interface{}{"max": map[string]interface{}{"field": "netflow.octet_total_count"}},
+						// Flows without a start time count as new.
+						"started": map[string]interface{}{"min": map[string]interface{}{"field": "event.start", "missing": from.UnixMilli()}},
+						"bytes": map[string]interface{}{
+							"bucket_script": map[string]interface{}{
+								"buckets_path": map[string]interface{}{"first": "first", "last": "last", "started": "started"},
+								"script": map[string]interface{}{
+									"source": "params.started >= params.from ? params.last : params.last - params.first",
+									"params": map[string]interface{}{"from": from.UnixMilli()},
+								},
+							},
+						},
+					},
+				},
+				"bytes": map[string]interface{}{"sum_bucket": map[string]interface{}{"buckets_path": "flows>bytes"}},
+			},
+		},
+		// Rollup documents carry the flow records they stand for; raw ones
+		// are one each.
+		"flows": map[string]interface{}{"sum": map[string]interface{}{"field": "flow.count", "missing": 1}},
+		"bytes": map[string]interface{}{
+			"bucket_script": map[string]interface{}{
+				"buckets_path": map[string]interface{}{"deltas": "deltas>bytes", "totals": "totals>bytes"},
+				"script":       "params.deltas + params.totals",
+			},
+		},
+	}
+}
+
+func search(ctx context.Context, es *elasticsearch.Client, index string, query map[string]interface{}) (map[string]interface{}, error) {
+	var result map[string]interface{}
+	err := searchStream(ctx, es, index, query, func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(&result)
+	})
+	return result, err
+}
+
+// searchStream runs query and hands the response body to decode, for
+// responses too large to hold as nested maps.
+func searchStream(ctx context.Context, es *elasticsearch.Client, index string, query map[string]interface{}, decode func(body io.Reader) error) error {
+	queryJSON, err := json.Marshal(query)
+	if err != nil {
+		return err
+	}
+	res, err := es.Search(
+		es.Search.WithContext(ctx),
+		es.Search.WithIndex(index),
+		es.Search.WithBody(bytes.NewReader(queryJSON)),
+		es.Search.WithSize(0),
+	)
+	if err != nil {
+		return fmt.Errorf("error getting response: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("search %s: %s", index, res.String())
+	}
+
+	if err := decode(res.Body); err != nil {
+		return fmt.Errorf("error parsing response: %w", err)
+	}
+	return nil
+}
+
+// lagHorizon bounds the search for the newest flow, so an index that has
+// stopped receiving data does not make IngestLag scan all of it.
+const lagHorizon = 7 * 24 * time.Hour
+
+func (s *elasticSource) IngestLag(ctx context.Context, now time.Time) (time.Duration, error) {
+	query := map[string]interface{}{
+		"size": 0,
+		"query": timeRangeCondition(map[string]interface{}{
+			"gte": now.Add(-lagHorizon).Format(time.RFC3339),
+			"lte": now.Format(time.RFC3339),
+		}),
+		"aggs": map[string]interface{}{
+			"newest": map[string]interface{}{
+				"max": map[string]interface{}{"field": "@timestamp"},
+			},
+		},
+	}
+	result, err := search(ctx, s.es, s.index, query)
+	if err != nil {
+		return 0, err
+	}
+	newest, ok := result["aggregations"].(map[string]interface{})["newest"].(map[string]interface{})["value"].(float64)
+	if !ok {
+		return 0, fmt.Errorf("no flows in %s since %s", s.index, now.Add(-lagHorizon).Format(time.RFC3339))
+	}
+	lag := now.Sub(time.UnixMilli(int64(newest)))
+	return max(lag, 0), nil
+}
+
+func eachPair(aggs map[string]interface{}, fn func(source, destination string, bytes, flows float64)) {
+	buckets := aggs["source_nodes"].(map[string]interface{})["buckets"].([]interface{})
+	for _, bucket := range buckets {
+		b := bucket.(map[string]interface{})
+		sourceIP := b["key"].(string)
+
+		destBuckets := b["destinations"].(map[string]interface{})["buckets"].([]interface{})
+		for _, destBucket := range destBuckets {
+			d := destBucket.(map[string]interface{})
+			destIP := d["key"].(string)
+			bytes := d["bytes"].(map[string]interface{})["value"].(float64)
+			flows, _ := d["flows"].(map[string]interface{})["value"].(float64)
+			fn(sourceIP, destIP, bytes, flows)
+		}
+	}
+}
+
+// fetchFlowMatrix totals the flows matching conditions, whose time range
+// is [from, to), and records the query in the matrix for the manifest.
+func fetchFlowMatrix(ctx context.Context, es *elasticsearch.Client, index string, conditions []map[string]interface{}, from, to time.Time) (*FlowMatrix, error) {
+	query := map[string]interface{}{
+		"size": 0,
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": conditions,
+			},
+		},
+		"aggs": pairAggs(from),
+	}
+
+	data, err := json.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+
+	matrix := NewFlowMatrix()
+	matrix.queries = []SourceQuery{{Index: index, From: from.UTC(), To: to.UTC(), SHA256: hex.EncodeToString(sum[:])}}
+	err = searchStream(ctx, es, index, query, func(body io.Reader) error {
+		return decodePairs(json.NewDecoder(body), &matrix.coverage, func(source, destination string, bytes, flows float64) {
+			matrix.Add(source, destination, bytes)
+			matrix.addFlows(source, destination, flows)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return matrix, nil
+}
+
+// decodePairs walks the pairAggs buckets of a search response token by
+// token, holding only one source bucket's destinations at a time. It adds
+// the shards that answered and the documents truncated buckets left out,
+// including the exports of flows past flowIDsSize, to coverage.
+func decodePairs(dec *json.Decoder, coverage *queryCoverage, fn func(source, destination string, bytes, flows float64)) error {
+	type destinationBucket struct {
+		Key   string `json:"key"`
+		Bytes struct {
+			Value float64 `json:"value"`
+		} `json:"bytes"`
+		Flows struct {
+			Value float64 `json:"value"`
+		} `json:"flows"`
+		Totals struct {
+			Flows struct {
+				Other float64 `json:"sum_other_doc_count"`
+			} `json:"flows"`
+		} `json:"totals"`
+	}
+	return decodeObject(dec, func(key string) error {
+		switch key {
+		case "_shards":
+			var shards struct {
+				Total  int `json:"total"`
+				Failed int `json:"failed"`
+			}
+			if err := dec.Decode(&shards); err != nil {
+				return err
+			}
+			coverage.Shards += shards.Total
+			coverage.FailedShards += shards.Failed
+			return nil
+		case "aggregations":
+		default:
+			return skipValue(dec)
+		}
+		return decodeObject(dec, func(key string) error {
+			if key != "source_nodes" {
+				return skipValue(dec)
+			}
+			var otherSources float64
+			err := decodeBuckets(dec, &otherSources, func() error {
+				var source string
+				var docs, otherDestinations float64
+				var destinations []destinationBucket
+				err := decodeObject(dec, func(key string) error {
+					switch key {
+					case "key":
+						return dec.Decode(&source)
+					case "doc_count":
+						return dec.Decode(&docs)
+					case "destinations":
+						return decodeBuckets(dec, &otherDestinations, func() error {
+							var bucket destinationBucket
+							if err := dec.Decode(&bucket); err != nil {
+								return err
+							}
+							destinations = append(destinations, bucket)
+							return nil
+						})
+					default:
+						return skipValue(dec)
+					}
+				})
+				for _, destination := range destinations {
+					fn(source, destination.Key, destination.Bytes.Value, destination.Flows.Value)
+					otherDestinations += destination.Totals.Flows.Other
+				}
+				coverage.Docs += docs
+				coverage.OmittedDocs += otherDestinations
+				return err
+			})
+			coverage.Docs += otherSources
+			coverage.OmittedDocs += otherSources
+			return err
+		})
+	})
+}
+
+// decodeObject reads a JSON object from dec, calling field for each key to
+// consume its value.
+func decodeObject(dec *json.Decoder, field func(key string) error) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if err := field(token.(string)); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// decodeBuckets reads a bucket aggregation from dec, calling bucket to
+// consume each of its buckets and adding the documents of the buckets a
+// terms aggregation left out to other.
+func decodeBuckets(dec *json.Decoder, other *float64, bucket func() error) error {
+	return decodeObject(dec, func(key string) error {
+		switch key {
+		case "buckets":
+		case "sum_other_doc_count":
+			var docs float64
+			if err := dec.Decode(&docs); err != nil {
+				return err
+			}
+			*other += docs
+			return nil
+		default:
+			return skipValue(dec)
+		}
+		if err := expectDelim(dec, '['); err != nil {
+			return err
+		}
+		for dec.More() {
+			if err := bucket(); err != nil {
+				return err
+			}
+		}
+		return expectDelim(dec, ']')
+	})
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("expected %s, got %v", delim, token)
+	}
+	return nil
+}
+
+// skipValue consumes the next value from dec without keeping it.
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// matchesQuery evaluates the bool and range clauses networkCondition builds
+// against a flow between source and destination.
+func matchesQuery(t *testing.T, query map[string]interface{}, doc map[string]netip.Addr) bool {
+	t.Helper()
+	if clause, ok := query["range"].(map[string]interface{}); ok {
+		for field, bounds := range clause {
+			b := bounds.(map[string]interface{})
+			low := netip.MustParseAddr(b["gte"].(string))
+			high := netip.MustParseAddr(b["lte"].(string))
+			addr := doc[field]
+			if addr.Compare(low) < 0 || addr.Compare(high) > 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	clause := query["bool"].(map[string]interface{})
+	if must, ok := clause["must"].([]interface{}); ok {
+		for _, q := range must {
+			if !matchesQuery(t, q.(map[string]interface{}), doc) {
+				return false
+			}
+		}
+	}
+	if should, ok := clause["should"].([]interface{}); ok && len(should) > 0 {
+		var matched int
+		for _, q := range should {
+			if matchesQuery(t, q.(map[string]interface{}), doc) {
+				matched++
+			}
+		}
+		if minimum, _ := clause["minimum_should_match"].(float64); float64(matched) < minimum {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNetworkConditionMatchesCIDRFilter(t *testing.T) {
+	networks := []string{"10.0.0.0/8", "192.168.0.0/16"}
+	condition, err := networkCondition(networks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Round-trip through JSON so the query is checked as Elasticsearch
+	// receives it.
+	data, err := json.Marshal(condition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var query map[string]interface{}
+	if err := json.Unmarshal(data, &query); err != nil {
+		t.Fatal(err)
+	}
+	filter, err := parseCIDRFilter(networks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		source, destination string
+		want                bool
+	}{
+		{"10.1.2.3", "10.4.5.6", true},
+		{"192.168.1.1", "192.168.2.2", true},
+		{"10.1.2.3", "192.168.2.2", false},
+		{"10.1.2.3", "8.8.8.8", false},
+		{"172.16.0.1", "172.16.0.2", false},
+	} {
+		doc := map[string]netip.Addr{
+			"source.ip":      netip.MustParseAddr(tc.source),
+			"destination.ip": netip.MustParseAddr(tc.destination),
+		}
+		if got := matchesQuery(t, query, doc); got != tc.want {
+			t.Errorf("Elasticsearch condition on %s -> %s = %v, want %v", tc.source, tc.destination, got, tc.want)
+		}
+		if got := filter.match(tc.source, tc.destination); got != tc.want {
+			t.Errorf("cidrFilter on %s -> %s = %v, want %v", tc.source, tc.destination, got, tc.want)
+		}
+	}
+}
+
+func TestDecodePairsCountsOmittedFlows(t *testing.T) {
+	response := `{
+		"_shards": {"total": 2, "failed": 0},
+		"aggregations": {"source_nodes": {"sum_other_doc_count": 5, "buckets": [
+			{"key": "10.0.0.1", "doc_count": 1200, "destinations": {"sum_other_doc_count": 7, "buckets": [
+				{"key": "10.0.0.2", "doc_count": 1193, "bytes": {"value": 4096}, "flows": {"value": 1193},
+					"totals": {"doc_count": 1100, "flows": {"sum_other_doc_count": 40, "buckets": []}}}
+			]}}
+		]}}
+	}`
+	var coverage queryCoverage
+	var bytes float64
+	err := decodePairs(json.NewDecoder(strings.NewReader(response)), &coverage, func(source, destination string, b, flows float64) {
+		bytes += b
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes != 4096 {
+		t.Errorf("bytes = %v, want 4096", bytes)
+	}
+	want := queryCoverage{Shards: 2, Docs: 1205, OmittedDocs: 5 + 7 + 40}
+	if coverage != want {
+		t.Errorf("coverage = %+v, want %+v", coverage, want)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// EmailConfig mails each rendered output to To.
+type EmailConfig struct {
+	To   []string `yaml:"to" toml:"to"`
+	From string   `yaml:"from" toml:"from"`
+	// Subject defaults to the output title.
+	Subject string `yaml:"subject" toml:"subject"`
+	Host    string `yaml:"host" toml:"host"`
+	// Port 465 uses implicit TLS; other ports upgrade with STARTTLS when
+	// the server offers it.
+	Port     int    `yaml:"port" toml:"port"`
+	Username string `yaml:"username" toml:"username"`
+	// Password falls back to SMTP_PASSWORD.
+	Password string `yaml:"password" toml:"password"`
+	// Summary is how many of the largest pairs to list in the message; 0
+	// sends the attachment alone.
+	Summary int `yaml:"summary" toml:"summary"`
+}
+
+// emailReport sends the output at path with a summary of matrix.
+func emailReport(cfg Config, matrix *FlowMatrix, manifest Manifest, path string) error {
+	attachment, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	subject := cfg.Email.Subject
+	if subject == "" {
+		subject = cfg.Output.Title
+	}
+
+	var message bytes.Buffer
+
+	parts := multipart.NewWriter(&message)
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "From: %s\r\n", cfg.Email.From)
+	fmt.Fprintf(&head, "To: %s\r\n", strings.Join(cfg.Email.To, ", "))
+	fmt.Fprintf(&head, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&head, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&head, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&head, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", parts.Boundary())
+
+	text, err := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return err
+	}
+	io.WriteString(text, reportSummary(matrix, manifest, cfg.Email.Summary))
+
+	name := filepath.Base(path)
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	file, err := parts.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": name})},
+	})
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(attachment)
+	for len(encoded) > 76 {
+		fmt.Fprintf(file, "%s\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	fmt.Fprintf(file, "%s\r\n", encoded)
+	if err := parts.Close(); err != nil {
+		return err
+	}
+
+	return sendMail(cfg.Email, append(head.Bytes(), message.Bytes()...))
+}
+
+// reportSummary describes the window and, with top above 0, lists its
+// largest conversations.
+func reportSummary(matrix *FlowMatrix, manifest Manifest, top int) string {
+	var w bytes.Buffer
+	fmt.Fprintf(&w, "Flows from %s to %s.\n", manifest.From.Format(time.RFC1123), manifest.To.Format(time.RFC1123))
+	if manifest.Completeness != nil {
+		fmt.Fprintf(&w, "Data %.1f%% complete.\n", manifest.Completeness.Score)
+	}
+	if top <= 0 {
+		return w.String()
+	}
+	var total float64
+	for i := range matrix.Flow {
+		for j := range matrix.Flow[i] {
+			total += matrix.Flow[i][j]
+		}
+	}
+	fmt.Fprintf(&w, "\n%d nodes, %.1f MB in total. Largest conversations:\n\n", len(matrix.Names), total/1024/1024)
+	tw := tabwriter.NewWriter(&w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "SOURCE\tDESTINATION\tMB\n")
+	for _, p := range topPairs(matrix, top) {
+		fmt.Fprintf(tw, "%s\t%s\t%.1f\n", p.Source, p.Destination, p.Bytes/1024/1024)
+	}
+	tw.Flush()
+	return w.String()
+}
+
+func sendMail(cfg EmailConfig, message []byte) error {
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		password := cfg.Password
+		if password == "" {
+			password = os.Getenv("SMTP_PASSWORD")
+		}
+		auth = smtp.PlainAuth("", cfg.Username, password, cfg.Host)
+	}
+	if cfg.Port != 465 {
+		return smtp.SendMail(addr, auth, cfg.From, cfg.To, message)
+	}
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: cfg.Host})
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(cfg.From); err != nil {
+		return err
+	}
+	for _, to := range cfg.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
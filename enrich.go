@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnrichmentConfig tunes the lookups that label matrix nodes.
+type EnrichmentConfig struct {
+	// ReverseDNS names addresses Kubernetes does not know by their PTR
+	// record.
+	ReverseDNS    bool          `yaml:"reverseDNS" toml:"reverseDNS"`
+	Workers       int           `yaml:"workers" toml:"workers"`
+	LookupTimeout time.Duration `yaml:"lookupTimeout" toml:"lookupTimeout"`
+	CacheTTL      time.Duration `yaml:"cacheTTL" toml:"cacheTTL"`
+	// NegativeTTL is how long an address without a name, or whose lookup
+	// failed, is not asked about again.
+	NegativeTTL time.Duration `yaml:"negativeTTL" toml:"negativeTTL"`
+	// InventoryTTL is how long long-running modes reuse the Kubernetes
+	// objects before listing them again.
+	InventoryTTL time.Duration `yaml:"inventoryTTL" toml:"inventoryTTL"`
+	// Resolvers enables and orders the resolvers labelling addresses:
+	// kubernetes, dns, geoip and static.
+	Resolvers map[string]ResolverConfig `yaml:"resolvers" toml:"resolvers"`
+	// GeoIPDatabase is a MaxMind City, Country or ASN database.
+	GeoIPDatabase string `yaml:"geoipDatabase" toml:"geoipDatabase"`
+	// StaticLabels names addresses and CIDR ranges, overriding
+	// StaticLabelsFile.
+	StaticLabels map[string]string `yaml:"staticLabels" toml:"staticLabels"`
+	// StaticLabelsFile is a hosts-style file of addresses or CIDR ranges
+	// and names, for infrastructure outside Kubernetes.
+	StaticLabelsFile string `yaml:"staticLabelsFile" toml:"staticLabelsFile"`
+}
+
+// enricher holds the lookup state that outlives one matrix, so repeated
+// renders by the collector reuse it.
+type enricher struct {
+	cfg Config
+
+	mu        sync.Mutex
+	client    *kubeClient
+	inventory kubeInventory
+	loadedAt  time.Time
+
+	dns *dnsCache
+
+	chainOnce sync.Once
+	chain     []chainedResolver
+	chainErr  error
+}
+
+func newEnricher(cfg Config) *enricher {
+	return &enricher{cfg: cfg, dns: newDNSCache(cfg.Enrichment)}
+}
+
+// kubeInventory returns the cluster's objects, listing them at most once per
+// InventoryTTL. Callers get their own copy to merge history into.
+func (e *enricher) kubeInventory(ctx context.Context) (kubeInventory, error) {
+	if e.cfg.Source == "demo" {
+		return demoInventory(), nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.inventory == nil || time.Since(e.loadedAt) >= e.cfg.Enrichment.InventoryTTL {
+		if e.client == nil {
+			client, err := newKubeClient(e.cfg.Kubernetes.Kubeconfig)
+			if err != nil {
+				return nil, fmt.Errorf("creating Kubernetes client: %w", err)
+			}
+			e.client = client
+		}
+		inventory, err := loadKubeInventory(ctx, e.client)
+		if err != nil {
+			return nil, fmt.Errorf("loading Kubernetes objects: %w", err)
+		}
+		e.inventory, e.loadedAt = inventory, time.Now()
+	}
+
+	inventory := make(kubeInventory, len(e.inventory))
+	for ip, endpoints := range e.inventory {
+		inventory[ip] = endpoints[:len(endpoints):len(endpoints)]
+	}
+	return inventory, nil
+}
+
+type dnsEntry struct {
+	name    string
+	expires time.Time
+}
+
+// dnsCache resolves addresses to names with a pool of workers, asking about
+// each address once however often it appears and remembering both answers
+// and misses.
+type dnsCache struct {
+	cfg     EnrichmentConfig
+	lookup  func(ctx context.Context, addr string) ([]string, error)
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+func newDNSCache(cfg EnrichmentConfig) *dnsCache {
+	return &dnsCache{cfg: cfg, lookup: net.DefaultResolver.LookupAddr, entries: make(map[string]dnsEntry)}
+}
+
+// resolve returns the names of those of ips that have one.
+func (c *dnsCache) resolve(ctx context.Context, ips []string) map[string]string {
+	now := time.Now()
+	names := make(map[string]string)
+	var pending []string
+	seen := make(map[string]bool)
+	c.mu.Lock()
+	for _, ip := range ips {
+		if seen[ip] {
+			continue
+		}
+		seen[ip] = true
+		if entry, ok := c.entries[ip]; ok && now.Before(entry.expires) {
+			if entry.name != "" {
+				names[ip] = entry.name
+			}
+			continue
+		}
+		pending = append(pending, ip)
+	}
+	c.mu.Unlock()
+
+	workers := c.cfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(pending); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ip := range work {
+				lookupCtx, cancel := context.WithTimeout(ctx, c.cfg.LookupTimeout)
+				results, err := c.lookup(lookupCtx, ip)
+				cancel()
+
+				entry := dnsEntry{expires: time.Now().Add(c.cfg.NegativeTTL)}
+				if err == nil && len(results) > 0 {
+					entry = dnsEntry{name: strings.TrimSuffix(results[0], "."), expires: time.Now().Add(c.cfg.CacheTTL)}
+				}
+				c.mu.Lock()
+				c.entries[ip] = entry
+				if entry.name != "" {
+					names[ip] = entry.name
+				}
+				c.mu.Unlock()
+			}
+		}()
+	}
+	for _, ip := range pending {
+		work <- ip
+	}
+	close(work)
+	wg.Wait()
+	return names
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type seriesKey struct {
+	source, destination string
+}
+
+type series struct {
+	labels  string
+	bytes   float64
+	updated time.Time
+}
+
+// flowCounters accumulates each pair's bytes across queries into
+// Prometheus counters.
+type flowCounters struct {
+	mu          sync.Mutex
+	series      map[seriesKey]*series
+	refreshedAt time.Time
+	lag         time.Duration
+	errors      uint64
+}
+
+// add counts one query's matrix. Series idle for longer than ttl are
+// dropped so churning pods do not grow the exposition without bound.
+func (c *flowCounters) add(matrix *FlowMatrix, nodes []apiNode, lag time.Duration, ttl time.Duration) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, source := range matrix.Names {
+		for j, destination := range matrix.Names {
+			if matrix.Flow[i][j] <= 0 {
+				continue
+			}
+			key := seriesKey{source, destination}
+			s, ok := c.series[key]
+			if !ok {
+				s = &series{labels: seriesLabels(nodes[i], nodes[j])}
+				c.series[key] = s
+			}
+			s.bytes += matrix.Flow[i][j]
+			s.updated = now
+		}
+	}
+	for key, s := range c.series {
+		if ttl > 0 && now.Sub(s.updated) > ttl {
+			delete(c.series, key)
+		}
+	}
+	c.refreshedAt, c.lag = now, lag
+}
+
+func seriesLabels(source, destination apiNode) string {
+	labels := []string{
+		`source="` + escapeLabel(source.Name) + `"`,
+		`destination="` + escapeLabel(destination.Name) + `"`,
+	}
+	if source.Namespace != "" {
+		labels = append(labels, `source_namespace="`+escapeLabel(source.Namespace)+`"`, `source_kind="`+source.Kind+`"`)
+	}
+	if destination.Namespace != "" {
+		labels = append(labels, `destination_namespace="`+escapeLabel(destination.Namespace)+`"`, `destination_kind="`+destination.Kind+`"`)
+	}
+	if source.Resolver != "" {
+		labels = append(labels, `source_resolver="`+source.Resolver+`"`)
+	}
+	if destination.Resolver != "" {
+		labels = append(labels, `destination_resolver="`+destination.Resolver+`"`)
+	}
+	return strings.Join(labels, ",")
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func (c *flowCounters) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var out bytes.Buffer
+	c.mu.Lock()
+	lines := make([]string, 0, len(c.series))
+	for _, s := range c.series {
+		lines = append(lines, fmt.Sprintf("kube_netflow_bytes_total{%s} %g\n", s.labels, s.bytes))
+	}
+	fmt.Fprintf(&out, "# HELP kube_netflow_query_errors_total Aggregation queries that failed.\n")
+	fmt.Fprintf(&out, "# TYPE kube_netflow_query_errors_total counter\n")
+	fmt.Fprintf(&out, "kube_netflow_query_errors_total %d\n", c.errors)
+	if !c.refreshedAt.IsZero() {
+		fmt.Fprintf(&out, "# HELP kube_netflow_last_refresh_timestamp_seconds When the last aggregation query succeeded.\n")
+		fmt.Fprintf(&out, "# TYPE kube_netflow_last_refresh_timestamp_seconds gauge\n")
+		fmt.Fprintf(&out, "kube_netflow_last_refresh_timestamp_seconds %d\n", c.refreshedAt.Unix())
+		fmt.Fprintf(&out, "# HELP kube_netflow_ingest_lag_seconds How far the source's newest data trailed the last query.\n")
+		fmt.Fprintf(&out, "# TYPE kube_netflow_ingest_lag_seconds gauge\n")
+		fmt.Fprintf(&out, "kube_netflow_ingest_lag_seconds %g\n", c.lag.Seconds())
+	}
+	c.mu.Unlock()
+
+	sort.Strings(lines)
+	fmt.Fprintf(&out, "# HELP kube_netflow_bytes_total Bytes sent from source to destination.\n")
+	fmt.Fprintf(&out, "# TYPE kube_netflow_bytes_total counter\n")
+	for _, line := range lines {
+		out.WriteString(line)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(out.Bytes())
+}
+
+func runExporter(args []string) {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		log.Fatalf("Error loading config: %s", err)
+	}
+
+	fs := flag.NewFlagSet("exporter", flag.ExitOnError)
+	fs.String("config", "", "YAML or TOML configuration file; flags override its values")
+	listenPtr := fs.String("listen", ":9101", "Address to serve /metrics on")
+	intervalPtr := fs.Duration("interval", time.Minute, "How often to query the source for the flows since the last query")
+	ttlPtr := fs.Duration("series-ttl", time.Hour, "Drop pairs that have not carried traffic for this long (0 to keep all)")
+	fs.StringVar(&cfg.Source, "source", cfg.Source, "Flow data source")
+	fs.Var((*stringList)(&cfg.Network), "network", "Network CIDR filter (e.g., '10.0.0.0/8,192.168.0.0/16')")
+	fs.BoolVar(&cfg.ShiftLag, "shift-lag", cfg.ShiftLag, "Query up to the newest indexed flow when ingestion lags behind now")
+	fs.BoolVar(&cfg.Kubernetes.Labels, "kube-labels", cfg.Kubernetes.Labels, "Label IPs with Kubernetes pod, service, or node names and add namespace labels")
+	fs.StringVar(&cfg.Kubernetes.GroupBy, "group-by", cfg.Kubernetes.GroupBy, "Aggregate nodes by ip or namespace")
+	fs.BoolVar(&cfg.Enrichment.ReverseDNS, "reverse-dns", cfg.Enrichment.ReverseDNS, "Label addresses Kubernetes does not know with their reverse DNS name")
+	fs.StringVar(&cfg.Enrichment.StaticLabelsFile, "labels-file", cfg.Enrichment.StaticLabelsFile, "Hosts-style file naming addresses and CIDR ranges outside Kubernetes, e.g. '192.168.1.10 nas'")
+	fs.Parse(args)
+
+	if cfg.Kubernetes.GroupBy != "ip" && cfg.Kubernetes.GroupBy != "namespace" {
+		log.Fatalf("Unsupported group-by: %s", cfg.Kubernetes.GroupBy)
+	}
+	if *intervalPtr <= 0 {
+		log.Fatalf("interval must be positive")
+	}
+	if _, err := parseCIDRFilter(cfg.Network); err != nil {
+		log.Fatalf("Invalid network: %s", err)
+	}
+	source, err := newFlowSource(cfg)
+	if err != nil {
+		log.Fatalf("Error creating %s source: %s", cfg.Source, err)
+	}
+	if _, ok := source.(boundedSource); ok {
+		log.Fatalf("The exporter needs a live source, not %s", source.Name())
+	}
+	if _, err := source.Version(context.Background()); err != nil {
+		log.Fatalf("Error reaching %s: %s", source.Name(), err)
+	}
+
+	counters := &flowCounters{series: make(map[seriesKey]*series)}
+	go func() {
+		enrich := newEnricher(cfg)
+		var last time.Time
+		ticker := time.NewTicker(*intervalPtr)
+		defer ticker.Stop()
+		for ; ; <-ticker.C {
+			ctx, cancel := context.WithTimeout(context.Background(), *intervalPtr)
+			from, to, lag, err := queryRange(ctx, source, *intervalPtr, time.Now(), cfg.ShiftLag)
+			// Consecutive queries meet so no flow is counted twice or missed.
+			if err == nil && !last.IsZero() {
+				from = last
+			}
+			if err == nil && to.After(from) {
+				err = exportRange(ctx, cfg, source, enrich, counters, from, to, lag, *ttlPtr)
+			}
+			cancel()
+			if err != nil {
+				log.Printf("Error querying flows: %s", err)
+				counters.mu.Lock()
+				counters.errors++
+				counters.mu.Unlock()
+				continue
+			}
+			last = to
+		}
+	}()
+
+	http.Handle("/metrics", counters)
+	log.Printf("Exporting %s flows on %s/metrics every %s", source.Name(), *listenPtr, *intervalPtr)
+	log.Fatal(http.ListenAndServe(*listenPtr, nil))
+}
+
+func exportRange(ctx context.Context, cfg Config, source FlowSource, enrich *enricher, counters *flowCounters, from, to time.Time, lag, ttl time.Duration) error {
+	matrix, err := fetchMatrix(ctx, cfg, source, enrich, from, to)
+	if err != nil {
+		return err
+	}
+	counters.add(matrix, describeNodes(ctx, cfg, enrich, matrix, from, to), lag, ttl)
+	return nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// silentAfter is how many intervals an agent may miss before the fleet
+// status reports it as silent.
+const silentAfter = 3
+
+// agentStatus is what the collector knows about one agent.
+type agentStatus struct {
+	Agent        string    `json:"agent"`
+	Address      string    `json:"address,omitempty"`
+	Capture      string    `json:"capture"`
+	Version      string    `json:"version"`
+	Interval     string    `json:"interval"`
+	RegisteredAt time.Time `json:"registeredAt"`
+	LastSeen     time.Time `json:"lastSeen"`
+	// Reporting is false once the agent has missed silentAfter heartbeats.
+	Reporting bool `json:"reporting"`
+
+	Snapshots      int64     `json:"snapshots"`
+	RecordsShipped int64     `json:"recordsShipped"`
+	BytesShipped   int64     `json:"bytesShipped"`
+	Errors         int64     `json:"errors"`
+	LastError      string    `json:"lastError,omitempty"`
+	LastShipped    time.Time `json:"lastShipped,omitempty"`
+	// RecordsReceived counts the records the collector got from the agent,
+	// to compare with RecordsShipped.
+	RecordsReceived int64 `json:"recordsReceived"`
+
+	interval time.Duration
+}
+
+// fleet tracks the agents shipping to the collector.
+type fleet struct {
+	mu     sync.Mutex
+	agents map[string]*agentStatus
+}
+
+func newFleet() *fleet {
+	return &fleet{agents: make(map[string]*agentStatus)}
+}
+
+func (f *fleet) register(ctx context.Context, registration *AgentRegistration) {
+	agent := &agentStatus{
+		Agent:        registration.GetAgent(),
+		Capture:      registration.GetCapture(),
+		Version:      registration.GetVersion(),
+		interval:     registration.GetInterval().AsDuration(),
+		RegisteredAt: time.Now(),
+	}
+	agent.Interval = agent.interval.String()
+	agent.LastSeen = agent.RegisteredAt
+	if p, ok := peer.FromContext(ctx); ok {
+		agent.Address = p.Addr.String()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if previous, ok := f.agents[agent.Agent]; ok {
+		agent.RecordsReceived = previous.RecordsReceived
+	}
+	f.agents[agent.Agent] = agent
+	log.Printf("Agent %s registered from %s (%s capture every %s)", agent.Agent, agent.Address, agent.Capture, agent.Interval)
+}
+
+// heartbeat records an agent's counters and reports whether the agent is
+// registered.
+func (f *fleet) heartbeat(heartbeat *AgentHeartbeat) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	agent, ok := f.agents[heartbeat.GetAgent()]
+	if !ok {
+		return false
+	}
+	stats := heartbeat.GetStats()
+	agent.LastSeen = time.Now()
+	agent.Snapshots = stats.GetSnapshots()
+	agent.RecordsShipped = stats.GetRecordsShipped()
+	agent.BytesShipped = stats.GetBytesShipped()
+	agent.Errors = stats.GetErrors()
+	agent.LastError = stats.GetLastError()
+	if stats.GetLastShipped() != nil {
+		agent.LastShipped = stats.GetLastShipped().AsTime()
+	}
+	return true
+}
+
+func (f *fleet) received(agent string, records int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if agent, ok := f.agents[agent]; ok {
+		agent.RecordsReceived += int64(records)
+	}
+}
+
+// status lists the agents by name as of now.
+func (f *fleet) status(now time.Time) []agentStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	agents := make([]agentStatus, 0, len(f.agents))
+	for _, status := range f.agents {
+		agent := *status
+		agent.Reporting = now.Sub(agent.LastSeen) <= silentAfter*agent.interval
+		agents = append(agents, agent)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].Agent < agents[j].Agent })
+	return agents
+}
+
+func (f *flowIngest) Register(ctx context.Context, registration *AgentRegistration) (*RegisterResponse, error) {
+	if registration.GetAgent() == "" {
+		return nil, status.Error(codes.InvalidArgument, "agent name required")
+	}
+	f.fleet.register(ctx, registration)
+	return &RegisterResponse{}, nil
+}
+
+func (f *flowIngest) Heartbeat(ctx context.Context, heartbeat *AgentHeartbeat) (*HeartbeatResponse, error) {
+	if !f.fleet.heartbeat(heartbeat) {
+		return nil, status.Errorf(codes.NotFound, "agent %s is not registered", heartbeat.GetAgent())
+	}
+	policy, version, err := f.policies.policy(heartbeat.GetAgent())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "capture policy: %s", err)
+	}
+	if version == heartbeat.GetPolicyVersion() {
+		return &HeartbeatResponse{}, nil
+	}
+	log.Printf("Sending agent %s capture policy %016x", heartbeat.GetAgent(), version)
+	return &HeartbeatResponse{Policy: policy, PolicyVersion: version}, nil
+}
+
+// agentReport keeps an agent's counters for its heartbeats.
+type agentReport struct {
+	registration *AgentRegistration
+	registered   bool
+	stats        *AgentStats
+}
+
+func newAgentReport(agent, capture string, interval time.Duration) *agentReport {
+	return &agentReport{
+		registration: &AgentRegistration{
+			Agent:    agent,
+			Capture:  capture,
+			Interval: durationpb.New(interval),
+			Version:  codeVersion(),
+		},
+		stats: &AgentStats{},
+	}
+}
+
+func (r *agentReport) shipped(records, bytes int64, at time.Time) {
+	r.stats.RecordsShipped += records
+	r.stats.BytesShipped += bytes
+	r.stats.LastShipped = timestamppb.New(at)
+}
+
+func (r *agentReport) failed(err error) {
+	r.stats.Errors++
+	r.stats.LastError = err.Error()
+}
+
+// heartbeat counts a snapshot and sends the counters, registering first
+// when the collector does not know the agent yet, and applies the capture
+// policy the collector returns.
+func (s *flowShipper) heartbeat(ctx context.Context) error {
+	report := s.report
+	report.stats.Snapshots++
+	if !report.registered {
+		if _, err := s.client.Register(ctx, report.registration); err != nil {
+			return err
+		}
+		report.registered = true
+	}
+	response, err := s.client.Heartbeat(ctx, &AgentHeartbeat{
+		Agent:         report.registration.Agent,
+		Stats:         report.stats,
+		PolicyVersion: s.policy.version,
+	})
+	if status.Code(err) == codes.NotFound {
+		report.registered = false
+	}
+	if err != nil {
+		return err
+	}
+	if response.GetPolicy() != nil {
+		s.policy = newCapturePolicy(response.GetPolicy(), response.GetPolicyVersion())
+		log.Printf("Applying capture policy %016x: %s", s.policy.version, s.policy.describe())
+	}
+	return nil
+}
+
+var fleetTemplate = template.Must(template.New("fleet").Funcs(template.FuncMap{
+	"ago": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return time.Since(t).Round(time.Second).String() + " ago"
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="30">
+<title>kube-netflow agents</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+caption { text-align: left; font-weight: bold; padding: 0.5em 0; }
+th, td { border: 1px solid #999; padding: 0.3em 0.6em; }
+td.number { text-align: right; font-variant-numeric: tabular-nums; }
+.silent { color: #b00; font-weight: bold; }
+</style>
+</head>
+<body>
+<main>
+<h1>kube-netflow agents</h1>
+<table>
+<caption>{{len .Agents}} agents; silent agents missed {{.Missed}} heartbeats</caption>
+<thead><tr>
+<th scope="col">Agent</th><th scope="col">Status</th><th scope="col">Capture</th><th scope="col">Last seen</th>
+<th scope="col">Last shipped</th><th scope="col">Records shipped</th><th scope="col">Records received</th>
+<th scope="col">Errors</th><th scope="col">Last error</th><th scope="col">Version</th>
+</tr></thead>
+<tbody>
+{{range .Agents}}<tr><th scope="row">{{.Agent}}</th>
+<td{{if not .Reporting}} class="silent"{{end}}>{{if .Reporting}}reporting{{else}}silent{{end}}</td>
+<td>{{.Capture}} every {{.Interval}}</td><td>{{ago .LastSeen}}</td><td>{{ago .LastShipped}}</td>
+<td class="number">{{.RecordsShipped}}</td><td class="number">{{.RecordsReceived}}</td>
+<td class="number">{{.Errors}}</td><td>{{.LastError}}</td><td>{{.Version}}</td></tr>
+{{end}}</tbody>
+</table>
+</main>
+</body>
+</html>
+`))
+
+// serveAgents handles /api/v1/agents with the fleet status as JSON.
+func (f *fleet) serveAgents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(f.status(time.Now()))
+}
+
+// servePage handles /agents with the fleet status as an HTML table.
+func (f *fleet) servePage(w http.ResponseWriter, r *http.Request) {
+	var page bytes.Buffer
+	data := struct {
+		Agents []agentStatus
+		Missed int
+	}{f.status(time.Now()), silentAfter}
+	if err := fleetTemplate.Execute(&page, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(page.Bytes())
+}
+
+// serveFleet serves the fleet status on address until the listener fails.
+func serveFleet(address string, fleet *fleet) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/agents", fleet.serveAgents)
+	mux.HandleFunc("/agents", fleet.servePage)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	log.Printf("Serving agent status on %s", address)
+	return http.ListenAndServe(address, mux)
+}
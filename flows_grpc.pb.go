@@ -0,0 +1,363 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: flows.proto
+
+package main
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	FlowService_GetFlowMatrix_FullMethodName = "/kubenetflow.v1.FlowService/GetFlowMatrix"
+	FlowService_StreamFlows_FullMethodName   = "/kubenetflow.v1.FlowService/StreamFlows"
+)
+
+// FlowServiceClient is the client API for FlowService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// FlowService serves the same labelled flow matrix as /api/v1/flows.
+type FlowServiceClient interface {
+	GetFlowMatrix(ctx context.Context, in *FlowMatrixRequest, opts ...grpc.CallOption) (*FlowMatrixResponse, error)
+	// StreamFlows sends a fresh matrix every interval, like /ws.
+	StreamFlows(ctx context.Context, in *StreamFlowsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[FlowMatrixResponse], error)
+}
+
+type flowServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewFlowServiceClient(cc grpc.ClientConnInterface) FlowServiceClient {
+	return &flowServiceClient{cc}
+}
+
+func (c *flowServiceClient) GetFlowMatrix(ctx context.Context, in *FlowMatrixRequest, opts ...grpc.CallOption) (*FlowMatrixResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(FlowMatrixResponse)
+	err := c.cc.Invoke(ctx, FlowService_GetFlowMatrix_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *flowServiceClient) StreamFlows(ctx context.Context, in *StreamFlowsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[FlowMatrixResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &FlowService_ServiceDesc.Streams[0], FlowService_StreamFlows_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[StreamFlowsRequest, FlowMatrixResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FlowService_StreamFlowsClient = grpc.ServerStreamingClient[FlowMatrixResponse]
+
+// FlowServiceServer is the server API for FlowService service.
+// All implementations must embed UnimplementedFlowServiceServer
+// for forward compatibility.
+//
+// FlowService serves the same labelled flow matrix as /api/v1/flows.
+type FlowServiceServer interface {
+	GetFlowMatrix(context.Context, *FlowMatrixRequest) (*FlowMatrixResponse, error)
+	// StreamFlows sends a fresh matrix every interval, like /ws.
+	StreamFlows(*StreamFlowsRequest, grpc.ServerStreamingServer[FlowMatrixResponse]) error
+	mustEmbedUnimplementedFlowServiceServer()
+}
+
+// UnimplementedFlowServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedFlowServiceServer struct{}
+
+func (UnimplementedFlowServiceServer) GetFlowMatrix(context.Context, *FlowMatrixRequest) (*FlowMatrixResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetFlowMatrix not implemented")
+}
+func (UnimplementedFlowServiceServer) StreamFlows(*StreamFlowsRequest, grpc.ServerStreamingServer[FlowMatrixResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamFlows not implemented")
+}
+func (UnimplementedFlowServiceServer) mustEmbedUnimplementedFlowServiceServer() {}
+func (UnimplementedFlowServiceServer) testEmbeddedByValue()                     {}
+
+// UnsafeFlowServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to FlowServiceServer will
+// result in compilation errors.
+type UnsafeFlowServiceServer interface {
+	mustEmbedUnimplementedFlowServiceServer()
+}
+
+func RegisterFlowServiceServer(s grpc.ServiceRegistrar, srv FlowServiceServer) {
+	// If the following call pancis, it indicates UnimplementedFlowServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&FlowService_ServiceDesc, srv)
+}
+
+func _FlowService_GetFlowMatrix_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FlowMatrixRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FlowServiceServer).GetFlowMatrix(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FlowService_GetFlowMatrix_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FlowServiceServer).GetFlowMatrix(ctx, req.(*FlowMatrixRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FlowService_StreamFlows_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamFlowsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FlowServiceServer).StreamFlows(m, &grpc.GenericServerStream[StreamFlowsRequest, FlowMatrixResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FlowService_StreamFlowsServer = grpc.ServerStreamingServer[FlowMatrixResponse]
+
+// FlowService_ServiceDesc is the grpc.ServiceDesc for FlowService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var FlowService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "kubenetflow.v1.FlowService",
+	HandlerType: (*FlowServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetFlowMatrix",
+			Handler:    _FlowService_GetFlowMatrix_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamFlows",
+			Handler:       _FlowService_StreamFlows_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "flows.proto",
+}
+
+const (
+	FlowIngest_Ship_FullMethodName      = "/kubenetflow.v1.FlowIngest/Ship"
+	FlowIngest_Register_FullMethodName  = "/kubenetflow.v1.FlowIngest/Register"
+	FlowIngest_Heartbeat_FullMethodName = "/kubenetflow.v1.FlowIngest/Heartbeat"
+)
+
+// FlowIngestClient is the client API for FlowIngest service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// FlowIngest receives flows from node agents, a compact alternative to
+// indexing them in Elasticsearch.
+type FlowIngestClient interface {
+	// Ship adds a batch of flows to the collector's window.
+	Ship(ctx context.Context, in *FlowBatch, opts ...grpc.CallOption) (*ShipResponse, error)
+	// Register announces an agent to the collector's fleet status.
+	Register(ctx context.Context, in *AgentRegistration, opts ...grpc.CallOption) (*RegisterResponse, error)
+	// Heartbeat reports an agent's counters every interval and returns its
+	// capture policy when it changed. It fails with NOT_FOUND when the
+	// collector does not know the agent, which then registers again.
+	Heartbeat(ctx context.Context, in *AgentHeartbeat, opts ...grpc.CallOption) (*HeartbeatResponse, error)
+}
+
+type flowIngestClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewFlowIngestClient(cc grpc.ClientConnInterface) FlowIngestClient {
+	return &flowIngestClient{cc}
+}
+
+func (c *flowIngestClient) Ship(ctx context.Context, in *FlowBatch, opts ...grpc.CallOption) (*ShipResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ShipResponse)
+	err := c.cc.Invoke(ctx, FlowIngest_Ship_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *flowIngestClient) Register(ctx context.Context, in *AgentRegistration, opts ...grpc.CallOption) (*RegisterResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RegisterResponse)
+	err := c.cc.Invoke(ctx, FlowIngest_Register_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *flowIngestClient) Heartbeat(ctx context.Context, in *AgentHeartbeat, opts ...grpc.CallOption) (*HeartbeatResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(HeartbeatResponse)
+	err := c.cc.Invoke(ctx, FlowIngest_Heartbeat_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// FlowIngestServer is the server API for FlowIngest service.
+// All implementations must embed UnimplementedFlowIngestServer
+// for forward compatibility.
+//
+// FlowIngest receives flows from node agents, a compact alternative to
+// indexing them in Elasticsearch.
+type FlowIngestServer interface {
+	// Ship adds a batch of flows to the collector's window.
+	Ship(context.Context, *FlowBatch) (*ShipResponse, error)
+	// Register announces an agent to the collector's fleet status.
+	Register(context.Context, *AgentRegistration) (*RegisterResponse, error)
+	// Heartbeat reports an agent's counters every interval and returns its
+	// capture policy when it changed. It fails with NOT_FOUND when the
+	// collector does not know the agent, which then registers again.
+	Heartbeat(context.Context, *AgentHeartbeat) (*HeartbeatResponse, error)
+	mustEmbedUnimplementedFlowIngestServer()
+}
+
+// UnimplementedFlowIngestServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedFlowIngestServer struct{}
+
+func (UnimplementedFlowIngestServer) Ship(context.Context, *FlowBatch) (*ShipResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Ship not implemented")
+}
+func (UnimplementedFlowIngestServer) Register(context.Context, *AgentRegistration) (*RegisterResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Register not implemented")
+}
+func (UnimplementedFlowIngestServer) Heartbeat(context.Context, *AgentHeartbeat) (*HeartbeatResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Heartbeat not implemented")
+}
+func (UnimplementedFlowIngestServer) mustEmbedUnimplementedFlowIngestServer() {}
+func (UnimplementedFlowIngestServer) testEmbeddedByValue()                    {}
+
+// UnsafeFlowIngestServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to FlowIngestServer will
+// result in compilation errors.
+type UnsafeFlowIngestServer interface {
+	mustEmbedUnimplementedFlowIngestServer()
+}
+
+func RegisterFlowIngestServer(s grpc.ServiceRegistrar, srv FlowIngestServer) {
+	// If the following call pancis, it indicates UnimplementedFlowIngestServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&FlowIngest_ServiceDesc, srv)
+}
+
+func _FlowIngest_Ship_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FlowBatch)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FlowIngestServer).Ship(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FlowIngest_Ship_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FlowIngestServer).Ship(ctx, req.(*FlowBatch))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FlowIngest_Register_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AgentRegistration)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FlowIngestServer).Register(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FlowIngest_Register_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FlowIngestServer).Register(ctx, req.(*AgentRegistration))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FlowIngest_Heartbeat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AgentHeartbeat)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FlowIngestServer).Heartbeat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FlowIngest_Heartbeat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FlowIngestServer).Heartbeat(ctx, req.(*AgentHeartbeat))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// FlowIngest_ServiceDesc is the grpc.ServiceDesc for FlowIngest service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var FlowIngest_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "kubenetflow.v1.FlowIngest",
+	HandlerType: (*FlowIngestServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Ship",
+			Handler:    _FlowIngest_Ship_Handler,
+		},
+		{
+			MethodName: "Register",
+			Handler:    _FlowIngest_Register_Handler,
+		},
+		{
+			MethodName: "Heartbeat",
+			Handler:    _FlowIngest_Heartbeat_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "flows.proto",
+}
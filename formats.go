@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fileFormat describes a JSON file kube-netflow writes and reads back later,
+// possibly from another release. Each document carries its version. Readers
+// ignore fields they do not know, so additive changes keep the version;
+// changes an older release would misread bump it, with an upgrade from the
+// previous version appended to upgrades. Older documents are upgraded as
+// they are loaded, and `kube-netflow migrate` rewrites them.
+type fileFormat struct {
+	name    string
+	version int
+	// upgrades[v] turns a version v document into version v+1. Documents
+	// written before versioning are version 0.
+	upgrades []func(doc map[string]interface{}) error
+	// detect recognises the format's documents for migrate.
+	detect func(doc map[string]interface{}) bool
+	indent bool
+}
+
+// stampVersion is the upgrade for formats that only gained their version.
+func stampVersion(doc map[string]interface{}) error {
+	return nil
+}
+
+var (
+	ownershipFormat = &fileFormat{
+		name:     "ownership index",
+		version:  ownershipIndexVersion,
+		upgrades: []func(map[string]interface{}) error{stampVersion},
+		detect:   func(doc map[string]interface{}) bool { return doc["endpoints"] != nil },
+	}
+	snapshotFormat = &fileFormat{
+		name:     "snapshot",
+		version:  snapshotVersion,
+		upgrades: []func(map[string]interface{}) error{stampVersion},
+		detect:   func(doc map[string]interface{}) bool { return doc["names"] != nil && doc["flow"] != nil },
+	}
+	manifestFormat = &fileFormat{
+		name:     "manifest",
+		version:  manifestVersion,
+		upgrades: []func(map[string]interface{}) error{stampVersion},
+		detect:   func(doc map[string]interface{}) bool { return doc["artifact"] != nil && doc["inputHash"] != nil },
+		indent:   true,
+	}
+	fileFormats = []*fileFormat{ownershipFormat, snapshotFormat, manifestFormat}
+)
+
+const (
+	ownershipIndexVersion = 1
+	snapshotVersion       = 1
+	manifestVersion       = 1
+)
+
+func documentVersion(doc map[string]interface{}) int {
+	version, _ := doc["version"].(float64)
+	return int(version)
+}
+
+// upgrade brings doc to the current version in place and reports whether it
+// changed.
+func (f *fileFormat) upgrade(doc map[string]interface{}) (bool, error) {
+	version := documentVersion(doc)
+	if version > f.version {
+		return false, fmt.Errorf("%s version %d is newer than this release reads (%d); upgrade kube-netflow", f.name, version, f.version)
+	}
+	for v := version; v < f.version; v++ {
+		if err := f.upgrades[v](doc); err != nil {
+			return false, fmt.Errorf("upgrading %s from version %d: %w", f.name, v, err)
+		}
+	}
+	doc["version"] = f.version
+	return version != f.version, nil
+}
+
+// decode upgrades data as needed and unmarshals it into out.
+func (f *fileFormat) decode(data []byte, out interface{}) error {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	changed, err := f.upgrade(doc)
+	if err != nil {
+		return err
+	}
+	if changed {
+		if data, err = json.Marshal(doc); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (f *fileFormat) encode(doc interface{}) ([]byte, error) {
+	if f.indent {
+		data, err := json.MarshalIndent(doc, "", "  ")
+		return append(data, '\n'), err
+	}
+	return json.Marshal(doc)
+}
+
+// writeFileAtomic replaces path so readers never see a partial file, and
+// syncs it first so a crash leaves either the old or the new contents. A
+// path of - writes to standard output.
+func writeFileAtomic(path string, data []byte) error {
+	if path == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// rotationLayout timestamps the historical copies rotateFile keeps.
+const rotationLayout = "20060102T150405Z"
+
+// rotateFile keeps a copy of path named after at, e.g.
+// network_flow-20240131T120000Z.png, and removes all but the keep newest
+// copies.
+func rotateFile(path string, keep int, at time.Time) error {
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext) + "-"
+	copyPath := stem + at.UTC().Format(rotationLayout) + ext
+	if err := os.Link(path, copyPath); err != nil {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(copyPath, data); err != nil {
+			return err
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	prefix := filepath.Base(stem)
+	var copies []string
+	for _, entry := range entries {
+		stamp, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok || !strings.HasSuffix(stamp, ext) {
+			continue
+		}
+		if _, err := time.Parse(rotationLayout, strings.TrimSuffix(stamp, ext)); err == nil {
+			copies = append(copies, filepath.Join(filepath.Dir(path), entry.Name()))
+		}
+	}
+	// The layout sorts chronologically.
+	sort.Strings(copies)
+	for len(copies) > keep {
+		if err := os.Remove(copies[0]); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		copies = copies[1:]
+	}
+	return nil
+}
+
+// migrateFile rewrites path at the current version of its format, keeping
+// the original next to it. Fields unknown to this release are kept.
+func migrateFile(path string, dryRun, force bool) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return "", fmt.Errorf("not a kube-netflow JSON file: %w", err)
+	}
+	var format *fileFormat
+	for _, candidate := range fileFormats {
+		if candidate.detect(doc) {
+			format = candidate
+			break
+		}
+	}
+	if format == nil {
+		return "", errors.New("not a kube-netflow snapshot, manifest or ownership index")
+	}
+
+	from := documentVersion(doc)
+	changed, err := format.upgrade(doc)
+	if err != nil {
+		return "", err
+	}
+	if !changed {
+		return fmt.Sprintf("%s already at version %d", format.name, format.version), nil
+	}
+	summary := fmt.Sprintf("%s version %d -> %d", format.name, from, format.version)
+	if _, err := os.Stat(path + ".sig"); err == nil && !force {
+		return "", fmt.Errorf("%s is signed; rewriting it invalidates %s.sig (use --force and re-sign)", summary, path)
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	if dryRun {
+		return summary + " (dry run)", nil
+	}
+
+	upgraded, err := format.encode(doc)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path+".bak", data, 0o644); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(path, upgraded); err != nil {
+		return "", err
+	}
+	return summary + ", original kept as " + filepath.Base(path) + ".bak", nil
+}
+
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRunPtr := fs.Bool("dry-run", false, "Report what would change without writing")
+	forcePtr := fs.Bool("force", false, "Rewrite signed manifests, whose signatures then need renewing")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		log.Fatalf("Usage: kube-netflow migrate [--dry-run] [--force] <file>...")
+	}
+
+	failed := false
+	for _, path := range fs.Args() {
+		summary, err := migrateFile(path, *dryRunPtr, *forcePtr)
+		if err != nil {
+			log.Printf("%s: %s", path, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: %s\n", path, summary)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"sort"
+	"strings"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotutil"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+)
+
+// graphIterations is how many steps the force-directed layout takes.
+const graphIterations = 300
+
+// ForceGraph draws a flow matrix as nodes placed by a force-directed layout
+// and joined by edges as wide as the log of the bytes between them, so hubs
+// end up central and groups that only talk among themselves drift apart.
+type ForceGraph struct {
+	Flow   [][]float64
+	Labels []string
+	// Positions are the nodes' places in [-1, 1]².
+	Positions [][2]float64
+	// Clusters, when set, colour nodes by the namespace they were pulled
+	// together by.
+	Clusters []int
+	Theme    chordTheme
+	// ResolvedBy names the resolver behind each label, for SVG tooltips.
+	ResolvedBy map[string]string
+	// Anomalies are the pairs, by label, drawn in red because they stray
+	// from the learned baseline.
+	Anomalies map[[2]string]anomaly
+}
+
+// graphPlot lays out matrix as a force-directed graph, pulling each
+// namespace's nodes together when clusterNamespaces is set.
+func graphPlot(matrix *FlowMatrix, title string, theme chordTheme, clusterNamespaces bool) *plot.Plot {
+	p := plot.New()
+	p.BackgroundColor = theme.Background
+	p.HideAxes()
+	p.X.Min, p.X.Max = -1, 1
+	p.Y.Min, p.Y.Max = -1, 1
+	p.Title.Text = title
+	p.Title.TextStyle.Font.Size = vg.Points(16)
+	p.Title.TextStyle.Color = theme.Text
+
+	n := len(matrix.Names)
+	weights := make([][]float64, n)
+	for i := range weights {
+		weights[i] = make([]float64, n)
+		for j := range weights[i] {
+			weights[i][j] = matrix.Flow[i][j] + matrix.Flow[j][i]
+		}
+	}
+	var clusters []int
+	if clusterNamespaces {
+		clusters = namespaceClusters(matrix.Names)
+	}
+
+	p.Add(ForceGraph{
+		Flow:       matrix.Flow,
+		Labels:     matrix.Names,
+		Positions:  forceLayout(weights, clusters),
+		Clusters:   clusters,
+		Theme:      theme,
+		ResolvedBy: matrix.resolvedBy,
+		Anomalies:  matrix.anomalies,
+	})
+	return p
+}
+
+// namespaceClusters numbers the namespaces of labels, such as kube-system
+// for kube-system/coredns. Unlabelled addresses share a cluster.
+func namespaceClusters(labels []string) []int {
+	namespaces := make([]string, len(labels))
+	seen := make(map[string]bool)
+	var names []string
+	for i, label := range labels {
+		namespace, _, found := strings.Cut(label, "/")
+		if !found {
+			namespace = ""
+		}
+		namespaces[i] = namespace
+		if !seen[namespace] {
+			seen[namespace] = true
+			names = append(names, namespace)
+		}
+	}
+	// Number namespaces by name so colours stay put between renders.
+	sort.Strings(names)
+	numbers := make(map[string]int, len(names))
+	for i, name := range names {
+		numbers[name] = i
+	}
+	clusters := make([]int, len(labels))
+	for i, namespace := range namespaces {
+		clusters[i] = numbers[namespace]
+	}
+	return clusters
+}
+
+// forceLayout places the nodes of the symmetric weights in [-1, 1]² with
+// the Fruchterman-Reingold algorithm: every node repels every other, edges
+// pull their ends together by the log of their weight and, with clusters,
+// nodes are also pulled towards the middle of their cluster. It starts from
+// a circle and is deterministic, so re-renders keep their shape.
+func forceLayout(weights [][]float64, clusters []int) [][2]float64 {
+	n := len(weights)
+	pos := make([][2]float64, n)
+	if n <= 1 {
+		return pos
+	}
+
+	// Start clusters on neighbouring arcs of the circle.
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	if clusters != nil {
+		sort.SliceStable(order, func(a, b int) bool { return clusters[order[a]] < clusters[order[b]] })
+	}
+	for rank, i := range order {
+		angle := 2 * math.Pi * float64(rank) / float64(n)
+		pos[i] = [2]float64{0.5 * math.Cos(angle), 0.5 * math.Sin(angle)}
+	}
+
+	maxWeight := 0.0
+	for i := range weights {
+		for j := range weights[i] {
+			maxWeight = math.Max(maxWeight, weights[i][j])
+		}
+	}
+	// k is the ideal distance between nodes, for n nodes spread over the
+	// square.
+	k := 2 / math.Sqrt(float64(n))
+	disp := make([][2]float64, n)
+	for step := 0; step < graphIterations; step++ {
+		for i := range disp {
+			disp[i] = [2]float64{}
+		}
+		for i := 0; i < n; i++ {
+			for j := i + 1; j < n; j++ {
+				dx, dy := pos[i][0]-pos[j][0], pos[i][1]-pos[j][1]
+				d := math.Max(math.Hypot(dx, dy), 1e-3)
+				f := k * k / d
+				if weights[i][j] > 0 {
+					f -= math.Log1p(weights[i][j]) / math.Log1p(maxWeight) * d * d / k
+				}
+				disp[i][0] += dx / d * f
+				disp[i][1] += dy / d * f
+				disp[j][0] -= dx / d * f
+				disp[j][1] -= dy / d * f
+			}
+		}
+
+		if clusters != nil {
+			centres := make(map[int][3]float64)
+			for i, cluster := range clusters {
+				c := centres[cluster]
+				centres[cluster] = [3]float64{c[0] + pos[i][0], c[1] + pos[i][1], c[2] + 1}
+			}
+			for i, cluster := range clusters {
+				c := centres[cluster]
+				dx, dy := c[0]/c[2]-pos[i][0], c[1]/c[2]-pos[i][1]
+				d := math.Hypot(dx, dy)
+				disp[i][0] += dx * d / k
+				disp[i][1] += dy * d / k
+			}
+		}
+
+		// Gravity keeps unconnected nodes from drifting off, and cooling
+		// lets the layout settle.
+		temperature := 0.1 * (1 - float64(step)/graphIterations)
+		for i := range pos {
+			disp[i][0] -= pos[i][0] * k
+			disp[i][1] -= pos[i][1] * k
+			length := math.Hypot(disp[i][0], disp[i][1])
+			if length == 0 {
+				continue
+			}
+			move := math.Min(length, temperature)
+			pos[i][0] += disp[i][0] / length * move
+			pos[i][1] += disp[i][1] / length * move
+		}
+	}
+
+	// Centre and scale the layout to fill the square.
+	minX, minY, maxX, maxY := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for _, p := range pos {
+		minX, maxX = math.Min(minX, p[0]), math.Max(maxX, p[0])
+		minY, maxY = math.Min(minY, p[1]), math.Max(maxY, p[1])
+	}
+	scale := 2 / math.Max(math.Max(maxX-minX, maxY-minY), 1e-9)
+	for i := range pos {
+		pos[i][0] = (pos[i][0] - (minX+maxX)/2) * scale
+		pos[i][1] = (pos[i][1] - (minY+maxY)/2) * scale
+	}
+	return pos
+}
+
+func (g ForceGraph) Plot(canvas draw.Canvas, plt *plot.Plot) {
+	origin := vg.Point{X: canvas.Size().X / 2, Y: canvas.Size().Y / 2}
+	// Leave room for labels at the edges.
+	radius := vg.Length(math.Min(float64(canvas.Size().X), float64(canvas.Size().Y)) * 0.42)
+	at := func(i int) vg.Point {
+		return vg.Point{
+			X: canvas.Min.X + origin.X + radius*vg.Length(g.Positions[i][0]),
+			Y: canvas.Min.Y + origin.Y + radius*vg.Length(g.Positions[i][1]),
+		}
+	}
+
+	n := len(g.Flow)
+	maxFlow, maxTotal := 0.0, 0.0
+	totals := make([]float64, n)
+	for i := range g.Flow {
+		for j := range g.Flow[i] {
+			maxFlow = math.Max(maxFlow, g.Flow[i][j]+g.Flow[j][i])
+			totals[i] += g.Flow[i][j] + g.Flow[j][i]
+		}
+		maxTotal = math.Max(maxTotal, totals[i])
+	}
+
+	// Edges first, so nodes sit on top of them.
+	for i := range g.Flow {
+		for j := range g.Flow[i] {
+			if g.Flow[i][j] <= 0 {
+				continue
+			}
+			var found anomaly
+			var anomalous bool
+			if g.Labels != nil {
+				found, anomalous = g.Anomalies[[2]string{g.Labels[i], g.Labels[j]}]
+				tip := chordTooltip{
+					title: fmt.Sprintf("%s → %s: %.1f MB", g.Labels[i], g.Labels[j], g.Flow[i][j]/1024/1024),
+					data:  []string{"source", g.Labels[i], "destination", g.Labels[j], "bytes", fmt.Sprintf("%.0f", g.Flow[i][j])},
+				}
+				if anomalous {
+					tip.title += fmt.Sprintf(" (%+.0f%% from baseline)", found.Percent)
+					tip.data = append(tip.data, "anomaly", fmt.Sprintf("%.1f", found.ZScore))
+				}
+				annotate(canvas, tip)
+			}
+			// The two directions of a pair share a line, each drawn as wide
+			// as its own traffic.
+			weight := math.Log1p(g.Flow[i][j]) / math.Log1p(maxFlow)
+			style := draw.LineStyle{Color: g.edgeColor(i), Width: vg.Points(0.5 + 3*weight)}
+			if g.Theme.Dashes != nil {
+				style.Dashes = g.Theme.Dashes[i%len(g.Theme.Dashes)]
+			}
+			if anomalous {
+				style = draw.LineStyle{Color: anomalyColor, Width: vg.Points(1 + 4*weight)}
+			}
+			canvas.SetLineStyle(style)
+			var edge vg.Path
+			edge.Move(at(i))
+			edge.Line(at(j))
+			canvas.Stroke(edge)
+		}
+	}
+	canvas.SetLineDash(nil, 0)
+
+	labelFont := plot.DefaultFont
+	labelFont.Size = vg.Points(10)
+	labelStyle := draw.TextStyle{
+		Color:   g.Theme.Text,
+		Font:    labelFont,
+		Handler: plot.DefaultTextHandler,
+		XAlign:  draw.XCenter,
+		YAlign:  draw.YBottom,
+	}
+	for i := 0; i < n; i++ {
+		size := vg.Points(3 + 9*math.Sqrt(totals[i]/math.Max(maxTotal, 1)))
+		var node vg.Path
+		node.Move(vg.Point{X: at(i).X + size, Y: at(i).Y})
+		node.Arc(at(i), size, 0, 2*math.Pi)
+		node.Close()
+		if g.Labels != nil {
+			annotate(canvas, ChordDiagram{Flow: g.Flow, Labels: g.Labels, ResolvedBy: g.ResolvedBy}.nodeTooltip(i))
+		}
+		canvas.SetColor(g.nodeColor(i))
+		canvas.Fill(node)
+
+		if g.Labels != nil {
+			labelPos := vg.Point{X: at(i).X, Y: at(i).Y + size + vg.Points(2)}
+			background := labelStyle
+			background.Color = g.Theme.LabelBackground
+			canvas.FillText(background, labelPos, g.Labels[i])
+			canvas.FillText(labelStyle, labelPos, g.Labels[i])
+		}
+	}
+}
+
+func (g ForceGraph) nodeColor(i int) color.Color {
+	if g.Clusters == nil {
+		return g.Theme.Arc
+	}
+	if g.Theme.Dashes != nil {
+		return color.Gray{Y: uint8(37 * g.Clusters[i] % 160)}
+	}
+	return plotutil.Color(g.Clusters[i])
+}
+
+// edgeColor is the source's node colour, faded so crossing edges stay
+// visible.
+func (g ForceGraph) edgeColor(i int) color.Color {
+	rgba := color.RGBAModel.Convert(g.nodeColor(i)).(color.RGBA)
+	return color.RGBA{R: rgba.R / 2, G: rgba.G / 2, B: rgba.B / 2, A: 128}
+}
@@ -0,0 +1,168 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative flows.proto
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/url"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// flowService implements the FlowService in flows.proto on top of serve's
+// queries, snapshot, limits and live cache.
+type flowService struct {
+	UnimplementedFlowServiceServer
+	server *diagramServer
+}
+
+func (f *flowService) parse(request *FlowMatrixRequest) (Config, time.Duration, bool, error) {
+	params := url.Values{"network": request.GetNetwork()}
+	if window := request.GetWindow(); window != "" {
+		params.Set("window", window)
+	}
+	cfg, window, isDefault, err := f.server.parseQuery(params)
+	if err != nil {
+		return cfg, 0, false, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if f.server.budget > 0 && heapInUse() > f.server.budget {
+		return cfg, 0, false, status.Error(codes.ResourceExhausted, "over memory budget, try again later")
+	}
+	return cfg, window, isDefault, nil
+}
+
+func (f *flowService) GetFlowMatrix(ctx context.Context, request *FlowMatrixRequest) (*FlowMatrixResponse, error) {
+	cfg, window, isDefault, err := f.parse(request)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, f.server.timeout)
+	defer cancel()
+	query, matrix, _, err := f.server.lookup(ctx, cfg, window, isDefault)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	return flowsProto(f.server.flowsResponse(ctx, cfg, query, matrix)), nil
+}
+
+func (f *flowService) StreamFlows(request *StreamFlowsRequest, stream grpc.ServerStreamingServer[FlowMatrixResponse]) error {
+	cfg, window, _, err := f.parse(request.GetQuery())
+	if err != nil {
+		return err
+	}
+	interval := max(f.server.pushInterval, request.GetInterval().AsDuration())
+
+	ctx := stream.Context()
+	key := liveKey(cfg)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if f.server.budget > 0 && heapInUse() > f.server.budget {
+			log.Printf("Skipping streamed update: over memory budget")
+		} else {
+			result, err := f.server.liveUpdate(ctx, cfg, window, key, interval)
+			if err != nil {
+				return queryError(ctx, err)
+			}
+			if err := stream.Send(flowsProto(f.server.flowsResponse(ctx, cfg, result.query, result.matrix))); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
+
+func queryError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	return status.Error(codes.Unavailable, err.Error())
+}
+
+func flowsProto(flows apiFlows) *FlowMatrixResponse {
+	response := &FlowMatrixResponse{
+		Query: &FlowQueryInfo{
+			Source:      flows.Query.Source,
+			Window:      flows.Query.Window,
+			Network:     flows.Query.Network,
+			GroupBy:     flows.Query.GroupBy,
+			From:        timestamppb.New(flows.Query.From),
+			To:          timestamppb.New(flows.Query.To),
+			RefreshedAt: timestamppb.New(flows.Query.RefreshedAt),
+			IngestLag:   durationpb.New(time.Duration(flows.Query.IngestLagSeconds * float64(time.Second))),
+		},
+		Freshness: &DataFreshness{
+			RefreshedAt: timestamppb.New(flows.Freshness.RefreshedAt),
+			Lag:         durationpb.New(time.Duration(flows.Freshness.LagSeconds * float64(time.Second))),
+			Stale:       flows.Freshness.Stale,
+		},
+		TotalBytes: flows.TotalBytes,
+	}
+	for _, node := range flows.Nodes {
+		response.Nodes = append(response.Nodes, &FlowNode{
+			Name:      node.Name,
+			Kind:      node.Kind,
+			Namespace: node.Namespace,
+			Resolver:  node.Resolver,
+			BytesOut:  node.BytesOut,
+			BytesIn:   node.BytesIn,
+		})
+	}
+	for _, row := range flows.Matrix {
+		response.Rows = append(response.Rows, &FlowRow{Bytes: row})
+	}
+	return response
+}
+
+// serveGRPC serves FlowService on address until the listener fails.
+func serveGRPC(address string, server *diagramServer) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	grpcServer := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, request any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := server.limiter.allowRPC(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, request)
+		}),
+		grpc.ChainStreamInterceptor(func(service any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := server.limiter.allowRPC(stream.Context()); err != nil {
+				return err
+			}
+			return handler(service, stream)
+		}),
+	)
+	RegisterFlowServiceServer(grpcServer, &flowService{server: server})
+	return grpcServer.Serve(listener)
+}
+
+// allowRPC takes a token for the caller of ctx, a stream taking one when
+// it opens.
+func (l *rateLimiter) allowRPC(ctx context.Context) error {
+	var authorization, addr string
+	if values := metadata.ValueFromIncomingContext(ctx, "authorization"); len(values) > 0 {
+		authorization = values[0]
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+	if ok, wait := l.allow(rateClient(authorization, addr), time.Now()); !ok {
+		return status.Errorf(codes.ResourceExhausted, "too many requests, retry in %s", wait.Round(time.Millisecond))
+	}
+	return nil
+}
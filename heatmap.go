@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/palette/moreland"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+)
+
+// Heatmap draws a flow matrix as a grid with a row per source and a column
+// per destination, each cell coloured by the log of its bytes. It stays
+// readable with more nodes than a chord diagram.
+type Heatmap struct {
+	Flow   [][]float64
+	Labels []string
+	Theme  chordTheme
+	// Anomalies are the pairs, by label, outlined in red because they
+	// stray from the learned baseline.
+	Anomalies map[[2]string]anomaly
+}
+
+// heatmapPlot lays out matrix as a heatmap.
+func heatmapPlot(matrix *FlowMatrix, title string, theme chordTheme) *plot.Plot {
+	p := plot.New()
+	p.BackgroundColor = theme.Background
+	p.Title.Text = title
+	p.Title.TextStyle.Font.Size = vg.Points(16)
+	p.Title.TextStyle.Color = theme.Text
+
+	n := len(matrix.Names)
+	if n == 0 {
+		p.HideAxes()
+		return p
+	}
+	// Sources read top to bottom in matrix order.
+	rows := make([]string, n)
+	for i, name := range matrix.Names {
+		rows[n-1-i] = name
+	}
+	p.NominalX(matrix.Names...)
+	p.NominalY(rows...)
+
+	labelSize := vg.Points(10)
+	if n > 60 {
+		labelSize = vg.Points(6)
+	}
+	for _, axis := range []*plot.Axis{&p.X, &p.Y} {
+		axis.Tick.Label.Font.Size = labelSize
+		axis.Tick.Label.Color = theme.Text
+		axis.Label.TextStyle.Color = theme.Text
+		axis.Min, axis.Max = -0.5, float64(n)-0.5
+	}
+	p.X.Label.Text = "Destination"
+	p.Y.Label.Text = "Source"
+	p.X.Tick.Label.Rotation = math.Pi / 2
+	p.X.Tick.Label.XAlign = draw.XRight
+	p.X.Tick.Label.YAlign = draw.YCenter
+	// NominalX pads Y by half the first name's width, meant for
+	// horizontal labels.
+	p.Y.Padding = 0
+
+	p.Add(Heatmap{
+		Flow:      matrix.Flow,
+		Labels:    matrix.Names,
+		Theme:     theme,
+		Anomalies: matrix.anomalies,
+	})
+	return p
+}
+
+func (h Heatmap) Plot(canvas draw.Canvas, plt *plot.Plot) {
+	trX, trY := plt.Transforms(&canvas)
+	n := len(h.Flow)
+
+	// Colour by log bytes between the smallest and largest flows, so a few
+	// heavy pairs do not wash out the rest.
+	low, high := math.Inf(1), math.Inf(-1)
+	for i := range h.Flow {
+		for _, bytes := range h.Flow[i] {
+			if bytes > 0 {
+				low = math.Min(low, math.Log10(bytes))
+				high = math.Max(high, math.Log10(bytes))
+			}
+		}
+	}
+	if high <= low {
+		low = high - 1
+	}
+	colors := moreland.Kindlmann()
+	colors.SetMin(0)
+	colors.SetMax(1)
+
+	for i := range h.Flow {
+		for j, bytes := range h.Flow[i] {
+			if bytes <= 0 {
+				continue
+			}
+			x0, x1 := trX(float64(j)-0.5), trX(float64(j)+0.5)
+			y0, y1 := trY(float64(n-1-i)-0.5), trY(float64(n-1-i)+0.5)
+			cell := vg.Path{}
+			cell.Move(vg.Point{X: x0, Y: y0})
+			cell.Line(vg.Point{X: x1, Y: y0})
+			cell.Line(vg.Point{X: x1, Y: y1})
+			cell.Line(vg.Point{X: x0, Y: y1})
+			cell.Close()
+
+			level := (math.Log10(bytes) - low) / (high - low)
+			var clr color.Color
+			if h.Theme.Dashes != nil {
+				clr = color.Gray{Y: uint8(230 - 200*level)}
+			} else {
+				// Kindlmann runs from near black to near white; keep clear of
+				// both so cells stand out from either background.
+				clr, _ = colors.At(0.15 + 0.75*level)
+			}
+
+			var found anomaly
+			var anomalous bool
+			if h.Labels != nil {
+				found, anomalous = h.Anomalies[[2]string{h.Labels[i], h.Labels[j]}]
+				tip := chordTooltip{
+					title: fmt.Sprintf("%s → %s: %.1f MB", h.Labels[i], h.Labels[j], bytes/1024/1024),
+					data:  []string{"source", h.Labels[i], "destination", h.Labels[j], "bytes", fmt.Sprintf("%.0f", bytes)},
+				}
+				if anomalous {
+					tip.title += fmt.Sprintf(" (%+.0f%% from baseline)", found.Percent)
+					tip.data = append(tip.data, "anomaly", fmt.Sprintf("%.1f", found.ZScore))
+				}
+				annotate(canvas, tip)
+			}
+			canvas.SetColor(clr)
+			canvas.Fill(cell)
+			if anomalous {
+				canvas.SetLineStyle(draw.LineStyle{Color: anomalyColor, Width: vg.Points(2)})
+				canvas.Stroke(cell)
+			}
+		}
+	}
+}
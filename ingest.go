@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// shipBatchSize caps the records in one Ship call, keeping messages well
+// under gRPC's default 4 MiB limit.
+const shipBatchSize = 16384
+
+const (
+	// shipPending caps the batches an agent holds while the collector is
+	// unreachable, dropping the oldest beyond it.
+	shipPending = 64
+	// shipTimeout bounds one Ship call so a hung collector does not stall
+	// the agent's snapshots.
+	shipTimeout = 30 * time.Second
+)
+
+// flowIngest implements FlowIngest for the collector, adding shipped
+// records to its window at their capture time, keeping the fleet status of
+// the agents sending them and handing them their capture policies. Resent
+// batches are merged once.
+type flowIngest struct {
+	UnimplementedFlowIngestServer
+	window     *flowWindow
+	filter     prefixFilter
+	stats      *collectorStats
+	fleet      *fleet
+	policies   *policyStore
+	deliveries *deliveries
+}
+
+func (f *flowIngest) Ship(ctx context.Context, batch *FlowBatch) (*ShipResponse, error) {
+	now := time.Now()
+	at := now
+	if batch.GetCapturedAt() != nil && batch.GetSentAt() != nil {
+		// Correct the agent's clock by how far its send time is from now,
+		// so batches resent after an outage land where they belong.
+		at = batch.GetCapturedAt().AsTime().Add(now.Sub(batch.GetSentAt().AsTime()))
+	}
+	type record struct {
+		source, destination netip.Addr
+		bytes               float64
+	}
+	// A record with a bad address is counted as an error and skipped; the
+	// batch still fills its sequence so the rest of it is not lost.
+	records := make([]record, 0, len(batch.GetFlows()))
+	var invalid int
+	for _, flow := range batch.GetFlows() {
+		source, ok := netip.AddrFromSlice(flow.GetSource())
+		destination, ok2 := netip.AddrFromSlice(flow.GetDestination())
+		if !ok || !ok2 {
+			invalid++
+			continue
+		}
+		records = append(records, record{source.Unmap(), destination.Unmap(), float64(flow.GetBytes())})
+	}
+	if f.deliveries.accept(batch, at, now) {
+		return &ShipResponse{Duplicate: true}, nil
+	}
+
+	if invalid > 0 {
+		f.stats.errors.Add(uint64(invalid))
+		log.Printf("Skipped %d records with invalid addresses in batch %d from %s", invalid, batch.GetSequence(), batch.GetAgent())
+	}
+	var accepted int64
+	for _, r := range records {
+		f.stats.records.Add(1)
+		if f.filter.match(r.source, r.destination) {
+			f.window.add(at, r.source, r.destination, r.bytes)
+			accepted++
+		}
+	}
+	f.fleet.received(batch.GetAgent(), len(records))
+	return &ShipResponse{Accepted: accepted}, nil
+}
+
+// serveIngest receives shipped flows on address until the listener fails.
+func serveIngest(address string, ingest *flowIngest) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	log.Printf("Receiving agent flows on %s", listener.Addr())
+	server := grpc.NewServer()
+	RegisterFlowIngestServer(server, ingest)
+	return server.Serve(listener)
+}
+
+// flowShipper sends an agent's flows to a collector as gzipped protobuf
+// batches, one record per address pair, and reports the agent's counters.
+// It ships only what the collector's capture policy asks for. Batches the
+// collector did not acknowledge are resent, with their sequence numbers,
+// after the next snapshot.
+type flowShipper struct {
+	conn     *grpc.ClientConn
+	client   FlowIngestClient
+	agent    string
+	session  string
+	interval time.Duration
+	report   *agentReport
+	policy   *capturePolicy
+	sequence uint64
+	// pending holds the unacknowledged batches, oldest first.
+	pending []*FlowBatch
+}
+
+func newFlowShipper(address, capture string, interval time.Duration) (*flowShipper, error) {
+	conn, err := grpc.NewClient(address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name)))
+	if err != nil {
+		return nil, err
+	}
+	agent, err := os.Hostname()
+	if err != nil {
+		agent = "unknown"
+	}
+	session := make([]byte, 8)
+	if _, err := rand.Read(session); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &flowShipper{
+		conn:     conn,
+		client:   NewFlowIngestClient(conn),
+		agent:    agent,
+		session:  hex.EncodeToString(session),
+		interval: interval,
+		report:   newAgentReport(agent, capture, interval),
+		policy:   &capturePolicy{},
+	}, nil
+}
+
+// ship queues the snapshot docs as batches and sends every pending batch.
+// A snapshot without flows still sends an empty batch, so the collector
+// knows it was taken.
+func (s *flowShipper) ship(ctx context.Context, docs []NetworkFlow) error {
+	type pair struct{ source, destination netip.Addr }
+	totals := make(map[pair]int64)
+	for _, doc := range s.policy.apply(docs) {
+		source, err := netip.ParseAddr(doc.Source)
+		if err != nil {
+			return err
+		}
+		destination, err := netip.ParseAddr(doc.Destination)
+		if err != nil {
+			return err
+		}
+		totals[pair{source, destination}] += doc.Bytes
+	}
+
+	capturedAt := timestamppb.Now()
+	newBatch := func() *FlowBatch {
+		s.sequence++
+		return &FlowBatch{
+			Agent:      s.agent,
+			Session:    s.session,
+			Sequence:   s.sequence,
+			CapturedAt: capturedAt,
+			Interval:   durationpb.New(s.interval),
+		}
+	}
+	batch := newBatch()
+	for p, bytes := range totals {
+		if len(batch.Flows) == shipBatchSize {
+			s.pending = append(s.pending, batch)
+			batch = newBatch()
+		}
+		batch.Flows = append(batch.Flows, &FlowRecord{
+			Source:      p.source.AsSlice(),
+			Destination: p.destination.AsSlice(),
+			Bytes:       bytes,
+		})
+	}
+	s.pending = append(s.pending, batch)
+	if over := len(s.pending) - shipPending; over > 0 {
+		s.report.failed(fmt.Errorf("dropped %d unsent batches", over))
+		log.Printf("Dropping %d batches the collector has not acknowledged", over)
+		s.pending = s.pending[over:]
+	}
+	return s.flush(ctx)
+}
+
+// flush sends the pending batches in order, stopping at the first failure.
+// A batch the collector rejects as invalid is dropped rather than resent.
+func (s *flowShipper) flush(ctx context.Context) error {
+	for len(s.pending) > 0 {
+		batch := s.pending[0]
+		batch.SentAt = timestamppb.Now()
+		callCtx, cancel := context.WithTimeout(ctx, shipTimeout)
+		_, err := s.client.Ship(callCtx, batch)
+		cancel()
+		if status.Code(err) == codes.InvalidArgument {
+			log.Printf("Dropping batch %d: %s", batch.Sequence, err)
+		} else if err != nil {
+			err = fmt.Errorf("shipping %d records, %d batches pending: %w", len(batch.Flows), len(s.pending), err)
+			s.report.failed(err)
+			return err
+		} else {
+			var bytes int64
+			for _, record := range batch.Flows {
+				bytes += record.Bytes
+			}
+			s.report.shipped(int64(len(batch.Flows)), bytes, time.Now())
+		}
+		s.pending = s.pending[1:]
+	}
+	return nil
+}
+
+func (s *flowShipper) Close() error {
+	return s.conn.Close()
+}
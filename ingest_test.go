@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestShipSkipsInvalidRecords(t *testing.T) {
+	ingest := &flowIngest{
+		window:     newFlowWindow(),
+		stats:      &collectorStats{},
+		fleet:      newFleet(),
+		deliveries: newDeliveries(time.Hour),
+	}
+	a, b := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	batch := func(sequence uint64, flows ...*FlowRecord) *FlowBatch {
+		return &FlowBatch{Agent: "node-1", Session: "s", Sequence: sequence, Interval: durationpb.New(time.Minute), CapturedAt: timestamppb.Now(), SentAt: timestamppb.Now(), Flows: flows}
+	}
+
+	res, err := ingest.Ship(context.Background(), batch(1,
+		&FlowRecord{Source: a.AsSlice(), Destination: b.AsSlice(), Bytes: 100},
+		&FlowRecord{Source: []byte{10, 0, 0}, Destination: b.AsSlice(), Bytes: 1000},
+		&FlowRecord{Source: b.AsSlice(), Destination: a.AsSlice(), Bytes: 50},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Accepted != 2 || res.Duplicate {
+		t.Errorf("Ship = %+v, want 2 accepted", res)
+	}
+	if errors := ingest.stats.errors.Load(); errors != 1 {
+		t.Errorf("counted %d errors, want 1", errors)
+	}
+	now := time.Now()
+	if got := pairTotals(ingest.window.snapshot(now.Add(-time.Minute), now)); got[[2]string{"10.0.0.1", "10.0.0.2"}] != 100 || got[[2]string{"10.0.0.2", "10.0.0.1"}] != 50 {
+		t.Errorf("window holds %v", got)
+	}
+
+	// The batch's sequence was taken, so no gap waits for it and a resend
+	// is a duplicate.
+	if res, err := ingest.Ship(context.Background(), batch(1)); err != nil || !res.Duplicate {
+		t.Errorf("resend = %+v, %v, want a duplicate", res, err)
+	}
+	if _, err := ingest.Ship(context.Background(), batch(2)); err != nil {
+		t.Fatal(err)
+	}
+	if a := ingest.deliveries.agents["node-1"]; a.next != 3 || len(a.ahead) != 0 {
+		t.Errorf("next sequence %d with %d ahead, want 3 and none", a.next, len(a.ahead))
+	}
+}
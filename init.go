@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/elastic/go-elasticsearch/v8"
+	"gopkg.in/yaml.v3"
+)
+
+// probeTimeout bounds each call init and check make to Elasticsearch or
+// Kubernetes.
+const probeTimeout = 30 * time.Second
+
+// flowField is a field kube-netflow reads from Elasticsearch, the types it
+// works with and, for optional fields, what needs it.
+type flowField struct {
+	name   string
+	types  []string
+	usedBy string
+}
+
+var flowFields = []flowField{
+	{name: "@timestamp", types: []string{"date", "date_nanos"}},
+	{name: "source.ip", types: []string{"ip"}},
+	{name: "destination.ip", types: []string{"ip"}},
+	{name: "network.bytes", types: numericTypes},
+	{name: "destination.port", types: numericTypes, usedBy: "--protocols and the protocols command"},
+	{name: "network.protocol", types: []string{"keyword", "constant_keyword"}, usedBy: "--protocols and the protocols command"},
+	{name: exporterField, types: []string{"ip", "keyword"}, usedBy: "clock skew and exporter gap checks"},
+	{name: "event.ingested", types: []string{"date", "date_nanos"}, usedBy: "clock skew checks"},
+	{name: "flow.id", types: []string{"keyword"}, usedBy: "counting interim netflow exports once"},
+	{name: "netflow.octet_total_count", types: numericTypes, usedBy: "counting interim netflow exports once"},
+}
+
+var numericTypes = []string{"long", "integer", "unsigned_long", "double", "float", "scaled_float"}
+
+// wizard asks questions on the terminal, offering a default that an empty
+// answer, or the end of input, accepts.
+type wizard struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func (w *wizard) ask(question, def string) string {
+	if def != "" {
+		fmt.Fprintf(w.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(w.out, "%s: ", question)
+	}
+	line, err := w.in.ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Fprintln(w.out)
+		return def
+	}
+	if answer := strings.TrimSpace(line); answer != "" {
+		return answer
+	}
+	return def
+}
+
+func (w *wizard) confirm(question string, def bool) bool {
+	hint := "y/N"
+	if def {
+		hint = "Y/n"
+	}
+	for {
+		switch strings.ToLower(w.ask(question+" ("+hint+")", "")) {
+		case "":
+			return def
+		case "y", "yes":
+			return true
+		case "n", "no":
+			return false
+		}
+	}
+}
+
+// choose asks until the answer is one of options.
+func (w *wizard) choose(question string, options []string, def string) string {
+	for {
+		answer := w.ask(fmt.Sprintf("%s (%s)", question, strings.Join(options, ", ")), def)
+		for _, option := range options {
+			if answer == option {
+				return answer
+			}
+		}
+		fmt.Fprintf(w.out, "Please answer one of %s.\n", strings.Join(options, ", "))
+	}
+}
+
+// runInit walks through a first configuration: it probes Elasticsearch for
+// flow indices and their mappings and Kubernetes for the addresses of the
+// cluster, suggests settings from them and writes the answers as a config
+// file, which is loaded back to check it.
+func runInit(args []string) {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	outputPtr := fs.String("output", "kube-netflow.yaml", "Config file to write, TOML when it ends in .toml and YAML otherwise")
+	forcePtr := fs.Bool("force", false, "Overwrite the config file if it exists")
+	fs.Parse(args)
+
+	path := *outputPtr
+	if _, err := os.Stat(path); err == nil && !*forcePtr {
+		log.Fatalf("%s exists; pass --force to overwrite it", path)
+	}
+
+	w := &wizard{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+	cfg := defaultConfig()
+	settings := map[string]interface{}{"source": "elasticsearch"}
+	fmt.Fprintln(w.out, "kube-netflow init writes a config file for querying flows in Elasticsearch. Press Enter to accept the suggestion in brackets.")
+
+	elastic := initElasticsearch(w, &cfg.Elasticsearch)
+	settings["elasticsearch"] = elastic
+
+	fmt.Fprintln(w.out)
+	if w.confirm("Label addresses with their Kubernetes pod, service and node names?", true) {
+		kube := map[string]interface{}{"labels": true}
+		cfg.Kubernetes.Kubeconfig = w.ask("Kubeconfig, empty for the in-cluster service account or kubectl's default", "")
+		if cfg.Kubernetes.Kubeconfig != "" {
+			kube["kubeconfig"] = cfg.Kubernetes.Kubeconfig
+		}
+		if network, ok := probeKubernetes(w.out, cfg.Kubernetes.Kubeconfig); ok {
+			cfg.Network = []string{network}
+		}
+		if w.choose("Draw a node per", []string{"ip", "namespace"}, cfg.Kubernetes.GroupBy) == "namespace" {
+			kube["groupBy"] = "namespace"
+		}
+		settings["kubernetes"] = kube
+	}
+
+	fmt.Fprintln(w.out)
+	for {
+		answer := w.ask("Only draw flows with both ends in this CIDR, empty for all flows", strings.Join(cfg.Network, ","))
+		if answer == "" {
+			settings["network"] = []string{}
+			break
+		}
+		if _, _, err := cidrToRange(answer); err != nil {
+			fmt.Fprintln(w.out, err)
+			continue
+		}
+		settings["network"] = []string{answer}
+		break
+	}
+	for {
+		window := w.ask("Window to draw, such as 15m, 3h or 7d", cfg.Window)
+		if _, err := parseWindow(window); err != nil {
+			fmt.Fprintf(w.out, "Invalid window: %s\n", window)
+			continue
+		}
+		settings["window"] = window
+		break
+	}
+	settings["output"] = map[string]interface{}{
+		"path": w.ask("Diagram file", cfg.Output.Path),
+	}
+
+	data, err := encodeSettings(path, settings)
+	if err != nil {
+		log.Fatalf("Error encoding config: %s", err)
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		log.Fatalf("Error writing %s: %s", path, err)
+	}
+	if _, err := loadConfig([]string{"--config", path}); err != nil {
+		log.Fatalf("Wrote %s, but it does not load: %s", path, err)
+	}
+	fmt.Fprintf(w.out, "\nWrote %s. Render a diagram with:\n\n  kube-netflow --config %s\n", path, path)
+}
+
+// initElasticsearch asks for the cluster, its credentials and the flow
+// index until the cluster answers or the user gives up on it, and checks
+// the index's mappings. It returns the settings to write.
+func initElasticsearch(w *wizard, es *ElasticsearchConfig) map[string]interface{} {
+	settings := make(map[string]interface{})
+	for {
+		es.Addresses = []string{w.ask("Elasticsearch URL", es.Addresses[0])}
+		settings["addresses"] = es.Addresses
+		delete(settings, "credentials")
+		delete(settings, "username")
+		delete(settings, "password")
+		delete(settings, "apiKey")
+		es.Credentials, es.Username, es.Password, es.APIKey = CredentialsConfig{}, "", "", ""
+
+		switch w.choose("Authenticate with", []string{"env", "apikey", "basic", "none"}, "env") {
+		case "env":
+			fmt.Fprintln(w.out, "Credentials will be read from ELASTICSEARCH_USERNAME and ELASTICSEARCH_PASSWORD, or ELASTICSEARCH_API_KEY.")
+			es.Credentials.Provider = "env"
+			settings["credentials"] = map[string]interface{}{"provider": "env"}
+		case "apikey":
+			es.APIKey = w.ask("API key (stored in the config file)", "")
+			settings["apiKey"] = es.APIKey
+		case "basic":
+			es.Username = w.ask("Username", "")
+			es.Password = w.ask("Password (shown as typed and stored in the config file)", "")
+			settings["username"], settings["password"] = es.Username, es.Password
+		}
+
+		client, version, err := probeElasticsearch(*es)
+		if err == nil {
+			fmt.Fprintf(w.out, "Connected to Elasticsearch %s.\n", version)
+			es.Index = w.ask("Index pattern holding the flows", suggestIndex(client, es.Index))
+			settings["index"] = es.Index
+			checkMappings(w.out, client, es.Index)
+			break
+		}
+		fmt.Fprintf(w.out, "Cannot reach Elasticsearch: %s\n", err)
+		if !w.confirm("Try again?", true) {
+			es.Index = w.ask("Index pattern holding the flows", es.Index)
+			settings["index"] = es.Index
+			break
+		}
+	}
+
+	if w.confirm("Flag exporters whose clocks are off?", false) {
+		for {
+			skew, err := time.ParseDuration(w.ask("Largest clock skew to accept", "5m"))
+			if err == nil && skew > 0 {
+				settings["maxClockSkew"] = skew.String()
+				break
+			}
+			fmt.Fprintln(w.out, "Please answer a positive duration such as 90s or 5m.")
+		}
+	}
+	return settings
+}
+
+func probeElasticsearch(cfg ElasticsearchConfig) (*elasticsearch.Client, string, error) {
+	es, err := newElasticClient(cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	version, err := elasticVersion(ctx, es)
+	if err != nil {
+		return nil, "", err
+	}
+	return es, version, nil
+}
+
+// suggestIndex looks for the indices filebeat's and Elastic Agent's netflow
+// integrations write, falling back to def.
+func suggestIndex(es *elasticsearch.Client, def string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	res, err := es.Cat.Indices(es.Cat.Indices.WithContext(ctx), es.Cat.Indices.WithFormat("json"), es.Cat.Indices.WithH("index"))
+	if err != nil {
+		return def
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return def
+	}
+	var indices []struct {
+		Index string `json:"index"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&indices); err != nil {
+		return def
+	}
+	for _, pattern := range []struct{ contains, suggest string }{
+		{"logs-netflow.log-", "logs-netflow.log-*"},
+		{"filebeat-", "filebeat-*"},
+		{"packetbeat-", "packetbeat-*"},
+	} {
+		for _, index := range indices {
+			if strings.Contains(index.Index, pattern.contains) {
+				return pattern.suggest
+			}
+		}
+	}
+	return def
+}
+
+// checkMappings reports how index maps the fields kube-netflow reads and
+// what to change where it cannot use them.
+func checkMappings(w io.Writer, es *elasticsearch.Client, index string) {
+	types, err := fieldTypes(es, index)
+	if err != nil {
+		fmt.Fprintf(w, "Cannot read the mappings of %s: %s\n", index, err)
+		return
+	}
+	problems := mappingProblems(types)
+	if len(problems) == 0 {
+		fmt.Fprintf(w, "%s maps every field kube-netflow reads.\n", index)
+		return
+	}
+	fmt.Fprintf(w, "%s:\n", index)
+	for _, problem := range problems {
+		fmt.Fprintf(w, "  %s\n", problem)
+	}
+}
+
+// fieldTypes returns the types the indices matching index map each flow
+// field to, sorted.
+func fieldTypes(es *elasticsearch.Client, index string) (map[string][]string, error) {
+	names := make([]string, len(flowFields))
+	for i, field := range flowFields {
+		names[i] = field.name
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	res, err := es.Indices.GetFieldMapping(names, es.Indices.GetFieldMapping.WithIndex(index), es.Indices.GetFieldMapping.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, fmt.Errorf("field mapping: %s", res.String())
+	}
+	var indices map[string]struct {
+		Mappings map[string]struct {
+			Mapping map[string]struct {
+				Type string `json:"type"`
+			} `json:"mapping"`
+		} `json:"mappings"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&indices); err != nil {
+		return nil, err
+	}
+	if len(indices) == 0 {
+		return nil, fmt.Errorf("no index matches %s", index)
+	}
+	seen := make(map[string]map[string]bool)
+	for _, mappings := range indices {
+		for name, field := range mappings.Mappings {
+			for _, leaf := range field.Mapping {
+				if seen[name] == nil {
+					seen[name] = make(map[string]bool)
+				}
+				seen[name][leaf.Type] = true
+			}
+		}
+	}
+	types := make(map[string][]string, len(seen))
+	for name, kinds := range seen {
+		for kind := range kinds {
+			types[name] = append(types[name], kind)
+		}
+		sort.Strings(types[name])
+	}
+	return types, nil
+}
+
+// mappingProblems describes the flow fields that are missing or mapped to
+// types kube-netflow cannot use.
+func mappingProblems(types map[string][]string) []string {
+	var problems []string
+	for _, field := range flowFields {
+		kinds, ok := types[field.name]
+		switch {
+		case !ok && field.usedBy == "":
+			problems = append(problems, fmt.Sprintf("%s is missing; kube-netflow needs it", field.name))
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s is missing, leaving out %s", field.name, field.usedBy))
+		case len(kinds) > 1:
+			problems = append(problems, fmt.Sprintf("%s is mapped as %s in different indices; map it as %s in the index template", field.name, strings.Join(kinds, " and "), field.types[0]))
+		case !containsString(field.types, kinds[0]):
+			problems = append(problems, fmt.Sprintf("%s is mapped as %s; map it as %s in the index template", field.name, kinds[0], field.types[0]))
+		}
+	}
+	return problems
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// probeKubernetes reads the cluster's inventory and suggests the network
+// covering its IPv4 addresses.
+func probeKubernetes(w io.Writer, kubeconfig string) (string, bool) {
+	client, err := newKubeClient(kubeconfig)
+	if err != nil {
+		fmt.Fprintf(w, "Cannot reach Kubernetes: %s\n", err)
+		return "", false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	inventory, err := loadKubeInventory(ctx, client)
+	if err != nil {
+		fmt.Fprintf(w, "Cannot read the cluster's pods, services and nodes: %s\n", err)
+		return "", false
+	}
+
+	kinds := make(map[string]int)
+	var addrs []netip.Addr
+	for ip, endpoints := range inventory {
+		for _, endpoint := range endpoints {
+			if endpoint.Until.IsZero() {
+				kinds[endpoint.Kind]++
+			}
+		}
+		if addr, err := netip.ParseAddr(ip); err == nil && addr.Unmap().Is4() {
+			addrs = append(addrs, addr.Unmap())
+		}
+	}
+	fmt.Fprintf(w, "Found %d pods, %d services and %d nodes.\n", kinds["pod"], kinds["service"], kinds["node"])
+	network, ok := coveringPrefix(addrs)
+	// Anything wider than a /8 takes in most of the internet.
+	if !ok || network.Bits() < 8 {
+		return "", false
+	}
+	return network.String(), true
+}
+
+// coveringPrefix returns the longest prefix holding every one of addrs.
+func coveringPrefix(addrs []netip.Addr) (netip.Prefix, bool) {
+	if len(addrs) == 0 {
+		return netip.Prefix{}, false
+	}
+	prefix, _ := addrs[0].Prefix(addrs[0].BitLen())
+	for _, addr := range addrs[1:] {
+		for !prefix.Contains(addr) {
+			prefix, _ = prefix.Addr().Prefix(prefix.Bits() - 1)
+		}
+	}
+	return prefix, true
+}
+
+// encodeSettings writes settings as the file format path names.
+func encodeSettings(path string, settings map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("# Written by kube-netflow init. Flags override these settings; see kube-netflow -help.\n")
+	if strings.ToLower(filepath.Ext(path)) == ".toml" {
+		if err := toml.NewEncoder(&buf).Encode(settings); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	data, err := yaml.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(data)
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,195 @@
+//go:build integration
+
+package main
+
+// The integration tests run the Elasticsearch source end to end against a
+// cluster testsupport starts in Docker:
+//
+//	go test -tags integration ./...
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+
+	"kube-netflow/testsupport"
+)
+
+// elasticAddress is the URL of the cluster TestMain started.
+var elasticAddress string
+
+func TestMain(m *testing.M) {
+	ctx := context.Background()
+	cluster, err := testsupport.StartElasticsearch(ctx)
+	if err != nil {
+		log.Fatalf("Error starting Elasticsearch: %s", err)
+	}
+	elasticAddress = cluster.Address
+
+	code := m.Run()
+	if err := cluster.Terminate(ctx); err != nil {
+		log.Printf("Error stopping Elasticsearch: %s", err)
+	}
+	os.Exit(code)
+}
+
+// seedFlows creates a flow index named after the test, holding the fixture
+// flows of the hour before now, and returns a configuration reading it.
+func seedFlows(t *testing.T, now time.Time) (Config, *elasticsearch.Client) {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.Elasticsearch.Addresses = []string{elasticAddress}
+	cfg.Elasticsearch.Index = "flows-" + strings.ToLower(t.Name())
+	cfg.Window = "1h"
+	es, err := newElasticClient(cfg.Elasticsearch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := json.Marshal(rollupMapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := testsupport.CreateIndex(ctx, es, cfg.Elasticsearch.Index, body); err != nil {
+		t.Fatal(err)
+	}
+
+	docs := []NetworkFlow{
+		{Source: "10.0.0.1", Destination: "10.0.0.2", Bytes: 1000, Timestamp: now.Add(-50 * time.Minute)},
+		{Source: "10.0.0.1", Destination: "10.0.0.2", Bytes: 500, Timestamp: now.Add(-10 * time.Minute)},
+		{Source: "192.168.1.1", Destination: "192.168.1.2", Bytes: 2000, Timestamp: now.Add(-30 * time.Minute)},
+		{Source: "10.0.0.1", Destination: "192.168.1.1", Bytes: 4000, Timestamp: now.Add(-20 * time.Minute)},
+		// Outside the window.
+		{Source: "10.0.0.3", Destination: "10.0.0.4", Bytes: 8000, Timestamp: now.Add(-2 * time.Hour)},
+	}
+	if err := bulkIndex(ctx, es, cfg.Elasticsearch.Index, docs); err != nil {
+		t.Fatal(err)
+	}
+	refreshIndex(t, es, cfg.Elasticsearch.Index)
+	return cfg, es
+}
+
+func refreshIndex(t *testing.T, es *elasticsearch.Client, index string) {
+	t.Helper()
+	if err := testsupport.Refresh(context.Background(), es, index); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkTotals(t *testing.T, got, want map[[2]string]float64) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("got %d pairs %v, want %d %v", len(got), got, len(want), want)
+	}
+	for pair, bytes := range want {
+		if got[pair] != bytes {
+			t.Errorf("%s -> %s = %v bytes, want %v", pair[0], pair[1], got[pair], bytes)
+		}
+	}
+}
+
+func TestElasticsearchFetch(t *testing.T) {
+	now := time.Now().UTC()
+	cfg, _ := seedFlows(t, now)
+	source, err := newFlowSource(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	matrix, err := source.Fetch(ctx, now.Add(-time.Hour), now, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTotals(t, pairTotals(matrix), map[[2]string]float64{
+		{"10.0.0.1", "10.0.0.2"}:       1500,
+		{"192.168.1.1", "192.168.1.2"}: 2000,
+		{"10.0.0.1", "192.168.1.1"}:    4000,
+	})
+	if len(matrix.queries) != 1 || matrix.queries[0].Index != cfg.Elasticsearch.Index {
+		t.Errorf("recorded queries %+v, want one of %s", matrix.queries, cfg.Elasticsearch.Index)
+	}
+
+	// Pairs between the two networks match neither.
+	matrix, err = source.Fetch(ctx, now.Add(-time.Hour), now, []string{"10.0.0.0/8", "192.168.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTotals(t, pairTotals(matrix), map[[2]string]float64{
+		{"10.0.0.1", "10.0.0.2"}:       1500,
+		{"192.168.1.1", "192.168.1.2"}: 2000,
+	})
+}
+
+func TestElasticsearchRollup(t *testing.T) {
+	now := time.Now().UTC()
+	cfg, es := seedFlows(t, now)
+	ctx := context.Background()
+	index := rollupIndex("1h")
+	if err := ensureRollupIndex(ctx, es, index, nil); err != nil {
+		t.Fatal(err)
+	}
+	docs, err := rollupChunk(ctx, es, cfg.Elasticsearch.Index, nil, "1h", now.Add(-3*time.Hour).Truncate(time.Hour), now.Truncate(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bulkIndex(ctx, es, index, docs); err != nil {
+		t.Fatal(err)
+	}
+	refreshIndex(t, es, index)
+
+	// Reading whole hours from the rollup and the edges raw adds up to
+	// the raw totals.
+	from := now.Add(-3 * time.Hour)
+	raw, err := fetchWindow(ctx, es, cfg.Elasticsearch.Index, nil, from, now, "raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rolled, err := fetchWindow(ctx, es, cfg.Elasticsearch.Index, nil, from, now, "1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTotals(t, pairTotals(rolled), pairTotals(raw))
+	if len(rolled.queries) < 2 {
+		t.Errorf("rollup read took %d queries, want the rollup and the raw edges", len(rolled.queries))
+	}
+}
+
+func TestElasticsearchRender(t *testing.T) {
+	now := time.Now().UTC()
+	cfg, _ := seedFlows(t, now)
+	cfg.Output.Path = filepath.Join(t.TempDir(), "flows.png")
+	source, err := newFlowSource(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := render(context.Background(), cfg, source, newEnricher(cfg), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(cfg.Output.Path); err != nil || info.Size() == 0 {
+		t.Fatalf("no diagram at %s: %v", cfg.Output.Path, err)
+	}
+	data, err := os.ReadFile(cfg.Output.Path + ".manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest Manifest
+	if err := manifestFormat.decode(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Queries) == 0 || manifest.Queries[0].Index != cfg.Elasticsearch.Index {
+		t.Errorf("manifest queries %+v, want ones of %s", manifest.Queries, cfg.Elasticsearch.Index)
+	}
+	if manifest.Completeness == nil {
+		t.Error("manifest has no completeness score")
+	}
+}
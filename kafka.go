@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+// KafkaConfig names the document fields a Kafka protocol parser fills in.
+// They differ between shippers, so they are configurable.
+type KafkaConfig struct {
+	TopicField  string `yaml:"topicField" toml:"topicField"`
+	ClientField string `yaml:"clientField" toml:"clientField"`
+}
+
+type kafkaUsage struct {
+	Broker, Topic, Client string
+	Bytes                 float64
+}
+
+// fetchKafkaUsage breaks traffic to Kafka brokers down by topic and client.
+// Flows without topic metadata are reported under "-", so the share that
+// cannot be attributed stays visible.
+func fetchKafkaUsage(ctx context.Context, es *elasticsearch.Client, index string, cfg KafkaConfig, networkFilters []string, from, to time.Time) ([]kafkaUsage, error) {
+	conditions, err := flowConditions(networkFilters, timeRangeCondition(map[string]interface{}{
+		"gte": from.Format(time.RFC3339),
+		"lt":  to.Format(time.RFC3339),
+	}))
+	if err != nil {
+		return nil, err
+	}
+	conditions = append(conditions, protocolCondition([]string{"kafka"}))
+
+	terms := func(field string) map[string]interface{} {
+		return map[string]interface{}{"field": field, "size": termsSize, "missing": missingProtocol}
+	}
+	query := map[string]interface{}{
+		"size":  0,
+		"query": map[string]interface{}{"bool": map[string]interface{}{"must": conditions}},
+		"aggs": map[string]interface{}{
+			"brokers": map[string]interface{}{
+				"terms": map[string]interface{}{"field": "destination.ip", "size": termsSize},
+				"aggs": map[string]interface{}{
+					"topics": map[string]interface{}{
+						"terms": terms(cfg.TopicField),
+						"aggs": map[string]interface{}{
+							"clients": map[string]interface{}{
+								"terms": terms(cfg.ClientField),
+								"aggs": map[string]interface{}{
+									"bytes": map[string]interface{}{"sum": map[string]interface{}{"field": "network.bytes"}},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	result, err := search(ctx, es, index, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var usage []kafkaUsage
+	for _, broker := range buckets(result["aggregations"], "brokers") {
+		for _, topic := range buckets(broker, "topics") {
+			for _, client := range buckets(topic, "clients") {
+				usage = append(usage, kafkaUsage{
+					Broker: broker["key"].(string),
+					Topic:  fmt.Sprint(topic["key"]),
+					Client: fmt.Sprint(client["key"]),
+					Bytes:  client["bytes"].(map[string]interface{})["value"].(float64),
+				})
+			}
+		}
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Bytes > usage[j].Bytes })
+	return usage, nil
+}
+
+func runKafka(args []string) {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		log.Fatalf("Error loading config: %s", err)
+	}
+
+	fs := flag.NewFlagSet("kafka", flag.ExitOnError)
+	fs.String("config", "", "YAML or TOML configuration file; flags override its values")
+	fs.StringVar(&cfg.Window, "window", cfg.Window, "Time window to report on")
+	fs.Var((*stringList)(&cfg.Network), "network", "Network CIDR filter")
+	fs.StringVar(&cfg.Kafka.TopicField, "topic-field", cfg.Kafka.TopicField, "Document field holding the Kafka topic")
+	fs.StringVar(&cfg.Kafka.ClientField, "client-field", cfg.Kafka.ClientField, "Document field holding the Kafka client ID")
+	fs.Parse(args)
+
+	window, err := parseWindow(cfg.Window)
+	if err != nil {
+		log.Fatalf("Invalid window: %s", err)
+	}
+	es, err := newElasticClient(cfg.Elasticsearch)
+	if err != nil {
+		log.Fatalf("Error creating the client: %s", err)
+	}
+
+	to := time.Now()
+	usage, err := fetchKafkaUsage(context.Background(), es, cfg.Elasticsearch.Index, cfg.Kafka, cfg.Network, to.Add(-window), to)
+	if err != nil {
+		log.Fatalf("Error querying flows: %s", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "BROKER\tTOPIC\tCLIENT\tBYTES")
+	for _, u := range usage {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", u.Broker, u.Topic, u.Client, strconv.FormatFloat(u.Bytes, 'f', 0, 64))
+	}
+	w.Flush()
+}
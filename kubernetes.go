@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeClient talks to the Kubernetes API either directly with the pod's
+// service account or, outside a cluster, through kubectl so the usual
+// kubeconfig and context selection apply.
+type kubeClient struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+	kubeconfig string
+}
+
+func newKubeClient(kubeconfig string) (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if kubeconfig != "" || host == "" {
+		if _, err := exec.LookPath("kubectl"); err != nil {
+			return nil, fmt.Errorf("not running in a cluster and kubectl is not available: %w", err)
+		}
+		return &kubeClient{kubeconfig: kubeconfig}, nil
+	}
+
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+
+	return &kubeClient{
+		baseURL: "https://" + net.JoinHostPort(host, port),
+		token:   strings.TrimSpace(string(token)),
+		httpClient: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+func (c *kubeClient) get(ctx context.Context, path string, out interface{}) error {
+	return c.send(ctx, http.MethodGet, path, nil, out)
+}
+
+// kubectlVerbs are the kubectl commands that send each method to a raw
+// API path.
+var kubectlVerbs = map[string]string{
+	http.MethodGet:  "get",
+	http.MethodPost: "create",
+	http.MethodPut:  "replace",
+}
+
+// send makes a GET, or a POST or PUT of in, to path and decodes the
+// response into out. Errors for missing objects wrap fs.ErrNotExist.
+func (c *kubeClient) send(ctx context.Context, method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	if c.baseURL == "" {
+		verb := kubectlVerbs[method]
+		args := []string{verb, "--raw", path}
+		if in != nil {
+			args = append(args, "-f", "-")
+		}
+		if c.kubeconfig != "" {
+			args = append(args, "--kubeconfig", c.kubeconfig)
+		}
+		cmd := exec.CommandContext(ctx, "kubectl", args...)
+		cmd.Stdin = bytes.NewReader(body)
+		data, err := cmd.Output()
+		if err != nil {
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				stderr := strings.TrimSpace(string(exitErr.Stderr))
+				if strings.Contains(stderr, "(NotFound)") {
+					return fmt.Errorf("kubectl %s --raw %s: %w", verb, path, fs.ErrNotExist)
+				}
+				return fmt.Errorf("kubectl %s --raw %s: %s", verb, path, stderr)
+			}
+			return err
+		}
+		return json.Unmarshal(data, out)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%s %s: %w", method, path, fs.ErrNotExist)
+	case res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated:
+		return fmt.Errorf("%s %s: %s", method, path, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+type kubeMetadata struct {
+	Name              string            `json:"name"`
+	Namespace         string            `json:"namespace"`
+	Labels            map[string]string `json:"labels"`
+	CreationTimestamp time.Time         `json:"creationTimestamp"`
+	OwnerReferences   []struct {
+		Kind string `json:"kind"`
+	} `json:"ownerReferences"`
+}
+
+func (m kubeMetadata) ownedBy(kind string) bool {
+	for _, owner := range m.OwnerReferences {
+		if owner.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+type kubePod struct {
+	Metadata kubeMetadata `json:"metadata"`
+	Spec     struct {
+		NodeName    string `json:"nodeName"`
+		HostNetwork bool   `json:"hostNetwork"`
+	} `json:"spec"`
+	Status struct {
+		Phase  string `json:"phase"`
+		PodIPs []struct {
+			IP string `json:"ip"`
+		} `json:"podIPs"`
+		StartTime         time.Time             `json:"startTime"`
+		ContainerStatuses []kubeContainerStatus `json:"containerStatuses"`
+		// InitContainerStatuses include sidecars run as restartable init
+		// containers.
+		InitContainerStatuses []kubeContainerStatus `json:"initContainerStatuses"`
+	} `json:"status"`
+}
+
+type kubeContainerStatus struct {
+	Name string `json:"name"`
+	// ContainerID is the runtime's, as <runtime>://<id>.
+	ContainerID string `json:"containerID"`
+	State       struct {
+		Terminated *struct {
+			FinishedAt time.Time `json:"finishedAt"`
+		} `json:"terminated"`
+	} `json:"state"`
+}
+
+// finishedAt is when the last container of a succeeded or failed pod
+// stopped, zero when it is unknown.
+func (p kubePod) finishedAt() time.Time {
+	var finished time.Time
+	for _, status := range p.Status.ContainerStatuses {
+		if terminated := status.State.Terminated; terminated != nil && terminated.FinishedAt.After(finished) {
+			finished = terminated.FinishedAt
+		}
+	}
+	return finished
+}
+
+type kubeService struct {
+	Metadata kubeMetadata `json:"metadata"`
+	Spec     struct {
+		ClusterIPs []string `json:"clusterIPs"`
+	} `json:"spec"`
+}
+
+type kubeNode struct {
+	Metadata kubeMetadata `json:"metadata"`
+	Status   struct {
+		Addresses []struct {
+			Type    string `json:"type"`
+			Address string `json:"address"`
+		} `json:"addresses"`
+	} `json:"status"`
+}
+
+// kubeEndpoint is an object that owned an IP during [Since, Until). A zero
+// Until means it still owns it. HostNetwork marks pods that share their
+// node's address rather than owning it outright.
+type kubeEndpoint struct {
+	Kind        string    `json:"kind"`
+	Namespace   string    `json:"namespace,omitempty"`
+	Name        string    `json:"name"`
+	Since       time.Time `json:"since"`
+	Until       time.Time `json:"until"`
+	HostNetwork bool      `json:"hostNetwork,omitempty"`
+}
+
+func (e kubeEndpoint) sameObject(other kubeEndpoint) bool {
+	return e.Kind == other.Kind && e.Namespace == other.Namespace && e.Name == other.Name
+}
+
+func (e kubeEndpoint) Label() string {
+	if e.Namespace == "" {
+		return e.Kind + "/" + e.Name
+	}
+	return e.Namespace + "/" + e.Name
+}
+
+// overlap returns how long the endpoint owned its IP within [from, to).
+func (e kubeEndpoint) overlap(from, to time.Time) time.Duration {
+	if e.Since.After(from) {
+		from = e.Since
+	}
+	if !e.Until.IsZero() && e.Until.Before(to) {
+		to = e.Until
+	}
+	if !to.After(from) {
+		return 0
+	}
+	return to.Sub(from)
+}
+
+// kubeInventory maps IP addresses to every object known to have owned them,
+// since pod IPs are recycled as pods come and go.
+type kubeInventory map[string][]kubeEndpoint
+
+func (inv kubeInventory) add(ip string, endpoint kubeEndpoint) {
+	inv[ip] = append(inv[ip], endpoint)
+}
+
+// Resolve picks, for each IP, the owner that held it for the largest part of
+// [from, to). An object created after the window never claims its traffic.
+// Ranges split at handovers have one owner per IP, so their flows go to the
+// owner of their time.
+//
+// A node address used by exactly one host-network pod during the window is
+// attributed to that pod. With several, flows cannot be split without port
+// data and stay with the node.
+func (inv kubeInventory) Resolve(from, to time.Time) kubeOwners {
+	owners := make(kubeOwners)
+	for ip, endpoints := range inv {
+		var best time.Duration
+		var hostPods []kubeEndpoint
+		for _, endpoint := range endpoints {
+			d := endpoint.overlap(from, to)
+			if d == 0 {
+				continue
+			}
+			if endpoint.HostNetwork {
+				if len(hostPods) == 0 || !hostPods[0].sameObject(endpoint) {
+					hostPods = append(hostPods, endpoint)
+				}
+				continue
+			}
+			if d > best {
+				best = d
+				owners[ip] = endpoint
+			}
+		}
+		if owner, ok := owners[ip]; len(hostPods) == 1 && (!ok || owner.Kind == "node") {
+			owners[ip] = hostPods[0]
+		}
+	}
+	return owners
+}
+
+// maxHandovers bounds how many parts handovers splits a range into, each
+// one more query; beyond it, owners are picked by largest overlap within
+// the parts.
+const maxHandovers = 11
+
+// handovers returns the moments within (from, to), to the minute, at which
+// an IP passed from one owner to another, so a range split at them has a
+// single owner per IP. IPs first taken within the range, that carried no
+// traffic before, do not split it.
+func (inv kubeInventory) handovers(from, to time.Time) []time.Time {
+	seen := make(map[time.Time]bool)
+	var moments []time.Time
+	for _, endpoints := range inv {
+		var owners []kubeEndpoint
+		for _, endpoint := range endpoints {
+			if !endpoint.HostNetwork && endpoint.overlap(from, to) > 0 {
+				owners = append(owners, endpoint)
+			}
+		}
+		if len(owners) < 2 {
+			continue
+		}
+		for _, owner := range owners {
+			for _, moment := range []time.Time{owner.Since, owner.Until} {
+				moment = moment.Truncate(time.Minute)
+				if moment.After(from) && moment.Before(to) && !seen[moment] {
+					seen[moment] = true
+					moments = append(moments, moment)
+				}
+			}
+		}
+	}
+	sort.Slice(moments, func(i, j int) bool { return moments[i].Before(moments[j]) })
+	if len(moments) > maxHandovers {
+		// Keep handovers spread over the range.
+		spread := make([]time.Time, maxHandovers)
+		for i := range spread {
+			spread[i] = moments[i*len(moments)/maxHandovers]
+		}
+		moments = spread
+	}
+	return moments
+}
+
+func loadKubeInventory(ctx context.Context, client *kubeClient) (kubeInventory, error) {
+	inventory := make(kubeInventory)
+
+	var nodes struct{ Items []kubeNode }
+	if err := client.get(ctx, "/api/v1/nodes", &nodes); err != nil {
+		return nil, err
+	}
+	for _, node := range nodes.Items {
+		for _, address := range node.Status.Addresses {
+			if address.Type == "InternalIP" || address.Type == "ExternalIP" {
+				inventory.add(address.Address, kubeEndpoint{Kind: "node", Name: node.Metadata.Name, Since: node.Metadata.CreationTimestamp})
+			}
+		}
+	}
+
+	var services struct{ Items []kubeService }
+	if err := client.get(ctx, "/api/v1/services", &services); err != nil {
+		return nil, err
+	}
+	for _, service := range services.Items {
+		for _, ip := range service.Spec.ClusterIPs {
+			if ip != "None" {
+				inventory.add(ip, kubeEndpoint{
+					Kind:      "service",
+					Namespace: service.Metadata.Namespace,
+					Name:      service.Metadata.Name,
+					Since:     service.Metadata.CreationTimestamp,
+				})
+			}
+		}
+	}
+
+	var pods struct{ Items []kubePod }
+	if err := client.get(ctx, "/api/v1/pods", &pods); err != nil {
+		return nil, err
+	}
+	for _, pod := range pods.Items {
+		// Finished pods keep listing their IPs, which may since have gone
+		// to a live pod: they owned them until their containers stopped.
+		var until time.Time
+		if pod.Status.Phase == "Succeeded" || pod.Status.Phase == "Failed" {
+			if until = pod.finishedAt(); until.IsZero() {
+				continue
+			}
+		}
+		// DaemonSet pods on the host network (kube-proxy, CNI agents,
+		// exporters) are node infrastructure; their traffic stays with the node.
+		if pod.Spec.HostNetwork && pod.Metadata.ownedBy("DaemonSet") {
+			continue
+		}
+		since := pod.Status.StartTime
+		if since.IsZero() {
+			since = pod.Metadata.CreationTimestamp
+		}
+		for _, ip := range pod.Status.PodIPs {
+			// Windows host-process pods report the node IP without setting
+			// hostNetwork.
+			shared := pod.Spec.HostNetwork || inventory.isNode(ip.IP)
+			if shared && pod.Metadata.ownedBy("DaemonSet") {
+				continue
+			}
+			inventory.add(ip.IP, kubeEndpoint{Kind: "pod", Namespace: pod.Metadata.Namespace, Name: pod.Metadata.Name, Since: since, Until: until, HostNetwork: shared})
+		}
+	}
+
+	return inventory, nil
+}
+
+// kubeContainer is a container of a pod.
+type kubeContainer struct {
+	Namespace, Pod, Name string
+}
+
+func (c kubeContainer) Label() string {
+	return c.Namespace + "/" + c.Pod + "/" + c.Name
+}
+
+// loadKubeContainers maps the runtime IDs of the containers of every pod,
+// without the runtime prefix, to the container.
+func loadKubeContainers(ctx context.Context, client *kubeClient) (map[string]kubeContainer, error) {
+	var pods struct{ Items []kubePod }
+	if err := client.get(ctx, "/api/v1/pods", &pods); err != nil {
+		return nil, err
+	}
+	containers := make(map[string]kubeContainer)
+	for _, pod := range pods.Items {
+		for _, statuses := range [][]kubeContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+			for _, status := range statuses {
+				if _, id, ok := strings.Cut(status.ContainerID, "://"); ok {
+					containers[id] = kubeContainer{Namespace: pod.Metadata.Namespace, Pod: pod.Metadata.Name, Name: status.Name}
+				}
+			}
+		}
+	}
+	return containers, nil
+}
+
+func (inv kubeInventory) isNode(ip string) bool {
+	for _, endpoint := range inv[ip] {
+		if endpoint.Kind == "node" {
+			return true
+		}
+	}
+	return false
+}
+
+// kubeOwners maps each IP to its single owner for one query window.
+type kubeOwners map[string]kubeEndpoint
+
+// assignHosts attributes node addresses to explicitly configured workloads.
+// Keys are node names or IPs and values are namespace/name labels.
+func (owners kubeOwners) assignHosts(hosts map[string]string) error {
+	for host, workload := range hosts {
+		namespace, name, ok := strings.Cut(workload, "/")
+		if !ok || namespace == "" || name == "" {
+			return fmt.Errorf("host owner for %s must be namespace/name, got %q", host, workload)
+		}
+		endpoint := kubeEndpoint{Kind: "pod", Namespace: namespace, Name: name, HostNetwork: true}
+		if net.ParseIP(host) != nil {
+			owners[host] = endpoint
+			continue
+		}
+		for ip, owner := range owners {
+			if owner.Kind == "node" && owner.Name == host {
+				owners[ip] = endpoint
+			}
+		}
+	}
+	return nil
+}
+
+func (owners kubeOwners) label(ip string) string {
+	if endpoint, ok := owners[ip]; ok {
+		return endpoint.Label()
+	}
+	return ip
+}
+
+func (owners kubeOwners) namespace(ip string) string {
+	endpoint, ok := owners[ip]
+	switch {
+	case !ok:
+		return ip
+	case endpoint.Kind == "node":
+		return "nodes"
+	default:
+		return endpoint.Namespace
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LimitsConfig bounds the resources the long-running modes use.
+type LimitsConfig struct {
+	// QueryConcurrency and RenderConcurrency cap how many source queries
+	// and diagram renders serve runs at once; further requests wait.
+	QueryConcurrency  int `yaml:"queryConcurrency" toml:"queryConcurrency"`
+	RenderConcurrency int `yaml:"renderConcurrency" toml:"renderConcurrency"`
+	// MemoryBudget, e.g. "512MiB" or "2GB", is a soft limit: the garbage
+	// collector works harder as the heap approaches it, and serve turns
+	// requests away while the heap is above it.
+	MemoryBudget string `yaml:"memoryBudget" toml:"memoryBudget"`
+	// MaxWindow is the longest window or from/to range a serve request may
+	// ask for; longer ones are cut to their most recent MaxWindow. 0 allows
+	// any length.
+	MaxWindow time.Duration `yaml:"maxWindow" toml:"maxWindow"`
+	// RequestRate is the queries per second serve answers each client, by
+	// bearer token or else by address, over HTTP and gRPC; RequestBurst
+	// more may come at once. 0 allows any rate.
+	RequestRate  float64 `yaml:"requestRate" toml:"requestRate"`
+	RequestBurst int     `yaml:"requestBurst" toml:"requestBurst"`
+}
+
+var byteUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tb":  1e12,
+	"tib": 1 << 40,
+}
+
+func parseByteSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	i := strings.IndexFunc(value, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(value)
+	}
+	n, err := strconv.ParseFloat(value[:i], 64)
+	unit, ok := byteUnits[strings.ToLower(strings.TrimSpace(value[i:]))]
+	if err != nil || !ok || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// apply sets the runtime's soft memory limit and returns the budget in
+// bytes, 0 meaning none.
+func (l LimitsConfig) apply() (int64, error) {
+	if l.MemoryBudget == "" {
+		return 0, nil
+	}
+	budget, err := parseByteSize(l.MemoryBudget)
+	if err != nil {
+		return 0, fmt.Errorf("memoryBudget: %w", err)
+	}
+	if budget > 0 {
+		debug.SetMemoryLimit(budget)
+	}
+	return budget, nil
+}
+
+// heapInUse reads the bytes held by live and not yet collected objects
+// without stopping the world.
+func heapInUse() int64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	return int64(sample[0].Value.Uint64())
+}
+
+// semaphore limits concurrent work; a nil semaphore does not.
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+func (s semaphore) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// rateLimiter keeps a token bucket per client; a nil rateLimiter allows
+// everything.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate, burst: float64(max(burst, 1)), buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token from client's bucket. When it is empty, it returns
+// how long until the next token.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// A bucket idle long enough to refill is the same as none.
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.swept) > full {
+		for key, bucket := range l.buckets {
+			if now.Sub(bucket.last) > full {
+				delete(l.buckets, key)
+			}
+		}
+		l.swept = now
+	}
+
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = bucket
+	}
+	bucket.tokens = min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// rateClient names what a request counts against: the hash of its bearer
+// token when it sends one, its host otherwise.
+func rateClient(authorization, addr string) string {
+	if token, ok := strings.CutPrefix(authorization, "Bearer "); ok && token != "" {
+		sum := sha256.Sum256([]byte(token))
+		return "token " + hex.EncodeToString(sum[:8])
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// limit answers 429 Too Many Requests to clients over their rate.
+func (l *rateLimiter) limit(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := l.allow(rateClient(r.Header.Get("Authorization"), r.RemoteAddr), time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
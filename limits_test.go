@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(2, 3)
+	now := time.Unix(0, 0)
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.allow("a", now); !ok {
+			t.Fatalf("request %d of the burst refused", i+1)
+		}
+	}
+	ok, wait := limiter.allow("a", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("request over the burst = %v, retry in %s; want refused, retry in 500ms", ok, wait)
+	}
+	if ok, _ := limiter.allow("b", now); !ok {
+		t.Error("another client's request refused")
+	}
+	if ok, _ := limiter.allow("a", now.Add(500*time.Millisecond)); !ok {
+		t.Error("request after the bucket refilled a token refused")
+	}
+
+	if ok, _ := (*rateLimiter)(nil).allow("a", now); !ok {
+		t.Error("request refused without a limit")
+	}
+	if got := rateClient("Bearer secret", "10.0.0.1:5000"); got == "10.0.0.1" || got == "secret" {
+		t.Errorf("client of a token = %q, want its hash", got)
+	}
+	if got := rateClient("", "10.0.0.1:5000"); got != "10.0.0.1" {
+		t.Errorf("client = %q, want 10.0.0.1", got)
+	}
+}
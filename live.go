@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// liveCache shares pushed results between the clients watching the same
+// query, so the source is asked once per interval however many are open.
+type liveCache struct {
+	mu      sync.Mutex
+	results map[string]liveResult
+}
+
+type liveResult struct {
+	query  flowQuery
+	matrix *FlowMatrix
+}
+
+func (c *liveCache) get(key string, maxAge time.Duration) (liveResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result, ok := c.results[key]
+	return result, ok && time.Since(result.query.RefreshedAt) < maxAge
+}
+
+// put stores a result and drops those nobody has refreshed for a while.
+func (c *liveCache) put(key string, result liveResult, maxAge time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.results == nil {
+		c.results = make(map[string]liveResult)
+	}
+	for other, old := range c.results {
+		if time.Since(old.query.RefreshedAt) > 2*maxAge {
+			delete(c.results, other)
+		}
+	}
+	c.results[key] = result
+}
+
+func liveKey(cfg Config) string {
+	return cfg.Window + "|" + strings.Join(cfg.Network, ",")
+}
+
+var upgrader = websocket.Upgrader{
+	// The UI is served from the same origin; other tools send none.
+	CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || strings.TrimPrefix(strings.TrimPrefix(origin, "https://"), "http://") == r.Host
+	},
+}
+
+// serveLive handles /ws. It takes the /api/v1/flows parameters plus an
+// optional interval, no shorter than the server's, and sends the same JSON
+// document as a text message every interval until the client goes away.
+func (s *diagramServer) serveLive(w http.ResponseWriter, r *http.Request) {
+	cfg, window, _, err := s.parseQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	interval := s.pushInterval
+	if value := r.URL.Query().Get("interval"); value != "" {
+		requested, err := time.ParseDuration(value)
+		if err != nil {
+			http.Error(w, "invalid interval: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		interval = max(interval, requested)
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// Reading handles control frames and notices when the client leaves.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	key := liveKey(cfg)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if s.budget > 0 && heapInUse() > s.budget {
+			log.Printf("Skipping live update for %s: over memory budget", r.RemoteAddr)
+		} else if err := s.push(ctx, conn, cfg, window, key, interval); err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Error pushing live update to %s: %s", r.RemoteAddr, err)
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error()), time.Now().Add(time.Second))
+			}
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *diagramServer) push(ctx context.Context, conn *websocket.Conn, cfg Config, window time.Duration, key string, interval time.Duration) error {
+	result, err := s.liveUpdate(ctx, cfg, window, key, interval)
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(interval))
+	return conn.WriteJSON(s.flowsResponse(ctx, cfg, result.query, result.matrix))
+}
+
+// liveUpdate returns the result for a pushed query, fetching it unless
+// another client's is recent enough.
+func (s *diagramServer) liveUpdate(ctx context.Context, cfg Config, window time.Duration, key string, interval time.Duration) (liveResult, error) {
+	// Allow for the tickers of different clients being out of phase.
+	if result, ok := s.live.get(key, interval/2); ok {
+		return result, nil
+	}
+	fetchCtx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	query, matrix, err := s.fetch(fetchCtx, cfg, window)
+	if err != nil {
+		return liveResult{}, err
+	}
+	result := liveResult{query: query, matrix: matrix}
+	s.live.put(key, result, interval)
+	return result, nil
+}
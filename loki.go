@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LokiConfig holds a LogQL metric query whose result vector is labelled by
+// source and destination. $window in the query is replaced with the window
+// length, e.g. [$window] becomes [10800s].
+type LokiConfig struct {
+	URL              string `yaml:"url" toml:"url"`
+	Username         string `yaml:"username" toml:"username"`
+	Password         string `yaml:"password" toml:"password"`
+	Tenant           string `yaml:"tenant" toml:"tenant"`
+	Query            string `yaml:"query" toml:"query"`
+	SourceLabel      string `yaml:"sourceLabel" toml:"sourceLabel"`
+	DestinationLabel string `yaml:"destinationLabel" toml:"destinationLabel"`
+}
+
+type lokiSource struct {
+	cfg        LokiConfig
+	httpClient *http.Client
+}
+
+func newLokiSource(cfg LokiConfig) (*lokiSource, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("loki source needs url")
+	}
+	return &lokiSource{cfg: cfg, httpClient: &http.Client{Timeout: 5 * time.Minute}}, nil
+}
+
+func (s *lokiSource) Name() string {
+	return "loki"
+}
+
+func (s *lokiSource) get(ctx context.Context, path string, params url.Values, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(s.cfg.URL, "/")+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if s.cfg.Username != "" {
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+	if s.cfg.Tenant != "" {
+		req.Header.Set("X-Scope-OrgID", s.cfg.Tenant)
+	}
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return fmt.Errorf("loki: %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func (s *lokiSource) Version(ctx context.Context) (string, error) {
+	var info struct {
+		Version string `json:"version"`
+	}
+	if err := s.get(ctx, "/loki/api/v1/status/buildinfo", url.Values{}, &info); err != nil {
+		return "", err
+	}
+	return info.Version, nil
+}
+
+func (s *lokiSource) Fetch(ctx context.Context, from, to time.Time, networkFilters []string) (*FlowMatrix, error) {
+	filter, err := parseCIDRFilter(networkFilters)
+	if err != nil {
+		return nil, err
+	}
+
+	window := fmt.Sprintf("%ds", int64(to.Sub(from).Seconds()))
+	params := url.Values{}
+	params.Set("query", strings.ReplaceAll(s.cfg.Query, "$window", window))
+	params.Set("time", strconv.FormatInt(to.UnixNano(), 10))
+
+	var result struct {
+		Data struct {
+			ResultType string `json:"resultType"`
+			Result     []struct {
+				Metric map[string]string `json:"metric"`
+				Value  [2]interface{}    `json:"value"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := s.get(ctx, "/loki/api/v1/query", params, &result); err != nil {
+		return nil, err
+	}
+	if result.Data.ResultType != "vector" {
+		return nil, fmt.Errorf("loki: query returned %q, expected a vector", result.Data.ResultType)
+	}
+
+	matrix := NewFlowMatrix()
+	for _, sample := range result.Data.Result {
+		source := sample.Metric[s.cfg.SourceLabel]
+		destination := sample.Metric[s.cfg.DestinationLabel]
+		if source == "" || destination == "" || !filter.match(source, destination) {
+			continue
+		}
+		value, _ := sample.Value[1].(string)
+		bytes, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("loki: invalid sample value %q", value)
+		}
+		matrix.Add(source, destination, bytes)
+	}
+	return matrix, nil
+}
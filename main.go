@@ -2,369 +2,419 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"image/color"
 	"log"
-	"math"
-	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
-
-	"github.com/elastic/go-elasticsearch/v8"
-	"gonum.org/v1/plot"
-	"gonum.org/v1/plot/vg"
-	"gonum.org/v1/plot/vg/draw"
 )
 
-func cidrToRange(cidr string) (string, string) {
-	_, ipNet, err := net.ParseCIDR(cidr)
-	if err != nil {
-		log.Fatalf("Invalid CIDR notation: %s", cidr)
-	}
-
-	network := ipNet.IP
-	broadcast := make(net.IP, len(network))
-	copy(broadcast, network)
-	for i := range broadcast {
-		broadcast[i] |= ^ipNet.Mask[i]
-	}
-
-	return network.String(), broadcast.String()
-}
-
 type NetworkFlow struct {
-	Source      string    `json:"source.ip"`
-	Destination string    `json:"destination.ip"`
-	Bytes       int64     `json:"network.bytes"`
-	Timestamp   time.Time `json:"@timestamp"`
-}
-
-type ChordDiagram struct {
-	Flow   [][]float64
-	Labels []string
-	Color  func(i, j int) color.Color
+	Source          string `json:"source.ip"`
+	Destination     string `json:"destination.ip"`
+	SourcePort      int    `json:"source.port,omitempty"`
+	DestinationPort int    `json:"destination.port,omitempty"`
+	Transport       string `json:"network.transport,omitempty"`
+	Bytes           int64  `json:"network.bytes"`
+	// ContainerID is the runtime ID of the sending container, from agents
+	// counting per container.
+	ContainerID string `json:"container.id,omitempty"`
+	// Flows is how many flow records a rollup document stands for.
+	Flows     int64     `json:"flow.count,omitempty"`
+	Timestamp time.Time `json:"@timestamp"`
 }
 
-func (c ChordDiagram) Plot(canvas draw.Canvas, plt *plot.Plot) {
-	origin := vg.Point{X: canvas.Size().X / 2, Y: canvas.Size().Y / 2}
-	radius := math.Min(float64(canvas.Size().X), float64(canvas.Size().Y)) * 0.35
-
-	n := len(c.Flow)
-	angleStep := 2 * math.Pi / float64(n)
-
-	outerLabelFont := plot.DefaultFont
-	outerLabelFont.Size = vg.Length(12)
-	outerLabelStyle := draw.TextStyle{
-		Color:   color.Black,
-		Font:    outerLabelFont,
-		Handler: plot.DefaultTextHandler,
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rollup":
+			runRollup(os.Args[2:])
+			return
+		case "ipwatch":
+			runIPWatch(os.Args[2:])
+			return
+		case "verify":
+			runVerify(os.Args[2:])
+			return
+		case "protocols":
+			runProtocols(os.Args[2:])
+			return
+		case "containers":
+			runContainers(os.Args[2:])
+			return
+		case "mesh":
+			runMesh(os.Args[2:])
+			return
+		case "collect":
+			runCollect(os.Args[2:])
+			return
+		case "kafka":
+			runKafka(os.Args[2:])
+			return
+		case "databases":
+			runDatabases(os.Args[2:])
+			return
+		case "domains":
+			runDomains(os.Args[2:])
+			return
+		case "agent":
+			runAgent(os.Args[2:])
+			return
+		case "loadgen":
+			runLoadgen(os.Args[2:])
+			return
+		case "serve":
+			runServe(os.Args[2:])
+			return
+		case "exporter":
+			runExporter(os.Args[2:])
+			return
+		case "migrate":
+			runMigrate(os.Args[2:])
+			return
+		case "init":
+			runInit(os.Args[2:])
+			return
+		case "check":
+			runCheck(os.Args[2:])
+			return
+		}
 	}
 
-	baseLabelFont := plot.DefaultFont
-	baseLabelFont.Size = vg.Length(12)
-	baseLabelStyle := draw.TextStyle{
-		Color:   color.Black,
-		Font:    baseLabelFont,
-		Handler: plot.DefaultTextHandler,
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Error loading config: %s", err)
 	}
 
-	for i := 0; i < n; i++ {
-		angle := float64(i) * angleStep
-		startAngle := angle - angleStep/3
-		endAngle := angle + angleStep/3
-
-		var path vg.Path
-		path.Move(pointOnCircle(origin, vg.Length(radius), startAngle))
-		path.Arc(origin, vg.Length(radius), startAngle, endAngle-startAngle)
-		canvas.SetLineWidth(vg.Points(2)) // Thicker arc lines
-		canvas.SetColor(color.RGBA{100, 100, 100, 255})
-		canvas.Stroke(path)
-
-		if c.Labels != nil {
-			baseAngle := angle
-			basePos := pointOnCircle(origin, vg.Length(radius*1.07), baseAngle)
+	flag.String("config", "", "YAML or TOML configuration file; flags override its values")
+	flag.StringVar(&cfg.Window, "window", cfg.Window, "Time window for data (e.g., 15m, 1h, 24h)")
+	flag.StringVar(&cfg.CompareWindow, "compare-window", cfg.CompareWindow, "Also query the window this long before (e.g. 1d for the same hours yesterday) and write a diff diagram and table of the changes")
+	flag.Var((*stringList)(&cfg.Network), "network", "Network CIDR filter (e.g., '10.0.0.0/8,192.168.0.0/16')")
+	flag.StringVar(&cfg.Elasticsearch.APIKey, "es-api-key", cfg.Elasticsearch.APIKey, "Base64-encoded Elasticsearch API key (prefer the config file or ELASTICSEARCH_API_KEY)")
+	flag.StringVar(&cfg.Elasticsearch.ServiceToken, "es-service-token", cfg.Elasticsearch.ServiceToken, "Elasticsearch service account token (prefer the config file or ELASTICSEARCH_SERVICE_TOKEN)")
+	flag.StringVar(&cfg.Elasticsearch.TLS.CAFile, "es-ca-file", cfg.Elasticsearch.TLS.CAFile, "PEM bundle of CAs trusted for the Elasticsearch connection")
+	flag.StringVar(&cfg.Elasticsearch.TLS.CertFile, "es-cert-file", cfg.Elasticsearch.TLS.CertFile, "Client certificate for mutual TLS with Elasticsearch")
+	flag.StringVar(&cfg.Elasticsearch.TLS.KeyFile, "es-key-file", cfg.Elasticsearch.TLS.KeyFile, "Private key for --es-cert-file")
+	flag.BoolVar(&cfg.Elasticsearch.TLS.InsecureSkipVerify, "es-insecure-skip-verify", cfg.Elasticsearch.TLS.InsecureSkipVerify, "Do not verify the Elasticsearch server certificate (testing only)")
+	flag.StringVar(&cfg.Source, "source", cfg.Source, "Flow data source: "+strings.Join(sourceNames(), ", ")+", or a plugin named in the config")
+	flag.StringVar(&cfg.Shadow.Source, "shadow-source", cfg.Shadow.Source, "Also query this source and log where it disagrees with --source, e.g. while migrating backends")
+	flag.StringVar(&cfg.Hubble.Server, "hubble-server", cfg.Hubble.Server, "Hubble Relay address for --source=hubble (defaults to the hubble CLI's)")
+	flag.StringVar(&cfg.Pcap.File, "file", cfg.Pcap.File, "Packet capture (pcap or pcapng) for --source=pcap; its time range replaces --window")
+	flag.StringVar(&cfg.BigQuery.Table, "bq-table", cfg.BigQuery.Table, "BigQuery table holding exported GCP VPC Flow Logs (project.dataset.table, * for sharded exports)")
+	demoPtr := flag.Bool("demo", false, "Render a synthetic cluster traffic matrix (same as --source=demo)")
+	flag.StringVar(&cfg.Privacy.PseudonymizeKeyFile, "pseudonymize-key-file", cfg.Privacy.PseudonymizeKeyFile, "File with a secret key used to replace IPs and names with stable HMAC pseudonyms")
+	flag.BoolVar(&cfg.Kubernetes.Labels, "kube-labels", cfg.Kubernetes.Labels, "Label IPs with Kubernetes pod, service, or node names")
+	flag.StringVar(&cfg.Kubernetes.Kubeconfig, "kubeconfig", cfg.Kubernetes.Kubeconfig, "Kubeconfig used for --kube-labels outside the cluster (defaults to kubectl's)")
+	flag.StringVar(&cfg.Kubernetes.OwnershipIndex, "ownership-index", cfg.Kubernetes.OwnershipIndex, "IP ownership history written by kube-netflow ipwatch, used to label past windows")
+	flag.BoolVar(&cfg.Enrichment.ReverseDNS, "reverse-dns", cfg.Enrichment.ReverseDNS, "Label addresses Kubernetes does not know with their reverse DNS name")
+	flag.StringVar(&cfg.Enrichment.StaticLabelsFile, "labels-file", cfg.Enrichment.StaticLabelsFile, "Hosts-style file naming addresses and CIDR ranges outside Kubernetes, e.g. '192.168.1.10 nas'")
+	flag.StringVar(&cfg.Kubernetes.GroupBy, "group-by", cfg.Kubernetes.GroupBy, "Aggregate nodes by ip or namespace")
+	flag.Float64Var(&cfg.Privacy.MinPairBytes, "min-pair-bytes", cfg.Privacy.MinPairBytes, "Suppress conversations carrying fewer bytes than this")
+	flag.Float64Var(&cfg.Privacy.MinPairFlows, "min-pair-flows", cfg.Privacy.MinPairFlows, "Suppress conversations seen in fewer flow records than this (elasticsearch source only)")
+	flag.Float64Var(&cfg.Privacy.NoiseEpsilon, "noise-epsilon", cfg.Privacy.NoiseEpsilon, "Add Laplace noise with this privacy budget to pair totals (0 disables)")
+	flag.Float64Var(&cfg.Privacy.NoiseSensitivity, "noise-sensitivity", cfg.Privacy.NoiseSensitivity, "Largest byte contribution of a single flow, used to scale the noise")
+	flag.StringVar(&cfg.Output.SignKey, "sign-key", cfg.Output.SignKey, "PEM-encoded Ed25519 private key used to sign the artifact and its manifest")
+	flag.Var((*stringList)(&cfg.Protocols), "protocol", "Only show conversations of these protocols (e.g. 'postgres,redis'; elasticsearch source only)")
+	flag.DurationVar(&cfg.Elasticsearch.MaxClockSkew, "max-clock-skew", cfg.Elasticsearch.MaxClockSkew, "Flag exporters whose flow timestamps stray further than this from Elasticsearch ingest time (0 disables)")
+	flag.BoolVar(&cfg.Elasticsearch.CorrectClockSkew, "correct-clock-skew", cfg.Elasticsearch.CorrectClockSkew, "Read flagged exporters' raw flows from where their clocks put them, so they land in the right window")
+	flag.BoolVar(&cfg.ShiftLag, "shift-lag", cfg.ShiftLag, "End the window at the newest indexed flow when ingestion lags behind now")
+	flag.StringVar(&cfg.Output.Path, "output", cfg.Output.Path, "File to write the diagram to, or - for standard output")
+	flag.Float64Var(&cfg.Output.Width, "width", cfg.Output.Width, "Diagram width in inches")
+	flag.Float64Var(&cfg.Output.Height, "height", cfg.Output.Height, "Diagram height in inches")
+	flag.IntVar(&cfg.Output.DPI, "dpi", cfg.Output.DPI, "Resolution of PNG output in dots per inch")
+	flag.StringVar(&cfg.Output.Format, "format", cfg.Output.Format, "Output format: png, svg, pdf or eps for the chord diagram, html for a self-contained report with the diagram and top talkers, or nodegraph for Grafana Node Graph JSON; the output's extension follows it")
+	flag.StringVar(&cfg.Resolution, "resolution", cfg.Resolution, "Data resolution: raw, 1h, 1d, or auto to pick rollups by window length")
+	flag.StringVar(&cfg.Output.Layout, "layout", cfg.Output.Layout, "Diagram layout: chord, bundled for chords bundled between namespaces or subnets, heatmap for a grid of sources by destinations that stays readable with many nodes, or graph for a force-directed graph that shows hubs and isolated groups")
+	flag.BoolVar(&cfg.Output.ClusterNamespaces, "cluster-namespaces", cfg.Output.ClusterNamespaces, "Pull each namespace's nodes together and colour them by namespace in the graph layout")
+	flag.StringVar(&cfg.Output.Theme, "theme", cfg.Output.Theme, "Diagram theme: light, dark, or print for grayscale with dashed chords")
+	flag.StringVar(&cfg.Output.Lang, "lang", cfg.Output.Lang, "Language of HTML reports and tables: en, de, es or fr")
+	flag.BoolVar(&cfg.Output.Table, "table", cfg.Output.Table, "Also write the data as an accessible, sortable HTML table next to the output")
+	flag.StringVar(&cfg.Output.Bundle, "bundle", cfg.Output.Bundle, "Also package the outputs, manifest and CSV/JSON data into this zip archive")
+	flag.StringVar(&cfg.Output.Timelapse, "timelapse", cfg.Output.Timelapse, "Also write the window as an animated .gif or .mp4 (needs ffmpeg) with one diagram per slice of it")
+	flag.IntVar(&cfg.Output.Frames, "frames", cfg.Output.Frames, "How many slices --timelapse splits the window into")
+	flag.IntVar(&cfg.Output.Keep, "keep", cfg.Output.Keep, "Keep this many timestamped copies of the output and bundle next to them, pruning older ones")
+	flag.Var((*stringList)(&cfg.Email.To), "email-to", "Mail each rendered output to these addresses, using the email settings of the config")
+	flag.StringVar(&cfg.Slack.Channel, "slack-channel", cfg.Slack.Channel, "Upload each rendered output to this Slack channel ID (token from the config or SLACK_TOKEN)")
+	flag.StringVar(&cfg.Webhook.URL, "webhook-url", cfg.Webhook.URL, "POST a JSON summary of each run to this URL")
+	flag.StringVar(&cfg.Alerts.Rules, "alert-rules", cfg.Alerts.Rules, "Check the rules in this YAML or TOML file after each query, posting to alerts.url or --webhook-url; a one-shot run exits with status 2 when any fire")
+	flag.StringVar(&cfg.Baseline.Path, "baseline", cfg.Baseline.Path, "Learn per-pair byte rates in this bolt database, or an s3://, elasticsearch:// or configmap:// location, and draw pairs that stray from them in red")
+	flag.Float64Var(&cfg.Baseline.ZScore, "anomaly-zscore", cfg.Baseline.ZScore, "Flag pairs this many standard deviations from their baseline rate (0 disables)")
+	flag.Float64Var(&cfg.Baseline.Percent, "anomaly-percent", cfg.Baseline.Percent, "Flag pairs whose rate differs from their baseline by this percentage (0 disables)")
+	watchPtr := flag.Bool("watch", false, "Keep running and re-render the output every --interval, replacing it atomically")
+	intervalPtr := flag.Duration("interval", 5*time.Minute, "How often --watch re-renders")
+	flag.Parse()
 
-			baseRotation := baseAngle
-			if baseAngle > math.Pi/2 && baseAngle < 3*math.Pi/2 {
-				baseRotation += math.Pi
-			}
-			baseLabelStyle.Rotation = baseRotation
-			baseLabelStyle.XAlign = draw.XCenter
-			baseLabelStyle.YAlign = draw.YCenter
+	if cfg.Kubernetes.GroupBy != "ip" && cfg.Kubernetes.GroupBy != "namespace" {
+		log.Fatalf("Unsupported group-by: %s", cfg.Kubernetes.GroupBy)
+	}
 
-			bgBaseStyle := baseLabelStyle
-			bgBaseStyle.Color = color.RGBA{255, 255, 255, 220}
-			canvas.FillText(bgBaseStyle, basePos, c.Labels[i])
-			canvas.FillText(baseLabelStyle, basePos, c.Labels[i])
+	if cfg.Output.Width <= 0 || cfg.Output.Height <= 0 || cfg.Output.DPI <= 0 {
+		log.Fatalf("--width, --height and --dpi must be positive")
+	}
+	switch cfg.Output.Format {
+	case "png", "svg", "pdf", "eps":
+		if cfg.Output.Path == "-" {
+			break
+		}
+		ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(cfg.Output.Path), "."))
+		switch {
+		case ext == cfg.Output.Format:
+		case chordFormats[ext] && cfg.Output.Format == "png":
+			// The default format gives way to an output path naming
+			// another, as before --format offered them.
+			cfg.Output.Format = ext
+		default:
+			cfg.Output.Path = strings.TrimSuffix(cfg.Output.Path, filepath.Ext(cfg.Output.Path)) + "." + cfg.Output.Format
+		}
+	case "html":
+		if cfg.Output.Table {
+			log.Fatalf("--format html already includes the table")
+		}
+		if cfg.Output.Path != "-" && filepath.Ext(cfg.Output.Path) != ".html" {
+			cfg.Output.Path = strings.TrimSuffix(cfg.Output.Path, filepath.Ext(cfg.Output.Path)) + ".html"
+		}
+	case "nodegraph":
+		if strings.HasSuffix(cfg.Output.Path, ".png") {
+			cfg.Output.Path = strings.TrimSuffix(cfg.Output.Path, ".png") + ".json"
+		}
+	default:
+		log.Fatalf("Unsupported format: %s", cfg.Output.Format)
+	}
+	if cfg.Output.Path == "-" {
+		// Everything else is written next to the output file.
+		if *watchPtr || cfg.Output.Table || cfg.Output.Bundle != "" || cfg.Output.Keep > 0 || cfg.CompareWindow != "" ||
+			cfg.Output.SignKey != "" || len(cfg.Email.To) > 0 || cfg.Slack.Channel != "" {
+			log.Fatalf("--output - writes the diagram alone; --watch, --table, --bundle, --keep, --compare-window, --sign-key, --email-to and --slack-channel need a file")
+		}
+	}
 
-			labelAngle := angle
-			labelRotation := labelAngle + math.Pi/2
-			if labelAngle > math.Pi/2 && labelAngle < 3*math.Pi/2 {
-				labelRotation += math.Pi
-			}
+	if *demoPtr {
+		cfg.Source = "demo"
+	}
+	if cfg.Elasticsearch.CorrectClockSkew && cfg.Elasticsearch.MaxClockSkew <= 0 {
+		log.Fatalf("--correct-clock-skew needs --max-clock-skew")
+	}
+	if len(cfg.Protocols) > 0 && cfg.Source != "elasticsearch" {
+		log.Fatalf("--protocol needs the elasticsearch source, which records ports")
+	}
+	if cfg.Privacy.MinPairFlows > 0 && cfg.Source != "elasticsearch" {
+		log.Fatalf("--min-pair-flows needs the elasticsearch source, which counts flow records")
+	}
 
-			totalBytes := float64(0)
-			for j := 0; j < n; j++ {
-				totalBytes += c.Flow[i][j]
-			}
-			statsLabel := fmt.Sprintf("%.1f MB", totalBytes/1024/1024) // Convert to MB
+	if _, err := parseWindow(cfg.Window); err != nil {
+		log.Fatalf("Invalid window: %s", err)
+	}
+	if cfg.CompareWindow != "" {
+		if offset, err := parseWindow(cfg.CompareWindow); err != nil || offset <= 0 {
+			log.Fatalf("Invalid compare window: %s", cfg.CompareWindow)
+		}
+	}
+	if _, ok := diagramLayouts[cfg.Output.Layout]; !ok {
+		log.Fatalf("Unsupported layout: %s", cfg.Output.Layout)
+	}
+	if cfg.Output.ClusterNamespaces && cfg.Output.Layout != "graph" {
+		log.Fatalf("--cluster-namespaces needs --layout graph")
+	}
+	if _, ok := chordThemes[cfg.Output.Theme]; !ok {
+		log.Fatalf("Unsupported theme: %s", cfg.Output.Theme)
+	}
+	if _, ok := messageCatalogs[cfg.Output.Lang]; !ok {
+		log.Fatalf("Unsupported lang: %s", cfg.Output.Lang)
+	}
+	if len(cfg.Email.To) > 0 && (cfg.Email.Host == "" || cfg.Email.From == "") {
+		log.Fatalf("--email-to needs email.host and email.from in the config")
+	}
+	if cfg.Slack.Channel != "" && cfg.Slack.Token == "" && os.Getenv("SLACK_TOKEN") == "" {
+		log.Fatalf("--slack-channel needs slack.token in the config or SLACK_TOKEN")
+	}
+	if cfg.Output.Timelapse != "" {
+		switch strings.ToLower(filepath.Ext(cfg.Output.Timelapse)) {
+		case ".gif", ".mp4":
+		default:
+			log.Fatalf("--timelapse must name a .gif or .mp4 file")
+		}
+		if cfg.Output.Frames <= 0 {
+			log.Fatalf("frames must be positive")
+		}
+	}
+	if cfg.Output.Keep < 0 {
+		log.Fatalf("keep must not be negative")
+	}
+	if *watchPtr && *intervalPtr <= 0 {
+		log.Fatalf("interval must be positive")
+	}
 
-			labelPos := pointOnCircle(origin, vg.Length(radius*1.15), angle)
-			outerLabelStyle.Rotation = labelRotation
-			outerLabelStyle.XAlign = draw.XCenter
-			outerLabelStyle.YAlign = draw.YCenter
+	source, err := newFlowSource(cfg)
+	if err != nil {
+		log.Fatalf("Error creating %s source: %s", cfg.Source, err)
+	}
 
-			bgStyle := outerLabelStyle
-			bgStyle.Color = color.RGBA{255, 255, 255, 220}
-			canvas.FillText(bgStyle, labelPos, statsLabel)
-			canvas.FillText(outerLabelStyle, labelPos, statsLabel)
+	var alerts *alerter
+	if cfg.Alerts.Rules != "" {
+		if alerts, err = newAlerter(cfg); err != nil {
+			log.Fatalf("Error loading alert rules: %s", err)
 		}
 	}
 
-	maxFlow := 0.0
-	for i := range c.Flow {
-		for j := range c.Flow[i] {
-			if c.Flow[i][j] > maxFlow {
-				maxFlow = c.Flow[i][j]
-			}
+	var learned *baseline
+	if cfg.Baseline.Path != "" {
+		if learned, err = openBaseline(cfg); err != nil {
+			log.Fatalf("Error opening baseline: %s", err)
 		}
+		defer learned.Close()
 	}
 
-	for i := range c.Flow {
-		for j := range c.Flow[i] {
-			if c.Flow[i][j] > 0 {
-				weight := c.Flow[i][j] / maxFlow
-				drawChord(canvas, origin, vg.Length(radius), i, j, n, weight, c.Color(i, j))
-			}
+	enrich := newEnricher(cfg)
+	if !*watchPtr {
+		firing, err := render(context.Background(), cfg, source, enrich, alerts, learned)
+		if err != nil {
+			log.Fatalf("Error %s", err)
+		}
+		if len(firing) > 0 {
+			os.Exit(2)
 		}
+		return
 	}
-}
 
-func pointOnCircle(origin vg.Point, radius vg.Length, angle float64) vg.Point {
-	return vg.Point{
-		X: origin.X + radius*vg.Length(math.Cos(angle)),
-		Y: origin.Y + radius*vg.Length(math.Sin(angle)),
+	log.Printf("Rendering %s every %s", cfg.Output.Path, *intervalPtr)
+	ticker := time.NewTicker(*intervalPtr)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), *intervalPtr)
+		if _, err := render(ctx, cfg, source, enrich, alerts, learned); err != nil {
+			log.Printf("Error %s", err)
+		}
+		cancel()
 	}
 }
 
-func drawChord(canvas draw.Canvas, origin vg.Point, radius vg.Length, i, j, n int, weight float64, clr color.Color) {
-	angleStep := 2 * math.Pi / float64(n)
-	angle1 := float64(i) * angleStep
-	angle2 := float64(j) * angleStep
-
-	start := pointOnCircle(origin, radius, angle1)
-	end := pointOnCircle(origin, radius, angle2)
-
-	var path vg.Path
-	path.Move(start)
-
-	ctrl1 := vg.Point{
-		X: origin.X + radius*0.5*vg.Length(math.Cos(angle1)),
-		Y: origin.Y + radius*0.5*vg.Length(math.Sin(angle1)),
+// render queries the window ending now, compares it with the baseline when
+// one is learned, publishes its diagram and returns the alerts firing in it.
+func render(ctx context.Context, cfg Config, source FlowSource, enrich *enricher, alerts *alerter, learned *baseline) ([]alert, error) {
+	window, err := parseWindow(cfg.Window)
+	if err != nil {
+		return nil, err
 	}
-	ctrl2 := vg.Point{
-		X: origin.X + radius*0.5*vg.Length(math.Cos(angle2)),
-		Y: origin.Y + radius*0.5*vg.Length(math.Sin(angle2)),
+	now := time.Now()
+	from, to, lag, err := queryRange(ctx, source, window, now, cfg.ShiftLag)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s time range: %w", source.Name(), err)
+	}
+	manifest := Manifest{
+		GeneratedAt:    now.UTC(),
+		From:           from.UTC(),
+		To:             to.UTC(),
+		CodeVersion:    codeVersion(),
+		SourceVersions: dependencyVersions(),
+		Settings:       flagSettings(flag.CommandLine),
 	}
 
-	path.CubeTo(ctrl1, ctrl2, end)
-
-	canvas.SetLineWidth(vg.Length(weight * 3))
-	rgba := color.RGBAModel.Convert(clr).(color.RGBA)
-	rgba.A = uint8(math.Min(255, float64(rgba.A)+100))
-	canvas.SetColor(rgba)
-	canvas.Stroke(path)
-}
-
-func main() {
-
-	timeWindowPtr := flag.String("window", "3h", "Time window for data (e.g., 15m, 1h, 24h)")
-	networkFilterPtr := flag.String("network", "10.0.0.0/8", "Network CIDR filter (e.g., '10.0.0.0/8,192.168.0.0/16')")
-	flag.Parse()
-
-	var networkFilters []string
-	if *networkFilterPtr != "" {
-		networkFilters = strings.Split(*networkFilterPtr, ",")
+	if lag > 0 {
+		manifest.IngestLag = lag.Round(time.Second).String()
+		log.Printf("Ingest lag is %s; querying up to %s", manifest.IngestLag, to.Format(time.RFC3339))
+	}
 
-		cfg := elasticsearch.Config{
-			Addresses: []string{"https://es.dinozavyr.com:443"},
-			Username:  "elastic",
-			Password:  "Ra4Zb9R52151X2bzq9dlQI7v",
-		}
-		es, err := elasticsearch.NewClient(cfg)
+	version, err := source.Version(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s version: %w", source.Name(), err)
+	}
+	manifest.SourceVersions[source.Name()] = version
+	if skewed, ok := source.(skewedSource); ok {
+		skews, err := skewed.ClockSkews(ctx, now)
 		if err != nil {
-			log.Fatalf("Error creating client: %s", err)
+			log.Printf("Error %s", err)
 		}
-
-		var conditions []map[string]interface{}
-		if len(networkFilters) > 0 {
-			var networkConditions []map[string]interface{}
-			for _, cidr := range networkFilters {
-				networkStart, networkEnd := cidrToRange(cidr)
-				networkConditions = append(networkConditions,
-					map[string]interface{}{
-						"bool": map[string]interface{}{
-							"must": []map[string]interface{}{
-								{
-									"range": map[string]interface{}{
-										"source.ip": map[string]interface{}{
-											"gte": networkStart,
-											"lte": networkEnd,
-										},
-									},
-								},
-								{
-									"range": map[string]interface{}{
-										"destination.ip": map[string]interface{}{
-											"gte": networkStart,
-											"lte": networkEnd,
-										},
-									},
-								},
-							},
-						},
-					},
-				)
+		manifest.ClockSkew = describeSkews(skews)
+		if cfg.Privacy.PseudonymizeKeyFile != "" && manifest.ClockSkew != nil {
+			// Exporter addresses are as identifying as the flows' own.
+			key, err := loadPseudonymKey(cfg.Privacy.PseudonymizeKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("loading pseudonymization key: %w", err)
 			}
-			conditions = append(conditions, map[string]interface{}{
-				"bool": map[string]interface{}{
-					"must": networkConditions,
-				},
-			})
+			manifest.ClockSkew = pseudonymizeKeys(manifest.ClockSkew, key)
 		}
+	}
 
-		conditions = append(conditions, map[string]interface{}{
-			"range": map[string]interface{}{
-				"@timestamp": map[string]interface{}{
-					"gte": fmt.Sprintf("now-%s", *timeWindowPtr),
-					"lte": "now",
-				},
-			},
-		})
+	matrix, err := fetchMatrix(ctx, cfg, source, enrich, from, to)
+	if err != nil {
+		return nil, err
+	}
+	manifest.Queries = matrix.queries
 
-		query := map[string]interface{}{
-			"size": 0,
-			"query": map[string]interface{}{
-				"bool": map[string]interface{}{
-					"must": conditions,
-				},
-			},
-			"aggs": map[string]interface{}{
-				"source_nodes": map[string]interface{}{
-					"terms": map[string]interface{}{
-						"field": "source.ip",
-						"size":  100,
-					},
-					"aggs": map[string]interface{}{
-						"destinations": map[string]interface{}{
-							"terms": map[string]interface{}{
-								"field": "destination.ip",
-								"size":  100,
-							},
-							"aggs": map[string]interface{}{
-								"bytes": map[string]interface{}{
-									"sum": map[string]interface{}{
-										"field": "network.bytes",
-									},
-								},
-							},
-						},
-					},
-				},
-			},
+	// Every artifact carries the completeness score in its title.
+	var exporters map[string]float64
+	if gapped, ok := source.(gappedSource); ok {
+		if exporters, err = gapped.ExporterCoverage(ctx, from, to); err != nil {
+			log.Printf("Error %s", err)
 		}
+	}
+	manifest.Completeness = queryCompleteness(matrix.coverage, exporters, lag, to.Sub(from), cfg.ShiftLag)
+	if factors := manifest.Completeness.describeFactors(); factors != "" {
+		log.Printf("Data %.1f%% complete: %s", manifest.Completeness.Score, factors)
+	}
+	cfg.Output.Title += " (" + manifest.Completeness.describe() + ")"
 
-		queryJSON, _ := json.Marshal(query)
-		res, err := es.Search(
-			es.Search.WithContext(context.Background()),
-			es.Search.WithIndex("filebeat-*"),
-			es.Search.WithBody(strings.NewReader(string(queryJSON))),
-			es.Search.WithSize(0),
-		)
-		if err != nil {
-			log.Fatalf("Error getting response: %s", err)
+	if learned != nil {
+		if _, err := learned.observe(ctx, matrix, from, to); err != nil {
+			return nil, fmt.Errorf("updating baseline: %w", err)
 		}
-		defer res.Body.Close()
-
-		var result map[string]interface{}
-		if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
-			log.Fatalf("Error parsing response: %s", err)
+	}
+	if err := publish(ctx, cfg, enrich, matrix, manifest); err != nil {
+		return nil, err
+	}
+	if cfg.Output.Timelapse != "" {
+		if err := timelapse(ctx, cfg, source, enrich, from, to, cfg.Output.Frames, cfg.Output.Timelapse); err != nil {
+			return nil, fmt.Errorf("writing time-lapse: %w", err)
 		}
-
-		buckets := result["aggregations"].(map[string]interface{})["source_nodes"].(map[string]interface{})["buckets"].([]interface{})
-
-		nodes := make(map[string]int)
-		var names []string
-
-		for _, bucket := range buckets {
-			sourceIP := bucket.(map[string]interface{})["key"].(string)
-			if _, exists := nodes[sourceIP]; !exists {
-				nodes[sourceIP] = len(nodes)
-				names = append(names, sourceIP)
-			}
-
-			destBuckets := bucket.(map[string]interface{})["destinations"].(map[string]interface{})["buckets"].([]interface{})
-			for _, destBucket := range destBuckets {
-				destIP := destBucket.(map[string]interface{})["key"].(string)
-				if _, exists := nodes[destIP]; !exists {
-					nodes[destIP] = len(nodes)
-					names = append(names, destIP)
-				}
-			}
+	}
+	if cfg.CompareWindow != "" {
+		if err := compare(ctx, cfg, source, enrich, matrix, from, to); err != nil {
+			return nil, fmt.Errorf("comparing windows: %w", err)
 		}
-
-		size := len(nodes)
-		flow := make([][]float64, size)
-		for i := range flow {
-			flow[i] = make([]float64, size)
+	}
+	if len(cfg.Email.To) > 0 {
+		if err := emailReport(cfg, matrix, manifest, cfg.Output.Path); err != nil {
+			return nil, fmt.Errorf("emailing report: %w", err)
 		}
-
-		for _, bucket := range buckets {
-			b := bucket.(map[string]interface{})
-			sourceIP := b["key"].(string)
-			sourceIdx := nodes[sourceIP]
-
-			destBuckets := b["destinations"].(map[string]interface{})["buckets"].([]interface{})
-			for _, destBucket := range destBuckets {
-				d := destBucket.(map[string]interface{})
-				destIP := d["key"].(string)
-				bytes := d["bytes"].(map[string]interface{})["value"].(float64)
-
-				destIdx := nodes[destIP]
-				flow[sourceIdx][destIdx] = bytes
-			}
+	}
+	if cfg.Slack.Channel != "" {
+		if err := uploadToSlack(ctx, cfg, matrix, manifest, cfg.Output.Path); err != nil {
+			return nil, fmt.Errorf("posting to Slack: %w", err)
 		}
+	}
+	if cfg.Webhook.URL != "" {
+		if err := postWebhook(ctx, cfg, matrix, manifest); err != nil {
+			return nil, fmt.Errorf("posting to webhook: %w", err)
+		}
+	}
+	if alerts == nil {
+		return nil, nil
+	}
+	return alerts.check(ctx, matrix, from, to)
+}
 
-		p := plot.New()
-
-		p.X.Min = -1
-		p.X.Max = 1
-		p.Y.Min = -1
-		p.Y.Max = 1
-
-		p.X.Label.Text = ""
-		p.Y.Label.Text = ""
-		p.X.Tick.Length = 0
-		p.Y.Tick.Length = 0
-		p.X.Tick.Label.Font.Size = 0
-		p.Y.Tick.Label.Font.Size = 0
-		p.X.LineStyle.Width = 0
-		p.Y.LineStyle.Width = 0
-
-		p.Title.Text = "Network Traffic Flow Between IPs"
-		p.Title.TextStyle.Font.Size = vg.Points(16)
-		p.Add(ChordDiagram{
-			Flow:   flow,
-			Labels: names,
-			Color: func(i, j int) color.Color {
-				return color.RGBA{R: uint8(30 * i), G: uint8(30 * j), B: 255, A: 200} // Increased base opacity
-			},
-		})
+// compare queries the window cfg.CompareWindow before [from, to) and writes
+// how matrix differs from it as a diagram and a table next to the output.
+func compare(ctx context.Context, cfg Config, source FlowSource, enrich *enricher, matrix *FlowMatrix, from, to time.Time) error {
+	offset, err := parseWindow(cfg.CompareWindow)
+	if err != nil {
+		return err
+	}
+	beforeFrom, beforeTo := from.Add(-offset), to.Add(-offset)
+	before, err := fetchMatrix(ctx, cfg, source, enrich, beforeFrom, beforeTo)
+	if err != nil {
+		return err
+	}
 
-		if err := p.Save(24*vg.Inch, 24*vg.Inch, "network_flow.png"); err != nil {
-			log.Fatalf("Error saving plot: %s", err)
+	deltas := diffMatrices(before, matrix)
+	if chordFormats[cfg.Output.Format] {
+		title := fmt.Sprintf("%s: change since %s earlier", cfg.Output.Title, cfg.CompareWindow)
+		path := diffPath(cfg.Output.Path, filepath.Ext(cfg.Output.Path))
+		if err := renderDiff(deltas, title, path, cfg.Output.Format, outputSize(cfg.Output), chordThemes[cfg.Output.Theme]); err != nil {
+			return fmt.Errorf("saving diff plot: %w", err)
 		}
 	}
+	return writeDiffTable(diffPath(cfg.Output.Path, ".txt"), deltas, [2]time.Time{beforeFrom, beforeTo}, [2]time.Time{from, to})
 }
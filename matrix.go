@@ -0,0 +1,94 @@
+package main
+
+type FlowMatrix struct {
+	Names []string
+	Flow  [][]float64
+
+	nodes map[string]int
+	// resolvedBy names the resolver that produced each labelled node.
+	resolvedBy map[string]string
+	// anomalies are the pairs, by source and destination name, whose
+	// traffic strays from the learned baseline.
+	anomalies map[[2]string]anomaly
+	// coverage is how much of the data the queries behind the matrix
+	// covered.
+	coverage queryCoverage
+	// flows counts the flow records behind each pair, by source and
+	// destination name, for sources that count them; it is nil otherwise.
+	flows map[[2]string]float64
+	// queries are the source queries behind the matrix, for the manifest.
+	queries []SourceQuery
+}
+
+func NewFlowMatrix() *FlowMatrix {
+	return &FlowMatrix{nodes: make(map[string]int)}
+}
+
+func (m *FlowMatrix) Index(name string) int {
+	if i, exists := m.nodes[name]; exists {
+		return i
+	}
+
+	i := len(m.Names)
+	m.nodes[name] = i
+	m.Names = append(m.Names, name)
+	for j := range m.Flow {
+		m.Flow[j] = append(m.Flow[j], 0)
+	}
+	m.Flow = append(m.Flow, make([]float64, i+1))
+	return i
+}
+
+func (m *FlowMatrix) Add(source, destination string, bytes float64) {
+	i := m.Index(source)
+	j := m.Index(destination)
+	m.Flow[i][j] += bytes
+}
+
+// addFlows counts n flow records between source and destination.
+func (m *FlowMatrix) addFlows(source, destination string, n float64) {
+	if m.flows == nil {
+		m.flows = make(map[[2]string]float64)
+	}
+	m.flows[[2]string{source, destination}] += n
+}
+
+func (m *FlowMatrix) Merge(other *FlowMatrix) {
+	m.coverage.add(other.coverage)
+	m.queries = append(m.queries, other.queries...)
+	for label, resolver := range other.resolvedBy {
+		if m.resolvedBy == nil {
+			m.resolvedBy = make(map[string]string)
+		}
+		m.resolvedBy[label] = resolver
+	}
+	for pair, n := range other.flows {
+		m.addFlows(pair[0], pair[1], n)
+	}
+	for i, source := range other.Names {
+		for j, destination := range other.Names {
+			if other.Flow[i][j] > 0 {
+				m.Add(source, destination, other.Flow[i][j])
+			}
+		}
+	}
+}
+
+// Relabel returns a copy of the matrix with every node renamed by fn. Nodes
+// that map to the same name are merged and their flows summed.
+func (m *FlowMatrix) Relabel(fn func(name string) string) *FlowMatrix {
+	relabeled := NewFlowMatrix()
+	relabeled.coverage, relabeled.queries = m.coverage, m.queries
+	for pair, n := range m.flows {
+		relabeled.addFlows(fn(pair[0]), fn(pair[1]), n)
+	}
+	for i, source := range m.Names {
+		relabeled.Index(fn(source))
+		for j, destination := range m.Names {
+			if m.Flow[i][j] > 0 {
+				relabeled.Add(fn(source), fn(destination), m.Flow[i][j])
+			}
+		}
+	}
+	return relabeled
+}
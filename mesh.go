@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// meshProxies maps the sidecar container names of known service meshes to
+// the mesh.
+var meshProxies = map[string]string{
+	"istio-proxy":      "istio",
+	"linkerd-proxy":    "linkerd",
+	"consul-dataplane": "consul",
+	"envoy-sidecar":    "consul",
+	"kuma-sidecar":     "kuma",
+}
+
+// meshPair is what a meshed pod's proxy sent to a destination: Wire bytes on
+// the network, of which Payload is the estimated application data.
+type meshPair struct {
+	Source, Destination string
+	Wire, Payload       float64
+}
+
+func (p meshPair) overhead() float64 {
+	return p.Wire - p.Payload
+}
+
+// meshOverhead splits the traffic of pods with a mesh proxy into payload and
+// overhead. The mesh redirects what application containers send to their
+// proxy over the loopback or the pod's own address, and the proxy sends it
+// on with its TLS, protocol and telemetry overhead plus its own control
+// plane traffic. The payload share of a pod's proxy traffic is what its
+// application containers sent locally over what the proxy sent off the
+// pod; each of the pod's pairs is assumed to carry that share. It returns
+// the meshes seen, none when no pod runs a known proxy.
+func meshOverhead(flows []containerFlow, containers map[string]kubeContainer, owners kubeOwners) ([]string, []meshPair) {
+	meshes := make(map[string]bool)
+	payload := make(map[string]float64)
+	proxied := make(map[string]float64)
+	wire := make(map[[2]string]float64)
+	for _, flow := range flows {
+		container, ok := containers[flow.Container]
+		if !ok || flow.Bytes <= 0 {
+			continue
+		}
+		pod := container.Namespace + "/" + container.Pod
+		local := owners.label(flow.Destination) == pod
+		if addr, err := netip.ParseAddr(flow.Destination); err == nil && addr.IsLoopback() {
+			local = true
+		}
+		mesh, proxy := meshProxies[container.Name]
+		switch {
+		case proxy && !local:
+			meshes[mesh] = true
+			proxied[pod] += flow.Bytes
+			wire[[2]string{pod, owners.label(flow.Destination)}] += flow.Bytes
+		case !proxy && local:
+			payload[pod] += flow.Bytes
+		}
+	}
+
+	var pairs []meshPair
+	for pair, bytes := range wire {
+		share := payload[pair[0]] / proxied[pair[0]]
+		if share > 1 {
+			// Proxies answering from a cache or dropping requests.
+			share = 1
+		}
+		pairs = append(pairs, meshPair{Source: pair[0], Destination: pair[1], Wire: bytes, Payload: bytes * share})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].overhead() != pairs[j].overhead() {
+			return pairs[i].overhead() > pairs[j].overhead()
+		}
+		return pairs[i].Source+pairs[i].Destination < pairs[j].Source+pairs[j].Destination
+	})
+	var names []string
+	for mesh := range meshes {
+		names = append(names, mesh)
+	}
+	sort.Strings(names)
+	return names, pairs
+}
+
+func runMesh(args []string) {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		log.Fatalf("Error loading config: %s", err)
+	}
+
+	fs := flag.NewFlagSet("mesh", flag.ExitOnError)
+	fs.String("config", "", "YAML or TOML configuration file; flags override its values")
+	fs.StringVar(&cfg.Window, "window", cfg.Window, "Time window to report on")
+	fs.StringVar(&cfg.Kubernetes.Kubeconfig, "kubeconfig", cfg.Kubernetes.Kubeconfig, "Kubeconfig used to find sidecars outside the cluster (defaults to kubectl's)")
+	fs.Parse(args)
+
+	window, err := parseWindow(cfg.Window)
+	if err != nil {
+		log.Fatalf("Invalid window: %s", err)
+	}
+	es, err := newElasticClient(cfg.Elasticsearch)
+	if err != nil {
+		log.Fatalf("Error creating the client: %s", err)
+	}
+
+	ctx := context.Background()
+	to := time.Now()
+	from := to.Add(-window)
+	// Application payload goes to the proxy over the loopback, so the
+	// report reads every network.
+	flows, err := fetchContainerFlows(ctx, es, cfg.Elasticsearch.Index, nil, from, to)
+	if err != nil {
+		log.Fatalf("Error querying flows: %s", err)
+	}
+	if len(flows) == 0 {
+		log.Fatalf("No per-container flows in the last %s; run the agent with --capture=ebpf --per-container", cfg.Window)
+	}
+	containers, owners := loadContainerNames(ctx, cfg, from, to)
+	if containers == nil {
+		log.Fatalf("Sidecars are found by container name, which needs the Kubernetes API")
+	}
+
+	meshes, pairs := meshOverhead(flows, containers, owners)
+	if len(meshes) == 0 {
+		fmt.Println("No service mesh detected")
+		return
+	}
+	var wire, payload float64
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tDESTINATION\tWIRE\tPAYLOAD\tOVERHEAD\tOVERHEAD %")
+	for _, pair := range pairs {
+		wire += pair.Wire
+		payload += pair.Payload
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", pair.Source, pair.Destination,
+			strconv.FormatFloat(pair.Wire, 'f', 0, 64),
+			strconv.FormatFloat(pair.Payload, 'f', 0, 64),
+			strconv.FormatFloat(pair.overhead(), 'f', 0, 64),
+			strconv.FormatFloat(100*pair.overhead()/pair.Wire, 'f', 1, 64))
+	}
+	fmt.Fprintf(w, "TOTAL (%s)\t\t%s\t%s\t%s\t%s\n", strings.Join(meshes, ", "),
+		strconv.FormatFloat(wire, 'f', 0, 64),
+		strconv.FormatFloat(payload, 'f', 0, 64),
+		strconv.FormatFloat(wire-payload, 'f', 0, 64),
+		strconv.FormatFloat(100*(wire-payload)/wire, 'f', 1, 64))
+	w.Flush()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMeshOverhead(t *testing.T) {
+	containers := map[string]kubeContainer{
+		"web-app":   {Namespace: "shop", Pod: "web", Name: "app"},
+		"web-proxy": {Namespace: "shop", Pod: "web", Name: "istio-proxy"},
+		"api-app":   {Namespace: "shop", Pod: "api", Name: "app"},
+		"api-proxy": {Namespace: "shop", Pod: "api", Name: "istio-proxy"},
+		"job-app":   {Namespace: "batch", Pod: "job", Name: "app"},
+	}
+	owners := kubeOwners{
+		"10.0.0.1": {Kind: "pod", Namespace: "shop", Name: "web"},
+		"10.0.0.2": {Kind: "pod", Namespace: "shop", Name: "api"},
+		"10.0.0.3": {Kind: "pod", Namespace: "batch", Name: "job"},
+		"10.0.0.9": {Kind: "pod", Namespace: "istio-system", Name: "istiod"},
+	}
+	flows := []containerFlow{
+		// web's app hands 800 bytes to its proxy, which sends 900 to api
+		// and 100 to istiod.
+		{Source: "127.0.0.1", Destination: "127.0.0.1", Container: "web-app", Bytes: 800},
+		{Source: "10.0.0.1", Destination: "10.0.0.2", Container: "web-proxy", Bytes: 900},
+		{Source: "10.0.0.1", Destination: "10.0.0.9", Container: "web-proxy", Bytes: 100},
+		// api's app answers its proxy on the pod address; the proxy's
+		// delivery to the app is not on the wire.
+		{Source: "10.0.0.2", Destination: "10.0.0.2", Container: "api-app", Bytes: 500},
+		{Source: "127.0.0.6", Destination: "10.0.0.2", Container: "api-proxy", Bytes: 700},
+		{Source: "10.0.0.2", Destination: "10.0.0.1", Container: "api-proxy", Bytes: 500},
+		// Traffic outside the mesh and of unknown containers is ignored.
+		{Source: "10.0.0.3", Destination: "10.0.0.2", Container: "job-app", Bytes: 300},
+		{Source: "10.0.0.4", Destination: "10.0.0.2", Container: "gone", Bytes: 300},
+	}
+
+	meshes, pairs := meshOverhead(flows, containers, owners)
+	if len(meshes) != 1 || meshes[0] != "istio" {
+		t.Errorf("meshes = %v, want [istio]", meshes)
+	}
+	want := []meshPair{
+		{Source: "shop/web", Destination: "shop/api", Wire: 900, Payload: 720},
+		{Source: "shop/web", Destination: "istio-system/istiod", Wire: 100, Payload: 80},
+		{Source: "shop/api", Destination: "shop/web", Wire: 500, Payload: 500},
+	}
+	if len(pairs) != len(want) {
+		t.Fatalf("got %d pairs %+v, want %+v", len(pairs), pairs, want)
+	}
+	for i, pair := range pairs {
+		if pair.Source != want[i].Source || pair.Destination != want[i].Destination || pair.Wire != want[i].Wire || math.Abs(pair.Payload-want[i].Payload) > 1e-9 {
+			t.Errorf("pair %d = %+v, want %+v", i, pair, want[i])
+		}
+	}
+
+	if meshes, _ := meshOverhead(flows[6:], containers, owners); len(meshes) != 0 {
+		t.Errorf("detected %v without proxies", meshes)
+	}
+}
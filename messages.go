@@ -0,0 +1,102 @@
+package main
+
+// messageCatalogs translate the fixed strings of HTML reports and tables,
+// keyed by their English text, per --lang. English needs no catalog.
+var messageCatalogs = map[string]map[string]string{
+	"en": nil,
+	"de": {
+		"Flows from":    "Flüsse von",
+		"to":            "bis",
+		"MB in":         "MB in",
+		"conversations": "Verbindungen",
+		"Hover over the diagram for its traffic.":                                   "Fahren Sie mit der Maus über das Diagramm, um den Verkehr zu sehen.",
+		"Top %d conversations, in megabytes; select a column heading to sort by it": "Die %d größten Verbindungen, in Megabyte; wählen Sie eine Spaltenüberschrift, um danach zu sortieren",
+		"Select a column heading to sort by it.":                                    "Wählen Sie eine Spaltenüberschrift, um danach zu sortieren.",
+		"Traffic per node, in megabytes":                                            "Verkehr pro Knoten, in Megabyte",
+		"Conversations, in megabytes":                                               "Verbindungen, in Megabyte",
+		"Source":                                                                    "Quelle",
+		"Destination":                                                               "Ziel",
+		"Sent":                                                                      "Gesendet",
+		"Received":                                                                  "Empfangen",
+		"Node":                                                                      "Knoten",
+		"Kind":                                                                      "Art",
+		"Namespace":                                                                 "Namespace",
+		"Query":                                                                     "Abfrage",
+		"Generated":                                                                 "Erstellt",
+		"Window":                                                                    "Zeitfenster",
+		"Networks":                                                                  "Netze",
+		"Protocols":                                                                 "Protokolle",
+		"Group by":                                                                  "Gruppiert nach",
+		"Resolution":                                                                "Auflösung",
+		"Ingest lag":                                                                "Verzögerung der Erfassung",
+		"Completeness":                                                              "Vollständigkeit",
+		"Clock skew":                                                                "Uhrenabweichung",
+		"Version":                                                                   "Version",
+	},
+	"es": {
+		"Flows from":    "Flujos del",
+		"to":            "al",
+		"MB in":         "MB en",
+		"conversations": "conversaciones",
+		"Hover over the diagram for its traffic.":                                   "Pase el cursor sobre el diagrama para ver su tráfico.",
+		"Top %d conversations, in megabytes; select a column heading to sort by it": "Las %d conversaciones principales, en megabytes; seleccione un encabezado de columna para ordenar",
+		"Select a column heading to sort by it.":                                    "Seleccione un encabezado de columna para ordenar.",
+		"Traffic per node, in megabytes":                                            "Tráfico por nodo, en megabytes",
+		"Conversations, in megabytes":                                               "Conversaciones, en megabytes",
+		"Source":                                                                    "Origen",
+		"Destination":                                                               "Destino",
+		"Sent":                                                                      "Enviado",
+		"Received":                                                                  "Recibido",
+		"Node":                                                                      "Nodo",
+		"Kind":                                                                      "Tipo",
+		"Namespace":                                                                 "Espacio de nombres",
+		"Query":                                                                     "Consulta",
+		"Generated":                                                                 "Generado",
+		"Window":                                                                    "Ventana",
+		"Networks":                                                                  "Redes",
+		"Protocols":                                                                 "Protocolos",
+		"Group by":                                                                  "Agrupar por",
+		"Resolution":                                                                "Resolución",
+		"Ingest lag":                                                                "Retraso de ingesta",
+		"Completeness":                                                              "Completitud",
+		"Clock skew":                                                                "Desfase de reloj",
+		"Version":                                                                   "Versión",
+	},
+	"fr": {
+		"Flows from":    "Flux du",
+		"to":            "au",
+		"MB in":         "Mo en",
+		"conversations": "conversations",
+		"Hover over the diagram for its traffic.":                                   "Survolez le diagramme pour voir son trafic.",
+		"Top %d conversations, in megabytes; select a column heading to sort by it": "Les %d principales conversations, en mégaoctets ; sélectionnez un en-tête de colonne pour trier",
+		"Select a column heading to sort by it.":                                    "Sélectionnez un en-tête de colonne pour trier.",
+		"Traffic per node, in megabytes":                                            "Trafic par nœud, en mégaoctets",
+		"Conversations, in megabytes":                                               "Conversations, en mégaoctets",
+		"Source":                                                                    "Source",
+		"Destination":                                                               "Destination",
+		"Sent":                                                                      "Envoyé",
+		"Received":                                                                  "Reçu",
+		"Node":                                                                      "Nœud",
+		"Kind":                                                                      "Type",
+		"Namespace":                                                                 "Espace de noms",
+		"Query":                                                                     "Requête",
+		"Generated":                                                                 "Généré",
+		"Window":                                                                    "Fenêtre",
+		"Networks":                                                                  "Réseaux",
+		"Protocols":                                                                 "Protocoles",
+		"Group by":                                                                  "Regroupement",
+		"Resolution":                                                                "Résolution",
+		"Ingest lag":                                                                "Retard d'ingestion",
+		"Completeness":                                                              "Complétude",
+		"Clock skew":                                                                "Décalage d'horloge",
+		"Version":                                                                   "Version",
+	},
+}
+
+// translate returns text in lang, or as is when the catalog lacks it.
+func translate(lang, text string) string {
+	if translated, ok := messageCatalogs[lang][text]; ok {
+		return translated
+	}
+	return text
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"text/template/parse"
+)
+
+// templateMessages collects the literal strings node passes to t.
+func templateMessages(node parse.Node, messages map[string]bool) {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node != nil {
+			for _, n := range node.Nodes {
+				templateMessages(n, messages)
+			}
+		}
+	case *parse.ActionNode:
+		templateMessages(node.Pipe, messages)
+	case *parse.PipeNode:
+		if node != nil {
+			for _, cmd := range node.Cmds {
+				templateMessages(cmd, messages)
+			}
+		}
+	case *parse.CommandNode:
+		if ident, ok := node.Args[0].(*parse.IdentifierNode); ok && ident.Ident == "t" {
+			if text, ok := node.Args[len(node.Args)-1].(*parse.StringNode); ok {
+				messages[text.Text] = true
+			}
+		}
+		for _, arg := range node.Args {
+			templateMessages(arg, messages)
+		}
+	case *parse.RangeNode:
+		templateMessages(node.Pipe, messages)
+		templateMessages(node.List, messages)
+		templateMessages(node.ElseList, messages)
+	case *parse.IfNode:
+		templateMessages(node.Pipe, messages)
+		templateMessages(node.List, messages)
+		templateMessages(node.ElseList, messages)
+	case *parse.WithNode:
+		templateMessages(node.Pipe, messages)
+		templateMessages(node.List, messages)
+		templateMessages(node.ElseList, messages)
+	}
+}
+
+func TestMessageCatalogs(t *testing.T) {
+	messages := make(map[string]bool)
+	templateMessages(flowReportTemplate.Tree.Root, messages)
+	templateMessages(flowTableTemplate.Tree.Root, messages)
+	if len(messages) == 0 {
+		t.Fatal("found no translated strings in the templates")
+	}
+	// The report's parameter names are translated as they are shown.
+	for _, name := range []string{"Source", "Window", "Networks", "Protocols", "Group by", "Resolution", "Ingest lag", "Completeness", "Clock skew", "Version"} {
+		messages[name] = true
+	}
+
+	for lang, catalog := range messageCatalogs {
+		if lang == "en" {
+			continue
+		}
+		for message := range messages {
+			if _, ok := catalog[message]; !ok {
+				t.Errorf("%s lacks %q", lang, message)
+			}
+		}
+		for message := range catalog {
+			if !messages[message] {
+				t.Errorf("%s translates unused %q", lang, message)
+			}
+		}
+	}
+	if got := translate("de", "Sent"); got != "Gesendet" {
+		t.Errorf("translate(de, Sent) = %q", got)
+	}
+	if got := translate("en", "Sent"); got != "Sent" {
+		t.Errorf("translate(en, Sent) = %q", got)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+)
+
+// Information elements used to build the matrix. NetFlow v9 and IPFIX share
+// these numbers.
+const (
+	nfInBytes          = 1
+	nfIPv4Src          = 8
+	nfIPv4Dst          = 12
+	nfIPv6Src          = 27
+	nfIPv6Dst          = 28
+	nfSamplingInterval = 34
+	nfSamplerInterval  = 50
+)
+
+// ipfixVariableLength marks a field whose length prefixes each value.
+const ipfixVariableLength = 65535
+
+type netflowField struct {
+	Type, Length uint16
+	// Enterprise is non-zero for vendor elements, which are skipped.
+	Enterprise uint32
+}
+
+type netflowTemplate struct {
+	fields []netflowField
+	// options templates describe exporter metadata such as sampling rather
+	// than flows.
+	options bool
+}
+
+type netflowDomain struct {
+	exporter netip.Addr
+	id       uint32
+}
+
+type netflowTemplateKey struct {
+	netflowDomain
+	templateID uint16
+}
+
+// netflowTemplates remembers v9 and IPFIX templates per exporter and
+// observation domain, since data records are meaningless without them, along
+// with the sampling rate each domain announces in options data.
+type netflowTemplates struct {
+	templates map[netflowTemplateKey]netflowTemplate
+	sampling  map[netflowDomain]float64
+	// sequences holds the next expected v5 flow sequence per exporter, from
+	// which lost counts the records that never arrived.
+	sequences map[netflowDomain]uint32
+	lost      atomic.Uint64
+	// values is reused for the fields of each record.
+	values [][]byte
+}
+
+func newNetflowTemplates() *netflowTemplates {
+	return &netflowTemplates{
+		templates: make(map[netflowTemplateKey]netflowTemplate),
+		sampling:  make(map[netflowDomain]float64),
+		sequences: make(map[netflowDomain]uint32),
+	}
+}
+
+// trackSequence counts the records skipped before sequence. Gaps of more
+// than half the sequence space are taken as an exporter restart.
+func (t *netflowTemplates) trackSequence(domain netflowDomain, sequence, count uint32) {
+	if expected, ok := t.sequences[domain]; ok {
+		if gap := sequence - expected; gap < 1<<31 {
+			t.lost.Add(uint64(gap))
+		}
+	}
+	t.sequences[domain] = sequence + count
+}
+
+// decodeNetFlow calls fn for every flow record in a v5, v9 or IPFIX
+// datagram. Records of templates not yet received are dropped.
+func decodeNetFlow(packet []byte, exporter netip.Addr, templates *netflowTemplates, fn func(source, destination netip.Addr, bytes float64)) error {
+	if len(packet) < 2 {
+		return fmt.Errorf("short datagram")
+	}
+	switch version := binary.BigEndian.Uint16(packet); version {
+	case 5:
+		if err := decodeNetFlowV5(packet, fn); err != nil {
+			return err
+		}
+		templates.trackSequence(netflowDomain{exporter: exporter}, binary.BigEndian.Uint32(packet[16:]), uint32(binary.BigEndian.Uint16(packet[2:])))
+		return nil
+	case 9:
+		if len(packet) < 20 {
+			return fmt.Errorf("short v9 header")
+		}
+		domain := netflowDomain{exporter, binary.BigEndian.Uint32(packet[16:])}
+		return templates.decodeSets(packet[20:], domain, 0, 1, fn)
+	case 10:
+		if len(packet) < 16 {
+			return fmt.Errorf("short IPFIX header")
+		}
+		length := int(binary.BigEndian.Uint16(packet[2:]))
+		if length < 16 || length > len(packet) {
+			return fmt.Errorf("IPFIX message length %d out of range", length)
+		}
+		domain := netflowDomain{exporter, binary.BigEndian.Uint32(packet[12:])}
+		return templates.decodeSets(packet[16:length], domain, 2, 3, fn)
+	default:
+		return fmt.Errorf("unsupported NetFlow version %d", version)
+	}
+}
+
+func decodeNetFlowV5(packet []byte, fn func(source, destination netip.Addr, bytes float64)) error {
+	const headerSize, recordSize = 24, 48
+	if len(packet) < headerSize {
+		return fmt.Errorf("short v5 header")
+	}
+	count := int(binary.BigEndian.Uint16(packet[2:]))
+	if len(packet) < headerSize+count*recordSize {
+		return fmt.Errorf("v5 datagram truncated")
+	}
+	// The low 14 bits hold the 1-in-N packet sampling rate.
+	sampling := float64(binary.BigEndian.Uint16(packet[22:]) & 0x3fff)
+	if sampling < 1 {
+		sampling = 1
+	}
+
+	for i := 0; i < count; i++ {
+		record := packet[headerSize+i*recordSize:]
+		source := netip.AddrFrom4([4]byte(record[0:4]))
+		destination := netip.AddrFrom4([4]byte(record[4:8]))
+		octets := float64(binary.BigEndian.Uint32(record[20:]))
+		fn(source, destination, octets*sampling)
+	}
+	return nil
+}
+
+// decodeSets walks the flowsets of a v9 packet or the sets of an IPFIX
+// message. The two formats differ only in the template and options template
+// set IDs and in IPFIX's enterprise and variable-length fields.
+func (t *netflowTemplates) decodeSets(sets []byte, domain netflowDomain, templateSet, optionsSet uint16, fn func(source, destination netip.Addr, bytes float64)) error {
+	ipfix := templateSet == 2
+	for len(sets) >= 4 {
+		setID := binary.BigEndian.Uint16(sets)
+		length := int(binary.BigEndian.Uint16(sets[2:]))
+		if length < 4 || length > len(sets) {
+			return fmt.Errorf("set length %d out of range", length)
+		}
+		body := sets[4:length]
+		sets = sets[length:]
+
+		switch {
+		case setID == templateSet || setID == optionsSet:
+			if err := t.decodeTemplates(body, domain, setID == optionsSet, ipfix); err != nil {
+				return err
+			}
+		case setID >= 256:
+			template, ok := t.templates[netflowTemplateKey{domain, setID}]
+			if !ok {
+				continue
+			}
+			minSize := 0
+			for _, field := range template.fields {
+				if field.Length == ipfixVariableLength {
+					minSize++
+				} else {
+					minSize += int(field.Length)
+				}
+			}
+			if minSize == 0 {
+				continue
+			}
+			// Anything shorter than a record at the end is padding.
+			for len(body) >= minSize {
+				if cap(t.values) < len(template.fields) {
+					t.values = make([][]byte, len(template.fields))
+				}
+				values := t.values[:len(template.fields)]
+				size, ok := splitNetflowRecord(body, template.fields, values)
+				if !ok {
+					break
+				}
+				body = body[size:]
+				if template.options {
+					t.recordSampling(domain, template.fields, values)
+				} else {
+					t.emitFlow(domain, template.fields, values, fn)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (t *netflowTemplates) decodeTemplates(body []byte, domain netflowDomain, options, ipfix bool) error {
+	for len(body) >= 4 {
+		templateID := binary.BigEndian.Uint16(body)
+		fieldCount := int(binary.BigEndian.Uint16(body[2:]))
+		body = body[4:]
+		if templateID < 256 {
+			// Padding at the end of the set.
+			return nil
+		}
+		if options {
+			if len(body) < 2 {
+				return fmt.Errorf("options template %d truncated", templateID)
+			}
+			// IPFIX gives the total and scope field counts; v9 gives the
+			// byte lengths of the scope and option field lists instead.
+			if !ipfix {
+				fieldCount = (fieldCount + int(binary.BigEndian.Uint16(body))) / 4
+			}
+			body = body[2:]
+		}
+
+		fields := make([]netflowField, 0, fieldCount)
+		for i := 0; i < fieldCount; i++ {
+			if len(body) < 4 {
+				return fmt.Errorf("template %d truncated", templateID)
+			}
+			field := netflowField{Type: binary.BigEndian.Uint16(body), Length: binary.BigEndian.Uint16(body[2:])}
+			body = body[4:]
+			if ipfix && field.Type&0x8000 != 0 {
+				if len(body) < 4 {
+					return fmt.Errorf("template %d truncated", templateID)
+				}
+				field.Type &^= 0x8000
+				field.Enterprise = binary.BigEndian.Uint32(body)
+				body = body[4:]
+			}
+			fields = append(fields, field)
+		}
+		t.templates[netflowTemplateKey{domain, templateID}] = netflowTemplate{fields: fields, options: options}
+	}
+	return nil
+}
+
+// splitNetflowRecord cuts one record into values, one per field, and returns
+// the number of bytes it occupied.
+func splitNetflowRecord(data []byte, fields []netflowField, values [][]byte) (int, bool) {
+	offset := 0
+	for i, field := range fields {
+		length := int(field.Length)
+		if field.Length == ipfixVariableLength {
+			if offset >= len(data) {
+				return 0, false
+			}
+			length = int(data[offset])
+			offset++
+			if length == 255 {
+				if offset+2 > len(data) {
+					return 0, false
+				}
+				length = int(binary.BigEndian.Uint16(data[offset:]))
+				offset += 2
+			}
+		}
+		if offset+length > len(data) {
+			return 0, false
+		}
+		values[i] = data[offset : offset+length]
+		offset += length
+	}
+	return offset, true
+}
+
+func netflowUint(value []byte) uint64 {
+	var n uint64
+	for _, b := range value {
+		n = n<<8 | uint64(b)
+	}
+	return n
+}
+
+// recordSampling keeps the 1-in-N packet sampling rate an options record
+// announces for its domain.
+func (t *netflowTemplates) recordSampling(domain netflowDomain, fields []netflowField, values [][]byte) {
+	for i, field := range fields {
+		if field.Enterprise == 0 && (field.Type == nfSamplingInterval || field.Type == nfSamplerInterval) {
+			if rate := netflowUint(values[i]); rate > 1 {
+				t.sampling[domain] = float64(rate)
+			}
+		}
+	}
+}
+
+func (t *netflowTemplates) emitFlow(domain netflowDomain, fields []netflowField, values [][]byte, fn func(source, destination netip.Addr, bytes float64)) {
+	var source, destination netip.Addr
+	var bytes uint64
+	for i, field := range fields {
+		value := values[i]
+		if field.Enterprise != 0 {
+			continue
+		}
+		switch {
+		case (field.Type == nfIPv4Src && len(value) == 4) || (field.Type == nfIPv6Src && len(value) == 16):
+			source, _ = netip.AddrFromSlice(value)
+		case (field.Type == nfIPv4Dst && len(value) == 4) || (field.Type == nfIPv6Dst && len(value) == 16):
+			destination, _ = netip.AddrFromSlice(value)
+		case field.Type == nfInBytes && len(value) <= 8:
+			bytes = netflowUint(value)
+		}
+	}
+	if !source.IsValid() || !destination.IsValid() {
+		return
+	}
+	sampling := t.sampling[domain]
+	if sampling < 1 {
+		sampling = 1
+	}
+	fn(source, destination, float64(bytes)*sampling)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// hexFixture assembles a datagram from hex fields, spaces allowed.
+func hexFixture(fields ...string) []byte {
+	data, err := hex.DecodeString(strings.ReplaceAll(strings.Join(fields, ""), " ", ""))
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+var (
+	exporterA = netip.MustParseAddr("192.0.2.1")
+	exporterB = netip.MustParseAddr("192.0.2.2")
+)
+
+// NetFlow v5 from exporter A: sequence 100, 1-in-100 sampling, two records.
+var netflowV5Fixture = hexFixture(
+	"0005 0002 00000000 00000000 00000000 00000064 00 00 4064",
+	"0a000001 0a000002 00000000 0000 0000 00000001 000003e8 00000000 00000000 0000 0000 00 00 06 00 0000 0000 00 00 0000",
+	"0a000002 0a000001 00000000 0000 0000 00000001 000001f4 00000000 00000000 0000 0000 00 00 06 00 0000 0000 00 00 0000",
+)
+
+// NetFlow v9 for source ID 7: template 256 (IPv4 source and destination,
+// in bytes), then a data flowset of two records.
+var (
+	netflowV9TemplateFixture = hexFixture(
+		"0009 0001 00000000 00000000 00000001 00000007",
+		"0000 0014 0100 0003 0008 0004 000c 0004 0001 0004",
+	)
+	netflowV9DataFixture = hexFixture(
+		"0009 0002 00000000 00000000 00000002 00000007",
+		"0100 001c 0a000001 0a000002 000003e8 0a000002 0a000001 000001f4",
+	)
+	// An options template 257 scoped to the system announcing 1-in-10
+	// sampling, padded to four bytes, and its data.
+	netflowV9SamplingFixture = hexFixture(
+		"0009 0002 00000000 00000000 00000003 00000007",
+		"0001 0014 0101 0004 0004 0001 0004 0022 0004 0000",
+		"0101 000c 00000000 0000000a",
+	)
+)
+
+type decodedFlow struct {
+	source, destination string
+	bytes               float64
+}
+
+func decodeAll(t *testing.T, templates *netflowTemplates, exporter netip.Addr, packets ...[]byte) ([]decodedFlow, error) {
+	t.Helper()
+	var flows []decodedFlow
+	for _, packet := range packets {
+		err := decodeNetFlow(packet, exporter, templates, func(source, destination netip.Addr, bytes float64) {
+			flows = append(flows, decodedFlow{source.String(), destination.String(), bytes})
+		})
+		if err != nil {
+			return flows, err
+		}
+	}
+	return flows, nil
+}
+
+func checkFlows(t *testing.T, got, want []decodedFlow) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("decoded %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("flow %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestDecodeNetFlowV5(t *testing.T) {
+	templates := newNetflowTemplates()
+	flows, err := decodeAll(t, templates, exporterA, netflowV5Fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFlows(t, flows, []decodedFlow{
+		{"10.0.0.1", "10.0.0.2", 100000},
+		{"10.0.0.2", "10.0.0.1", 50000},
+	})
+
+	// The next datagram should start at 102; starting at 110 loses 8.
+	next := append([]byte(nil), netflowV5Fixture...)
+	next[19] = 110
+	if _, err := decodeAll(t, templates, exporterA, next); err != nil {
+		t.Fatal(err)
+	}
+	if lost := templates.lost.Load(); lost != 8 {
+		t.Errorf("lost %d records, want 8", lost)
+	}
+	// Another exporter's sequence is its own.
+	if _, err := decodeAll(t, templates, exporterB, netflowV5Fixture); err != nil {
+		t.Fatal(err)
+	}
+	if lost := templates.lost.Load(); lost != 8 {
+		t.Errorf("lost %d records after a second exporter, want 8", lost)
+	}
+}
+
+func TestDecodeNetFlowV9Templates(t *testing.T) {
+	templates := newNetflowTemplates()
+	// Data ahead of its template cannot be read and is dropped.
+	flows, err := decodeAll(t, templates, exporterA, netflowV9DataFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFlows(t, flows, nil)
+
+	flows, err = decodeAll(t, templates, exporterA, netflowV9TemplateFixture, netflowV9DataFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFlows(t, flows, []decodedFlow{
+		{"10.0.0.1", "10.0.0.2", 1000},
+		{"10.0.0.2", "10.0.0.1", 500},
+	})
+
+	// Templates belong to one exporter and source ID.
+	flows, err = decodeAll(t, templates, exporterB, netflowV9DataFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFlows(t, flows, nil)
+	otherDomain := append([]byte(nil), netflowV9DataFixture...)
+	otherDomain[19] = 8
+	flows, err = decodeAll(t, templates, exporterA, otherDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFlows(t, flows, nil)
+}
+
+func TestDecodeNetFlowV9Sampling(t *testing.T) {
+	templates := newNetflowTemplates()
+	flows, err := decodeAll(t, templates, exporterA, netflowV9TemplateFixture, netflowV9SamplingFixture, netflowV9DataFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFlows(t, flows, []decodedFlow{
+		{"10.0.0.1", "10.0.0.2", 10000},
+		{"10.0.0.2", "10.0.0.1", 5000},
+	})
+}
+
+func TestDecodeNetFlowMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		packet []byte
+	}{
+		{"empty", nil},
+		{"unknown version", hexFixture("0007 0000")},
+		{"v5 count beyond the datagram", hexFixture("0005 0003", strings.Repeat("00", 20+2*48))},
+		{"v9 set longer than the datagram", hexFixture("0009 0001 00000000 00000000 00000001 00000007 0100 0040 0a000001")},
+		{"v9 set shorter than its header", hexFixture("0009 0001 00000000 00000000 00000001 00000007 0100 0002 0a000001")},
+		{"v9 template cut in a field", hexFixture("0009 0001 00000000 00000000 00000001 00000007 0000 000e 0100 0003 0008 0004 000c")},
+	} {
+		if _, err := decodeAll(t, newNetflowTemplates(), exporterA, tc.packet); err == nil {
+			t.Errorf("%s: decoded without an error", tc.name)
+		}
+	}
+}
+
+// TestDecodeNetFlowTruncated feeds every prefix of the fixtures to a
+// decoder that holds their templates: a datagram cut anywhere must not
+// panic or yield flows it does not contain.
+func TestDecodeNetFlowTruncated(t *testing.T) {
+	for _, fixture := range [][]byte{netflowV5Fixture, netflowV9TemplateFixture, netflowV9DataFixture, netflowV9SamplingFixture} {
+		for n := 0; n < len(fixture); n++ {
+			templates := newNetflowTemplates()
+			decodeAll(t, templates, exporterA, netflowV9TemplateFixture, netflowV9SamplingFixture)
+			flows, _ := decodeAll(t, templates, exporterA, fixture[:n])
+			if len(flows) > 2 {
+				t.Errorf("%d-byte prefix yielded %d flows", n, len(flows))
+			}
+		}
+	}
+}
+
+// IPFIX for observation domain 7: template 256 of IPv6 source and
+// destination, octet delta count, an enterprise element and a
+// variable-length interface name, then two records, the second with the
+// three-byte length form.
+var (
+	ipfixTemplateFixture = hexFixture(
+		"000a 0030 00000000 00000001 00000007",
+		"0002 0020 0100 0005 001b 0010 001c 0010 0001 0008 8064 0004 00000009 0052 ffff",
+	)
+	ipfixDataFixture = hexFixture(
+		"000a 007a 00000000 00000002 00000007",
+		"0100 006a",
+		"20010db8000000000000000000000001 20010db8000000000000000000000002 0000000000000bb8 deadbeef 04 65746830",
+		"20010db8000000000000000000000002 20010db8000000000000000000000001 00000000000007d0 00000000 ff0006 656e73313932",
+	)
+	// An options template 258 scoped to the observation domain, and its
+	// data announcing 1-in-10 sampling.
+	ipfixSamplingFixture = hexFixture(
+		"000a 002e 00000000 00000003 00000007",
+		"0003 0012 0102 0002 0001 0095 0004 0022 0004",
+		"0102 000c 00000007 0000000a",
+	)
+)
+
+func TestDecodeIPFIX(t *testing.T) {
+	templates := newNetflowTemplates()
+	flows, err := decodeAll(t, templates, exporterA, ipfixTemplateFixture, ipfixDataFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFlows(t, flows, []decodedFlow{
+		{"2001:db8::1", "2001:db8::2", 3000},
+		{"2001:db8::2", "2001:db8::1", 2000},
+	})
+
+	flows, err = decodeAll(t, templates, exporterA, ipfixSamplingFixture, ipfixDataFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFlows(t, flows, []decodedFlow{
+		{"2001:db8::1", "2001:db8::2", 30000},
+		{"2001:db8::2", "2001:db8::1", 20000},
+	})
+
+	// Enterprise element 100 of enterprise 9 keeps its number, so it is
+	// skipped rather than read as standard element 100.
+	key := netflowTemplateKey{netflowDomain{exporterA, 7}, 256}
+	if fields := templates.templates[key].fields; len(fields) != 5 || fields[3] != (netflowField{Type: 100, Length: 4, Enterprise: 9}) {
+		t.Errorf("template fields %+v", fields)
+	}
+}
+
+func TestDecodeIPFIXMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		packets [][]byte
+	}{
+		{"message length beyond the datagram", [][]byte{hexFixture("000a 0100 00000000 00000001 00000007")}},
+		{"message length under the header", [][]byte{hexFixture("000a 0008 00000000 00000001 00000007")}},
+		{"enterprise field without its number", [][]byte{hexFixture("000a 001c 00000000 00000001 00000007 0002 000c 0100 0001 8064 0004")}},
+		{"options template without its scope count", [][]byte{hexFixture("000a 0018 00000000 00000001 00000007 0003 0008 0102 0002")}},
+	} {
+		if _, err := decodeAll(t, newNetflowTemplates(), exporterA, tc.packets...); err == nil {
+			t.Errorf("%s: decoded without an error", tc.name)
+		}
+	}
+
+	// A variable-length value running past its set ends the set's records.
+	templates := newNetflowTemplates()
+	cut := hexFixture(
+		"000a 0039 00000000 00000002 00000007",
+		"0100 0029",
+		"20010db8000000000000000000000001 20010db8000000000000000000000002 0000000000000bb8 deadbeef 08 6574",
+	)
+	flows, err := decodeAll(t, templates, exporterA, ipfixTemplateFixture, cut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFlows(t, flows, nil)
+}
+
+func TestDecodeIPFIXTruncated(t *testing.T) {
+	for _, fixture := range [][]byte{ipfixTemplateFixture, ipfixDataFixture, ipfixSamplingFixture} {
+		for n := 0; n < len(fixture); n++ {
+			templates := newNetflowTemplates()
+			decodeAll(t, templates, exporterA, ipfixTemplateFixture)
+			// Cut messages keep their header's length, so the decoder
+			// must notice they are short.
+			flows, err := decodeAll(t, templates, exporterA, fixture[:n])
+			if err == nil && n < len(fixture) {
+				t.Errorf("%d-byte prefix of a %d-byte message decoded without an error", n, len(fixture))
+			}
+			if len(flows) > 0 {
+				t.Errorf("%d-byte prefix yielded %v", n, flows)
+			}
+		}
+	}
+}
+
+// Full datagrams for the benchmarks: 30 v5 records, the most a v5 datagram
+// holds, and as many v9 and IPFIX records as fit a 1500-byte MTU.
+var (
+	benchmarkV5 = hexFixture(
+		"0005 001e 00000000 00000000 00000000 00000064 00 00 0000",
+		strings.Repeat("0a000001 0a000002 00000000 0000 0000 00000001 000003e8 00000000 00000000 0000 0000 00 00 06 00 0000 0000 00 00 0000", 30),
+	)
+	benchmarkV9 = hexFixture(
+		"0009 0078 00000000 00000000 00000002 00000007",
+		"0100 05a4", strings.Repeat("0a000001 0a000002 000003e8", 120),
+	)
+	benchmarkIPFIX = hexFixture(
+		"000a 05d2 00000000 00000002 00000007",
+		"0100 05c2", strings.Repeat("20010db8000000000000000000000001 20010db8000000000000000000000002 0000000000000bb8 deadbeef 04 65746830", 30),
+	)
+)
+
+// decodeBenchmarks pairs each benchmark datagram with a decoder holding
+// its templates.
+func decodeBenchmarks() map[string]func() error {
+	templates := newNetflowTemplates()
+	for _, packet := range [][]byte{netflowV9TemplateFixture, ipfixTemplateFixture, ipfixSamplingFixture} {
+		decodeNetFlow(packet, exporterA, templates, func(source, destination netip.Addr, bytes float64) {})
+	}
+	var total float64
+	add := func(source, destination netip.Addr, bytes float64) { total += bytes }
+	return map[string]func() error{
+		"v5":    func() error { return decodeNetFlow(benchmarkV5, exporterA, templates, add) },
+		"v9":    func() error { return decodeNetFlow(benchmarkV9, exporterA, templates, add) },
+		"ipfix": func() error { return decodeNetFlow(benchmarkIPFIX, exporterA, templates, add) },
+		"sflow": func() error { return decodeSFlow(sflowFlowFixture, add, func(sflowInterfaceCounters) {}) },
+	}
+}
+
+// TestDecodeAllocations keeps the decode path free of allocations once an
+// exporter's templates are known.
+func TestDecodeAllocations(t *testing.T) {
+	for name, decode := range decodeBenchmarks() {
+		if allocs := testing.AllocsPerRun(100, func() {
+			if err := decode(); err != nil {
+				t.Fatal(err)
+			}
+		}); allocs != 0 {
+			t.Errorf("decoding %s allocates %.0f times per datagram", name, allocs)
+		}
+	}
+}
+
+func benchmarkDecode(b *testing.B, name string, records int) {
+	decode := decodeBenchmarks()[name]
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := decode(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N*records)/b.Elapsed().Seconds(), "flows/s")
+}
+
+func BenchmarkDecodeNetFlowV5(b *testing.B) { benchmarkDecode(b, "v5", 30) }
+func BenchmarkDecodeNetFlowV9(b *testing.B) { benchmarkDecode(b, "v9", 120) }
+func BenchmarkDecodeIPFIX(b *testing.B)     { benchmarkDecode(b, "ipfix", 30) }
+func BenchmarkDecodeSFlow(b *testing.B)     { benchmarkDecode(b, "sflow", 2) }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// nodeGraph is the nodes/edges JSON of Grafana's Node Graph panel, as served
+// by the Node Graph API datasource.
+type nodeGraph struct {
+	Nodes []nodeGraphNode `json:"nodes"`
+	Edges []nodeGraphEdge `json:"edges"`
+}
+
+type nodeGraphNode struct {
+	ID            string  `json:"id"`
+	Title         string  `json:"title"`
+	Subtitle      string  `json:"subtitle,omitempty"`
+	MainStat      float64 `json:"mainstat"`
+	SecondaryStat float64 `json:"secondarystat"`
+	// The arc around a node shows how its traffic splits into sent and
+	// received.
+	ArcOut         float64 `json:"arc__out"`
+	ArcIn          float64 `json:"arc__in"`
+	DetailKind     string  `json:"detail__kind,omitempty"`
+	DetailResolver string  `json:"detail__resolver,omitempty"`
+}
+
+type nodeGraphEdge struct {
+	ID       string  `json:"id"`
+	Source   string  `json:"source"`
+	Target   string  `json:"target"`
+	MainStat float64 `json:"mainstat"`
+}
+
+type nodeGraphField struct {
+	Name        string `json:"field_name"`
+	Type        string `json:"type"`
+	DisplayName string `json:"displayName,omitempty"`
+	Color       string `json:"color,omitempty"`
+}
+
+// nodeGraphFields describes nodeGraph's columns for /api/graph/fields.
+var nodeGraphFields = map[string][]nodeGraphField{
+	"nodes_fields": {
+		{Name: "id", Type: "string"},
+		{Name: "title", Type: "string"},
+		{Name: "subtitle", Type: "string"},
+		{Name: "mainstat", Type: "number", DisplayName: "Bytes sent"},
+		{Name: "secondarystat", Type: "number", DisplayName: "Bytes received"},
+		{Name: "arc__out", Type: "number", DisplayName: "Sent", Color: "blue"},
+		{Name: "arc__in", Type: "number", DisplayName: "Received", Color: "green"},
+		{Name: "detail__kind", Type: "string", DisplayName: "Kind"},
+		{Name: "detail__resolver", Type: "string", DisplayName: "Labelled by"},
+	},
+	"edges_fields": {
+		{Name: "id", Type: "string"},
+		{Name: "source", Type: "string"},
+		{Name: "target", Type: "string"},
+		{Name: "mainstat", Type: "number", DisplayName: "Bytes"},
+	},
+}
+
+func newNodeGraph(matrix *FlowMatrix, nodes []apiNode) nodeGraph {
+	graph := nodeGraph{Nodes: []nodeGraphNode{}, Edges: []nodeGraphEdge{}}
+	for _, node := range nodes {
+		graphNode := nodeGraphNode{
+			ID:             node.Name,
+			Title:          node.Name,
+			Subtitle:       node.Namespace,
+			MainStat:       node.BytesOut,
+			SecondaryStat:  node.BytesIn,
+			DetailKind:     node.Kind,
+			DetailResolver: node.Resolver,
+		}
+		if total := node.BytesOut + node.BytesIn; total > 0 {
+			graphNode.ArcOut, graphNode.ArcIn = node.BytesOut/total, node.BytesIn/total
+		}
+		graph.Nodes = append(graph.Nodes, graphNode)
+	}
+	for i, source := range matrix.Names {
+		for j, target := range matrix.Names {
+			if matrix.Flow[i][j] > 0 {
+				graph.Edges = append(graph.Edges, nodeGraphEdge{
+					ID:       source + "->" + target,
+					Source:   source,
+					Target:   target,
+					MainStat: matrix.Flow[i][j],
+				})
+			}
+		}
+	}
+	return graph
+}
+
+// writeNodeGraph writes graph to path for a JSON API or Infinity datasource
+// to read.
+func writeNodeGraph(path string, graph nodeGraph) error {
+	data, err := json.MarshalIndent(graph, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// serveNodeGraph answers the Node Graph API datasource: /api/graph/fields,
+// /api/graph/data (taking the same parameters as /diagram.png) and
+// /api/health.
+func (s *diagramServer) serveNodeGraph(w http.ResponseWriter, r *http.Request) {
+	var body interface{}
+	switch strings.TrimPrefix(r.URL.Path, "/api/") {
+	case "graph/fields":
+		body = nodeGraphFields
+	case "graph/data":
+		cfg, query, matrix, ok := s.query(w, r)
+		if !ok {
+			return
+		}
+		body = newNodeGraph(matrix, describeNodes(r.Context(), cfg, s.enrich, matrix, query.From, query.To))
+	case "health":
+		w.Write([]byte("ok\n"))
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(body)
+}
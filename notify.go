@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SlackConfig uploads each rendered output to a channel.
+type SlackConfig struct {
+	// Token is a bot token with files:write; it falls back to SLACK_TOKEN.
+	Token   string `yaml:"token" toml:"token"`
+	Channel string `yaml:"channel" toml:"channel"`
+	// Summary is how many of the largest pairs to list with the upload.
+	Summary int `yaml:"summary" toml:"summary"`
+}
+
+// WebhookConfig posts a JSON summary of each run to URL.
+type WebhookConfig struct {
+	URL     string            `yaml:"url" toml:"url"`
+	Headers map[string]string `yaml:"headers" toml:"headers"`
+	// ImageURL is where the output can be fetched, e.g. from a web server
+	// publishing the output directory; it is passed on as is.
+	ImageURL string `yaml:"imageURL" toml:"imageURL"`
+	Summary  int    `yaml:"summary" toml:"summary"`
+}
+
+var slackAPI = "https://slack.com/api"
+
+var notifyClient = &http.Client{Timeout: time.Minute}
+
+// webhookReport is the body posted to WebhookConfig.URL.
+type webhookReport struct {
+	Title      string          `json:"title"`
+	From       time.Time       `json:"from"`
+	To         time.Time       `json:"to"`
+	ImageURL   string          `json:"imageURL,omitempty"`
+	Nodes      int             `json:"nodes"`
+	TotalBytes float64         `json:"totalBytes"`
+	TopPairs   []flowTablePair `json:"topPairs"`
+	// Completeness is the manifest's completeness score.
+	Completeness *Completeness `json:"completeness,omitempty"`
+}
+
+func postWebhook(ctx context.Context, cfg Config, matrix *FlowMatrix, manifest Manifest) error {
+	report := webhookReport{
+		Title:        cfg.Output.Title,
+		From:         manifest.From,
+		To:           manifest.To,
+		ImageURL:     cfg.Webhook.ImageURL,
+		Nodes:        len(matrix.Names),
+		TopPairs:     topPairs(matrix, cfg.Webhook.Summary),
+		Completeness: manifest.Completeness,
+	}
+	for i := range matrix.Flow {
+		for j := range matrix.Flow[i] {
+			report.TotalBytes += matrix.Flow[i][j]
+		}
+	}
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.Webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range cfg.Webhook.Headers {
+		req.Header.Set(key, value)
+	}
+	res, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return fmt.Errorf("webhook: %s: %s", res.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// uploadToSlack shares the output at path in the channel with Slack's
+// external upload flow: reserve an upload URL, send the file, then complete
+// the upload into the channel.
+func uploadToSlack(ctx context.Context, cfg Config, matrix *FlowMatrix, manifest Manifest, path string) error {
+	token := cfg.Slack.Token
+	if token == "" {
+		token = os.Getenv("SLACK_TOKEN")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var reserved struct {
+		UploadURL string `json:"upload_url"`
+		FileID    string `json:"file_id"`
+	}
+	form := url.Values{"filename": {filepath.Base(path)}, "length": {strconv.Itoa(len(data))}}
+	if err := slackCall(ctx, token, "files.getUploadURLExternal", "application/x-www-form-urlencoded", []byte(form.Encode()), &reserved); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reserved.UploadURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	res, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("slack: uploading %s: %s", filepath.Base(path), res.Status)
+	}
+
+	complete, err := json.Marshal(map[string]interface{}{
+		"files":           []map[string]string{{"id": reserved.FileID, "title": cfg.Output.Title}},
+		"channel_id":      cfg.Slack.Channel,
+		"initial_comment": "```" + reportSummary(matrix, manifest, cfg.Slack.Summary) + "```",
+	})
+	if err != nil {
+		return err
+	}
+	return slackCall(ctx, token, "files.completeUploadExternal", "application/json; charset=utf-8", complete, nil)
+}
+
+// slackCall posts body to a Web API method, whose responses carry ok and
+// error whatever the HTTP status.
+func slackCall(ctx context.Context, token, method, contentType string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, slackAPI+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", contentType)
+	res, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	var response struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return fmt.Errorf("slack %s: %s", method, res.Status)
+	}
+	if !response.OK {
+		return fmt.Errorf("slack %s: %s", method, response.Error)
+	}
+	if out != nil {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
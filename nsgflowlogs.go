@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NSGFlowLogsConfig points at the insights-logs-networksecuritygroupflowevent
+// container, either as its https:// URL (optionally followed by a prefix) or
+// as a local copy. A flow between two NICs that both have flow logging
+// enabled is logged by each and counted twice.
+type NSGFlowLogsConfig struct {
+	Location string `yaml:"location" toml:"location"`
+	SASToken string `yaml:"sasToken" toml:"sasToken"`
+}
+
+type nsgFlowLogsSource struct {
+	store  objectStore
+	prefix string
+}
+
+func newNSGFlowLogsSource(cfg NSGFlowLogsConfig) (*nsgFlowLogsSource, error) {
+	if cfg.Location == "" {
+		return nil, fmt.Errorf("nsgflowlogs source needs a location")
+	}
+	if !strings.HasPrefix(cfg.Location, "https://") {
+		return &nsgFlowLogsSource{store: dirStore{root: cfg.Location}}, nil
+	}
+
+	u, err := url.Parse(cfg.Location)
+	if err != nil {
+		return nil, err
+	}
+	container, prefix, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	if container == "" {
+		return nil, fmt.Errorf("nsgflowlogs location %s has no container", cfg.Location)
+	}
+	store, err := newAzureBlobStore("https://"+u.Host+"/"+container, cfg.SASToken)
+	if err != nil {
+		return nil, err
+	}
+	return &nsgFlowLogsSource{store: store, prefix: prefix}, nil
+}
+
+func (s *nsgFlowLogsSource) Name() string {
+	return "nsgflowlogs"
+}
+
+func (s *nsgFlowLogsSource) Version(ctx context.Context) (string, error) {
+	return "azure-nsg-flow-logs-v2", nil
+}
+
+// Blobs are named .../y=2024/m=05/d=01/h=13/m=00/macAddress=.../PT1H.json and
+// hold one hour of records.
+var nsgBlobHour = regexp.MustCompile(`/y=(\d{4})/m=(\d{2})/d=(\d{2})/h=(\d{2})/`)
+
+func (s *nsgFlowLogsSource) Fetch(ctx context.Context, from, to time.Time, networkFilters []string) (*FlowMatrix, error) {
+	filter, err := parseCIDRFilter(networkFilters)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := s.store.list(ctx, s.prefix)
+	if err != nil {
+		return nil, fmt.Errorf("listing %s: %w", s.prefix, err)
+	}
+
+	matrix := NewFlowMatrix()
+	for _, key := range keys {
+		match := nsgBlobHour.FindStringSubmatch(key)
+		if match == nil {
+			continue
+		}
+		hour, err := time.Parse("2006010215", match[1]+match[2]+match[3]+match[4])
+		if err != nil || !hour.Add(time.Hour).After(from) || !hour.Before(to) {
+			continue
+		}
+		if err := s.readBlob(ctx, key, from, to, filter, matrix); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", key, err)
+		}
+	}
+	return matrix, nil
+}
+
+type nsgFlowLog struct {
+	Records []struct {
+		Properties struct {
+			Version int `json:"Version"`
+			Flows   []struct {
+				Flows []struct {
+					FlowTuples []string `json:"flowTuples"`
+				} `json:"flows"`
+			} `json:"flows"`
+		} `json:"properties"`
+	} `json:"records"`
+}
+
+func (s *nsgFlowLogsSource) readBlob(ctx context.Context, key string, from, to time.Time, filter cidrFilter, matrix *FlowMatrix) error {
+	body, err := s.store.open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	var flowLog nsgFlowLog
+	if err := json.NewDecoder(body).Decode(&flowLog); err != nil {
+		return err
+	}
+	for _, record := range flowLog.Records {
+		// Version 1 tuples carry no byte counts.
+		if record.Properties.Version < 2 {
+			continue
+		}
+		for _, rule := range record.Properties.Flows {
+			for _, group := range rule.Flows {
+				for _, tuple := range group.FlowTuples {
+					addNSGFlowTuple(tuple, from, to, filter, matrix)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// addNSGFlowTuple adds one version 2 tuple:
+// time,src,dst,sport,dport,proto,direction,decision,state,packetsS2D,bytesS2D,packetsD2S,bytesD2S.
+// Counts on continuing and end tuples cover the interval since the previous
+// tuple of the flow, so they can be summed.
+func addNSGFlowTuple(tuple string, from, to time.Time, filter cidrFilter, matrix *FlowMatrix) {
+	fields := strings.Split(tuple, ",")
+	if len(fields) < 13 {
+		return
+	}
+	seconds, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return
+	}
+	if t := time.Unix(seconds, 0); t.Before(from) || !t.Before(to) {
+		return
+	}
+	source, destination := fields[1], fields[2]
+	if !filter.match(source, destination) {
+		return
+	}
+	if sent, err := strconv.ParseFloat(fields[10], 64); err == nil && sent > 0 {
+		matrix.Add(source, destination, sent)
+	}
+	if received, err := strconv.ParseFloat(fields[12], 64); err == nil && received > 0 {
+		matrix.Add(destination, source, received)
+	}
+}
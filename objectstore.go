@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// objectStore is the bucket-like storage flow log exporters write to. Keys
+// are slash-separated paths relative to the store root.
+type objectStore interface {
+	list(ctx context.Context, prefix string) ([]string, error)
+	open(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+type s3Store struct {
+	client *s3.Client
+	bucket string
+}
+
+func (s *s3Store) list(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			keys = append(keys, aws.ToString(object.Key))
+		}
+	}
+	return keys, nil
+}
+
+func (s *s3Store) open(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// azureBlobStore reads a blob container over the REST API, authenticating
+// with a SAS token or, without one, an Azure AD token from the az CLI.
+type azureBlobStore struct {
+	containerURL string
+	sasToken     string
+	bearerToken  string
+	httpClient   *http.Client
+}
+
+func newAzureBlobStore(containerURL, sasToken string) (*azureBlobStore, error) {
+	store := &azureBlobStore{
+		containerURL: strings.TrimRight(containerURL, "/"),
+		sasToken:     strings.TrimPrefix(sasToken, "?"),
+		httpClient:   &http.Client{Timeout: 5 * time.Minute},
+	}
+	if store.sasToken != "" {
+		return store, nil
+	}
+
+	if _, err := exec.LookPath("az"); err != nil {
+		return nil, fmt.Errorf("no SAS token configured and the az CLI is not available: %w", err)
+	}
+	out, err := exec.Command("az", "account", "get-access-token", "--resource", "https://storage.azure.com/", "--query", "accessToken", "--output", "tsv").Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("az account get-access-token: %s", strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, err
+	}
+	store.bearerToken = strings.TrimSpace(string(out))
+	return store, nil
+}
+
+func (s *azureBlobStore) get(ctx context.Context, path string, params url.Values) (io.ReadCloser, error) {
+	query := params.Encode()
+	if s.sasToken != "" {
+		if query != "" {
+			query += "&"
+		}
+		query += s.sasToken
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.containerURL+path+"?"+query, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-ms-version", "2021-08-06")
+	if s.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.bearerToken)
+	}
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return nil, fmt.Errorf("azure blob: %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return res.Body, nil
+}
+
+func (s *azureBlobStore) list(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	params := url.Values{}
+	params.Set("restype", "container")
+	params.Set("comp", "list")
+	params.Set("prefix", prefix)
+	for {
+		body, err := s.get(ctx, "", params)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Blobs []struct {
+				Name string `xml:"Name"`
+			} `xml:"Blobs>Blob"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		err = xml.NewDecoder(body).Decode(&page)
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, blob := range page.Blobs {
+			keys = append(keys, blob.Name)
+		}
+		if page.NextMarker == "" {
+			return keys, nil
+		}
+		params.Set("marker", page.NextMarker)
+	}
+}
+
+func (s *azureBlobStore) open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.get(ctx, "/"+(&url.URL{Path: key}).EscapedPath(), url.Values{})
+}
+
+type dirStore struct {
+	root string
+}
+
+func (d dirStore) list(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(filepath.Join(d.root, prefix), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !entry.IsDir() {
+			rel, err := filepath.Rel(d.root, path)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (d dirStore) open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(d.root, filepath.FromSlash(key)))
+}
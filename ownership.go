@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io/fs"
+	"log"
+	"os"
+	"time"
+)
+
+// ownershipIndex is the on-disk history of which object owned each IP. It is
+// kept up to date by `kube-netflow ipwatch` and merged into the live inventory
+// so historical windows are attributed to the pods that existed back then.
+type ownershipIndex struct {
+	Version   int           `json:"version"`
+	UpdatedAt time.Time     `json:"updatedAt"`
+	Endpoints kubeInventory `json:"endpoints"`
+}
+
+func loadOwnershipIndex(path string) (*ownershipIndex, error) {
+	index := &ownershipIndex{Version: ownershipIndexVersion, Endpoints: make(kubeInventory)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := ownershipFormat.decode(data, index); err != nil {
+		return nil, err
+	}
+	if index.Endpoints == nil {
+		index.Endpoints = make(kubeInventory)
+	}
+	return index, nil
+}
+
+func (index *ownershipIndex) save(path string) error {
+	index.Version = ownershipIndexVersion
+	data, err := ownershipFormat.encode(index)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// observe closes intervals whose owner no longer holds the IP and opens new
+// ones for owners seen for the first time.
+func (index *ownershipIndex) observe(live kubeInventory, now time.Time) {
+	for ip, endpoints := range index.Endpoints {
+		for i, endpoint := range endpoints {
+			if !endpoint.Until.IsZero() {
+				continue
+			}
+			if !live.holds(ip, endpoint) {
+				endpoints[i].Until = now
+			}
+		}
+	}
+
+	for ip, endpoints := range live {
+		for _, endpoint := range endpoints {
+			if index.Endpoints.holds(ip, endpoint) {
+				continue
+			}
+			if endpoint.Since.IsZero() {
+				endpoint.Since = now
+			}
+			index.Endpoints.add(ip, endpoint)
+		}
+	}
+	index.UpdatedAt = now
+}
+
+// prune forgets intervals that ended before cutoff.
+func (index *ownershipIndex) prune(cutoff time.Time) {
+	for ip, endpoints := range index.Endpoints {
+		kept := endpoints[:0]
+		for _, endpoint := range endpoints {
+			if endpoint.Until.IsZero() || endpoint.Until.After(cutoff) {
+				kept = append(kept, endpoint)
+			}
+		}
+		if len(kept) == 0 {
+			delete(index.Endpoints, ip)
+		} else {
+			index.Endpoints[ip] = kept
+		}
+	}
+}
+
+// holds reports whether endpoint currently (open interval) owns ip.
+func (inv kubeInventory) holds(ip string, endpoint kubeEndpoint) bool {
+	for _, current := range inv[ip] {
+		if current.Until.IsZero() && current.sameObject(endpoint) {
+			return true
+		}
+	}
+	return false
+}
+
+// merge adds the recorded history to a live inventory. Live entries win for
+// objects present in both, since they carry the authoritative start time.
+func (inv kubeInventory) merge(history kubeInventory) {
+	for ip, endpoints := range history {
+		for _, endpoint := range endpoints {
+			if endpoint.Until.IsZero() && inv.holds(ip, endpoint) {
+				continue
+			}
+			inv.add(ip, endpoint)
+		}
+	}
+}
+
+func runIPWatch(args []string) {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		log.Fatalf("Error loading config: %s", err)
+	}
+
+	fs := flag.NewFlagSet("ipwatch", flag.ExitOnError)
+	fs.String("config", "", "YAML or TOML configuration file")
+	fs.StringVar(&cfg.Kubernetes.OwnershipIndex, "store", cfg.Kubernetes.OwnershipIndex, "File recording IP ownership intervals")
+	fs.StringVar(&cfg.Kubernetes.Kubeconfig, "kubeconfig", cfg.Kubernetes.Kubeconfig, "Kubeconfig used outside the cluster (defaults to kubectl's)")
+	intervalPtr := fs.Duration("interval", 30*time.Second, "How often to poll the Kubernetes API")
+	retentionPtr := fs.Duration("retention", 30*24*time.Hour, "How long to keep ended ownership intervals")
+	fs.Parse(args)
+
+	if cfg.Kubernetes.OwnershipIndex == "" {
+		log.Fatalf("Usage: kube-netflow ipwatch --store <file>")
+	}
+
+	client, err := newKubeClient(cfg.Kubernetes.Kubeconfig)
+	if err != nil {
+		log.Fatalf("Error creating Kubernetes client: %s", err)
+	}
+	index, err := loadOwnershipIndex(cfg.Kubernetes.OwnershipIndex)
+	if err != nil {
+		log.Fatalf("Error loading %s: %s", cfg.Kubernetes.OwnershipIndex, err)
+	}
+
+	ticker := time.NewTicker(*intervalPtr)
+	defer ticker.Stop()
+	for {
+		live, err := loadKubeInventory(context.Background(), client)
+		if err != nil {
+			log.Printf("Error loading Kubernetes objects: %s", err)
+		} else {
+			now := time.Now().UTC()
+			index.observe(live, now)
+			index.prune(now.Add(-*retentionPtr))
+			if err := index.save(cfg.Kubernetes.OwnershipIndex); err != nil {
+				log.Printf("Error saving %s: %s", cfg.Kubernetes.OwnershipIndex, err)
+			}
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// Pages of /api/v1/pairs hold defaultPageSize pairs unless a request asks
+// for up to maxPageSize.
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+type apiPair struct {
+	Source      string  `json:"source"`
+	Destination string  `json:"destination"`
+	Bytes       float64 `json:"bytes"`
+	// Flows is the flow records behind the pair, for sources that count
+	// them.
+	Flows float64 `json:"flows,omitempty"`
+}
+
+type apiPairs struct {
+	Query     flowQuery `json:"query"`
+	Freshness freshness `json:"freshness"`
+	Pairs     []apiPair `json:"pairs"`
+	// Total is how many pairs matched the filters, of which Pairs is the
+	// page starting at Offset.
+	Total  int `json:"total"`
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+}
+
+// pairFilter selects, orders and pages the pairs of a matrix. A pair
+// matches namespaces or kinds when either end does; empty sets match all.
+type pairFilter struct {
+	namespaces map[string]bool
+	kinds      map[string]bool
+	minBytes   float64
+	sort       string
+	descending bool
+	offset     int
+	limit      int
+}
+
+// parsePairFilter reads the namespace, kind, minBytes, sort, order, offset
+// and limit parameters. namespace and kind may be repeated or
+// comma-separated. Pairs are sorted by bytes, the default, flows, source or
+// destination; numbers descend and names ascend unless order says otherwise.
+func parsePairFilter(params url.Values) (pairFilter, error) {
+	filter := pairFilter{sort: "bytes", limit: defaultPageSize}
+	set := func(name string) map[string]bool {
+		var values map[string]bool
+		for _, value := range params[name] {
+			var items stringList
+			items.Set(value)
+			for _, item := range items {
+				if values == nil {
+					values = make(map[string]bool)
+				}
+				values[item] = true
+			}
+		}
+		return values
+	}
+	filter.namespaces = set("namespace")
+	filter.kinds = set("kind")
+
+	var err error
+	if value := params.Get("minBytes"); value != "" {
+		if filter.minBytes, err = strconv.ParseFloat(value, 64); err != nil || filter.minBytes < 0 {
+			return filter, fmt.Errorf("invalid minBytes: %s", value)
+		}
+	}
+	if value := params.Get("sort"); value != "" {
+		filter.sort = value
+	}
+	switch filter.sort {
+	case "bytes", "flows":
+		filter.descending = true
+	case "source", "destination":
+	default:
+		return filter, fmt.Errorf("invalid sort: want bytes, flows, source or destination")
+	}
+	switch params.Get("order") {
+	case "":
+	case "asc":
+		filter.descending = false
+	case "desc":
+		filter.descending = true
+	default:
+		return filter, fmt.Errorf("invalid order: want asc or desc")
+	}
+	if value := params.Get("offset"); value != "" {
+		if filter.offset, err = strconv.Atoi(value); err != nil || filter.offset < 0 {
+			return filter, fmt.Errorf("invalid offset: %s", value)
+		}
+	}
+	if value := params.Get("limit"); value != "" {
+		if filter.limit, err = strconv.Atoi(value); err != nil || filter.limit < 1 || filter.limit > maxPageSize {
+			return filter, fmt.Errorf("invalid limit: want 1 to %d", maxPageSize)
+		}
+	}
+	return filter, nil
+}
+
+// apply returns the page of matrix's pairs the filter selects and how many
+// matched in all. nodes are the matrix's nodes as describeNodes returns
+// them.
+func (f pairFilter) apply(matrix *FlowMatrix, nodes []apiNode) ([]apiPair, int) {
+	byName := make(map[string]apiNode, len(nodes))
+	for _, node := range nodes {
+		if node.Kind == "namespace" {
+			node.Namespace = node.Name
+		}
+		byName[node.Name] = node
+	}
+	matches := func(set map[string]bool, field func(apiNode) string) func(pair apiPair) bool {
+		return func(pair apiPair) bool {
+			return set == nil || set[field(byName[pair.Source])] || set[field(byName[pair.Destination])]
+		}
+	}
+	inNamespace := matches(f.namespaces, func(node apiNode) string { return node.Namespace })
+	ofKind := matches(f.kinds, func(node apiNode) string { return node.Kind })
+
+	pairs := []apiPair{}
+	for _, pair := range topPairs(matrix, 0) {
+		p := apiPair{Source: pair.Source, Destination: pair.Destination, Bytes: pair.Bytes, Flows: matrix.flows[[2]string{pair.Source, pair.Destination}]}
+		if p.Bytes >= f.minBytes && inNamespace(p) && ofKind(p) {
+			pairs = append(pairs, p)
+		}
+	}
+
+	key := map[string]func(i, j int) int{
+		"bytes":       func(i, j int) int { return cmp.Compare(pairs[i].Bytes, pairs[j].Bytes) },
+		"flows":       func(i, j int) int { return cmp.Compare(pairs[i].Flows, pairs[j].Flows) },
+		"source":      func(i, j int) int { return cmp.Compare(pairs[i].Source, pairs[j].Source) },
+		"destination": func(i, j int) int { return cmp.Compare(pairs[i].Destination, pairs[j].Destination) },
+	}[f.sort]
+	sort.SliceStable(pairs, func(i, j int) bool {
+		if f.descending {
+			return key(i, j) > 0
+		}
+		return key(i, j) < 0
+	})
+
+	total := len(pairs)
+	start := min(f.offset, total)
+	end := min(start+f.limit, total)
+	return pairs[start:end], total
+}
+
+// servePairs handles /api/v1/pairs, which lists the matrix of
+// /api/v1/flows as filtered, sorted pages of source and destination pairs
+// so clients need not download all of it.
+func (s *diagramServer) servePairs(w http.ResponseWriter, r *http.Request) {
+	filter, err := parsePairFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cfg, query, matrix, ok := s.query(w, r)
+	if !ok {
+		return
+	}
+
+	if notModified(w, r, "W/"+matrixETag(r, query, matrix)) {
+		return
+	}
+	nodes := describeNodes(r.Context(), cfg, s.enrich, matrix, query.From, query.To)
+	response := apiPairs{Query: query, Freshness: s.freshness(query), Offset: filter.offset, Limit: filter.limit}
+	response.Pairs, response.Total = filter.apply(matrix, nodes)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
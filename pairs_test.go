@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestPairFilter(t *testing.T) {
+	matrix := NewFlowMatrix()
+	matrix.Add("shop/web", "shop/api", 900)
+	matrix.Add("shop/api", "shop/db", 400)
+	matrix.Add("batch/job", "shop/api", 300)
+	matrix.Add("batch/job", "10.1.0.1", 50)
+	matrix.addFlows("shop/api", "shop/db", 7)
+	nodes := []apiNode{
+		{Name: "shop/web", Kind: "pod", Namespace: "shop"},
+		{Name: "shop/api", Kind: "service", Namespace: "shop"},
+		{Name: "shop/db", Kind: "pod", Namespace: "shop"},
+		{Name: "batch/job", Kind: "pod", Namespace: "batch"},
+		{Name: "10.1.0.1", Kind: "ip"},
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+		total int
+	}{
+		{"", []string{"shop/web>shop/api", "shop/api>shop/db", "batch/job>shop/api", "batch/job>10.1.0.1"}, 4},
+		{"limit=2&offset=1", []string{"shop/api>shop/db", "batch/job>shop/api"}, 4},
+		{"offset=10", nil, 4},
+		{"namespace=batch", []string{"batch/job>shop/api", "batch/job>10.1.0.1"}, 2},
+		{"kind=ip,service&minBytes=100", []string{"shop/web>shop/api", "shop/api>shop/db", "batch/job>shop/api"}, 3},
+		{"sort=source", []string{"batch/job>shop/api", "batch/job>10.1.0.1", "shop/api>shop/db", "shop/web>shop/api"}, 4},
+		{"sort=bytes&order=asc&limit=1", []string{"batch/job>10.1.0.1"}, 4},
+		{"sort=flows&limit=1", []string{"shop/api>shop/db"}, 4},
+	}
+	for _, test := range tests {
+		params, _ := url.ParseQuery(test.query)
+		filter, err := parsePairFilter(params)
+		if err != nil {
+			t.Errorf("%q: %s", test.query, err)
+			continue
+		}
+		pairs, total := filter.apply(matrix, nodes)
+		var got []string
+		for _, pair := range pairs {
+			got = append(got, pair.Source+">"+pair.Destination)
+		}
+		if !reflect.DeepEqual(got, test.want) || total != test.total {
+			t.Errorf("%q = %v of %d, want %v of %d", test.query, got, total, test.want, test.total)
+		}
+	}
+
+	for _, query := range []string{"limit=0", "limit=1001", "offset=-1", "minBytes=x", "sort=name", "order=up"} {
+		params, _ := url.ParseQuery(query)
+		if _, err := parsePairFilter(params); err == nil {
+			t.Errorf("%q parsed, want an error", query)
+		}
+	}
+}
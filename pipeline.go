@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// fetchMatrix queries [from, to) from source and prepares it. An address
+// that changed Kubernetes owner within the range would go to one owner for
+// all of it, so the range is queried and labelled in parts split where
+// owners changed, and each flow goes to the owner of its time.
+func fetchMatrix(ctx context.Context, cfg Config, source FlowSource, enrich *enricher, from, to time.Time) (*FlowMatrix, error) {
+	changes, err := enrich.ownerChanges(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	bounds := append(append([]time.Time{from}, changes...), to)
+	matrix := NewFlowMatrix()
+	for k := 0; k+1 < len(bounds); k++ {
+		part, err := source.Fetch(ctx, bounds[k], bounds[k+1], cfg.Network)
+		if err != nil {
+			return nil, fmt.Errorf("querying flows: %w", err)
+		}
+		if part, err = enrich.label(ctx, part, bounds[k], bounds[k+1]); err != nil {
+			return nil, err
+		}
+		matrix.Merge(part)
+	}
+	return protectMatrix(cfg, matrix)
+}
+
+// prepareMatrix applies the resolver chain and the privacy settings to a
+// matrix fetched for [from, to).
+func prepareMatrix(ctx context.Context, cfg Config, enrich *enricher, matrix *FlowMatrix, from, to time.Time) (*FlowMatrix, error) {
+	matrix, err := enrich.label(ctx, matrix, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return protectMatrix(cfg, matrix)
+}
+
+// protectMatrix applies the privacy settings to a labelled matrix.
+func protectMatrix(cfg Config, matrix *FlowMatrix) (*FlowMatrix, error) {
+	var err error
+	if cfg.Privacy.MinPairBytes > 0 || cfg.Privacy.MinPairFlows > 0 {
+		if matrix, err = suppressSmallPairs(matrix, cfg.Privacy.MinPairBytes, cfg.Privacy.MinPairFlows); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Privacy.NoiseEpsilon > 0 {
+		matrix = addLaplaceNoise(matrix, cfg.Privacy.NoiseEpsilon, cfg.Privacy.NoiseSensitivity, rand.New(rand.NewSource(time.Now().UnixNano())))
+	}
+
+	if cfg.Privacy.PseudonymizeKeyFile != "" {
+		key, err := loadPseudonymKey(cfg.Privacy.PseudonymizeKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading pseudonymization key: %w", err)
+		}
+		matrix = pseudonymize(matrix, key)
+	}
+	return matrix, nil
+}
+
+// publish writes the diagram, the HTML report or the node graph to
+// cfg.Output.Path or to standard output for -, writes its manifest and, with
+// a signing key configured, signs both. The data table and the bundle are
+// written, and copies of the output and bundle rotated, when configured.
+func publish(ctx context.Context, cfg Config, enrich *enricher, matrix *FlowMatrix, manifest Manifest) error {
+	output := cfg.Output.Path
+	var nodes []apiNode
+	if cfg.Output.Format == "nodegraph" || cfg.Output.Table || cfg.Output.Bundle != "" {
+		nodes = describeNodes(ctx, cfg, enrich, matrix, manifest.From, manifest.To)
+	}
+	switch cfg.Output.Format {
+	case "nodegraph":
+		if err := writeNodeGraph(output, newNodeGraph(matrix, nodes)); err != nil {
+			return fmt.Errorf("saving node graph: %w", err)
+		}
+	case "html":
+		theme, ok := chordThemes[cfg.Output.Theme]
+		if !ok {
+			return fmt.Errorf("unknown theme: %s", cfg.Output.Theme)
+		}
+		report, err := newFlowReport(cfg, matrix, manifest, theme)
+		if err != nil {
+			return fmt.Errorf("rendering report: %w", err)
+		}
+		if err := writeFlowReport(output, report); err != nil {
+			return fmt.Errorf("saving report: %w", err)
+		}
+	default:
+		theme, ok := chordThemes[cfg.Output.Theme]
+		if !ok {
+			return fmt.Errorf("unknown theme: %s", cfg.Output.Theme)
+		}
+		if err := renderDiagram(matrix, cfg.Output.Title, cfg.Output, output, cfg.Output.Format, outputSize(cfg.Output), theme); err != nil {
+			return fmt.Errorf("saving plot: %w", err)
+		}
+	}
+	// Standard output gets the diagram alone.
+	if output == "-" {
+		return nil
+	}
+	artifacts := []string{output, output + ".manifest.json"}
+	if cfg.Output.Table {
+		table := newFlowTable(cfg.Output.Lang, cfg.Output.Title, matrix, nodes, manifest.From, manifest.To)
+		if err := writeFlowTable(tablePath(output), table); err != nil {
+			return fmt.Errorf("saving data table: %w", err)
+		}
+		artifacts = append(artifacts, tablePath(output))
+	}
+	if err := writeManifest(output, manifest); err != nil {
+		return fmt.Errorf("writing manifest: %w", err)
+	}
+
+	var key ed25519.PrivateKey
+	if cfg.Output.SignKey != "" {
+		var err error
+		if key, err = loadSigningKey(cfg.Output.SignKey); err != nil {
+			return fmt.Errorf("loading signing key: %w", err)
+		}
+		for _, path := range artifacts {
+			if err := signFile(key, path); err != nil {
+				return fmt.Errorf("signing %s: %w", path, err)
+			}
+		}
+	}
+
+	if cfg.Output.Bundle != "" {
+		files := artifacts
+		if key != nil {
+			for _, path := range artifacts {
+				files = append(files, path+".sig")
+			}
+		}
+		if err := writeBundle(cfg.Output.Bundle, files, matrix, nodes, manifest); err != nil {
+			return fmt.Errorf("writing bundle: %w", err)
+		}
+		if key != nil {
+			if err := signFile(key, cfg.Output.Bundle); err != nil {
+				return fmt.Errorf("signing %s: %w", cfg.Output.Bundle, err)
+			}
+		}
+	}
+
+	if cfg.Output.Keep > 0 {
+		rotated := []string{output}
+		if cfg.Output.Bundle != "" {
+			rotated = append(rotated, cfg.Output.Bundle)
+		}
+		for _, path := range rotated {
+			if err := rotateFile(path, cfg.Output.Keep, manifest.GeneratedAt); err != nil {
+				return fmt.Errorf("rotating %s: %w", path, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// PluginConfig declares an out-of-tree source: an executable speaking the
+// plugin protocol, selected with --source=<name>. Env is added to the
+// plugin's environment, e.g. for its credentials.
+//
+// The protocol has two commands. "<command> version" prints the backend
+// version on stdout. "<command> fetch --from <RFC3339> --to <RFC3339>
+// [--network <CIDR>]..." prints one JSON object per line,
+// {"source": "10.0.0.1", "destination": "10.0.0.2", "bytes": 1234}, for
+// the flows in [from, to), and exits non-zero with a message on stderr if
+// it fails. Plugins may push the network filter down; it is applied to
+// their output either way.
+type PluginConfig struct {
+	Command []string          `yaml:"command" toml:"command"`
+	Env     map[string]string `yaml:"env" toml:"env"`
+}
+
+type pluginSource struct {
+	name string
+	cfg  PluginConfig
+}
+
+type pluginFlow struct {
+	Source      string  `json:"source"`
+	Destination string  `json:"destination"`
+	Bytes       float64 `json:"bytes"`
+}
+
+func newPluginSource(name string, cfg PluginConfig) (*pluginSource, error) {
+	if len(cfg.Command) == 0 {
+		return nil, fmt.Errorf("plugin %s has no command", name)
+	}
+	if _, err := exec.LookPath(cfg.Command[0]); err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", name, err)
+	}
+	return &pluginSource{name: name, cfg: cfg}, nil
+}
+
+func (s *pluginSource) Name() string {
+	return s.name
+}
+
+func (s *pluginSource) command(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, s.cfg.Command[0], append(s.cfg.Command[1:], args...)...)
+	cmd.Env = os.Environ()
+	for key, value := range s.cfg.Env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	return cmd
+}
+
+func (s *pluginSource) Version(ctx context.Context) (string, error) {
+	cmd := s.command(ctx, "version")
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("plugin %s version: %s", s.name, strings.TrimSpace(stderr.String()))
+	}
+	version, _, _ := strings.Cut(string(out), "\n")
+	return strings.TrimSpace(version), nil
+}
+
+func (s *pluginSource) Fetch(ctx context.Context, from, to time.Time, networkFilters []string) (*FlowMatrix, error) {
+	filter, err := parseCIDRFilter(networkFilters)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"fetch", "--from", from.UTC().Format(time.RFC3339), "--to", to.UTC().Format(time.RFC3339)}
+	for _, cidr := range networkFilters {
+		args = append(args, "--network", strings.TrimSpace(cidr))
+	}
+	cmd := s.command(ctx, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	matrix := NewFlowMatrix()
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var flow pluginFlow
+		if err := json.Unmarshal(scanner.Bytes(), &flow); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return nil, fmt.Errorf("plugin %s line %d: %w", s.name, line, err)
+		}
+		if filter.match(flow.Source, flow.Destination) {
+			matrix.Add(flow.Source, flow.Destination, flow.Bytes)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		cmd.Wait()
+		return nil, err
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("plugin %s fetch: %s", s.name, strings.TrimSpace(stderr.String()))
+	}
+	return matrix, nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"net/netip"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// policyRefresh is how often the collector rereads the policy file and
+// resolves its namespaces to pod addresses.
+const policyRefresh = time.Minute
+
+// AgentPolicy narrows what agents capture and ship, so their overhead can
+// be tuned from the collector without redeploying them.
+type AgentPolicy struct {
+	// SampleRate ships this fraction of address pairs, picked by hashing the
+	// pair so a sampled pair is shipped every interval. Bytes are scaled up
+	// to compensate. 0 ships every pair.
+	SampleRate float64 `yaml:"sampleRate" toml:"sampleRate"`
+	// Ports ships only flows with one of these ports at either end. eBPF
+	// capture records no ports and is not filtered by them.
+	Ports []int `yaml:"ports" toml:"ports"`
+	// Namespaces ships only flows with a pod of these namespaces at either
+	// end.
+	Namespaces []string `yaml:"namespaces" toml:"namespaces"`
+}
+
+// agentPolicies is the --agent-policy file: the policy of every agent, and
+// the policies of agents whose names match a path.Match pattern instead.
+type agentPolicies struct {
+	Default AgentPolicy            `yaml:"default" toml:"default"`
+	Agents  map[string]AgentPolicy `yaml:"agents" toml:"agents"`
+}
+
+func loadAgentPolicies(path string) (*agentPolicies, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file agentPolicies
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		meta, err := toml.Decode(string(data), &file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("%s: unknown setting %s", path, undecoded[0])
+		}
+	default:
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&file); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if err := file.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &file, nil
+}
+
+func (f *agentPolicies) validate() error {
+	if err := f.Default.validate(); err != nil {
+		return fmt.Errorf("default: %w", err)
+	}
+	for pattern, policy := range f.Agents {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("agents: %q: %w", pattern, err)
+		}
+		if err := policy.validate(); err != nil {
+			return fmt.Errorf("agents: %s: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+func (p AgentPolicy) validate() error {
+	if p.SampleRate < 0 || p.SampleRate > 1 {
+		return fmt.Errorf("sampleRate must be between 0 and 1, got %g", p.SampleRate)
+	}
+	for _, port := range p.Ports {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+	return nil
+}
+
+// lookup returns the policy of agent: that of its name, else that of the
+// first matching pattern in sorted order, else the default.
+func (f *agentPolicies) lookup(agent string) AgentPolicy {
+	if policy, ok := f.Agents[agent]; ok {
+		return policy
+	}
+	patterns := make([]string, 0, len(f.Agents))
+	for pattern := range f.Agents {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, agent); ok {
+			return f.Agents[pattern]
+		}
+	}
+	return f.Default
+}
+
+// policyStore serves the --agent-policy file to agents, rereading it when
+// it changes and resolving its namespaces through the Kubernetes API.
+type policyStore struct {
+	path       string
+	kubeconfig string
+
+	mu       sync.Mutex
+	policies *agentPolicies
+	modTime  time.Time
+	// pods holds the addresses of the pods of each namespace.
+	pods map[string][][]byte
+}
+
+func newPolicyStore(path, kubeconfig string) (*policyStore, error) {
+	s := &policyStore{path: path, kubeconfig: kubeconfig}
+	if err := s.refresh(context.Background()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// refresh rereads the file if it changed and resolves the namespaces it
+// names. A file that no longer loads leaves the previous policies in force.
+func (s *policyStore) refresh(ctx context.Context) error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	policies, modTime := s.policies, s.modTime
+	s.mu.Unlock()
+	if policies == nil || !info.ModTime().Equal(modTime) {
+		if policies, err = loadAgentPolicies(s.path); err != nil {
+			return err
+		}
+		if modTime.IsZero() {
+			log.Printf("Loaded agent policies from %s", s.path)
+		} else {
+			log.Printf("Reloaded agent policies from %s", s.path)
+		}
+	}
+
+	var pods map[string][][]byte
+	if policies.namespaces() {
+		client, err := newKubeClient(s.kubeconfig)
+		if err != nil {
+			return err
+		}
+		inventory, err := loadKubeInventory(ctx, client)
+		if err != nil {
+			return fmt.Errorf("resolving policy namespaces: %w", err)
+		}
+		pods = make(map[string][][]byte)
+		for ip, endpoints := range inventory {
+			addr, err := netip.ParseAddr(ip)
+			if err != nil {
+				continue
+			}
+			for _, endpoint := range endpoints {
+				// A host-network pod's address is its node's, which would
+				// let the node's other traffic through.
+				if endpoint.Kind == "pod" && !endpoint.HostNetwork && endpoint.Until.IsZero() {
+					pods[endpoint.Namespace] = append(pods[endpoint.Namespace], addr.Unmap().AsSlice())
+					break
+				}
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policies, s.modTime, s.pods = policies, info.ModTime(), pods
+	return nil
+}
+
+func (f *agentPolicies) namespaces() bool {
+	if len(f.Default.Namespaces) > 0 {
+		return true
+	}
+	for _, policy := range f.Agents {
+		if len(policy.Namespaces) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// watch refreshes the store every policyRefresh until ctx is done.
+func (s *policyStore) watch(ctx context.Context) {
+	ticker := time.NewTicker(policyRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.refresh(ctx); err != nil {
+				log.Printf("Error refreshing agent policies: %s", err)
+			}
+		}
+	}
+}
+
+// policy returns agent's capture policy and its version, a hash of its
+// contents. Without a store every agent gets the empty policy, version 0.
+func (s *policyStore) policy(agent string) (*CapturePolicy, uint64, error) {
+	if s == nil {
+		return &CapturePolicy{}, 0, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	policy := s.policies.lookup(agent)
+	capture := &CapturePolicy{
+		SampleRate: policy.SampleRate,
+		Namespaces: policy.Namespaces,
+	}
+	for _, port := range policy.Ports {
+		capture.Ports = append(capture.Ports, int32(port))
+	}
+	for _, namespace := range policy.Namespaces {
+		capture.Addresses = append(capture.Addresses, s.pods[namespace]...)
+	}
+	// Map order is random, so sort for a stable version.
+	sort.Slice(capture.Addresses, func(i, j int) bool {
+		return bytes.Compare(capture.Addresses[i], capture.Addresses[j]) < 0
+	})
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(capture)
+	if err != nil {
+		return nil, 0, err
+	}
+	h := fnv.New64a()
+	h.Write(data)
+	return capture, h.Sum64(), nil
+}
+
+// capturePolicy is a CapturePolicy as an agent applies it to its flows.
+type capturePolicy struct {
+	version    uint64
+	sampleRate float64
+	ports      map[int]bool
+	addresses  map[netip.Addr]bool
+}
+
+func newCapturePolicy(policy *CapturePolicy, version uint64) *capturePolicy {
+	p := &capturePolicy{version: version, sampleRate: policy.GetSampleRate()}
+	if len(policy.GetPorts()) > 0 {
+		p.ports = make(map[int]bool)
+		for _, port := range policy.GetPorts() {
+			p.ports[int(port)] = true
+		}
+	}
+	if len(policy.GetAddresses()) > 0 || len(policy.GetNamespaces()) > 0 {
+		// Namespaces without pods match nothing rather than everything.
+		p.addresses = make(map[netip.Addr]bool)
+		for _, address := range policy.GetAddresses() {
+			if addr, ok := netip.AddrFromSlice(address); ok {
+				p.addresses[addr.Unmap()] = true
+			}
+		}
+	}
+	return p
+}
+
+func (p *capturePolicy) describe() string {
+	var parts []string
+	if p.sampleRate > 0 {
+		parts = append(parts, fmt.Sprintf("sampling %g of pairs", p.sampleRate))
+	}
+	if p.ports != nil {
+		parts = append(parts, fmt.Sprintf("%d ports", len(p.ports)))
+	}
+	if p.addresses != nil {
+		parts = append(parts, fmt.Sprintf("%d pod addresses", len(p.addresses)))
+	}
+	if len(parts) == 0 {
+		return "shipping every flow"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// apply returns the flows of docs the policy ships, with sampled bytes
+// scaled up.
+func (p *capturePolicy) apply(docs []NetworkFlow) []NetworkFlow {
+	if p.sampleRate == 0 && p.ports == nil && p.addresses == nil {
+		return docs
+	}
+	var kept []NetworkFlow
+	for _, doc := range docs {
+		if p.ports != nil && (doc.SourcePort != 0 || doc.DestinationPort != 0) &&
+			!p.ports[doc.SourcePort] && !p.ports[doc.DestinationPort] {
+			continue
+		}
+		if p.addresses != nil {
+			source, _ := netip.ParseAddr(doc.Source)
+			destination, _ := netip.ParseAddr(doc.Destination)
+			if !p.addresses[source.Unmap()] && !p.addresses[destination.Unmap()] {
+				continue
+			}
+		}
+		if p.sampleRate > 0 && p.sampleRate < 1 {
+			h := fnv.New64a()
+			h.Write([]byte(doc.Source + "\x00" + doc.Destination))
+			if float64(h.Sum64())/math.MaxUint64 >= p.sampleRate {
+				continue
+			}
+			doc.Bytes = int64(math.Round(float64(doc.Bytes) / p.sampleRate))
+		}
+		kept = append(kept, doc)
+	}
+	return kept
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+)
+
+func loadPseudonymKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) < 16 {
+		return nil, fmt.Errorf("pseudonymization key in %s is shorter than 16 bytes", path)
+	}
+	return key, nil
+}
+
+// pseudonym maps a name to a stable opaque label. The same key always yields
+// the same label, so diagrams produced at different times remain comparable
+// without revealing the underlying addresses.
+func pseudonym(key []byte, name string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(name))
+	return "node-" + hex.EncodeToString(mac.Sum(nil))[:12]
+}
+
+func pseudonymize(matrix *FlowMatrix, key []byte) *FlowMatrix {
+	return matrix.Relabel(func(name string) string {
+		return pseudonym(key, name)
+	})
+}
+
+// pseudonymizeKeys replaces the names keying values with their pseudonyms.
+func pseudonymizeKeys(values map[string]string, key []byte) map[string]string {
+	renamed := make(map[string]string, len(values))
+	for name, value := range values {
+		renamed[pseudonym(key, name)] = value
+	}
+	return renamed
+}
+
+// suppressSmallPairs drops conversations below minBytes, or seen in fewer
+// than minFlows flow records, and then the nodes left without traffic, so
+// rarely seen endpoints cannot be singled out in published diagrams.
+func suppressSmallPairs(matrix *FlowMatrix, minBytes, minFlows float64) (*FlowMatrix, error) {
+	if minFlows > 0 && matrix.flows == nil {
+		return nil, fmt.Errorf("the source does not count flow records to suppress pairs by")
+	}
+	for i, source := range matrix.Names {
+		for j, destination := range matrix.Names {
+			if matrix.Flow[i][j] < minBytes || (minFlows > 0 && matrix.flows[[2]string{source, destination}] < minFlows) {
+				matrix.Flow[i][j] = 0
+			}
+		}
+	}
+	return dropIdleNodes(matrix), nil
+}
+
+// dropIdleNodes returns matrix without the nodes that neither send nor
+// receive anything.
+func dropIdleNodes(matrix *FlowMatrix) *FlowMatrix {
+	kept := NewFlowMatrix()
+	kept.resolvedBy, kept.anomalies, kept.coverage, kept.queries = matrix.resolvedBy, matrix.anomalies, matrix.coverage, matrix.queries
+	for i, source := range matrix.Names {
+		for j, destination := range matrix.Names {
+			if matrix.Flow[i][j] > 0 {
+				kept.Add(source, destination, matrix.Flow[i][j])
+				if n, ok := matrix.flows[[2]string{source, destination}]; ok {
+					kept.addFlows(source, destination, n)
+				}
+			}
+		}
+	}
+	return kept
+}
+
+// addLaplaceNoise perturbs every cell of the matrix, silent pairs included,
+// with Laplace noise of scale sensitivity/epsilon, the standard mechanism for
+// epsilon-differential privacy: noising only the pairs that talked would give
+// away which ones did. Cells whose noisy total stays below scale·ln 10, which
+// noise alone exceeds in one silent pair out of twenty, are then dropped, as
+// are nodes left without traffic. Both steps only look at noisy values, so
+// they keep the guarantee; the set of nodes still comes from the data.
+func addLaplaceNoise(matrix *FlowMatrix, epsilon, sensitivity float64, rng *rand.Rand) *FlowMatrix {
+	scale := sensitivity / epsilon
+	floor := scale * math.Ln10
+	for i := range matrix.Flow {
+		for j := range matrix.Flow[i] {
+			u := rng.Float64() - 0.5
+			noise := -scale * math.Copysign(1, u) * math.Log(1-2*math.Abs(u))
+			matrix.Flow[i][j] += noise
+			if matrix.Flow[i][j] < floor {
+				matrix.Flow[i][j] = 0
+			}
+		}
+	}
+	return dropIdleNodes(matrix)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PrometheusConfig holds a PromQL query whose result vector is labelled by
+// source and destination, e.g. over flow byte counters from Cilium or
+// kube-router, or from `kube-netflow exporter`. $window in the query is
+// replaced with the window length, as for Loki. URL may point at any server
+// with the Prometheus query API, such as Thanos or Mimir.
+type PrometheusConfig struct {
+	URL              string `yaml:"url" toml:"url"`
+	Username         string `yaml:"username" toml:"username"`
+	Password         string `yaml:"password" toml:"password"`
+	BearerToken      string `yaml:"bearerToken" toml:"bearerToken"`
+	Tenant           string `yaml:"tenant" toml:"tenant"`
+	Query            string `yaml:"query" toml:"query"`
+	SourceLabel      string `yaml:"sourceLabel" toml:"sourceLabel"`
+	DestinationLabel string `yaml:"destinationLabel" toml:"destinationLabel"`
+}
+
+type prometheusSource struct {
+	cfg        PrometheusConfig
+	httpClient *http.Client
+}
+
+func newPrometheusSource(cfg PrometheusConfig) (*prometheusSource, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("prometheus source needs url")
+	}
+	return &prometheusSource{cfg: cfg, httpClient: &http.Client{Timeout: 5 * time.Minute}}, nil
+}
+
+func (s *prometheusSource) Name() string {
+	return "prometheus"
+}
+
+// get calls the query API, whose responses are {"status", "data", "error"}
+// whatever the HTTP status.
+func (s *prometheusSource) get(ctx context.Context, path string, params url.Values, data interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(s.cfg.URL, "/")+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	switch {
+	case s.cfg.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+s.cfg.BearerToken)
+	case s.cfg.Username != "":
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+	if s.cfg.Tenant != "" {
+		req.Header.Set("X-Scope-OrgID", s.cfg.Tenant)
+	}
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var response struct {
+		Status string          `json:"status"`
+		Data   json.RawMessage `json:"data"`
+		Error  string          `json:"error"`
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		if len(body) > 4096 {
+			body = body[:4096]
+		}
+		return fmt.Errorf("prometheus: %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	if response.Status != "success" {
+		return fmt.Errorf("prometheus: %s: %s", res.Status, response.Error)
+	}
+	return json.Unmarshal(response.Data, data)
+}
+
+func (s *prometheusSource) Version(ctx context.Context) (string, error) {
+	var info struct {
+		Version string `json:"version"`
+	}
+	if err := s.get(ctx, "/api/v1/status/buildinfo", url.Values{}, &info); err != nil {
+		return "", err
+	}
+	return info.Version, nil
+}
+
+func (s *prometheusSource) Fetch(ctx context.Context, from, to time.Time, networkFilters []string) (*FlowMatrix, error) {
+	filter, err := parseCIDRFilter(networkFilters)
+	if err != nil {
+		return nil, err
+	}
+
+	window := fmt.Sprintf("%ds", int64(to.Sub(from).Seconds()))
+	params := url.Values{}
+	params.Set("query", strings.ReplaceAll(s.cfg.Query, "$window", window))
+	params.Set("time", strconv.FormatFloat(float64(to.UnixMilli())/1000, 'f', 3, 64))
+
+	var result struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+			Value  [2]interface{}    `json:"value"`
+		} `json:"result"`
+	}
+	if err := s.get(ctx, "/api/v1/query", params, &result); err != nil {
+		return nil, err
+	}
+	if result.ResultType != "vector" {
+		return nil, fmt.Errorf("prometheus: query returned %q, expected a vector", result.ResultType)
+	}
+
+	matrix := NewFlowMatrix()
+	for _, sample := range result.Result {
+		source := sample.Metric[s.cfg.SourceLabel]
+		destination := sample.Metric[s.cfg.DestinationLabel]
+		if source == "" || destination == "" || !filter.match(source, destination) {
+			continue
+		}
+		value, _ := sample.Value[1].(string)
+		bytes, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("prometheus: invalid sample value %q", value)
+		}
+		// Counter resets and rate extrapolation can leave increase() a
+		// little below zero.
+		if bytes > 0 {
+			matrix.Add(source, destination, bytes)
+		}
+	}
+	return matrix, nil
+}
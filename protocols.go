@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+// Well-known server ports, used when a flow carries no L7 protocol field.
+var protocolPorts = map[int]string{
+	22:    "ssh",
+	53:    "dns",
+	80:    "http",
+	443:   "https",
+	2379:  "etcd",
+	3306:  "mysql",
+	4222:  "nats",
+	5432:  "postgres",
+	5672:  "amqp",
+	6379:  "redis",
+	6443:  "kube-apiserver",
+	8080:  "http",
+	9042:  "cassandra",
+	9092:  "kafka",
+	9200:  "elasticsearch",
+	11211: "memcached",
+	27017: "mongodb",
+	50051: "grpc",
+}
+
+// packetbeat's network.protocol values where they differ from the names above.
+var protocolAliases = map[string]string{
+	"pgsql":    "postgres",
+	"memcache": "memcached",
+	"mongo":    "mongodb",
+	"tls":      "https",
+}
+
+const missingProtocol = "-"
+
+// classifyProtocol prefers the L7 protocol recorded by the shipper and falls
+// back to the destination port.
+func classifyProtocol(l7 string, port int) string {
+	if l7 != "" && l7 != missingProtocol {
+		l7 = strings.ToLower(l7)
+		if alias, ok := protocolAliases[l7]; ok {
+			return alias
+		}
+		return l7
+	}
+	if name, ok := protocolPorts[port]; ok {
+		return name
+	}
+	return "other"
+}
+
+// protocolCondition matches flows that classifyProtocol would put in one of
+// protocols: an L7 field naming it, or no L7 field and a matching port.
+func protocolCondition(protocols []string) map[string]interface{} {
+	var names []string
+	var ports []int
+	for _, protocol := range protocols {
+		names = append(names, protocol)
+		for alias, name := range protocolAliases {
+			if name == protocol {
+				names = append(names, alias)
+			}
+		}
+		for port, name := range protocolPorts {
+			if name == protocol {
+				ports = append(ports, port)
+			}
+		}
+	}
+	sort.Ints(ports)
+
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"should": []map[string]interface{}{
+				{"terms": map[string]interface{}{"network.protocol": names}},
+				{
+					"bool": map[string]interface{}{
+						"must":     map[string]interface{}{"terms": map[string]interface{}{"destination.port": ports}},
+						"must_not": map[string]interface{}{"exists": map[string]interface{}{"field": "network.protocol"}},
+					},
+				},
+			},
+			"minimum_should_match": 1,
+		},
+	}
+}
+
+type protocolFlow struct {
+	Source, Destination, Protocol string
+	Bytes                         float64
+}
+
+// fetchProtocolFlows breaks each pair down by destination port and L7
+// protocol. Rollups do not keep ports, so this always reads raw flows.
+func fetchProtocolFlows(ctx context.Context, es *elasticsearch.Client, index string, networkFilters []string, from, to time.Time) ([]protocolFlow, error) {
+	conditions, err := flowConditions(networkFilters, timeRangeCondition(map[string]interface{}{
+		"gte": from.Format(time.RFC3339),
+		"lt":  to.Format(time.RFC3339),
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	aggs := pairAggs(from)
+	destinations := aggs["source_nodes"].(map[string]interface{})["aggs"].(map[string]interface{})["destinations"].(map[string]interface{})
+	sum := destinations["aggs"]
+	destinations["aggs"] = map[string]interface{}{
+		"ports": map[string]interface{}{
+			"terms": map[string]interface{}{"field": "destination.port", "size": termsSize, "missing": 0},
+			"aggs": map[string]interface{}{
+				"protocols": map[string]interface{}{
+					"terms": map[string]interface{}{"field": "network.protocol", "size": termsSize, "missing": missingProtocol},
+					"aggs":  sum,
+				},
+			},
+		},
+	}
+
+	result, err := search(ctx, es, index, map[string]interface{}{
+		"size":  0,
+		"query": map[string]interface{}{"bool": map[string]interface{}{"must": conditions}},
+		"aggs":  aggs,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	totals := make(map[protocolFlow]float64)
+	for _, bucket := range buckets(result["aggregations"], "source_nodes") {
+		for _, destination := range buckets(bucket, "destinations") {
+			for _, port := range buckets(destination, "ports") {
+				portNumber, _ := port["key"].(float64)
+				for _, protocol := range buckets(port, "protocols") {
+					key := protocolFlow{
+						Source:      bucket["key"].(string),
+						Destination: destination["key"].(string),
+						Protocol:    classifyProtocol(fmt.Sprint(protocol["key"]), int(portNumber)),
+					}
+					totals[key] += protocol["bytes"].(map[string]interface{})["value"].(float64)
+				}
+			}
+		}
+	}
+
+	var flows []protocolFlow
+	for key, bytes := range totals {
+		key.Bytes = bytes
+		flows = append(flows, key)
+	}
+	sort.Slice(flows, func(i, j int) bool { return flows[i].Bytes > flows[j].Bytes })
+	return flows, nil
+}
+
+func buckets(aggs interface{}, name string) []map[string]interface{} {
+	var out []map[string]interface{}
+	for _, bucket := range aggs.(map[string]interface{})[name].(map[string]interface{})["buckets"].([]interface{}) {
+		out = append(out, bucket.(map[string]interface{}))
+	}
+	return out
+}
+
+func runProtocols(args []string) {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		log.Fatalf("Error loading config: %s", err)
+	}
+
+	fs := flag.NewFlagSet("protocols", flag.ExitOnError)
+	fs.String("config", "", "YAML or TOML configuration file; flags override its values")
+	fs.StringVar(&cfg.Window, "window", cfg.Window, "Time window to report on")
+	fs.Var((*stringList)(&cfg.Network), "network", "Network CIDR filter")
+	byPtr := fs.String("by", "pair", "Report per pair or per protocol")
+	fs.Parse(args)
+
+	window, err := parseWindow(cfg.Window)
+	if err != nil {
+		log.Fatalf("Invalid window: %s", err)
+	}
+	es, err := newElasticClient(cfg.Elasticsearch)
+	if err != nil {
+		log.Fatalf("Error creating the client: %s", err)
+	}
+
+	to := time.Now()
+	flows, err := fetchProtocolFlows(context.Background(), es, cfg.Elasticsearch.Index, cfg.Network, to.Add(-window), to)
+	if err != nil {
+		log.Fatalf("Error querying flows: %s", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	switch *byPtr {
+	case "pair":
+		fmt.Fprintln(w, "SOURCE\tDESTINATION\tPROTOCOL\tBYTES")
+		for _, flow := range flows {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", flow.Source, flow.Destination, flow.Protocol, strconv.FormatFloat(flow.Bytes, 'f', 0, 64))
+		}
+	case "protocol":
+		totals := make(map[string]float64)
+		for _, flow := range flows {
+			totals[flow.Protocol] += flow.Bytes
+		}
+		var protocols []string
+		for protocol := range totals {
+			protocols = append(protocols, protocol)
+		}
+		sort.Slice(protocols, func(i, j int) bool { return totals[protocols[i]] > totals[protocols[j]] })
+		fmt.Fprintln(w, "PROTOCOL\tBYTES")
+		for _, protocol := range protocols {
+			fmt.Fprintf(w, "%s\t%s\n", protocol, strconv.FormatFloat(totals[protocol], 'f', 0, 64))
+		}
+	default:
+		log.Fatalf("Unsupported --by: %s", *byPtr)
+	}
+	w.Flush()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"sort"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+// Manifest records everything needed to reproduce or audit an artifact.
+type Manifest struct {
+	Version        int               `json:"version"`
+	Artifact       string            `json:"artifact"`
+	SHA256         string            `json:"sha256"`
+	InputHash      string            `json:"inputHash"`
+	GeneratedAt    time.Time         `json:"generatedAt"`
+	From           time.Time         `json:"from"`
+	To             time.Time         `json:"to"`
+	IngestLag      string            `json:"ingestLag,omitempty"`
+	CodeVersion    string            `json:"codeVersion"`
+	SourceVersions map[string]string `json:"sourceVersions"`
+	Settings       map[string]string `json:"settings"`
+	// AgentCompleteness is, for a collector receiving agents' flows, the
+	// percentage of each agent's snapshots in the window that arrived.
+	AgentCompleteness map[string]float64 `json:"agentCompleteness,omitempty"`
+	// ClockSkew lists the exporters whose clocks stray from the source's,
+	// e.g. "5m0s ahead".
+	ClockSkew map[string]string `json:"clockSkew,omitempty"`
+	// Completeness scores how much of the window's data the artifact shows.
+	Completeness *Completeness `json:"completeness,omitempty"`
+	// Queries are the source queries the artifact's flows came from, for
+	// sources that record them.
+	Queries []SourceQuery `json:"queries,omitempty"`
+}
+
+// SourceQuery identifies one query: the index it ran against, the range it
+// read and the SHA-256 of its serialized body.
+type SourceQuery struct {
+	Index  string    `json:"index"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	SHA256 string    `json:"sha256"`
+}
+
+func codeVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	version := info.Main.Version
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			version += " " + setting.Value
+		case "vcs.modified":
+			if setting.Value == "true" {
+				version += " (modified)"
+			}
+		}
+	}
+	return version
+}
+
+func dependencyVersions() map[string]string {
+	versions := make(map[string]string)
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			versions[dep.Path] = dep.Version
+		}
+	}
+	return versions
+}
+
+func elasticVersion(ctx context.Context, es *elasticsearch.Client) (string, error) {
+	res, err := es.Info(es.Info.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return "", fmt.Errorf("info: %s", res.String())
+	}
+
+	var info struct {
+		Version struct {
+			Number string `json:"number"`
+		} `json:"version"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return "", err
+	}
+	return info.Version.Number, nil
+}
+
+// secretFlags are recorded only as set or unset so manifests never leak them.
+var secretFlags = map[string]bool{
+	"es-api-key":       true,
+	"es-service-token": true,
+}
+
+func flagSettings(fs *flag.FlagSet) map[string]string {
+	settings := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretFlags[f.Name] && value != "" {
+			value = "<redacted>"
+		}
+		settings[f.Name] = value
+	})
+	return settings
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// inputHash covers the inputs only, so two runs over the same range with the
+// same settings and code share it even if the data changed in between.
+func (m *Manifest) inputHash() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", m.CodeVersion, m.From.UTC().Format(time.RFC3339Nano), m.To.UTC().Format(time.RFC3339Nano))
+	for _, values := range []map[string]string{m.Settings, m.SourceVersions} {
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(h, "%s=%s\n", k, values[k])
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func writeManifest(artifact string, manifest Manifest) error {
+	sum, err := fileSHA256(artifact)
+	if err != nil {
+		return err
+	}
+	manifest.Artifact = artifact
+	manifest.SHA256 = sum
+	manifest.InputHash = manifest.inputHash()
+
+	manifest.Version = manifestVersion
+
+	data, err := manifestFormat.encode(manifest)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(artifact+".manifest.json", data)
+}
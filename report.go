@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reportTopTalkers is how many conversations the report lists.
+const reportTopTalkers = 50
+
+// flowReport is a single HTML page holding the diagram, the top talkers
+// and how they were queried, for attaching to a ticket or an email.
+type flowReport struct {
+	// Lang is the language of the page's fixed strings.
+	Lang        string
+	Title       string
+	From, To    time.Time
+	GeneratedAt time.Time
+	// Diagram is the diagram as inline SVG.
+	Diagram    template.HTML
+	Pairs      []flowTablePair
+	TotalPairs int
+	TotalBytes float64
+	Parameters [][2]string
+}
+
+func newFlowReport(cfg Config, matrix *FlowMatrix, manifest Manifest, theme chordTheme) (flowReport, error) {
+	var svg bytes.Buffer
+	// The page scales the diagram to fit.
+	if err := writeDiagram(&svg, matrix, cfg.Output.Title, cfg.Output, "svg", outputSize(cfg.Output), theme); err != nil {
+		return flowReport{}, err
+	}
+	// Drop the XML prologue, which is not allowed inside HTML.
+	diagram := svg.String()
+	if start := strings.Index(diagram, "<svg"); start >= 0 {
+		diagram = diagram[start:]
+	}
+
+	report := flowReport{
+		Lang:        cfg.Output.Lang,
+		Title:       cfg.Output.Title,
+		From:        manifest.From.UTC(),
+		To:          manifest.To.UTC(),
+		GeneratedAt: manifest.GeneratedAt.UTC(),
+		Diagram:     template.HTML(diagram),
+		Pairs:       topPairs(matrix, 0),
+	}
+	report.TotalPairs = len(report.Pairs)
+	for _, pair := range report.Pairs {
+		report.TotalBytes += pair.Bytes
+	}
+	if len(report.Pairs) > reportTopTalkers {
+		report.Pairs = report.Pairs[:reportTopTalkers]
+	}
+
+	add := func(name, value string) {
+		if value != "" {
+			report.Parameters = append(report.Parameters, [2]string{name, value})
+		}
+	}
+	add("Source", cfg.Source)
+	add("Window", cfg.Window)
+	add("Networks", strings.Join(cfg.Network, ", "))
+	add("Protocols", strings.Join(cfg.Protocols, ", "))
+	add("Group by", cfg.Kubernetes.GroupBy)
+	add("Resolution", cfg.Resolution)
+	add("Ingest lag", manifest.IngestLag)
+	if manifest.Completeness != nil {
+		completeness := fmt.Sprintf("%.1f%%", manifest.Completeness.Score)
+		if factors := manifest.Completeness.describeFactors(); factors != "" {
+			completeness += " (" + factors + ")"
+		}
+		add("Completeness", completeness)
+	}
+	var skews []string
+	for exporter, skew := range manifest.ClockSkew {
+		skews = append(skews, exporter+" "+skew)
+	}
+	sort.Strings(skews)
+	add("Clock skew", strings.Join(skews, ", "))
+	add("Version", manifest.CodeVersion)
+	return report, nil
+}
+
+var flowReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"mb":  func(bytes float64) string { return fmt.Sprintf("%.1f", bytes/1024/1024) },
+	"raw": func(bytes float64) string { return fmt.Sprintf("%.0f", bytes) },
+	"t":   translate,
+}).Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+figure { margin: 0 0 2em; }
+figure svg { max-width: 100%; height: auto; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+caption { text-align: left; font-weight: bold; padding: 0.5em 0; }
+th, td { border: 1px solid #999; padding: 0.3em 0.6em; }
+td.number { text-align: right; font-variant-numeric: tabular-nums; }
+th button { font: inherit; font-weight: bold; background: none; border: none; padding: 0; cursor: pointer; }
+th button:focus { outline: 2px solid #005fcc; }
+dl { display: grid; grid-template-columns: max-content auto; gap: 0.3em 1em; }
+dt { font-weight: bold; }
+dd { margin: 0; }
+</style>
+</head>
+<body>
+<main>
+<h1>{{.Title}}</h1>
+<p>{{t .Lang "Flows from"}} <time datetime="{{.From.Format "2006-01-02T15:04:05Z07:00"}}">{{.From.Format "2006-01-02 15:04 MST"}}</time>
+{{t .Lang "to"}} <time datetime="{{.To.Format "2006-01-02T15:04:05Z07:00"}}">{{.To.Format "2006-01-02 15:04 MST"}}</time>:
+{{mb .TotalBytes}} {{t .Lang "MB in"}} {{.TotalPairs}} {{t .Lang "conversations"}}.</p>
+
+<figure>
+{{.Diagram}}
+<figcaption>{{t .Lang "Hover over the diagram for its traffic."}}</figcaption>
+</figure>
+
+<table>
+<caption>{{printf (t .Lang "Top %d conversations, in megabytes; select a column heading to sort by it") (len .Pairs)}}</caption>
+<thead><tr>
+<th scope="col" aria-sort="none"><button type="button">{{t .Lang "Source"}}</button></th>
+<th scope="col" aria-sort="none"><button type="button">{{t .Lang "Destination"}}</button></th>
+<th scope="col" aria-sort="descending"><button type="button">{{t .Lang "Sent"}}</button></th>
+</tr></thead>
+<tbody>
+{{range .Pairs}}<tr><td>{{.Source}}</td><td>{{.Destination}}</td><td class="number" data-value="{{raw .Bytes}}">{{mb .Bytes}}</td></tr>
+{{end}}</tbody>
+</table>
+
+<h2>{{t .Lang "Query"}}</h2>
+<dl>
+{{range .Parameters}}<dt>{{t $.Lang (index . 0)}}</dt><dd>{{index . 1}}</dd>
+{{end}}<dt>{{t .Lang "Generated"}}</dt><dd><time datetime="{{.GeneratedAt.Format "2006-01-02T15:04:05Z07:00"}}">{{.GeneratedAt.Format "2006-01-02 15:04 MST"}}</time></dd>
+</dl>
+</main>
+<script>
+` + sortTablesScript + `</script>
+</body>
+</html>
+`))
+
+func writeFlowReport(path string, report flowReport) error {
+	var page bytes.Buffer
+	if err := flowReportTemplate.Execute(&page, report); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, page.Bytes())
+}
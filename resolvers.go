@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// ResolverConfig places one resolver in the chain that labels addresses.
+type ResolverConfig struct {
+	// Enabled overrides the resolver's own switch, e.g. kubernetes.labels
+	// or reverseDNS.
+	Enabled *bool `yaml:"enabled" toml:"enabled"`
+	// Priority orders the chain, lowest first; 0 keeps the default order
+	// kubernetes, dns, geoip, static.
+	Priority int `yaml:"priority" toml:"priority"`
+}
+
+var resolverPriorities = map[string]int{"kubernetes": 10, "dns": 20, "geoip": 30, "static": 40}
+
+// labelResolver names some of the addresses of flows in [from, to).
+type labelResolver interface {
+	resolve(ctx context.Context, ips []string, from, to time.Time) (map[string]string, error)
+}
+
+type chainedResolver struct {
+	name     string
+	priority int
+	labelResolver
+}
+
+// resolverEnabled reports whether cfg runs the named resolver.
+func resolverEnabled(cfg Config, name string) bool {
+	if enabled := cfg.Enrichment.Resolvers[name].Enabled; enabled != nil {
+		return *enabled
+	}
+	switch name {
+	case "kubernetes":
+		return cfg.Kubernetes.Labels || cfg.Kubernetes.GroupBy == "namespace"
+	case "dns":
+		return cfg.Enrichment.ReverseDNS
+	case "geoip":
+		return cfg.Enrichment.GeoIPDatabase != ""
+	case "static":
+		return len(cfg.Enrichment.StaticLabels) > 0 || cfg.Enrichment.StaticLabelsFile != ""
+	}
+	return false
+}
+
+// resolverChain builds the enabled resolvers in the order they run.
+func (e *enricher) resolverChain() ([]chainedResolver, error) {
+	for name := range e.cfg.Enrichment.Resolvers {
+		if _, ok := resolverPriorities[name]; !ok {
+			return nil, fmt.Errorf("unknown resolver %q", name)
+		}
+	}
+	if e.cfg.Kubernetes.GroupBy == "namespace" && !resolverEnabled(e.cfg, "kubernetes") {
+		return nil, fmt.Errorf("group-by namespace needs the kubernetes resolver")
+	}
+
+	var chain []chainedResolver
+	for name, priority := range resolverPriorities {
+		if !resolverEnabled(e.cfg, name) {
+			continue
+		}
+		if configured := e.cfg.Enrichment.Resolvers[name].Priority; configured != 0 {
+			priority = configured
+		}
+		var resolver labelResolver
+		switch name {
+		case "kubernetes":
+			resolver = kubeResolver{e}
+		case "dns":
+			resolver = dnsResolver{e.dns}
+		case "geoip":
+			if e.cfg.Enrichment.GeoIPDatabase == "" {
+				return nil, fmt.Errorf("geoip resolver needs geoipDatabase")
+			}
+			db, err := maxminddb.Open(e.cfg.Enrichment.GeoIPDatabase)
+			if err != nil {
+				return nil, fmt.Errorf("opening GeoIP database: %w", err)
+			}
+			resolver = geoIPResolver{db}
+		case "static":
+			static, err := newStaticResolver(e.cfg.Enrichment.StaticLabels, e.cfg.Enrichment.StaticLabelsFile)
+			if err != nil {
+				return nil, fmt.Errorf("static labels: %w", err)
+			}
+			resolver = static
+		}
+		chain = append(chain, chainedResolver{name, priority, resolver})
+	}
+	sort.Slice(chain, func(i, j int) bool {
+		if chain[i].priority != chain[j].priority {
+			return chain[i].priority < chain[j].priority
+		}
+		return resolverPriorities[chain[i].name] < resolverPriorities[chain[j].name]
+	})
+	return chain, nil
+}
+
+// label runs the resolver chain, each resolver naming the addresses the ones
+// before it left bare, and records which resolver produced each label.
+func (e *enricher) label(ctx context.Context, matrix *FlowMatrix, from, to time.Time) (*FlowMatrix, error) {
+	e.chainOnce.Do(func() { e.chain, e.chainErr = e.resolverChain() })
+	if e.chainErr != nil {
+		return nil, e.chainErr
+	}
+
+	resolvedBy := make(map[string]string)
+	for _, resolver := range e.chain {
+		var ips []string
+		for _, name := range matrix.Names {
+			if net.ParseIP(name) != nil {
+				ips = append(ips, name)
+			}
+		}
+		if len(ips) == 0 {
+			break
+		}
+		labels, err := resolver.resolve(ctx, ips, from, to)
+		if err != nil {
+			return nil, fmt.Errorf("%s resolver: %w", resolver.name, err)
+		}
+		for _, label := range labels {
+			resolvedBy[label] = resolver.name
+		}
+		matrix = matrix.Relabel(func(name string) string {
+			if label, ok := labels[name]; ok {
+				return label
+			}
+			return name
+		})
+	}
+	matrix.resolvedBy = resolvedBy
+	return matrix, nil
+}
+
+// kubeResolver names addresses by the pod, service or node owning them, or
+// by namespace when grouping by namespace.
+type kubeResolver struct {
+	e *enricher
+}
+
+// ownershipInventory returns the cluster's objects along with the history of
+// the ownership index, when one is configured.
+func (e *enricher) ownershipInventory(ctx context.Context) (kubeInventory, error) {
+	inventory, err := e.kubeInventory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if e.cfg.Kubernetes.OwnershipIndex != "" {
+		index, err := loadOwnershipIndex(e.cfg.Kubernetes.OwnershipIndex)
+		if err != nil {
+			return nil, fmt.Errorf("loading ownership index: %w", err)
+		}
+		inventory.merge(index.Endpoints)
+	}
+	return inventory, nil
+}
+
+// ownerChanges returns the moments within (from, to) at which an address
+// changed Kubernetes owner, none when the kubernetes resolver is off.
+func (e *enricher) ownerChanges(ctx context.Context, from, to time.Time) ([]time.Time, error) {
+	if !resolverEnabled(e.cfg, "kubernetes") {
+		return nil, nil
+	}
+	inventory, err := e.ownershipInventory(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes resolver: %w", err)
+	}
+	return inventory.handovers(from, to), nil
+}
+
+func (r kubeResolver) resolve(ctx context.Context, ips []string, from, to time.Time) (map[string]string, error) {
+	cfg := r.e.cfg
+	inventory, err := r.e.ownershipInventory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	owners := inventory.Resolve(from, to)
+	if err := owners.assignHosts(cfg.Kubernetes.HostOwners); err != nil {
+		return nil, fmt.Errorf("in hostOwners: %w", err)
+	}
+
+	labels := make(map[string]string)
+	for _, ip := range ips {
+		if _, ok := owners[ip]; !ok {
+			continue
+		}
+		if cfg.Kubernetes.GroupBy == "namespace" {
+			labels[ip] = owners.namespace(ip)
+		} else {
+			labels[ip] = owners.label(ip)
+		}
+	}
+	return labels, nil
+}
+
+// dnsResolver names addresses by their PTR record.
+type dnsResolver struct {
+	cache *dnsCache
+}
+
+func (r dnsResolver) resolve(ctx context.Context, ips []string, from, to time.Time) (map[string]string, error) {
+	return r.cache.resolve(ctx, ips), nil
+}
+
+// geoIPResolver names addresses from a MaxMind database: by autonomous
+// system with an ASN database, otherwise by city and country.
+type geoIPResolver struct {
+	db *maxminddb.Reader
+}
+
+type geoIPRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASNumber       uint   `maxminddb:"autonomous_system_number"`
+	ASOrganization string `maxminddb:"autonomous_system_organization"`
+}
+
+func (r geoIPResolver) resolve(ctx context.Context, ips []string, from, to time.Time) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, ip := range ips {
+		var record geoIPRecord
+		if err := r.db.Lookup(net.ParseIP(ip), &record); err != nil {
+			return nil, err
+		}
+		switch city := record.City.Names["en"]; {
+		case record.ASNumber != 0:
+			labels[ip] = fmt.Sprintf("AS%d %s", record.ASNumber, record.ASOrganization)
+		case city != "" && record.Country.ISOCode != "":
+			labels[ip] = city + ", " + record.Country.ISOCode
+		case record.Country.ISOCode != "":
+			labels[ip] = record.Country.ISOCode
+		}
+	}
+	return labels, nil
+}
+
+// staticResolver names addresses from a map of addresses and CIDR ranges,
+// the most specific match winning. The map combines a hosts-style file, read
+// again whenever it changes, with the inline labels, which take precedence.
+type staticResolver struct {
+	inline map[string]string
+	path   string
+
+	mu      sync.Mutex
+	modTime time.Time
+	table   *staticTable
+}
+
+func newStaticResolver(inline map[string]string, path string) (*staticResolver, error) {
+	r := &staticResolver{inline: inline, path: path}
+	if _, err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load returns the table, rebuilding it when the file changed.
+func (r *staticResolver) load() (*staticTable, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var modTime time.Time
+	if r.path != "" {
+		info, err := os.Stat(r.path)
+		if err != nil {
+			return nil, err
+		}
+		modTime = info.ModTime()
+	}
+	if r.table != nil && modTime.Equal(r.modTime) {
+		return r.table, nil
+	}
+
+	labels := make(map[string]string)
+	if r.path != "" {
+		hosts, err := readHostsFile(r.path)
+		if err != nil {
+			return nil, err
+		}
+		for key, label := range hosts {
+			labels[key] = label
+		}
+	}
+	for key, label := range r.inline {
+		labels[key] = label
+	}
+	table, err := newStaticTable(labels)
+	if err != nil {
+		return nil, err
+	}
+	r.table, r.modTime = table, modTime
+	return table, nil
+}
+
+func (r *staticResolver) resolve(ctx context.Context, ips []string, from, to time.Time) (map[string]string, error) {
+	table, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	labels := make(map[string]string)
+	for _, ip := range ips {
+		if label, ok := table.lookup(net.ParseIP(ip)); ok {
+			labels[ip] = label
+		}
+	}
+	return labels, nil
+}
+
+// readHostsFile reads lines of an address or CIDR range and a name, like
+// /etc/hosts. Further names on a line are aliases and ignored; # starts a
+// comment.
+func readHostsFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	labels := make(map[string]string)
+	for n, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			return nil, fmt.Errorf("%s:%d: %q has no name", path, n+1, fields[0])
+		}
+		labels[fields[0]] = fields[1]
+	}
+	return labels, nil
+}
+
+type staticTable struct {
+	networks []*net.IPNet
+	labels   []string
+}
+
+func newStaticTable(labels map[string]string) (*staticTable, error) {
+	t := &staticTable{}
+	for key, label := range labels {
+		_, network, err := net.ParseCIDR(key)
+		if err != nil {
+			ip := net.ParseIP(key)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is neither an address nor a CIDR range", key)
+			}
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		t.networks = append(t.networks, network)
+		t.labels = append(t.labels, label)
+	}
+	sort.Sort(t)
+	return t, nil
+}
+
+func (t *staticTable) Len() int { return len(t.networks) }
+
+func (t *staticTable) Less(i, j int) bool {
+	ones, _ := t.networks[i].Mask.Size()
+	other, _ := t.networks[j].Mask.Size()
+	return ones > other
+}
+
+func (t *staticTable) Swap(i, j int) {
+	t.networks[i], t.networks[j] = t.networks[j], t.networks[i]
+	t.labels[i], t.labels[j] = t.labels[j], t.labels[i]
+}
+
+func (t *staticTable) lookup(ip net.IP) (string, bool) {
+	for i, network := range t.networks {
+		if network.Contains(ip) {
+			return t.labels[i], true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenUDPs opens n sockets on address with SO_REUSEPORT. The kernel
+// spreads datagrams across them by source address and port, so each
+// exporter's datagrams keep reaching the same socket in order.
+func listenUDPs(address string, n int) ([]*net.UDPConn, error) {
+	config := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		if controlErr := c.Control(func(fd uintptr) {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}); controlErr != nil {
+			return controlErr
+		}
+		return err
+	}}
+	var conns []*net.UDPConn
+	for i := 0; i < n; i++ {
+		conn, err := config.ListenPacket(context.Background(), "udp", address)
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn.(*net.UDPConn))
+		// The rest join the port the first was given, for :0.
+		address = conn.LocalAddr().String()
+	}
+	return conns, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestListenUDPsSharesPort(t *testing.T) {
+	conns, err := listenUDPs("127.0.0.1:0", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	if len(conns) != 4 {
+		t.Fatalf("opened %d sockets, want 4", len(conns))
+	}
+	port := conns[0].LocalAddr().(*net.UDPAddr).Port
+	var received atomic.Int64
+	for _, conn := range conns {
+		if got := conn.LocalAddr().(*net.UDPAddr).Port; got != port {
+			t.Fatalf("socket on port %d, want %d", got, port)
+		}
+		go func(conn *net.UDPConn) {
+			buf := make([]byte, 16)
+			for {
+				if _, _, err := conn.ReadFromUDP(buf); err != nil {
+					return
+				}
+				received.Add(1)
+			}
+		}(conn)
+	}
+
+	// Datagrams from many exporters all arrive on one of the sockets.
+	const exporters = 32
+	for i := 0; i < exporters; i++ {
+		sender, err := net.DialUDP("udp", nil, conns[0].LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sender.Write([]byte("flow"))
+		sender.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for received.Load() < exporters && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := received.Load(); n != exporters {
+		t.Errorf("received %d of %d datagrams", n, exporters)
+	}
+}
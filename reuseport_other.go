@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// listenUDPs opens one socket on address; spreading an exporter's
+// datagrams over several needs Linux's SO_REUSEPORT.
+func listenUDPs(address string, n int) ([]*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return []*net.UDPConn{conn}, nil
+}
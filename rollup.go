@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+var rollupIntervals = map[string]time.Duration{
+	"1h": time.Hour,
+	"1d": 24 * time.Hour,
+}
+
+// searchMaxBuckets is Elasticsearch's default search.max_buckets, the most
+// buckets one search may build.
+const searchMaxBuckets = 65536
+
+// rollupBucketsPerStep is the most buckets one rollup interval of a chunk
+// builds: its filter, the source terms and, per pair, the pair and its
+// deltas and totals filters.
+const rollupBucketsPerStep = 1 + termsSize + 3*termsSize*termsSize
+
+func rollupIndex(interval string) string {
+	return "kube-netflow-rollup-" + interval
+}
+
+// Rollup documents reuse the raw field names so the regular flow query runs
+// unchanged against a rollup index.
+var rollupMapping = map[string]interface{}{
+	"mappings": map[string]interface{}{
+		"properties": map[string]interface{}{
+			"@timestamp":  map[string]interface{}{"type": "date"},
+			"source":      map[string]interface{}{"properties": map[string]interface{}{"ip": map[string]interface{}{"type": "ip"}}},
+			"destination": map[string]interface{}{"properties": map[string]interface{}{"ip": map[string]interface{}{"type": "ip"}}},
+			"network":     map[string]interface{}{"properties": map[string]interface{}{"bytes": map[string]interface{}{"type": "long"}}},
+			"flow":        map[string]interface{}{"properties": map[string]interface{}{"count": map[string]interface{}{"type": "long"}}},
+		},
+	},
+}
+
+func runRollup(args []string) {
+	if len(args) > 0 && args[0] == "run" {
+		runContinuousRollup(args[1:])
+		return
+	}
+	if len(args) == 0 || args[0] != "backfill" {
+		log.Fatalf("Usage: kube-netflow rollup backfill --from <time> [--to <time>] | rollup run [--delay <duration>] [--allowed-lateness <duration>]")
+	}
+
+	cfg, err := loadConfig(args[1:])
+	if err != nil {
+		log.Fatalf("Error loading config: %s", err)
+	}
+
+	fs := flag.NewFlagSet("rollup backfill", flag.ExitOnError)
+	fs.String("config", "", "YAML or TOML configuration file")
+	fromPtr := fs.String("from", "", "Start of the range to rebuild (RFC3339 or YYYY-MM-DD)")
+	toPtr := fs.String("to", "", "End of the range to rebuild (RFC3339 or YYYY-MM-DD, defaults to now)")
+	intervalPtr := fs.String("interval", "1h", "Rollup resolution to rebuild (1h or 1d)")
+	chunkPtr := fs.Duration("chunk", 24*time.Hour, "Raw data range aggregated per query, shortened to stay under search.max_buckets")
+	qpsPtr := fs.Float64("qps", 1, "Maximum raw queries per second")
+	fs.Var((*stringList)(&cfg.Network), "network", "Network CIDR filter applied to the raw data")
+	fs.Parse(args[1:])
+
+	step, ok := rollupIntervals[*intervalPtr]
+	if !ok {
+		log.Fatalf("Unsupported rollup interval: %s", *intervalPtr)
+	}
+	if *qpsPtr <= 0 {
+		log.Fatalf("--qps must be positive")
+	}
+
+	from, err := parseTime(*fromPtr)
+	if err != nil {
+		log.Fatalf("Invalid --from: %s", err)
+	}
+	to := time.Now()
+	if *toPtr != "" {
+		if to, err = parseTime(*toPtr); err != nil {
+			log.Fatalf("Invalid --to: %s", err)
+		}
+	}
+
+	// Only complete intervals are rolled up; chunks are whole intervals so no
+	// bucket is split across two queries.
+	from = from.UTC().Truncate(step)
+	to = to.UTC().Truncate(step)
+	chunk := *chunkPtr / step * step
+	if most := searchMaxBuckets / rollupBucketsPerStep * step; chunk > most {
+		chunk = most
+	}
+	if chunk < step {
+		chunk = step
+	}
+
+	es, err := newElasticClient(cfg.Elasticsearch)
+	if err != nil {
+		log.Fatalf("Error creating client: %s", err)
+	}
+
+	ctx := context.Background()
+	index := rollupIndex(*intervalPtr)
+	if err := ensureRollupIndex(ctx, es, index, cfg.Network); err != nil {
+		log.Fatalf("Error preparing %s: %s", index, err)
+	}
+
+	limiter := time.NewTicker(time.Duration(float64(time.Second) / *qpsPtr))
+	defer limiter.Stop()
+
+	for start := from; start.Before(to); start = start.Add(chunk) {
+		if start != from {
+			<-limiter.C
+		}
+		end := start.Add(chunk)
+		if end.After(to) {
+			end = to
+		}
+
+		docs, err := rollupChunk(ctx, es, cfg.Elasticsearch.Index, cfg.Network, *intervalPtr, start, end)
+		if err != nil {
+			log.Fatalf("Error aggregating %s - %s: %s", start.Format(time.RFC3339), end.Format(time.RFC3339), err)
+		}
+		if err := bulkIndex(ctx, es, index, docs); err != nil {
+			log.Fatalf("Error writing %s - %s: %s", start.Format(time.RFC3339), end.Format(time.RFC3339), err)
+		}
+		log.Printf("Rolled up %s - %s into %s (%d pairs)", start.Format(time.RFC3339), end.Format(time.RFC3339), index, len(docs))
+	}
+}
+
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// rollupMeta is kept in a rollup index's mapping _meta: the network filter
+// its flows were aggregated with and, for indices `rollup run` keeps, the
+// watermark before which its buckets no longer change.
+type rollupMeta struct {
+	Network   []string   `json:"network"`
+	Watermark *time.Time `json:"watermark,omitempty"`
+}
+
+// ensureRollupIndex creates index for rollups of networkFilters, or checks
+// an existing one was built with the same filter. Indices from before the
+// filter was recorded are taken to hold networkFilters.
+func ensureRollupIndex(ctx context.Context, es *elasticsearch.Client, index string, networkFilters []string) error {
+	meta, found, err := readRollupMeta(ctx, es, index)
+	if err != nil {
+		return err
+	}
+	if found {
+		if meta == nil {
+			log.Printf("Recording %s as a rollup of network %q", index, strings.Join(networkFilters, ","))
+			return writeRollupMeta(ctx, es, index, rollupMeta{Network: networkFilters})
+		}
+		if !sameNetworks(meta.Network, networkFilters) {
+			return fmt.Errorf("%s holds rollups of network %q, not %q; delete it to rebuild it", index, strings.Join(meta.Network, ","), strings.Join(networkFilters, ","))
+		}
+		return nil
+	}
+
+	mapping := map[string]interface{}{
+		"mappings": map[string]interface{}{
+			"_meta":      rollupMeta{Network: networkFilters},
+			"properties": rollupMapping["mappings"].(map[string]interface{})["properties"],
+		},
+	}
+	body, err := json.Marshal(mapping)
+	if err != nil {
+		return err
+	}
+	res, err := es.Indices.Create(index,
+		es.Indices.Create.WithContext(ctx),
+		es.Indices.Create.WithBody(bytes.NewReader(body)),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("create index: %s", res.String())
+	}
+	return nil
+}
+
+// readRollupMeta returns the _meta of index, nil when it has none, and
+// whether index exists.
+func readRollupMeta(ctx context.Context, es *elasticsearch.Client, index string) (*rollupMeta, bool, error) {
+	res, err := es.Indices.GetMapping(es.Indices.GetMapping.WithContext(ctx), es.Indices.GetMapping.WithIndex(index))
+	if err != nil {
+		return nil, false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return nil, false, nil
+	}
+	if res.IsError() {
+		return nil, false, fmt.Errorf("get mapping: %s", res.String())
+	}
+	var mappings map[string]struct {
+		Mappings struct {
+			Meta *rollupMeta `json:"_meta"`
+		} `json:"mappings"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&mappings); err != nil {
+		return nil, false, err
+	}
+	for _, m := range mappings {
+		return m.Mappings.Meta, true, nil
+	}
+	return nil, false, nil
+}
+
+func writeRollupMeta(ctx context.Context, es *elasticsearch.Client, index string, meta rollupMeta) error {
+	body, err := json.Marshal(map[string]interface{}{"_meta": meta})
+	if err != nil {
+		return err
+	}
+	res, err := es.Indices.PutMapping([]string{index}, bytes.NewReader(body), es.Indices.PutMapping.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("put mapping: %s", res.String())
+	}
+	return nil
+}
+
+// sameNetworks reports whether a and b list the same CIDRs in any order.
+func sameNetworks(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]int)
+	for _, cidr := range a {
+		seen[strings.TrimSpace(cidr)]++
+	}
+	for _, cidr := range b {
+		seen[strings.TrimSpace(cidr)]--
+	}
+	for _, n := range seen {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func rollupChunk(ctx context.Context, es *elasticsearch.Client, index string, networkFilters []string, interval string, start, end time.Time) ([]NetworkFlow, error) {
+	// The upper bound is exclusive so adjacent chunks never count a flow twice.
+	conditions, err := flowConditions(networkFilters, timeRangeCondition(map[string]interface{}{
+		"gte": start.Format(time.RFC3339),
+		"lt":  end.Format(time.RFC3339),
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	// A filter per bucket rather than a date_histogram, so each bucket's
+	// pair bytes are taken from where the bucket starts.
+	aggs := make(map[string]interface{})
+	step := rollupIntervals[interval]
+	for bucket := start; bucket.Before(end); bucket = bucket.Add(step) {
+		aggs[strconv.FormatInt(bucket.Unix(), 10)] = map[string]interface{}{
+			"filter": timeRangeCondition(map[string]interface{}{
+				"gte": bucket.Format(time.RFC3339),
+				"lt":  bucket.Add(step).Format(time.RFC3339),
+			}),
+			"aggs": pairAggs(bucket),
+		}
+	}
+	query := map[string]interface{}{
+		"size": 0,
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": conditions,
+			},
+		},
+		"aggs": aggs,
+	}
+
+	result, err := search(ctx, es, index, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []NetworkFlow
+	for key, bucket := range result["aggregations"].(map[string]interface{}) {
+		seconds, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			continue
+		}
+		timestamp := time.Unix(seconds, 0).UTC()
+		eachPair(bucket.(map[string]interface{}), func(source, destination string, bytes, flows float64) {
+			docs = append(docs, NetworkFlow{
+				Source:      source,
+				Destination: destination,
+				Bytes:       int64(bytes),
+				Flows:       int64(flows),
+				Timestamp:   timestamp,
+			})
+		})
+	}
+	return docs, nil
+}
+
+// flowDocID is deterministic, so re-running a backfill over the same range
+// overwrites the previous rollup instead of duplicating it.
+func flowDocID(doc NetworkFlow) string {
+	id := fmt.Sprintf("%d-%s-%s", doc.Timestamp.Unix(), doc.Source, doc.Destination)
+	if doc.Transport != "" {
+		// Per-connection documents from agents: both nodes of a cross-node
+		// connection report it, and keep one copy.
+		id = fmt.Sprintf("%d-%s-%s:%d-%s:%d", doc.Timestamp.Unix(), doc.Transport, doc.Source, doc.SourcePort, doc.Destination, doc.DestinationPort)
+	}
+	if doc.ContainerID != "" {
+		// Each container sending to a destination is a document of its own.
+		id += "-" + doc.ContainerID
+	}
+	return id
+}
+
+func bulkIndex(ctx context.Context, es *elasticsearch.Client, index string, docs []NetworkFlow) error {
+	if len(docs) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, doc := range docs {
+		if err := enc.Encode(map[string]interface{}{"index": map[string]interface{}{"_index": index, "_id": flowDocID(doc)}}); err != nil {
+			return err
+		}
+		if err := enc.Encode(doc); err != nil {
+			return err
+		}
+	}
+
+	res, err := es.Bulk(&buf, es.Bulk.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("bulk: %s", res.String())
+	}
+
+	var result struct {
+		Errors bool `json:"errors"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return err
+	}
+	if result.Errors {
+		return fmt.Errorf("bulk: some documents were rejected by %s", index)
+	}
+	return nil
+}
+
+type resolution struct {
+	name  string
+	index string
+	step  time.Duration
+	// from and to bound the range the resolution holds complete buckets
+	// for; both are zero for the raw data and explicitly chosen rollups.
+	from, to time.Time
+}
+
+// Resolutions ordered from coarsest to finest, each used only when the window
+// is at least minWindow long.
+var rollupResolutions = []struct {
+	resolution
+	minWindow time.Duration
+}{
+	{resolution{name: "1d", index: rollupIndex("1d"), step: 24 * time.Hour}, 7 * 24 * time.Hour},
+	{resolution{name: "1h", index: rollupIndex("1h"), step: time.Hour}, 24 * time.Hour},
+}
+
+type querySegment struct {
+	resolution resolution
+	from, to   time.Time
+}
+
+// planSegments covers [from, to) with the coarsest resolution that fits whole
+// intervals and fills the ragged edges, and whatever lies outside the range
+// the resolution covers, with progressively finer ones.
+func planSegments(from, to time.Time, raw resolution, levels []resolution) []querySegment {
+	if !from.Before(to) {
+		return nil
+	}
+	if len(levels) == 0 {
+		return []querySegment{{resolution: raw, from: from, to: to}}
+	}
+
+	level := levels[0]
+	start := from.Truncate(level.step)
+	if start.Before(from) {
+		start = start.Add(level.step)
+	}
+	end := to.Truncate(level.step)
+	if !level.from.IsZero() && start.Before(level.from) {
+		start = level.from
+	}
+	if !level.to.IsZero() && end.After(level.to) {
+		end = level.to
+	}
+	if !start.Before(end) {
+		return planSegments(from, to, raw, levels[1:])
+	}
+
+	segments := planSegments(from, start, raw, levels[1:])
+	segments = append(segments, querySegment{resolution: level, from: start, to: end})
+	return append(segments, planSegments(end, to, raw, levels[1:])...)
+}
+
+// selectResolutions picks the rollups to query a window with. In auto mode a
+// rollup is only used when it was built with the same network filter, or
+// none, and only for the buckets it holds that late flows can no longer
+// change.
+func selectResolutions(ctx context.Context, es *elasticsearch.Client, mode string, window time.Duration, networkFilters []string) ([]resolution, error) {
+	var levels []resolution
+	for _, r := range rollupResolutions {
+		switch mode {
+		case "raw":
+		case "auto":
+			if window < r.minWindow {
+				continue
+			}
+			meta, found, err := readRollupMeta(ctx, es, r.index)
+			if err != nil {
+				return nil, err
+			}
+			if !found || meta == nil || (len(meta.Network) > 0 && !sameNetworks(meta.Network, networkFilters)) {
+				continue
+			}
+			level := r.resolution
+			if level.from, level.to, err = rollupCoverage(ctx, es, level); err != nil {
+				return nil, err
+			}
+			if level.from.IsZero() {
+				continue
+			}
+			if meta.Watermark != nil && level.to.After(*meta.Watermark) {
+				level.to = *meta.Watermark
+			}
+			levels = append(levels, level)
+		default:
+			if _, ok := rollupIntervals[mode]; !ok {
+				return nil, fmt.Errorf("unsupported resolution: %s", mode)
+			}
+			if r.step <= rollupIntervals[mode] {
+				levels = append(levels, r.resolution)
+			}
+		}
+	}
+	return levels, nil
+}
+
+// rollupCoverage returns the range from the oldest bucket of r to the end of
+// its newest, zero when it holds none.
+func rollupCoverage(ctx context.Context, es *elasticsearch.Client, r resolution) (from, to time.Time, err error) {
+	query := map[string]interface{}{
+		"size": 0,
+		"aggs": map[string]interface{}{
+			"oldest": map[string]interface{}{"min": map[string]interface{}{"field": "@timestamp"}},
+			"newest": map[string]interface{}{"max": map[string]interface{}{"field": "@timestamp"}},
+		},
+	}
+	result, err := search(ctx, es, r.index, query)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("finding %s coverage: %w", r.index, err)
+	}
+	aggs, _ := result["aggregations"].(map[string]interface{})
+	oldest, _ := aggs["oldest"].(map[string]interface{})["value"].(float64)
+	newest, ok := aggs["newest"].(map[string]interface{})["value"].(float64)
+	if !ok {
+		return time.Time{}, time.Time{}, nil
+	}
+	return time.UnixMilli(int64(oldest)).UTC(), time.UnixMilli(int64(newest)).UTC().Add(r.step), nil
+}
+
+func fetchWindow(ctx context.Context, es *elasticsearch.Client, index string, networkFilters []string, from, to time.Time, mode string) (*FlowMatrix, error) {
+	levels, err := selectResolutions(ctx, es, mode, to.Sub(from), networkFilters)
+	if err != nil {
+		return nil, err
+	}
+
+	matrix := NewFlowMatrix()
+	raw := resolution{name: "raw", index: index}
+	for _, segment := range planSegments(from.UTC(), to.UTC(), raw, levels) {
+		conditions, err := flowConditions(networkFilters, timeRangeCondition(map[string]interface{}{
+			"gte": segment.from.Format(time.RFC3339Nano),
+			"lt":  segment.to.Format(time.RFC3339Nano),
+		}))
+		if err != nil {
+			return nil, err
+		}
+
+		part, err := fetchFlowMatrix(ctx, es, segment.resolution.index, conditions, segment.from, segment.to)
+		if err != nil {
+			return nil, fmt.Errorf("%s segment: %w", segment.resolution.name, err)
+		}
+		matrix.Merge(part)
+	}
+	return matrix, nil
+}
+
+func parseWindow(window string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(window, suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(window, suffix), 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid window: %s", window)
+			}
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+	return time.ParseDuration(window)
+}
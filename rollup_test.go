@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlowDocID(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	pair := NetworkFlow{Source: "10.0.0.1", Destination: "10.0.0.2", Timestamp: at}
+	connection := NetworkFlow{Source: "10.0.0.1", Destination: "10.0.0.2", SourcePort: 40000, DestinationPort: 443, Transport: "tcp", Timestamp: at}
+	app := pair
+	app.ContainerID = "aaaa"
+	sidecar := pair
+	sidecar.ContainerID = "bbbb"
+
+	for _, tc := range []struct {
+		doc  NetworkFlow
+		want string
+	}{
+		{pair, "1700000000-10.0.0.1-10.0.0.2"},
+		{connection, "1700000000-tcp-10.0.0.1:40000-10.0.0.2:443"},
+		{app, "1700000000-10.0.0.1-10.0.0.2-aaaa"},
+		{sidecar, "1700000000-10.0.0.1-10.0.0.2-bbbb"},
+	} {
+		if got := flowDocID(tc.doc); got != tc.want {
+			t.Errorf("flowDocID(%+v) = %s, want %s", tc.doc, got, tc.want)
+		}
+	}
+	// Re-indexing the same bucket overwrites rather than duplicates.
+	if flowDocID(app) != flowDocID(app) || flowDocID(app) == flowDocID(sidecar) {
+		t.Error("container documents of one pair must differ from each other and only from each other")
+	}
+}
@@ -0,0 +1,636 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gonum.org/v1/plot/vg"
+)
+
+// Served images are sized in pixels at the PNG renderer's 96 DPI; the default
+// matches the 24 inch diagram the CLI writes.
+const (
+	imageDPI           = 96
+	defaultImagePixels = 24 * imageDPI
+)
+
+// diagramServer renders diagrams on request. The source and the enrichment
+// caches are shared by all requests.
+type diagramServer struct {
+	cfg     Config
+	source  FlowSource
+	enrich  *enricher
+	queries semaphore
+	renders semaphore
+	budget  int64
+	limiter *rateLimiter
+	warm    *warmStart
+	alerts  *alerter
+	timeout time.Duration
+
+	pushInterval time.Duration
+	live         liveCache
+}
+
+// flowQuery is a request's effective settings, echoed back by the API.
+type flowQuery struct {
+	Source  string    `json:"source"`
+	Window  string    `json:"window"`
+	Network []string  `json:"network"`
+	GroupBy string    `json:"groupBy"`
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	// RefreshedAt is when the source last answered this query.
+	RefreshedAt time.Time `json:"refreshedAt"`
+	// IngestLagSeconds is how far the source's newest data trailed
+	// RefreshedAt; the range ends that much earlier when shiftLag is set.
+	IngestLagSeconds float64 `json:"ingestLagSeconds,omitempty"`
+}
+
+// freshness tells clients how old the data behind a response is. Lag is
+// the time since the newest data in the queried range, which grows with
+// ingest delay, for snapshots and for sources whose data stops in the past.
+type freshness struct {
+	RefreshedAt time.Time `json:"refreshedAt"`
+	LagSeconds  float64   `json:"lagSeconds"`
+	Stale       bool      `json:"stale"`
+}
+
+func (s *diagramServer) freshness(query flowQuery) freshness {
+	newest := query.To
+	if ingested := query.RefreshedAt.Add(-time.Duration(query.IngestLagSeconds) * time.Second); ingested.Before(newest) {
+		newest = ingested
+	}
+	lag := time.Since(newest)
+	return freshness{
+		RefreshedAt: query.RefreshedAt,
+		LagSeconds:  lag.Round(time.Second).Seconds(),
+		Stale:       s.cfg.Output.StaleAfter > 0 && lag > s.cfg.Output.StaleAfter,
+	}
+}
+
+// parseQuery applies a request's parameters to the configuration. window
+// and network default to the configured values; network may be repeated or
+// comma-separated. isDefault is set when neither is given. A requested
+// window is cut to limits.maxWindow.
+func (s *diagramServer) parseQuery(params url.Values) (cfg Config, window time.Duration, isDefault bool, err error) {
+	cfg = s.cfg
+	if value := params.Get("window"); value != "" {
+		cfg.Window = value
+	}
+	if values := params["network"]; len(values) > 0 {
+		cfg.Network = nil
+		for _, value := range values {
+			var networks stringList
+			networks.Set(value)
+			cfg.Network = append(cfg.Network, networks...)
+		}
+	}
+	if value := params.Get("title"); value != "" {
+		cfg.Output.Title = value
+	}
+	isDefault = params.Get("window") == "" && len(params["network"]) == 0
+
+	if window, err = parseWindow(cfg.Window); err != nil {
+		return cfg, 0, false, fmt.Errorf("invalid window: %w", err)
+	}
+	if longest := s.cfg.Limits.MaxWindow; !isDefault && longest > 0 && window > longest {
+		window = longest
+		cfg.Window = longest.String()
+	}
+	if _, err := parseCIDRFilter(cfg.Network); err != nil {
+		return cfg, 0, false, err
+	}
+	return cfg, window, isDefault, nil
+}
+
+// query fetches and labels the matrix for a request. It writes the error
+// response itself and returns false on failure.
+func (s *diagramServer) query(w http.ResponseWriter, r *http.Request) (Config, flowQuery, *FlowMatrix, bool) {
+	if s.budget > 0 && heapInUse() > s.budget {
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "over memory budget, try again later", http.StatusServiceUnavailable)
+		return s.cfg, flowQuery{}, nil, false
+	}
+	cfg, window, isDefault, err := s.parseQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return cfg, flowQuery{}, nil, false
+	}
+
+	from, to, explicit, err := parseRange(r.URL.Query(), time.Now(), s.cfg.Limits.MaxWindow)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return cfg, flowQuery{}, nil, false
+	}
+
+	var (
+		query        flowQuery
+		matrix       *FlowMatrix
+		fromSnapshot bool
+	)
+	if explicit {
+		cfg.Window = to.Sub(from).String()
+		query, matrix, err = s.fetchRange(r.Context(), cfg, from, to, 0)
+	} else {
+		query, matrix, fromSnapshot, err = s.lookup(r.Context(), cfg, window, isDefault)
+	}
+	if err != nil {
+		s.fail(w, r, err)
+		return cfg, flowQuery{}, nil, false
+	}
+	if fromSnapshot {
+		w.Header().Set("X-Snapshot-Time", query.To.Format(time.RFC3339))
+	}
+	s.markFreshness(w, query)
+	return cfg, query, matrix, true
+}
+
+// parseRange reads an explicit from/to range as Grafana's image panels send
+// it: epoch milliseconds, RFC 3339, or relative to now like "now-6h". A range
+// longer than longest, when that is positive, keeps its last longest.
+func parseRange(params url.Values, now time.Time, longest time.Duration) (from, to time.Time, ok bool, err error) {
+	if params.Get("from") == "" && params.Get("to") == "" {
+		return from, to, false, nil
+	}
+	if from, err = parseRangeTime(params.Get("from"), now); err != nil {
+		return from, to, false, fmt.Errorf("invalid from: %w", err)
+	}
+	if to, err = parseRangeTime(params.Get("to"), now); err != nil {
+		return from, to, false, fmt.Errorf("invalid to: %w", err)
+	}
+	if !to.After(from) {
+		return from, to, false, fmt.Errorf("from must be before to")
+	}
+	if longest > 0 && to.Sub(from) > longest {
+		from = to.Add(-longest)
+	}
+	return from, to, true, nil
+}
+
+func parseRangeTime(value string, now time.Time) (time.Time, error) {
+	switch {
+	case value == "" || value == "now":
+		return now, nil
+	case strings.HasPrefix(value, "now-"):
+		ago, err := parseWindow(strings.TrimPrefix(value, "now-"))
+		if err != nil {
+			return time.Time{}, err
+		}
+		return now.Add(-ago), nil
+	}
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(millis), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// parseImageParams reads the size in pixels and the theme of a rendered
+// diagram.
+func parseImageParams(params url.Values) (width, height vg.Length, theme chordTheme, err error) {
+	size := func(name string) (vg.Length, error) {
+		pixels := defaultImagePixels
+		if value := params.Get(name); value != "" {
+			if pixels, err = strconv.Atoi(value); err != nil || pixels < 100 || pixels > 8192 {
+				return 0, fmt.Errorf("invalid %s: want 100 to 8192 pixels", name)
+			}
+		}
+		return vg.Length(pixels) * vg.Inch / imageDPI, nil
+	}
+	if width, err = size("width"); err != nil {
+		return
+	}
+	if height, err = size("height"); err != nil {
+		return
+	}
+	name := params.Get("theme")
+	if name == "" {
+		name = "light"
+	}
+	theme, ok := chordThemes[name]
+	if !ok {
+		return 0, 0, theme, fmt.Errorf("unknown theme: %s", name)
+	}
+	return width, height, theme, nil
+}
+
+// lookup answers a parsed query, from the warm-start snapshot for the
+// default query until a fresh result replaces it.
+func (s *diagramServer) lookup(ctx context.Context, cfg Config, window time.Duration, isDefault bool) (query flowQuery, matrix *FlowMatrix, fromSnapshot bool, err error) {
+	if isDefault {
+		if snapshot := s.warm.stale(); snapshot != nil {
+			return snapshot.Query, snapshot.matrix(), true, nil
+		}
+	}
+	query, matrix, err = s.fetch(ctx, cfg, window)
+	if err != nil {
+		return query, nil, false, err
+	}
+	if isDefault {
+		// The snapshot is worth keeping even if the client has gone.
+		if err := s.warm.update(context.WithoutCancel(ctx), query, matrix); err != nil {
+			log.Printf("Error saving snapshot: %s", err)
+		}
+		if s.alerts != nil {
+			if _, err := s.alerts.check(ctx, matrix, query.From, query.To); err != nil {
+				log.Printf("Error %s", err)
+			}
+		}
+	}
+	return query, matrix, false, nil
+}
+
+func (s *diagramServer) markFreshness(w http.ResponseWriter, query flowQuery) {
+	fresh := s.freshness(query)
+	w.Header().Set("X-Data-Refreshed", fresh.RefreshedAt.Format(time.RFC3339))
+	w.Header().Set("X-Data-Lag", strconv.FormatFloat(fresh.LagSeconds, 'f', 0, 64))
+	if fresh.Stale {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+}
+
+// matrixETag names the version of a response: the request, the range and
+// flows behind it and anything else its body depends on. It changes only when
+// the data does, so clients polling between refreshes get 304s.
+func matrixETag(r *http.Request, query flowQuery, matrix *FlowMatrix, extra ...string) string {
+	h := sha256.New()
+	io.WriteString(h, r.URL.Path+"?"+r.URL.RawQuery+"\x00"+query.From.String()+"\x00"+query.To.String()+"\x00")
+	for _, value := range extra {
+		io.WriteString(h, value+"\x00")
+	}
+	for i, name := range matrix.Names {
+		io.WriteString(h, name+"\x00")
+		binary.Write(h, binary.LittleEndian, matrix.Flow[i])
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// notModified sets a response's ETag and answers 304 Not Modified when the
+// request's If-None-Match already names it, comparing weakly.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if match = strings.TrimPrefix(strings.TrimSpace(match), "W/"); match == strings.TrimPrefix(etag, "W/") || match == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *diagramServer) fetch(ctx context.Context, cfg Config, window time.Duration) (flowQuery, *FlowMatrix, error) {
+	if err := s.queries.acquire(ctx); err != nil {
+		return flowQuery{}, nil, err
+	}
+	from, to, lag, err := queryRange(ctx, s.source, window, time.Now(), cfg.ShiftLag)
+	s.queries.release()
+	if err != nil {
+		return flowQuery{}, nil, err
+	}
+	return s.fetchRange(ctx, cfg, from, to, lag)
+}
+
+// fetchRange queries the flows between from and to, which trail now by lag.
+func (s *diagramServer) fetchRange(ctx context.Context, cfg Config, from, to time.Time, lag time.Duration) (flowQuery, *FlowMatrix, error) {
+	if err := s.queries.acquire(ctx); err != nil {
+		return flowQuery{}, nil, err
+	}
+	matrix, err := fetchMatrix(ctx, cfg, s.source, s.enrich, from, to)
+	s.queries.release()
+	if err != nil {
+		return flowQuery{}, nil, err
+	}
+
+	query := flowQuery{
+		Source:  s.source.Name(),
+		Window:  cfg.Window,
+		Network: cfg.Network,
+		GroupBy: cfg.Kubernetes.GroupBy,
+		From:    from.UTC(),
+		To:      to.UTC(),
+
+		RefreshedAt:      time.Now().UTC(),
+		IngestLagSeconds: lag.Round(time.Second).Seconds(),
+	}
+	return query, matrix, nil
+}
+
+// warmUp runs the default query in the background so the stored snapshot
+// is replaced as soon as possible rather than on the first request.
+func (s *diagramServer) warmUp(timeout time.Duration) {
+	window, err := parseWindow(s.cfg.Window)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	query, matrix, err := s.fetch(ctx, s.cfg, window)
+	if err != nil {
+		log.Printf("Error refreshing snapshot: %s", err)
+		return
+	}
+	if err := s.warm.update(ctx, query, matrix); err != nil {
+		log.Printf("Error saving snapshot: %s", err)
+	}
+}
+
+// watchAlerts queries the default window every interval so the alert rules
+// are checked when no one is looking at it too.
+func (s *diagramServer) watchAlerts(interval time.Duration) {
+	window, err := parseWindow(s.cfg.Window)
+	if err != nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+		if _, _, _, err := s.lookup(ctx, s.cfg, window, true); err != nil {
+			log.Printf("Error checking alerts: %s", err)
+		}
+		cancel()
+	}
+}
+
+// ServeHTTP handles /diagram.png.
+func (s *diagramServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	width, height, theme, err := parseImageParams(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cfg, query, matrix, ok := s.query(w, r)
+	if !ok {
+		return
+	}
+	title := cfg.Output.Title + " (data until " + query.To.Format("2006-01-02 15:04 MST") + ")"
+	if fresh := s.freshness(query); fresh.Stale {
+		title += fmt.Sprintf(" - STALE, %s old", time.Duration(fresh.LagSeconds)*time.Second)
+	}
+	if notModified(w, r, matrixETag(r, query, matrix, title)) {
+		return
+	}
+
+	// Render fully before answering so a failure is still an error status.
+	if err := s.renders.acquire(r.Context()); err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	var image bytes.Buffer
+	err = writeDiagram(&image, matrix, title, cfg.Output, "png", plotSize{width: width, height: height}, theme)
+	s.renders.release()
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(image.Bytes())
+}
+
+type apiNode struct {
+	Name string `json:"name"`
+	// Kind is ip, pod, service, node or namespace when known.
+	Kind      string `json:"kind,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	// Resolver is the resolver that produced the name, if any.
+	Resolver string  `json:"resolver,omitempty"`
+	BytesOut float64 `json:"bytesOut"`
+	BytesIn  float64 `json:"bytesIn"`
+}
+
+type apiFlows struct {
+	Query      flowQuery   `json:"query"`
+	Freshness  freshness   `json:"freshness"`
+	Nodes      []apiNode   `json:"nodes"`
+	Matrix     [][]float64 `json:"matrix"`
+	TotalBytes float64     `json:"totalBytes"`
+}
+
+// serveFlows handles /api/v1/flows, which returns the same matrix as the
+// diagram as JSON: matrix[i][j] is the bytes nodes[i] sent to nodes[j].
+func (s *diagramServer) serveFlows(w http.ResponseWriter, r *http.Request) {
+	cfg, query, matrix, ok := s.query(w, r)
+	if !ok {
+		return
+	}
+
+	// The freshness in the body ages between refreshes.
+	if notModified(w, r, "W/"+matrixETag(r, query, matrix)) {
+		return
+	}
+	response := s.flowsResponse(r.Context(), cfg, query, matrix)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// flowsResponse describes a labelled matrix for the API.
+func (s *diagramServer) flowsResponse(ctx context.Context, cfg Config, query flowQuery, matrix *FlowMatrix) apiFlows {
+	response := apiFlows{
+		Query:     query,
+		Freshness: s.freshness(query),
+		Nodes:     describeNodes(ctx, cfg, s.enrich, matrix, query.From, query.To),
+		Matrix:    matrix.Flow,
+	}
+	if response.Matrix == nil {
+		response.Matrix = [][]float64{}
+	}
+	for _, node := range response.Nodes {
+		response.TotalBytes += node.BytesOut
+	}
+	return response
+}
+
+// describeNodes returns the kind, namespace and byte totals of each node of
+// a labelled matrix. Kubernetes metadata is looked up again by label from
+// the objects that held the addresses during [from, to).
+func describeNodes(ctx context.Context, cfg Config, enrich *enricher, matrix *FlowMatrix, from, to time.Time) []apiNode {
+	endpoints := make(map[string]kubeEndpoint)
+	if resolverEnabled(cfg, "kubernetes") && cfg.Kubernetes.GroupBy == "ip" {
+		// Any object holding an address during the range may have labels
+		// from the part of it it held the address in.
+		if inventory, err := enrich.kubeInventory(ctx); err == nil {
+			for _, owners := range inventory {
+				for _, endpoint := range owners {
+					if endpoint.overlap(from, to) > 0 {
+						endpoints[endpoint.Label()] = endpoint
+					}
+				}
+			}
+		}
+	}
+
+	nodes := make([]apiNode, len(matrix.Names))
+	for i, name := range matrix.Names {
+		node := apiNode{Name: name, Resolver: matrix.resolvedBy[name]}
+		switch endpoint, ok := endpoints[name]; {
+		case net.ParseIP(name) != nil:
+			node.Kind = "ip"
+		case ok:
+			node.Kind, node.Namespace = endpoint.Kind, endpoint.Namespace
+		case cfg.Kubernetes.GroupBy == "namespace":
+			node.Kind = "namespace"
+		}
+		for j := range matrix.Names {
+			node.BytesOut += matrix.Flow[i][j]
+			node.BytesIn += matrix.Flow[j][i]
+		}
+		nodes[i] = node
+	}
+	return nodes
+}
+
+func (s *diagramServer) fail(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("Error rendering %s: %s", r.URL, err)
+	status := http.StatusBadGateway
+	if r.Context().Err() != nil {
+		status = http.StatusGatewayTimeout
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func runServe(args []string) {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		log.Fatalf("Error loading config: %s", err)
+	}
+
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.String("config", "", "YAML or TOML configuration file; flags override its values")
+	listenPtr := fs.String("listen", ":8080", "Address to serve the UI, /diagram.png, /api/v1/flows, /api/v1/pairs and /ws on")
+	grpcListenPtr := fs.String("grpc-listen", "", "Address to serve the FlowService gRPC API on (disabled when empty)")
+	timeoutPtr := fs.Duration("timeout", 2*time.Minute, "Longest a single render may take")
+	fs.StringVar(&cfg.Source, "source", cfg.Source, "Flow data source")
+	fs.StringVar(&cfg.Shadow.Source, "shadow-source", cfg.Shadow.Source, "Also query this source and log where it disagrees with --source")
+	fs.StringVar(&cfg.Window, "window", cfg.Window, "Window rendered when a request does not set one")
+	fs.BoolVar(&cfg.ShiftLag, "shift-lag", cfg.ShiftLag, "End windows at the newest indexed flow when ingestion lags behind now")
+	fs.Var((*stringList)(&cfg.Network), "network", "Network CIDR filter used when a request does not set one")
+	fs.BoolVar(&cfg.Kubernetes.Labels, "kube-labels", cfg.Kubernetes.Labels, "Label IPs with Kubernetes pod, service, or node names")
+	fs.StringVar(&cfg.Kubernetes.GroupBy, "group-by", cfg.Kubernetes.GroupBy, "Aggregate nodes by ip or namespace")
+	fs.BoolVar(&cfg.Enrichment.ReverseDNS, "reverse-dns", cfg.Enrichment.ReverseDNS, "Label addresses Kubernetes does not know with their reverse DNS name")
+	fs.StringVar(&cfg.Enrichment.StaticLabelsFile, "labels-file", cfg.Enrichment.StaticLabelsFile, "Hosts-style file naming addresses and CIDR ranges outside Kubernetes, e.g. '192.168.1.10 nas'")
+	fs.IntVar(&cfg.Enrichment.Workers, "enrichment-workers", cfg.Enrichment.Workers, "Concurrent reverse DNS lookups")
+	fs.IntVar(&cfg.Limits.QueryConcurrency, "query-concurrency", cfg.Limits.QueryConcurrency, "Source queries run at once (0 for no limit)")
+	fs.IntVar(&cfg.Limits.RenderConcurrency, "render-concurrency", cfg.Limits.RenderConcurrency, "Diagrams rendered at once (0 for no limit)")
+	pushPtr := fs.Duration("push-interval", 30*time.Second, "Shortest interval between /ws updates")
+	snapshotPtr := fs.String("snapshot", "", "File, s3://bucket/key, elasticsearch://index/id or configmap://namespace/name/key keeping the last default diagram, served after a restart until the first fresh query finishes")
+	fs.StringVar(&cfg.Output.Layout, "layout", cfg.Output.Layout, "Diagram layout: chord, bundled, heatmap or graph")
+	fs.StringVar(&cfg.Output.Lang, "lang", cfg.Output.Lang, "Language of /table.html: en, de, es or fr")
+	fs.BoolVar(&cfg.Output.ClusterNamespaces, "cluster-namespaces", cfg.Output.ClusterNamespaces, "Pull each namespace's nodes together in the graph layout")
+	fs.DurationVar(&cfg.Output.StaleAfter, "stale-after", cfg.Output.StaleAfter, "Flag responses whose data ends longer ago than this as stale (0 to never)")
+	fs.DurationVar(&cfg.Limits.MaxWindow, "max-window", cfg.Limits.MaxWindow, "Longest window or from/to range a request may ask for; longer ones keep their most recent part (0 for no limit)")
+	fs.Float64Var(&cfg.Limits.RequestRate, "rate-limit", cfg.Limits.RequestRate, "Queries per second each client, by bearer token or address, may make over HTTP and gRPC (0 for no limit)")
+	fs.IntVar(&cfg.Limits.RequestBurst, "rate-burst", cfg.Limits.RequestBurst, "Queries a client may make at once before --rate-limit applies")
+	fs.StringVar(&cfg.Limits.MemoryBudget, "memory-budget", cfg.Limits.MemoryBudget, "Soft memory limit, e.g. 1GiB; requests get 503 while the heap is above it")
+	fs.StringVar(&cfg.Alerts.Rules, "alert-rules", cfg.Alerts.Rules, "Check the rules in this YAML or TOML file against the default window after each query of it")
+	alertIntervalPtr := fs.Duration("alert-interval", 5*time.Minute, "How often the default window is queried for --alert-rules")
+	fs.Parse(args)
+
+	if cfg.Kubernetes.GroupBy != "ip" && cfg.Kubernetes.GroupBy != "namespace" {
+		log.Fatalf("Unsupported group-by: %s", cfg.Kubernetes.GroupBy)
+	}
+	if _, ok := diagramLayouts[cfg.Output.Layout]; !ok {
+		log.Fatalf("Unsupported layout: %s", cfg.Output.Layout)
+	}
+	if _, ok := messageCatalogs[cfg.Output.Lang]; !ok {
+		log.Fatalf("Unsupported lang: %s", cfg.Output.Lang)
+	}
+	if *pushPtr <= 0 {
+		log.Fatalf("push-interval must be positive")
+	}
+	if cfg.Limits.RequestRate < 0 || cfg.Limits.RequestBurst < 1 {
+		log.Fatalf("rate-limit must not be negative and rate-burst must be positive")
+	}
+	if cfg.Alerts.Rules != "" && *alertIntervalPtr <= 0 {
+		log.Fatalf("alert-interval must be positive")
+	}
+	budget, err := cfg.Limits.apply()
+	if err != nil {
+		log.Fatalf("Invalid limits: %s", err)
+	}
+	source, err := newFlowSource(cfg)
+	if err != nil {
+		log.Fatalf("Error creating %s source: %s", cfg.Source, err)
+	}
+	if _, err := source.Version(context.Background()); err != nil {
+		log.Fatalf("Error reaching %s: %s", source.Name(), err)
+	}
+
+	server := &diagramServer{
+		cfg:     cfg,
+		source:  source,
+		enrich:  newEnricher(cfg),
+		queries: newSemaphore(cfg.Limits.QueryConcurrency),
+		renders: newSemaphore(cfg.Limits.RenderConcurrency),
+		budget:  budget,
+		limiter: newRateLimiter(cfg.Limits.RequestRate, cfg.Limits.RequestBurst),
+		timeout: *timeoutPtr,
+
+		pushInterval: *pushPtr,
+	}
+	if cfg.Alerts.Rules != "" {
+		if server.alerts, err = newAlerter(cfg); err != nil {
+			log.Fatalf("Error loading alert rules: %s", err)
+		}
+	}
+	if *snapshotPtr != "" {
+		store, err := openState(cfg, *snapshotPtr)
+		if err != nil {
+			log.Fatalf("Error opening snapshot storage: %s", err)
+		}
+		server.warm = &warmStart{store: store}
+		snapshot, err := loadSnapshot(context.Background(), store)
+		switch {
+		case err == nil && !snapshot.matches(cfg):
+			log.Printf("Ignoring snapshot taken with different settings")
+		case err == nil:
+			server.warm.snapshot = snapshot
+			log.Printf("Serving snapshot from %s until the first query finishes", snapshot.Query.To.Local().Format(time.RFC3339))
+		case !errors.Is(err, os.ErrNotExist):
+			log.Printf("Error loading snapshot: %s", err)
+		}
+		go server.warmUp(*timeoutPtr)
+	}
+	if server.alerts != nil {
+		go server.watchAlerts(*alertIntervalPtr)
+	}
+	if *grpcListenPtr != "" {
+		go func() {
+			log.Printf("Serving FlowService gRPC on %s", *grpcListenPtr)
+			log.Fatal(serveGRPC(*grpcListenPtr, server))
+		}()
+	}
+
+	mux := http.NewServeMux()
+	// Everything that queries the source counts against the rate limit.
+	limit := server.limiter.limit
+	mux.Handle("/diagram.png", limit(http.TimeoutHandler(server, *timeoutPtr, "rendering timed out")))
+	mux.Handle("/api/v1/flows", limit(http.TimeoutHandler(http.HandlerFunc(server.serveFlows), *timeoutPtr, "query timed out")))
+	mux.Handle("/api/v1/pairs", limit(http.TimeoutHandler(http.HandlerFunc(server.servePairs), *timeoutPtr, "query timed out")))
+	mux.Handle("/api/graph/", limit(http.TimeoutHandler(http.HandlerFunc(server.serveNodeGraph), *timeoutPtr, "query timed out")))
+	mux.HandleFunc("/api/health", server.serveNodeGraph)
+	mux.Handle("/table.html", limit(http.TimeoutHandler(http.HandlerFunc(server.serveTable), *timeoutPtr, "query timed out")))
+	mux.Handle("/ws", limit(http.HandlerFunc(server.serveLive)))
+	mux.Handle("/", uiHandler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	log.Printf("Serving %s diagrams on %s", source.Name(), *listenPtr)
+	log.Fatal(http.ListenAndServe(*listenPtr, mux))
+}
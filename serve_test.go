@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatrixETag(t *testing.T) {
+	query := flowQuery{From: time.Unix(0, 0), To: time.Unix(3600, 0)}
+	matrix := NewFlowMatrix()
+	matrix.Add("10.0.0.1", "10.0.0.2", 100)
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/flows?window=1h", nil)
+	etag := matrixETag(r, query, matrix)
+
+	if matrixETag(r, query, matrix) != etag {
+		t.Error("ETag of the same data changed")
+	}
+	matrix.Add("10.0.0.1", "10.0.0.2", 1)
+	if matrixETag(r, query, matrix) == etag {
+		t.Error("ETag did not change with the flows")
+	}
+	if matrixETag(httptest.NewRequest(http.MethodGet, "/api/v1/flows?window=2h", nil), query, matrix) == matrixETag(r, query, matrix) {
+		t.Error("ETag did not change with the request")
+	}
+
+	for _, test := range []struct {
+		ifNoneMatch string
+		status      int
+	}{
+		{"", http.StatusOK},
+		{`"other"`, http.StatusOK},
+		{etag, http.StatusNotModified},
+		{`"other", W/` + etag, http.StatusNotModified},
+		{"*", http.StatusNotModified},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/diagram.png", nil)
+		if test.ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", test.ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		if !notModified(w, r, etag) {
+			w.WriteHeader(http.StatusOK)
+		}
+		if w.Code != test.status || w.Header().Get("ETag") != etag {
+			t.Errorf("If-None-Match %q: %d with ETag %q, want %d with %q", test.ifNoneMatch, w.Code, w.Header().Get("ETag"), test.status, etag)
+		}
+	}
+}
+
+// TestOpenAPISchemas checks that the OpenAPI document describes every
+// field of the API's responses.
+func TestOpenAPISchemas(t *testing.T) {
+	data, err := webFiles.ReadFile("web/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var document struct {
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]json.RawMessage `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, value := range map[string]interface{}{
+		"Query":     flowQuery{},
+		"Freshness": freshness{},
+		"Node":      apiNode{},
+		"Flows":     apiFlows{},
+		"Pair":      apiPair{},
+		"Pairs":     apiPairs{},
+	} {
+		want := make(map[string]bool)
+		typ := reflect.TypeOf(value)
+		for i := 0; i < typ.NumField(); i++ {
+			want[strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]] = true
+		}
+		got := document.Components.Schemas[name].Properties
+		for field := range want {
+			if _, ok := got[field]; !ok {
+				t.Errorf("schema %s lacks %s", name, field)
+			}
+		}
+		for field := range got {
+			if !want[field] {
+				t.Errorf("schema %s has %s, which %T does not", name, field, value)
+			}
+		}
+	}
+}
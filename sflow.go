@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// sFlow v5 sample and record formats (enterprise 0).
+const (
+	sflowFlowSample            = 1
+	sflowCounterSample         = 2
+	sflowExpandedFlowSample    = 3
+	sflowExpandedCounterSample = 4
+
+	sflowRawHeader   = 1
+	sflowSampledIPv4 = 3
+	sflowSampledIPv6 = 4
+
+	sflowGenericInterfaceCounters = 1
+)
+
+// sflowInterfaceCounters is a generic interface counters record, the
+// agent's cumulative totals for one of its interfaces.
+type sflowInterfaceCounters struct {
+	Agent                                        netip.Addr
+	Index                                        uint32
+	Speed                                        uint64
+	InOctets, OutOctets                          uint64
+	InDiscards, InErrors, OutDiscards, OutErrors uint32
+}
+
+// xdrReader reads the big-endian, 4-byte aligned encoding sFlow uses.
+type xdrReader struct {
+	data []byte
+	err  error
+}
+
+func (r *xdrReader) uint32() uint32 {
+	if r.err != nil || len(r.data) < 4 {
+		r.err = fmt.Errorf("sflow datagram truncated")
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v
+}
+
+func (r *xdrReader) uint64() uint64 {
+	return uint64(r.uint32())<<32 | uint64(r.uint32())
+}
+
+// bytes returns the next n bytes and skips the padding after them.
+func (r *xdrReader) bytes(n int) []byte {
+	padded := (n + 3) &^ 3
+	if r.err != nil || n < 0 || len(r.data) < padded {
+		r.err = fmt.Errorf("sflow datagram truncated")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[padded:]
+	return b
+}
+
+// decodeSFlow calls fn for every flow sample in an sFlow v5 datagram, with
+// the sampled frame length scaled by the sampling rate, and counters for the
+// generic interface counters of every counter sample.
+func decodeSFlow(packet []byte, fn func(source, destination netip.Addr, bytes float64), counters func(sflowInterfaceCounters)) error {
+	r := &xdrReader{data: packet}
+	if version := r.uint32(); r.err == nil && version != 5 {
+		return fmt.Errorf("unsupported sFlow version %d", version)
+	}
+	var agent netip.Addr
+	switch r.uint32() {
+	case 1:
+		agent = addrFromSlice(r.bytes(4))
+	case 2:
+		agent = addrFromSlice(r.bytes(16))
+	default:
+		return fmt.Errorf("unknown sFlow agent address type")
+	}
+	r.uint32() // sub-agent ID
+	r.uint32() // sequence number
+	r.uint32() // uptime
+	samples := r.uint32()
+
+	for i := uint32(0); i < samples && r.err == nil; i++ {
+		format := r.uint32()
+		sample := &xdrReader{data: r.bytes(int(r.uint32()))}
+		if r.err != nil {
+			break
+		}
+		switch format {
+		case sflowFlowSample:
+			sample.uint32() // sequence number
+			sample.uint32() // source ID
+		case sflowExpandedFlowSample:
+			sample.uint32() // sequence number
+			sample.uint32() // source ID type
+			sample.uint32() // source ID index
+		case sflowCounterSample:
+			sample.uint32() // sequence number
+			sample.uint32() // source ID
+			decodeSFlowCounters(sample, agent, counters)
+			if sample.err != nil {
+				return sample.err
+			}
+			continue
+		case sflowExpandedCounterSample:
+			sample.uint32() // sequence number
+			sample.uint32() // source ID type
+			sample.uint32() // source ID index
+			decodeSFlowCounters(sample, agent, counters)
+			if sample.err != nil {
+				return sample.err
+			}
+			continue
+		default:
+			// Enterprise-specific formats.
+			continue
+		}
+		rate := float64(sample.uint32())
+		sample.uint32() // sample pool
+		sample.uint32() // drops
+		if format == sflowExpandedFlowSample {
+			sample.bytes(16) // input and output interface format and value
+		} else {
+			sample.bytes(8) // input and output interfaces
+		}
+		if rate < 1 {
+			rate = 1
+		}
+		decodeSFlowRecords(sample, rate, fn)
+		if sample.err != nil {
+			return sample.err
+		}
+	}
+	return r.err
+}
+
+// decodeSFlowRecords reports the sample once, from the first record that
+// yields both addresses, since agents may describe one packet several ways.
+func decodeSFlowRecords(sample *xdrReader, rate float64, fn func(source, destination netip.Addr, bytes float64)) {
+	records := sample.uint32()
+	for i := uint32(0); i < records && sample.err == nil; i++ {
+		format := sample.uint32()
+		record := &xdrReader{data: sample.bytes(int(sample.uint32()))}
+		if sample.err != nil {
+			return
+		}
+
+		var source, destination netip.Addr
+		var length uint32
+		switch format {
+		case sflowRawHeader:
+			protocol := record.uint32()
+			length = record.uint32()
+			record.uint32() // bytes stripped
+			header := record.bytes(int(record.uint32()))
+			if record.err == nil {
+				source, destination = packetAddresses(protocol, header)
+			}
+		case sflowSampledIPv4:
+			length = record.uint32()
+			record.uint32() // protocol
+			source, destination = addrFromSlice(record.bytes(4)), addrFromSlice(record.bytes(4))
+		case sflowSampledIPv6:
+			length = record.uint32()
+			record.uint32() // protocol
+			source, destination = addrFromSlice(record.bytes(16)), addrFromSlice(record.bytes(16))
+		}
+		if record.err == nil && source.IsValid() && destination.IsValid() {
+			fn(source, destination, float64(length)*rate)
+			return
+		}
+	}
+}
+
+// decodeSFlowCounters reports the generic interface counters records of a
+// counter sample; the other counter records are skipped.
+func decodeSFlowCounters(sample *xdrReader, agent netip.Addr, fn func(sflowInterfaceCounters)) {
+	records := sample.uint32()
+	for i := uint32(0); i < records && sample.err == nil; i++ {
+		format := sample.uint32()
+		record := &xdrReader{data: sample.bytes(int(sample.uint32()))}
+		if sample.err != nil || format != sflowGenericInterfaceCounters {
+			continue
+		}
+		c := sflowInterfaceCounters{Agent: agent, Index: record.uint32()}
+		record.uint32() // type
+		c.Speed = record.uint64()
+		record.uint32() // direction
+		record.uint32() // status
+		c.InOctets = record.uint64()
+		record.uint32() // unicast packets
+		record.uint32() // multicast packets
+		record.uint32() // broadcast packets
+		c.InDiscards = record.uint32()
+		c.InErrors = record.uint32()
+		record.uint32() // unknown protocols
+		c.OutOctets = record.uint64()
+		record.uint32() // unicast packets
+		record.uint32() // multicast packets
+		record.uint32() // broadcast packets
+		c.OutDiscards = record.uint32()
+		c.OutErrors = record.uint32()
+		if record.err == nil {
+			fn(c)
+		}
+	}
+}
+
+// packetAddresses extracts the IP addresses from a sampled header, which is
+// Ethernet (possibly VLAN-tagged) or a bare IPv4 or IPv6 packet.
+func packetAddresses(protocol uint32, header []byte) (netip.Addr, netip.Addr) {
+	const ethernet, ipv4, ipv6 = 1, 11, 12
+	etherType := uint16(0)
+	switch protocol {
+	case ethernet:
+		if len(header) < 14 {
+			return netip.Addr{}, netip.Addr{}
+		}
+		etherType = binary.BigEndian.Uint16(header[12:])
+		header = header[14:]
+		for etherType == 0x8100 || etherType == 0x88a8 {
+			if len(header) < 4 {
+				return netip.Addr{}, netip.Addr{}
+			}
+			etherType = binary.BigEndian.Uint16(header[2:])
+			header = header[4:]
+		}
+	case ipv4:
+		etherType = 0x0800
+	case ipv6:
+		etherType = 0x86dd
+	}
+
+	switch {
+	case etherType == 0x0800 && len(header) >= 20:
+		return addrFromSlice(header[12:16]), addrFromSlice(header[16:20])
+	case etherType == 0x86dd && len(header) >= 40:
+		return addrFromSlice(header[8:24]), addrFromSlice(header[24:40])
+	}
+	return netip.Addr{}, netip.Addr{}
+}
+
+// addrFromSlice returns the zero Addr for anything but 4 or 16 bytes.
+func addrFromSlice(b []byte) netip.Addr {
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+// sFlow v5 from agent 192.0.2.10 with a flow sample of an Ethernet frame
+// header, 1 in 512, and an expanded flow sample of a sampled IPv6 packet,
+// 1 in 100, laid out as switches send them.
+var sflowFlowFixture = hexFixture(
+	"00000005 00000001 c000020a 00000000 00000001 00000000 00000002",
+	// Flow sample.
+	"00000001 0000005c 00000001 00000003 00000200 00000000 00000000 00000001 00000002",
+	"00000001 00000001 00000034 00000001 000005ea 00000004 00000022",
+	"ffffffffffff 020000000001 0800 4500 05dc 0000 4000 4006 0000 0a000001 0a000002 0000",
+	// Expanded flow sample.
+	"00000003 0000006c 00000002 00000000 00000003 00000064 00000000 00000000 00000000 00000001 00000000 00000002",
+	"00000001 00000004 00000038 000005dc 00000006",
+	"20010db8000000000000000000000001 20010db8000000000000000000000002 00000000 000001bb 00000000 00000000",
+)
+
+// A counter sample with generic interface counters and Ethernet counters
+// for interface 3, and an expanded counter sample for interface 7.
+var sflowCounterFixture = hexFixture(
+	"00000005 00000001 c000020a 00000000 00000002 00000000 00000002",
+	"00000002 000000a8 00000001 00000003 00000002",
+	"00000001 00000058 00000003 00000006 00000002540be400 00000001 00000003",
+	"00000000000f4240 00000000 00000000 00000000 00000002 00000001 00000000",
+	"00000000001e8480 00000000 00000000 00000000 00000004 00000003 00000000",
+	"00000002 00000034 00000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000",
+	"00000004 00000070 00000003 00000000 00000007 00000001",
+	"00000001 00000058 00000007 00000006 000000003b9aca00 00000001 00000003",
+	"0000000000000064 00000000 00000000 00000000 00000000 00000000 00000000",
+	"00000000000000c8 00000000 00000000 00000000 00000000 00000000 00000000",
+)
+
+func decodeSFlowAll(packet []byte) ([]decodedFlow, []sflowInterfaceCounters, error) {
+	var flows []decodedFlow
+	var counters []sflowInterfaceCounters
+	err := decodeSFlow(packet, func(source, destination netip.Addr, bytes float64) {
+		flows = append(flows, decodedFlow{source.String(), destination.String(), bytes})
+	}, func(c sflowInterfaceCounters) {
+		counters = append(counters, c)
+	})
+	return flows, counters, err
+}
+
+func TestDecodeSFlow(t *testing.T) {
+	agent := netip.MustParseAddr("192.0.2.10")
+	for _, tc := range []struct {
+		name     string
+		packet   []byte
+		flows    []decodedFlow
+		counters []sflowInterfaceCounters
+	}{
+		{
+			name:   "flow samples",
+			packet: sflowFlowFixture,
+			flows: []decodedFlow{
+				{"10.0.0.1", "10.0.0.2", 1514 * 512},
+				{"2001:db8::1", "2001:db8::2", 1500 * 100},
+			},
+		},
+		{
+			name:   "counter samples",
+			packet: sflowCounterFixture,
+			counters: []sflowInterfaceCounters{
+				{Agent: agent, Index: 3, Speed: 10e9, InOctets: 1e6, OutOctets: 2e6, InDiscards: 2, InErrors: 1, OutDiscards: 4, OutErrors: 3},
+				{Agent: agent, Index: 7, Speed: 1e9, InOctets: 100, OutOctets: 200},
+			},
+		},
+	} {
+		flows, counters, err := decodeSFlowAll(tc.packet)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if len(flows) != len(tc.flows) {
+			t.Errorf("%s: decoded flows %v, want %v", tc.name, flows, tc.flows)
+		} else {
+			for i := range flows {
+				if flows[i] != tc.flows[i] {
+					t.Errorf("%s: flow %d = %v, want %v", tc.name, i, flows[i], tc.flows[i])
+				}
+			}
+		}
+		if len(counters) != len(tc.counters) {
+			t.Errorf("%s: decoded counters %+v, want %+v", tc.name, counters, tc.counters)
+		} else {
+			for i := range counters {
+				if counters[i] != tc.counters[i] {
+					t.Errorf("%s: counters %d = %+v, want %+v", tc.name, i, counters[i], tc.counters[i])
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeSFlowMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		packet []byte
+	}{
+		{"empty", nil},
+		{"version 4", hexFixture("00000004 00000001 c000020a")},
+		{"unknown agent address type", hexFixture("00000005 00000003 c000020a")},
+		{"sample longer than the datagram", hexFixture("00000005 00000001 c000020a 00000000 00000001 00000000 00000001 00000001 00000100 00000001")},
+	} {
+		if _, _, err := decodeSFlowAll(tc.packet); err == nil {
+			t.Errorf("%s: decoded without an error", tc.name)
+		}
+	}
+}
+
+func TestDecodeSFlowTruncated(t *testing.T) {
+	for _, fixture := range [][]byte{sflowFlowFixture, sflowCounterFixture} {
+		for n := 0; n < len(fixture); n++ {
+			flows, counters, err := decodeSFlowAll(fixture[:n])
+			if err == nil {
+				t.Errorf("%d-byte prefix of a %d-byte datagram decoded without an error", n, len(fixture))
+			}
+			if len(flows) > 1 || len(counters) > 1 {
+				t.Errorf("%d-byte prefix yielded %v and %v", n, flows, counters)
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ShadowConfig names a second source queried alongside the main one during
+// a migration. Its results are only compared, never shown.
+type ShadowConfig struct {
+	Source string `yaml:"source" toml:"source"`
+	// Tolerance is the relative difference in a pair's bytes that is still
+	// reported as a match, e.g. 0.01 for 1%.
+	Tolerance float64 `yaml:"tolerance" toml:"tolerance"`
+	// Report is how many of the largest discrepancies to log.
+	Report int `yaml:"report" toml:"report"`
+}
+
+// shadowSource answers from primary and checks every answer against shadow.
+type shadowSource struct {
+	primary FlowSource
+	shadow  FlowSource
+	cfg     ShadowConfig
+}
+
+func newShadowSource(cfg Config, primary FlowSource) (*shadowSource, error) {
+	if _, ok := primary.(boundedSource); ok {
+		return nil, fmt.Errorf("shadow mode needs a source queried by window, not %s", primary.Name())
+	}
+	shadowCfg := cfg
+	shadowCfg.Source, shadowCfg.Shadow = cfg.Shadow.Source, ShadowConfig{}
+	shadow, err := newFlowSource(shadowCfg)
+	if err != nil {
+		return nil, fmt.Errorf("shadow: %w", err)
+	}
+	return &shadowSource{primary: primary, shadow: shadow, cfg: cfg.Shadow}, nil
+}
+
+func (s *shadowSource) Name() string {
+	return s.primary.Name()
+}
+
+func (s *shadowSource) Version(ctx context.Context) (string, error) {
+	if version, err := s.shadow.Version(ctx); err != nil {
+		log.Printf("Shadow %s unreachable: %s", s.shadow.Name(), err)
+	} else {
+		log.Printf("Shadowing %s with %s %s", s.primary.Name(), s.shadow.Name(), version)
+	}
+	return s.primary.Version(ctx)
+}
+
+func (s *shadowSource) IngestLag(ctx context.Context, now time.Time) (time.Duration, error) {
+	if lagging, ok := s.primary.(laggingSource); ok {
+		return lagging.IngestLag(ctx, now)
+	}
+	return 0, nil
+}
+
+func (s *shadowSource) ExporterCoverage(ctx context.Context, from, to time.Time) (map[string]float64, error) {
+	if gapped, ok := s.primary.(gappedSource); ok {
+		return gapped.ExporterCoverage(ctx, from, to)
+	}
+	return nil, nil
+}
+
+func (s *shadowSource) Fetch(ctx context.Context, from, to time.Time, networkFilters []string) (*FlowMatrix, error) {
+	type result struct {
+		matrix  *FlowMatrix
+		err     error
+		elapsed time.Duration
+	}
+	shadowed := make(chan result, 1)
+	go func() {
+		start := time.Now()
+		matrix, err := s.shadow.Fetch(ctx, from, to, networkFilters)
+		shadowed <- result{matrix, err, time.Since(start)}
+	}()
+
+	start := time.Now()
+	matrix, err := s.primary.Fetch(ctx, from, to, networkFilters)
+	elapsed := time.Since(start)
+	shadow := <-shadowed
+	if err != nil {
+		return nil, err
+	}
+	if shadow.err != nil {
+		log.Printf("Shadow %s failed for %s - %s: %s", s.shadow.Name(), from.Format(time.RFC3339), to.Format(time.RFC3339), shadow.err)
+		return matrix, nil
+	}
+
+	diff := compareMatrices(matrix, shadow.matrix, s.cfg.Tolerance)
+	log.Printf("Shadow %s for %s - %s: %s (%s, primary %s)", s.shadow.Name(), from.Format(time.RFC3339), to.Format(time.RFC3339),
+		diff, shadow.elapsed.Round(time.Millisecond), elapsed.Round(time.Millisecond))
+	for i, pair := range diff.mismatches {
+		if i == s.cfg.Report {
+			break
+		}
+		log.Printf("  %s -> %s: primary %.0f, shadow %.0f bytes", pair.source, pair.destination, pair.primary, pair.shadow)
+	}
+	return matrix, nil
+}
+
+type pairDiff struct {
+	source, destination string
+	primary, shadow     float64
+}
+
+type matrixDiff struct {
+	pairs, shadowPairs      int
+	total, shadowTotal      float64
+	onlyPrimary, onlyShadow int
+	// mismatches are the pairs outside the tolerance, largest first.
+	mismatches []pairDiff
+}
+
+func pairTotals(matrix *FlowMatrix) map[[2]string]float64 {
+	totals := make(map[[2]string]float64)
+	for i, source := range matrix.Names {
+		for j, destination := range matrix.Names {
+			if matrix.Flow[i][j] > 0 {
+				totals[[2]string{source, destination}] += matrix.Flow[i][j]
+			}
+		}
+	}
+	return totals
+}
+
+func compareMatrices(primary, shadow *FlowMatrix, tolerance float64) matrixDiff {
+	primaryPairs, shadowPairs := pairTotals(primary), pairTotals(shadow)
+	diff := matrixDiff{pairs: len(primaryPairs), shadowPairs: len(shadowPairs)}
+	for pair, bytes := range primaryPairs {
+		diff.total += bytes
+		other, ok := shadowPairs[pair]
+		if !ok {
+			diff.onlyPrimary++
+		}
+		if math.Abs(bytes-other) > tolerance*math.Max(bytes, other) {
+			diff.mismatches = append(diff.mismatches, pairDiff{pair[0], pair[1], bytes, other})
+		}
+	}
+	for pair, bytes := range shadowPairs {
+		diff.shadowTotal += bytes
+		if _, ok := primaryPairs[pair]; !ok {
+			diff.onlyShadow++
+			diff.mismatches = append(diff.mismatches, pairDiff{pair[0], pair[1], 0, bytes})
+		}
+	}
+	sort.Slice(diff.mismatches, func(i, j int) bool {
+		a, b := diff.mismatches[i], diff.mismatches[j]
+		return math.Abs(a.primary-a.shadow) > math.Abs(b.primary-b.shadow)
+	})
+	return diff
+}
+
+func (d matrixDiff) String() string {
+	if len(d.mismatches) == 0 {
+		return fmt.Sprintf("%d pairs match", d.pairs)
+	}
+	parts := []string{fmt.Sprintf("%d pairs (primary %d)", d.shadowPairs, d.pairs)}
+	if d.total > 0 {
+		parts = append(parts, fmt.Sprintf("total bytes %+.1f%%", 100*(d.shadowTotal-d.total)/d.total))
+	}
+	parts = append(parts, fmt.Sprintf("%d pairs differ", len(d.mismatches)))
+	if d.onlyPrimary > 0 {
+		parts = append(parts, fmt.Sprintf("%d missing", d.onlyPrimary))
+	}
+	if d.onlyShadow > 0 {
+		parts = append(parts, fmt.Sprintf("%d extra", d.onlyShadow))
+	}
+	return strings.Join(parts, ", ")
+}
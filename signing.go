@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+func readPEMBlock(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	return block, nil
+}
+
+// loadSigningKey reads a PKCS#8 Ed25519 private key as produced by
+// `openssl genpkey -algorithm ed25519`.
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEMBlock(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 private key", path)
+	}
+	return private, nil
+}
+
+func loadVerifyKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEMBlock(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 public key", path)
+	}
+	return public, nil
+}
+
+// signFile writes a detached raw signature to path.sig, which can also be
+// checked with `openssl pkeyutl -verify -rawin -pubin -inkey pub.pem -in path -sigfile path.sig`.
+func signFile(key ed25519.PrivateKey, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path+".sig", ed25519.Sign(key, data))
+}
+
+func verifyFile(key ed25519.PublicKey, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	signature, err := os.ReadFile(path + ".sig")
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, data, signature) {
+		return fmt.Errorf("%s: signature does not match", path)
+	}
+	return nil
+}
+
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	keyPtr := fs.String("key", "", "PEM-encoded Ed25519 public key")
+	fs.Parse(args)
+	if *keyPtr == "" || fs.NArg() == 0 {
+		log.Fatalf("Usage: kube-netflow verify --key <public.pem> <file>...")
+	}
+
+	key, err := loadVerifyKey(*keyPtr)
+	if err != nil {
+		log.Fatalf("Error loading public key: %s", err)
+	}
+	for _, path := range fs.Args() {
+		if err := verifyFile(key, path); err != nil {
+			log.Fatalf("Verification failed: %s", err)
+		}
+		fmt.Printf("%s: OK\n", path)
+	}
+}
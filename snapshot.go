@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// flowSnapshot is the last matrix serve produced for its default query,
+// kept so a restarted server has something to show before its first query
+// finishes. The matrix has already been through the privacy settings.
+type flowSnapshot struct {
+	Version int         `json:"version"`
+	Query   flowQuery   `json:"query"`
+	Names   []string    `json:"names"`
+	Flow    [][]float64 `json:"flow"`
+}
+
+func loadSnapshot(ctx context.Context, store stateStore) (*flowSnapshot, error) {
+	data, err := store.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &flowSnapshot{}
+	if err := snapshotFormat.decode(data, snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+func (s *flowSnapshot) save(ctx context.Context, store stateStore) error {
+	s.Version = snapshotVersion
+	data, err := snapshotFormat.encode(s)
+	if err != nil {
+		return err
+	}
+	return store.save(ctx, data)
+}
+
+// matches reports whether the snapshot answers cfg's default query.
+func (s *flowSnapshot) matches(cfg Config) bool {
+	return s.Query.Source == cfg.Source && s.Query.Window == cfg.Window &&
+		s.Query.GroupBy == cfg.Kubernetes.GroupBy && slices.Equal(s.Query.Network, cfg.Network)
+}
+
+func (s *flowSnapshot) matrix() *FlowMatrix {
+	matrix := NewFlowMatrix()
+	for i, source := range s.Names {
+		matrix.Index(source)
+		for j, destination := range s.Names {
+			if i < len(s.Flow) && j < len(s.Flow[i]) && s.Flow[i][j] > 0 {
+				matrix.Add(source, destination, s.Flow[i][j])
+			}
+		}
+	}
+	return matrix
+}
+
+// warmStart answers the default query from the stored snapshot until the
+// first fresh result for it arrives, and stores each fresh result.
+type warmStart struct {
+	store stateStore
+
+	mu       sync.Mutex
+	snapshot *flowSnapshot
+	fresh    bool
+}
+
+// stale returns the stored snapshot while no fresh result has replaced it.
+func (w *warmStart) stale() *flowSnapshot {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.fresh {
+		return nil
+	}
+	return w.snapshot
+}
+
+func (w *warmStart) update(ctx context.Context, query flowQuery, matrix *FlowMatrix) error {
+	if w == nil {
+		return nil
+	}
+	snapshot := &flowSnapshot{Query: query, Names: matrix.Names, Flow: matrix.Flow}
+	w.mu.Lock()
+	w.snapshot, w.fresh = snapshot, true
+	w.mu.Unlock()
+	return snapshot.save(ctx, w.store)
+}
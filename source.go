@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+// FlowSource produces the aggregated flow matrix for a time range.
+type FlowSource interface {
+	Name() string
+	Version(ctx context.Context) (string, error)
+	Fetch(ctx context.Context, from, to time.Time, networkFilters []string) (*FlowMatrix, error)
+}
+
+// boundedSource is implemented by sources whose data covers a fixed period,
+// such as a capture file, which replaces the window ending now.
+type boundedSource interface {
+	TimeRange(ctx context.Context) (from, to time.Time, err error)
+}
+
+// laggingSource is implemented by sources that can tell how far their
+// newest data trails the present, e.g. because of ingest pipeline delay.
+type laggingSource interface {
+	IngestLag(ctx context.Context, now time.Time) (time.Duration, error)
+}
+
+// queryRange picks the range to query: the source's own period for bounded
+// sources, otherwise the window ending now, moved back by the ingest lag
+// when shift is set so data still in the pipeline does not look like a
+// drop in traffic. lag is zero for sources that cannot measure it.
+func queryRange(ctx context.Context, source FlowSource, window time.Duration, now time.Time, shift bool) (from, to time.Time, lag time.Duration, err error) {
+	if bounded, ok := source.(boundedSource); ok {
+		from, to, err = bounded.TimeRange(ctx)
+		return from, to, 0, err
+	}
+	to = now
+	if lagging, ok := source.(laggingSource); ok {
+		// Not knowing the lag is no reason to skip the query.
+		if lag, err = lagging.IngestLag(ctx, now); err != nil {
+			log.Printf("Error measuring %s ingest lag: %s", source.Name(), err)
+		} else if shift {
+			to = now.Add(-lag)
+		}
+	}
+	return to.Add(-window), to, lag, nil
+}
+
+// flowSources maps each --source name to the constructor of its backend.
+var flowSources = map[string]func(cfg Config) (FlowSource, error){
+	"elasticsearch": func(cfg Config) (FlowSource, error) {
+		es, err := newElasticClient(cfg.Elasticsearch)
+		if err != nil {
+			return nil, err
+		}
+		return &elasticSource{
+			es:          es,
+			index:       cfg.Elasticsearch.Index,
+			resolution:  cfg.Resolution,
+			protocols:   cfg.Protocols,
+			maxSkew:     cfg.Elasticsearch.MaxClockSkew,
+			correctSkew: cfg.Elasticsearch.CorrectClockSkew,
+		}, nil
+	},
+	"clickhouse":  func(cfg Config) (FlowSource, error) { return newClickHouseSource(cfg.ClickHouse) },
+	"loki":        func(cfg Config) (FlowSource, error) { return newLokiSource(cfg.Loki) },
+	"prometheus":  func(cfg Config) (FlowSource, error) { return newPrometheusSource(cfg.Prometheus) },
+	"bigquery":    func(cfg Config) (FlowSource, error) { return newBigQuerySource(cfg.BigQuery) },
+	"vpcflowlogs": func(cfg Config) (FlowSource, error) { return newVPCFlowLogsSource(cfg.VPCFlowLogs) },
+	"nsgflowlogs": func(cfg Config) (FlowSource, error) { return newNSGFlowLogsSource(cfg.NSGFlowLogs) },
+	"hubble":      func(cfg Config) (FlowSource, error) { return newHubbleSource(cfg.Hubble) },
+	"pcap":        func(cfg Config) (FlowSource, error) { return newPcapSource(cfg.Pcap) },
+	"demo":        func(cfg Config) (FlowSource, error) { return demoSource{}, nil },
+}
+
+// sourceNames lists the built-in sources, for usage messages.
+func sourceNames() []string {
+	names := make([]string, 0, len(flowSources))
+	for name := range flowSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newFlowSource builds the source named by cfg.Source: a built-in backend,
+// or an out-of-tree one configured under plugins. With a shadow source
+// configured, that is queried too and its answers compared.
+func newFlowSource(cfg Config) (FlowSource, error) {
+	var source FlowSource
+	var err error
+	if factory, ok := flowSources[cfg.Source]; ok {
+		source, err = factory(cfg)
+	} else if plugin, ok := cfg.Plugins[cfg.Source]; ok {
+		source, err = newPluginSource(cfg.Source, plugin)
+	} else {
+		return nil, fmt.Errorf("unknown source: %s", cfg.Source)
+	}
+	if err != nil || cfg.Shadow.Source == "" {
+		return source, err
+	}
+	return newShadowSource(cfg, source)
+}
+
+type elasticSource struct {
+	es         *elasticsearch.Client
+	index      string
+	resolution string
+	protocols  []string
+	// maxSkew flags exporters whose clocks stray further from ingest time;
+	// correctSkew reads their flows from where their clocks put them.
+	maxSkew     time.Duration
+	correctSkew bool
+	skew        skewCache
+}
+
+func (s *elasticSource) Name() string {
+	return "elasticsearch"
+}
+
+func (s *elasticSource) Version(ctx context.Context) (string, error) {
+	return elasticVersion(ctx, s.es)
+}
+
+func (s *elasticSource) Fetch(ctx context.Context, from, to time.Time, networkFilters []string) (*FlowMatrix, error) {
+	if s.correctSkew {
+		skews, err := s.ClockSkews(ctx, time.Now())
+		if err != nil {
+			log.Printf("Error %s; not correcting clock skew", err)
+		} else if len(skews) > 0 {
+			var conditions []map[string]interface{}
+			if len(networkFilters) > 0 {
+				condition, err := networkCondition(networkFilters)
+				if err != nil {
+					return nil, err
+				}
+				conditions = append(conditions, condition)
+			}
+			if len(s.protocols) > 0 {
+				conditions = append(conditions, protocolCondition(s.protocols))
+			}
+			return fetchCorrected(ctx, s.es, s.index, conditions, from, to, skews)
+		}
+	}
+	if len(s.protocols) == 0 {
+		return fetchWindow(ctx, s.es, s.index, networkFilters, from, to, s.resolution)
+	}
+
+	// Rollups do not keep ports, so protocol filters always read raw flows.
+	conditions, err := flowConditions(networkFilters, timeRangeCondition(map[string]interface{}{
+		"gte": from.Format(time.RFC3339),
+		"lt":  to.Format(time.RFC3339),
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return fetchFlowMatrix(ctx, s.es, s.index, append(conditions, protocolCondition(s.protocols)), from, to)
+}
+
+type demoSource struct{}
+
+func (demoSource) Name() string {
+	return "demo"
+}
+
+func (demoSource) Version(ctx context.Context) (string, error) {
+	return "synthetic", nil
+}
+
+func (demoSource) Fetch(ctx context.Context, from, to time.Time, networkFilters []string) (*FlowMatrix, error) {
+	return demoMatrix(to.Sub(from), to), nil
+}
+
+// cidrFilter applies the network filter to sources that cannot push it down
+// into their query language: a pair matches when both ends fall inside the
+// same network, like networkCondition's Elasticsearch range conditions.
+type cidrFilter []*net.IPNet
+
+func parseCIDRFilter(networkFilters []string) (cidrFilter, error) {
+	var filter cidrFilter
+	for _, cidr := range networkFilters {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR notation: %s", cidr)
+		}
+		filter = append(filter, ipNet)
+	}
+	return filter, nil
+}
+
+func (f cidrFilter) match(source, destination string) bool {
+	if len(f) == 0 {
+		return true
+	}
+	src, dst := net.ParseIP(source), net.ParseIP(destination)
+	if src == nil || dst == nil {
+		return false
+	}
+	for _, ipNet := range f {
+		if ipNet.Contains(src) && ipNet.Contains(dst) {
+			return true
+		}
+	}
+	return false
+}
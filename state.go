@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+// stateStore keeps one document the long-running modes remember between
+// runs, the serve snapshot or the learned baselines, so that stateless
+// deployments can keep it in shared storage. load returns an error
+// wrapping fs.ErrNotExist until the first save.
+type stateStore interface {
+	load(ctx context.Context) ([]byte, error)
+	save(ctx context.Context, data []byte) error
+}
+
+// openState returns the store at location:
+//
+//	s3://bucket/key                      an S3 object
+//	elasticsearch://index/id             a document in the configured cluster
+//	configmap://namespace/name/key       a key of a ConfigMap
+//	anything else                        a local file
+func openState(cfg Config, location string) (stateStore, error) {
+	scheme, rest, ok := strings.Cut(location, "://")
+	if !ok {
+		return fileState(location), nil
+	}
+	parts := strings.Split(rest, "/")
+	switch scheme {
+	case "s3":
+		if len(parts) < 2 || parts[0] == "" || parts[len(parts)-1] == "" {
+			return nil, fmt.Errorf("%s: want s3://bucket/key", location)
+		}
+		awsCfg, err := awsconfig.LoadDefaultConfig(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		return &s3State{client: s3.NewFromConfig(awsCfg), bucket: parts[0], key: strings.Join(parts[1:], "/")}, nil
+	case "elasticsearch":
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%s: want elasticsearch://index/id", location)
+		}
+		es, err := newElasticClient(cfg.Elasticsearch)
+		if err != nil {
+			return nil, err
+		}
+		return &esState{es: es, index: parts[0], id: parts[1]}, nil
+	case "configmap":
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("%s: want configmap://namespace/name/key", location)
+		}
+		client, err := newKubeClient(cfg.Kubernetes.Kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		return &configMapState{client: client, namespace: parts[0], name: parts[1], key: parts[2]}, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported storage %s", location, scheme)
+}
+
+type fileState string
+
+func (f fileState) load(ctx context.Context) ([]byte, error) {
+	return os.ReadFile(string(f))
+}
+
+func (f fileState) save(ctx context.Context, data []byte) error {
+	return writeFileAtomic(string(f), data)
+}
+
+type s3State struct {
+	client      *s3.Client
+	bucket, key string
+}
+
+func (s *s3State) load(ctx context.Context) ([]byte, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(s.key)})
+	var missing *types.NoSuchKey
+	if errors.As(err, &missing) {
+		return nil, fmt.Errorf("s3://%s/%s: %w", s.bucket, s.key, fs.ErrNotExist)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+func (s *s3State) save(ctx context.Context, data []byte) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+// esState keeps the document in the data field of an Elasticsearch
+// document. The index is created unindexed, as only its source is read.
+type esState struct {
+	es        *elasticsearch.Client
+	index, id string
+	created   sync.Once
+}
+
+type esStateDocument struct {
+	Data []byte `json:"data"`
+}
+
+func (s *esState) load(ctx context.Context) ([]byte, error) {
+	res, err := s.es.Get(s.index, s.id, s.es.Get.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s/%s: %w", s.index, s.id, fs.ErrNotExist)
+	}
+	if res.IsError() {
+		return nil, fmt.Errorf("getting %s/%s: %s", s.index, s.id, res.String())
+	}
+	var doc struct {
+		Source esStateDocument `json:"_source"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc.Source.Data, nil
+}
+
+func (s *esState) save(ctx context.Context, data []byte) error {
+	s.created.Do(func() {
+		res, err := s.es.Indices.Create(s.index, s.es.Indices.Create.WithContext(ctx),
+			s.es.Indices.Create.WithBody(strings.NewReader(`{"mappings": {"dynamic": false}}`)))
+		if err == nil {
+			// Losing the race to create it is fine.
+			res.Body.Close()
+		}
+	})
+	body, err := json.Marshal(esStateDocument{Data: data})
+	if err != nil {
+		return err
+	}
+	res, err := s.es.Index(s.index, bytes.NewReader(body), s.es.Index.WithDocumentID(s.id), s.es.Index.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("saving %s/%s: %s", s.index, s.id, res.String())
+	}
+	return nil
+}
+
+// configMapState keeps the document under a binaryData key of a ConfigMap,
+// leaving its other keys alone. ConfigMaps hold at most 1 MiB.
+type configMapState struct {
+	client               *kubeClient
+	namespace, name, key string
+}
+
+type kubeConfigMap struct {
+	APIVersion string                 `json:"apiVersion"`
+	Kind       string                 `json:"kind"`
+	Metadata   map[string]interface{} `json:"metadata"`
+	Data       map[string]string      `json:"data,omitempty"`
+	BinaryData map[string][]byte      `json:"binaryData,omitempty"`
+}
+
+func (c *configMapState) path() string {
+	return "/api/v1/namespaces/" + url.PathEscape(c.namespace) + "/configmaps/" + url.PathEscape(c.name)
+}
+
+func (c *configMapState) load(ctx context.Context) ([]byte, error) {
+	var configMap kubeConfigMap
+	if err := c.client.get(ctx, c.path(), &configMap); err != nil {
+		return nil, err
+	}
+	data, ok := configMap.BinaryData[c.key]
+	if !ok {
+		return nil, fmt.Errorf("configmap %s/%s has no %s: %w", c.namespace, c.name, c.key, fs.ErrNotExist)
+	}
+	return data, nil
+}
+
+// save replaces the ConfigMap as it was read, so a concurrent change
+// makes it fail rather than be lost.
+func (c *configMapState) save(ctx context.Context, data []byte) error {
+	var configMap kubeConfigMap
+	err := c.client.get(ctx, c.path(), &configMap)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		configMap = kubeConfigMap{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+			Metadata:   map[string]interface{}{"name": c.name, "namespace": c.namespace},
+			BinaryData: map[string][]byte{c.key: data},
+		}
+		return c.client.send(ctx, http.MethodPost, "/api/v1/namespaces/"+url.PathEscape(c.namespace)+"/configmaps", configMap, &configMap)
+	case err != nil:
+		return err
+	}
+	if configMap.BinaryData == nil {
+		configMap.BinaryData = make(map[string][]byte)
+	}
+	configMap.BinaryData[c.key] = data
+	return c.client.send(ctx, http.MethodPut, c.path(), configMap, &configMap)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// flowTable is the data behind a diagram as HTML tables, for screen readers
+// and anyone who cannot use the image.
+type flowTable struct {
+	// Lang is the language of the page's fixed strings.
+	Lang     string
+	Title    string
+	From, To time.Time
+	Nodes    []apiNode
+	Pairs    []flowTablePair
+}
+
+type flowTablePair struct {
+	Source      string  `json:"source"`
+	Destination string  `json:"destination"`
+	Bytes       float64 `json:"bytes"`
+}
+
+// topPairs returns the top conversations of matrix by bytes, all of them
+// when top is 0.
+func topPairs(matrix *FlowMatrix, top int) []flowTablePair {
+	var pairs []flowTablePair
+	for i, source := range matrix.Names {
+		for j, destination := range matrix.Names {
+			if matrix.Flow[i][j] > 0 {
+				pairs = append(pairs, flowTablePair{source, destination, matrix.Flow[i][j]})
+			}
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Bytes > pairs[j].Bytes })
+	if top > 0 && len(pairs) > top {
+		pairs = pairs[:top]
+	}
+	return pairs
+}
+
+func newFlowTable(lang, title string, matrix *FlowMatrix, nodes []apiNode, from, to time.Time) flowTable {
+	table := flowTable{Lang: lang, Title: title, From: from.UTC(), To: to.UTC(), Nodes: nodes, Pairs: topPairs(matrix, 0)}
+	sort.SliceStable(table.Nodes, func(i, j int) bool {
+		return table.Nodes[i].BytesOut+table.Nodes[i].BytesIn > table.Nodes[j].BytesOut+table.Nodes[j].BytesIn
+	})
+	return table
+}
+
+// tablePath is where publish writes the table for the output at path.
+func tablePath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".html"
+}
+
+// sortTablesScript sorts a page's tables by the column heading selected,
+// numerically by the data-value of cells that have one.
+const sortTablesScript = `for (const table of document.querySelectorAll("table")) {
+  const headers = [...table.querySelectorAll("thead th")];
+  headers.forEach((th, column) => th.querySelector("button").addEventListener("click", () => {
+    const order = th.getAttribute("aria-sort") === "descending" ? "ascending" : "descending";
+    headers.forEach(other => other.setAttribute("aria-sort", "none"));
+    th.setAttribute("aria-sort", order);
+    const key = row => {
+      const cell = row.children[column];
+      return cell.dataset.value !== undefined ? Number(cell.dataset.value) : cell.textContent;
+    };
+    const body = table.tBodies[0];
+    const rows = [...body.rows].sort((a, b) => {
+      const x = key(a), y = key(b);
+      const cmp = typeof x === "number" ? x - y : x.localeCompare(y);
+      return order === "ascending" ? cmp : -cmp;
+    });
+    body.append(...rows);
+  }));
+}
+`
+
+var flowTableTemplate = template.Must(template.New("table").Funcs(template.FuncMap{
+	"mb":  func(bytes float64) string { return fmt.Sprintf("%.1f", bytes/1024/1024) },
+	"raw": func(bytes float64) string { return fmt.Sprintf("%.0f", bytes) },
+	"t":   translate,
+}).Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+caption { text-align: left; font-weight: bold; padding: 0.5em 0; }
+th, td { border: 1px solid #999; padding: 0.3em 0.6em; }
+td.number { text-align: right; font-variant-numeric: tabular-nums; }
+th button { font: inherit; font-weight: bold; background: none; border: none; padding: 0; cursor: pointer; }
+th button:focus { outline: 2px solid #005fcc; }
+</style>
+</head>
+<body>
+<main>
+<h1>{{.Title}}</h1>
+<p>{{t .Lang "Flows from"}} <time datetime="{{.From.Format "2006-01-02T15:04:05Z07:00"}}">{{.From.Format "2006-01-02 15:04 MST"}}</time>
+{{t .Lang "to"}} <time datetime="{{.To.Format "2006-01-02T15:04:05Z07:00"}}">{{.To.Format "2006-01-02 15:04 MST"}}</time>.
+{{t .Lang "Select a column heading to sort by it."}}</p>
+
+<table>
+<caption>{{t .Lang "Traffic per node, in megabytes"}}</caption>
+<thead><tr>
+<th scope="col" aria-sort="none"><button type="button">{{t .Lang "Node"}}</button></th>
+<th scope="col" aria-sort="none"><button type="button">{{t .Lang "Kind"}}</button></th>
+<th scope="col" aria-sort="none"><button type="button">{{t .Lang "Namespace"}}</button></th>
+<th scope="col" aria-sort="descending"><button type="button">{{t .Lang "Sent"}}</button></th>
+<th scope="col" aria-sort="none"><button type="button">{{t .Lang "Received"}}</button></th>
+</tr></thead>
+<tbody>
+{{range .Nodes}}<tr><th scope="row">{{.Name}}</th><td>{{.Kind}}</td><td>{{.Namespace}}</td><td class="number" data-value="{{raw .BytesOut}}">{{mb .BytesOut}}</td><td class="number" data-value="{{raw .BytesIn}}">{{mb .BytesIn}}</td></tr>
+{{end}}</tbody>
+</table>
+
+<table>
+<caption>{{t .Lang "Conversations, in megabytes"}}</caption>
+<thead><tr>
+<th scope="col" aria-sort="none"><button type="button">{{t .Lang "Source"}}</button></th>
+<th scope="col" aria-sort="none"><button type="button">{{t .Lang "Destination"}}</button></th>
+<th scope="col" aria-sort="descending"><button type="button">{{t .Lang "Sent"}}</button></th>
+</tr></thead>
+<tbody>
+{{range .Pairs}}<tr><td>{{.Source}}</td><td>{{.Destination}}</td><td class="number" data-value="{{raw .Bytes}}">{{mb .Bytes}}</td></tr>
+{{end}}</tbody>
+</table>
+</main>
+<script>
+` + sortTablesScript + `</script>
+</body>
+</html>
+`))
+
+func writeFlowTable(path string, table flowTable) error {
+	var page bytes.Buffer
+	if err := flowTableTemplate.Execute(&page, table); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, page.Bytes())
+}
+
+// serveTable handles /table.html, taking the same parameters as
+// /diagram.png.
+func (s *diagramServer) serveTable(w http.ResponseWriter, r *http.Request) {
+	cfg, query, matrix, ok := s.query(w, r)
+	if !ok {
+		return
+	}
+	nodes := describeNodes(r.Context(), cfg, s.enrich, matrix, query.From, query.To)
+	var page bytes.Buffer
+	if err := flowTableTemplate.Execute(&page, newFlowTable(cfg.Output.Lang, cfg.Output.Title, matrix, nodes, query.From, query.To)); err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(page.Bytes())
+}
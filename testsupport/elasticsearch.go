@@ -0,0 +1,105 @@
+//go:build integration
+
+// Package testsupport runs the Elasticsearch cluster kube-netflow's
+// integration tests query, so they and checks of custom mappings share one
+// setup:
+//
+//	go test -tags integration ./...
+//
+// KUBE_NETFLOW_ES_IMAGE picks the Elasticsearch image. KUBE_NETFLOW_ES_MAPPING
+// names a JSON create-index body, e.g. the mappings of a production index
+// template, that CreateIndex uses instead of the caller's.
+package testsupport
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// DefaultElasticImage is the image started without KUBE_NETFLOW_ES_IMAGE.
+const DefaultElasticImage = "docker.elastic.co/elasticsearch/elasticsearch:8.16.0"
+
+// Elasticsearch is a single-node cluster running in Docker.
+type Elasticsearch struct {
+	// Address is the cluster's HTTP URL.
+	Address   string
+	container testcontainers.Container
+}
+
+// StartElasticsearch starts a cluster without security and waits for it to
+// turn yellow.
+func StartElasticsearch(ctx context.Context) (*Elasticsearch, error) {
+	image := os.Getenv("KUBE_NETFLOW_ES_IMAGE")
+	if image == "" {
+		image = DefaultElasticImage
+	}
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        image,
+			ExposedPorts: []string{"9200/tcp"},
+			Env: map[string]string{
+				"discovery.type":         "single-node",
+				"xpack.security.enabled": "false",
+				"ES_JAVA_OPTS":           "-Xms512m -Xmx512m",
+			},
+			WaitingFor: wait.ForHTTP("/_cluster/health?wait_for_status=yellow").
+				WithPort("9200/tcp").
+				WithStartupTimeout(3 * time.Minute),
+		},
+		Started: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("starting %s: %w", image, err)
+	}
+	address, err := container.PortEndpoint(ctx, "9200/tcp", "http")
+	if err != nil {
+		container.Terminate(ctx)
+		return nil, fmt.Errorf("finding the Elasticsearch port: %w", err)
+	}
+	return &Elasticsearch{Address: address, container: container}, nil
+}
+
+// Terminate stops and removes the cluster.
+func (e *Elasticsearch) Terminate(ctx context.Context) error {
+	return e.container.Terminate(ctx)
+}
+
+// CreateIndex creates index from the create-index body, or from the one
+// KUBE_NETFLOW_ES_MAPPING names when set.
+func CreateIndex(ctx context.Context, es *elasticsearch.Client, index string, body []byte) error {
+	if path := os.Getenv("KUBE_NETFLOW_ES_MAPPING"); path != "" {
+		var err error
+		if body, err = os.ReadFile(path); err != nil {
+			return err
+		}
+	}
+	res, err := es.Indices.Create(index, es.Indices.Create.WithContext(ctx), es.Indices.Create.WithBody(bytes.NewReader(body)))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("creating %s: %s", index, res.String())
+	}
+	return nil
+}
+
+// Refresh makes what was indexed into index searchable.
+func Refresh(ctx context.Context, es *elasticsearch.Client, index string) error {
+	res, err := es.Indices.Refresh(es.Indices.Refresh.WithContext(ctx), es.Indices.Refresh.WithIndex(index))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("refreshing %s: %s", index, res.String())
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gonum.org/v1/plot/vg"
+)
+
+const (
+	// timelapseFrameSize keeps frames, and so the animation, small.
+	timelapseFrameSize = 8 * vg.Inch
+	// timelapseFPS is how many buckets the animation shows per second.
+	timelapseFPS = 2
+)
+
+// timelapse queries [from, to) in frames equal buckets and writes them as
+// an animated GIF or, through ffmpeg, an MP4 to path, by its extension.
+func timelapse(ctx context.Context, cfg Config, source FlowSource, enrich *enricher, from, to time.Time, frames int, path string) error {
+	step := to.Sub(from) / time.Duration(frames)
+	if step <= 0 {
+		return fmt.Errorf("window too short for %d frames", frames)
+	}
+
+	// Every frame places the nodes of the whole window in the same order so
+	// arcs stay put while chords change.
+	order := NewFlowMatrix()
+	matrices := make([]*FlowMatrix, frames)
+	for i := range matrices {
+		bucketFrom := from.Add(time.Duration(i) * step)
+		matrix, err := fetchMatrix(ctx, cfg, source, enrich, bucketFrom, bucketFrom.Add(step))
+		if err != nil {
+			return fmt.Errorf("frame %d: %w", i+1, err)
+		}
+		for _, name := range matrix.Names {
+			order.Index(name)
+		}
+		matrices[i] = matrix
+	}
+
+	theme := chordThemes[cfg.Output.Theme]
+	images := make([]image.Image, frames)
+	for i, matrix := range matrices {
+		frame := NewFlowMatrix()
+		for _, name := range order.Names {
+			frame.Index(name)
+		}
+		frame.Merge(matrix)
+		frame.resolvedBy = matrix.resolvedBy
+
+		bucketFrom := from.Add(time.Duration(i) * step)
+		title := fmt.Sprintf("%s, %s – %s", cfg.Output.Title, bucketFrom.UTC().Format("2006-01-02 15:04"), bucketFrom.Add(step).UTC().Format("15:04"))
+		var encoded bytes.Buffer
+		if err := writeDiagram(&encoded, frame, title, cfg.Output, "png", plotSize{width: timelapseFrameSize, height: timelapseFrameSize}, theme); err != nil {
+			return fmt.Errorf("rendering frame %d: %w", i+1, err)
+		}
+		img, err := png.Decode(&encoded)
+		if err != nil {
+			return fmt.Errorf("rendering frame %d: %w", i+1, err)
+		}
+		images[i] = img
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gif":
+		return writeGIF(path, images)
+	case ".mp4":
+		return writeMP4(ctx, path, images)
+	default:
+		return fmt.Errorf("%s: time-lapse must be .gif or .mp4", path)
+	}
+}
+
+func writeGIF(path string, images []image.Image) error {
+	animation := &gif.GIF{}
+	for _, img := range images {
+		frame := image.NewPaletted(img.Bounds(), palette.Plan9)
+		draw.Draw(frame, frame.Bounds(), img, img.Bounds().Min, draw.Src)
+		animation.Image = append(animation.Image, frame)
+		animation.Delay = append(animation.Delay, 100/timelapseFPS)
+	}
+	var encoded bytes.Buffer
+	if err := gif.EncodeAll(&encoded, animation); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, encoded.Bytes())
+}
+
+// writeMP4 has ffmpeg encode the frames as H.264.
+func writeMP4(ctx context.Context, path string, images []image.Image) error {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return fmt.Errorf("MP4 output needs ffmpeg: %w", err)
+	}
+	dir, err := os.MkdirTemp("", "kube-netflow-frames")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	for i, img := range images {
+		file, err := os.Create(filepath.Join(dir, fmt.Sprintf("frame%04d.png", i)))
+		if err != nil {
+			return err
+		}
+		err = png.Encode(file, img)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// ffmpeg writes next to path so the rename replaces it atomically.
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp.mp4")
+	defer os.Remove(tmp)
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-y", "-loglevel", "error",
+		"-framerate", fmt.Sprint(timelapseFPS), "-i", filepath.Join(dir, "frame%04d.png"),
+		"-c:v", "libx264", "-pix_fmt", "yuv420p", "-vf", "scale=trunc(iw/2)*2:trunc(ih/2)*2", tmp)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	return os.Rename(tmp, path)
+}
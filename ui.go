@@ -0,0 +1,21 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// The UI draws the /api/v1/flows matrix as an interactive chord diagram;
+// /openapi.json describes serve's HTTP API.
+//
+//go:embed web
+var webFiles embed.FS
+
+func uiHandler() http.Handler {
+	files, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(files))
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/parquet-go/parquet-go"
+)
+
+// VPCFlowLogsConfig points at flow logs delivered to S3. Location is either
+// s3://bucket/prefix or a local directory with the same layout, where the
+// prefix usually ends in AWSLogs/<account>/vpcflowlogs/<region>/.
+type VPCFlowLogsConfig struct {
+	Location string `yaml:"location" toml:"location"`
+	Region   string `yaml:"region" toml:"region"`
+	// DatePrefixes is "daily" for the default yyyy/mm/dd/ layout, "hive" for
+	// year=yyyy/month=mm/day=dd/, or "none" to scan everything under Location.
+	DatePrefixes string `yaml:"datePrefixes" toml:"datePrefixes"`
+}
+
+type vpcFlowLogsSource struct {
+	store        objectStore
+	prefix       string
+	datePrefixes string
+}
+
+func newVPCFlowLogsSource(cfg VPCFlowLogsConfig) (*vpcFlowLogsSource, error) {
+	if cfg.Location == "" {
+		return nil, fmt.Errorf("vpcflowlogs source needs a location")
+	}
+	source := &vpcFlowLogsSource{datePrefixes: cfg.DatePrefixes}
+
+	if location, ok := strings.CutPrefix(cfg.Location, "s3://"); ok {
+		bucket, prefix, _ := strings.Cut(location, "/")
+		var options []func(*awsconfig.LoadOptions) error
+		if cfg.Region != "" {
+			options = append(options, awsconfig.WithRegion(cfg.Region))
+		}
+		awsCfg, err := awsconfig.LoadDefaultConfig(context.Background(), options...)
+		if err != nil {
+			return nil, err
+		}
+		source.store = &s3Store{client: s3.NewFromConfig(awsCfg), bucket: bucket}
+		source.prefix = prefix
+	} else {
+		source.store = dirStore{root: cfg.Location}
+	}
+
+	if source.prefix != "" && !strings.HasSuffix(source.prefix, "/") {
+		source.prefix += "/"
+	}
+	return source, nil
+}
+
+func (s *vpcFlowLogsSource) Name() string {
+	return "vpcflowlogs"
+}
+
+func (s *vpcFlowLogsSource) Version(ctx context.Context) (string, error) {
+	return "aws-vpc-flow-logs", nil
+}
+
+// prefixes lists the per-day prefixes that can hold records for [from, to).
+// Files are delivered up to a few minutes late, so the day after to is
+// scanned as well.
+func (s *vpcFlowLogsSource) prefixes(from, to time.Time) []string {
+	var layout string
+	switch s.datePrefixes {
+	case "", "daily":
+		layout = "2006/01/02/"
+	case "hive":
+		layout = "year=2006/month=01/day=02/"
+	default:
+		return []string{s.prefix}
+	}
+
+	var prefixes []string
+	day := from.UTC().Truncate(24 * time.Hour)
+	for ; !day.After(to.UTC().Add(24 * time.Hour)); day = day.Add(24 * time.Hour) {
+		prefixes = append(prefixes, s.prefix+day.Format(layout))
+	}
+	return prefixes
+}
+
+func (s *vpcFlowLogsSource) Fetch(ctx context.Context, from, to time.Time, networkFilters []string) (*FlowMatrix, error) {
+	filter, err := parseCIDRFilter(networkFilters)
+	if err != nil {
+		return nil, err
+	}
+
+	matrix := NewFlowMatrix()
+	add := func(record vpcFlowRecord) {
+		if record.End < from.Unix() || record.Start >= to.Unix() {
+			return
+		}
+		if filter.match(record.SrcAddr, record.DstAddr) {
+			matrix.Add(record.SrcAddr, record.DstAddr, float64(record.Bytes))
+		}
+	}
+
+	for _, prefix := range s.prefixes(from, to) {
+		keys, err := s.store.list(ctx, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("listing %s: %w", prefix, err)
+		}
+		for _, key := range keys {
+			if err := s.readObject(ctx, key, add); err != nil {
+				return nil, fmt.Errorf("reading %s: %w", key, err)
+			}
+		}
+	}
+	return matrix, nil
+}
+
+type vpcFlowRecord struct {
+	SrcAddr string `parquet:"srcaddr,optional"`
+	DstAddr string `parquet:"dstaddr,optional"`
+	Bytes   int64  `parquet:"bytes,optional"`
+	Start   int64  `parquet:"start,optional"`
+	End     int64  `parquet:"end,optional"`
+}
+
+func (s *vpcFlowLogsSource) readObject(ctx context.Context, key string, fn func(vpcFlowRecord)) error {
+	body, err := s.store.open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if strings.HasSuffix(key, ".parquet") {
+		// Parquet needs random access to the footer, so the object is
+		// buffered; delivered files are small (one per interval and ENI batch).
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		records, err := parquet.Read[vpcFlowRecord](bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if record.SrcAddr != "" && record.DstAddr != "" {
+				fn(record)
+			}
+		}
+		return nil
+	}
+
+	var r io.Reader = body
+	if strings.HasSuffix(key, ".gz") {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return readVPCFlowText(r, fn)
+}
+
+// readVPCFlowText parses the space-separated text format. The header line
+// names the fields, so custom log formats work as long as they include
+// srcaddr, dstaddr, bytes, start and end.
+func readVPCFlowText(r io.Reader, fn func(vpcFlowRecord)) error {
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() {
+		return scanner.Err()
+	}
+	columns := make(map[string]int)
+	for i, name := range strings.Fields(scanner.Text()) {
+		columns[name] = i
+	}
+	for _, name := range []string{"srcaddr", "dstaddr", "bytes", "start", "end"} {
+		if _, ok := columns[name]; !ok {
+			return fmt.Errorf("log format has no %s field", name)
+		}
+	}
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != len(columns) {
+			continue
+		}
+		// NODATA and SKIPDATA records carry "-" in every traffic field.
+		bytes, err := strconv.ParseInt(fields[columns["bytes"]], 10, 64)
+		if err != nil {
+			continue
+		}
+		start, _ := strconv.ParseInt(fields[columns["start"]], 10, 64)
+		end, _ := strconv.ParseInt(fields[columns["end"]], 10, 64)
+		fn(vpcFlowRecord{
+			SrcAddr: fields[columns["srcaddr"]],
+			DstAddr: fields[columns["dstaddr"]],
+			Bytes:   bytes,
+			Start:   start,
+			End:     end,
+		})
+	}
+	return scanner.Err()
+}
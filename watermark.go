@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+// rollupCatchUp caps the buckets one pass of `rollup run` aggregates, so
+// resuming after a long stop catches up over several passes.
+const rollupCatchUp = 24
+
+// RollupConfig is how `kube-netflow rollup run` keeps a rollup current.
+type RollupConfig struct {
+	Interval string `yaml:"interval" toml:"interval"`
+	// Delay is how far the watermark trails now: a bucket is first rolled
+	// up once the watermark passes its end.
+	Delay time.Duration `yaml:"delay" toml:"delay"`
+	// AllowedLateness is how long after the watermark passes a bucket late
+	// flows still correct it; the bucket is rolled up again whenever they
+	// change its totals. Later flows only reach raw queries.
+	AllowedLateness time.Duration `yaml:"allowedLateness" toml:"allowedLateness"`
+}
+
+// bucketTotals is what a bucket held when it was last emitted.
+type bucketTotals struct {
+	pairs int
+	bytes int64
+}
+
+func runContinuousRollup(args []string) {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		log.Fatalf("Error loading config: %s", err)
+	}
+
+	fs := flag.NewFlagSet("rollup run", flag.ExitOnError)
+	fs.String("config", "", "YAML or TOML configuration file")
+	fs.StringVar(&cfg.Rollup.Interval, "interval", cfg.Rollup.Interval, "Rollup resolution to maintain (1h or 1d)")
+	fs.DurationVar(&cfg.Rollup.Delay, "delay", cfg.Rollup.Delay, "How far the watermark trails now; buckets are first rolled up once it passes their end")
+	fs.DurationVar(&cfg.Rollup.AllowedLateness, "allowed-lateness", cfg.Rollup.AllowedLateness, "How long after the watermark passes a bucket late flows still correct it")
+	everyPtr := fs.Duration("every", time.Minute, "How often to advance the watermark")
+	fs.Var((*stringList)(&cfg.Network), "network", "Network CIDR filter applied to the raw data")
+	fs.Parse(args)
+
+	step, ok := rollupIntervals[cfg.Rollup.Interval]
+	if !ok {
+		log.Fatalf("Unsupported rollup interval: %s", cfg.Rollup.Interval)
+	}
+	if cfg.Rollup.Delay < 0 || cfg.Rollup.AllowedLateness < 0 {
+		log.Fatalf("--delay and --allowed-lateness must not be negative")
+	}
+
+	es, err := newElasticClient(cfg.Elasticsearch)
+	if err != nil {
+		log.Fatalf("Error creating client: %s", err)
+	}
+	ctx := context.Background()
+	index := rollupIndex(cfg.Rollup.Interval)
+	if err := ensureRollupIndex(ctx, es, index, cfg.Network); err != nil {
+		log.Fatalf("Error preparing %s: %s", index, err)
+	}
+
+	// Resume after the newest bucket rolled up before, so a restart
+	// neither skips buckets nor starts over.
+	next, err := newestRollup(ctx, es, index)
+	if err != nil {
+		log.Fatalf("Error reading %s: %s", index, err)
+	}
+	if !next.IsZero() {
+		next = next.Add(step)
+		log.Printf("Resuming %s after %s", index, next.Add(-step).Format(time.RFC3339))
+	}
+
+	emitted := make(map[time.Time]bucketTotals)
+	var settled time.Time
+	ticker := time.NewTicker(*everyPtr)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		watermark := time.Now().UTC().Add(-cfg.Rollup.Delay)
+		// Buckets ending at or before end are closed; those starting at or
+		// after open still take late flows.
+		end := watermark.Truncate(step)
+		open := watermark.Add(-cfg.Rollup.AllowedLateness).Truncate(step)
+		if open.After(end) {
+			open = end
+		}
+		from := open
+		if !next.IsZero() && next.Before(from) {
+			from = next
+		}
+		if limit := from.Add(rollupCatchUp * step); end.After(limit) {
+			end = limit
+		}
+		if !from.Before(end) {
+			continue
+		}
+
+		if err := rollupPass(ctx, es, cfg, index, from, end, emitted); err != nil {
+			log.Printf("Error rolling up %s - %s: %s", from.Format(time.RFC3339), end.Format(time.RFC3339), err)
+			continue
+		}
+		next = end
+
+		// Queries read the rollup only up to where its buckets are final,
+		// and the raw data past it.
+		final := open
+		if end.Before(final) {
+			final = end
+		}
+		if !final.Equal(settled) {
+			if err := writeRollupMeta(ctx, es, index, rollupMeta{Network: cfg.Network, Watermark: &final}); err != nil {
+				log.Printf("Error recording %s watermark: %s", index, err)
+			} else {
+				settled = final
+			}
+		}
+		for bucket := range emitted {
+			if bucket.Before(open) {
+				delete(emitted, bucket)
+			}
+		}
+	}
+}
+
+// rollupPass aggregates the buckets in [from, to), one query each to stay
+// under search.max_buckets, and rewrites those whose totals differ from what
+// was last emitted for them. A rewritten bucket's old documents are deleted
+// first, so a pair that dropped out of its top terms leaves no stale rollup.
+func rollupPass(ctx context.Context, es *elasticsearch.Client, cfg Config, index string, from, to time.Time, emitted map[time.Time]bucketTotals) error {
+	step := rollupIntervals[cfg.Rollup.Interval]
+	for bucket := from; bucket.Before(to); bucket = bucket.Add(step) {
+		docs, err := rollupChunk(ctx, es, cfg.Elasticsearch.Index, cfg.Network, cfg.Rollup.Interval, bucket, bucket.Add(step))
+		if err != nil {
+			return err
+		}
+		totals := bucketTotals{pairs: len(docs)}
+		for _, doc := range docs {
+			totals.bytes += doc.Bytes
+		}
+		previous, seen := emitted[bucket]
+		if seen && previous == totals {
+			continue
+		}
+		if !seen && totals.pairs == 0 {
+			emitted[bucket] = totals
+			continue
+		}
+		if err := deleteBucket(ctx, es, index, bucket); err != nil {
+			return err
+		}
+		if err := bulkIndex(ctx, es, index, docs); err != nil {
+			return err
+		}
+		emitted[bucket] = totals
+		if seen {
+			log.Printf("Corrected %s bucket %s with late flows: %+d bytes, %+d pairs", index, bucket.Format(time.RFC3339),
+				totals.bytes-previous.bytes, totals.pairs-previous.pairs)
+		} else {
+			log.Printf("Rolled up %s bucket %s (%d pairs)", index, bucket.Format(time.RFC3339), totals.pairs)
+		}
+	}
+	return nil
+}
+
+// deleteBucket removes the documents of the bucket starting at bucket.
+func deleteBucket(ctx context.Context, es *elasticsearch.Client, index string, bucket time.Time) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"query": map[string]interface{}{
+			"term": map[string]interface{}{"@timestamp": bucket.Format(time.RFC3339)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	res, err := es.DeleteByQuery([]string{index}, bytes.NewReader(body),
+		es.DeleteByQuery.WithContext(ctx),
+		es.DeleteByQuery.WithRefresh(true),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("delete bucket %s: %s", bucket.Format(time.RFC3339), res.String())
+	}
+	return nil
+}
+
+// newestRollup returns the start of the newest bucket in index, zero when
+// it is empty.
+func newestRollup(ctx context.Context, es *elasticsearch.Client, index string) (time.Time, error) {
+	query := map[string]interface{}{
+		"size": 0,
+		"aggs": map[string]interface{}{
+			"newest": map[string]interface{}{
+				"max": map[string]interface{}{"field": "@timestamp"},
+			},
+		},
+	}
+	result, err := search(ctx, es, index, query)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("finding newest bucket: %w", err)
+	}
+	newest, ok := result["aggregations"].(map[string]interface{})["newest"].(map[string]interface{})["value"].(float64)
+	if !ok {
+		return time.Time{}, nil
+	}
+	return time.UnixMilli(int64(newest)).UTC(), nil
+}